@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxUsernameLength is the size of the username column.
+const maxUsernameLength = 20
+
+// The template of the notice sent to the old address when a user changes their email.
+const emailChangedTemplate = "email-changed"
+
+// accountRequest is the body of the endpoints that change an account. Each of them only reads
+// the fields it needs.
+type accountRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// Password is the current password of the user, for the changes that need it again.
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+// registerAccountRoutes adds the endpoints signed in users change their account with.
+func registerAccountRoutes(router *mux.Router, m Mailer, users UserStore) {
+	router.HandleFunc("/api/auth/account/username", changeUsername(users)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/account/email", changeEmail(m, users)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/account/password", changePassword(users)).Methods(http.MethodPost)
+}
+
+// validUsername checks a new username. Usernames can't contain "@" so that signin can tell
+// them apart from emails.
+func validUsername(username string) error {
+	if username == "" {
+		return errors.New("username is required")
+	}
+	if len(username) > maxUsernameLength {
+		return fmt.Errorf("username can't be longer than %d characters", maxUsernameLength)
+	}
+	if strings.Contains(username, "@") {
+		return errors.New(`username can't contain "@"`)
+	}
+	return nil
+}
+
+// Renames the signed in user, as long as nobody else has the name.
+func changeUsername(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		var req accountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error reading request", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if err := validUsername(req.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := users.ChangeUsername(r.Context(), u.UserID, req.Username)
+		if errors.Is(err, ErrUsernameTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error updating username", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+}
+
+// Moves the signed in user to a new email. It needs their password, since whoever has the
+// email can reset the password. The new address has to be verified again, and the old one gets
+// a notice in case someone else made the change.
+func changeEmail(m Mailer, users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		var req accountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error reading request", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if req.Email == "" {
+			http.Error(w, "email is required", http.StatusBadRequest)
+			return
+		}
+		if bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(req.Password)) != nil {
+			http.Error(w, "incorrect password", http.StatusBadRequest)
+			return
+		}
+		if req.Email == u.Email {
+			http.Error(w, "that is already your email", http.StatusBadRequest)
+			return
+		}
+
+		token := GetRandomBase62(verifyTokenSize)
+		err := users.ChangeEmail(r.Context(), u.UserID, req.Email, token, time.Now().Add(VerifyTokenExpiry))
+		if errors.Is(err, ErrEmailTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error updating email", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		oldEmail := u.Email
+		u.Email = req.Email
+		u.Verified = false
+
+		// The session cookies say whether the email is verified, so they have to change too.
+		err = setSessionCookies(w, u)
+		if err != nil {
+			http.Error(w, "error creating accessToken", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		err = m.SendEmail(verifyEmail(u, token))
+		if err != nil {
+			http.Error(w, "error sending verification email", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		err = m.SendEmail(Email{
+			Recipient: oldEmail,
+			Template:  emailChangedTemplate,
+			Locale:    u.Locale,
+			Data:      map[string]interface{}{"Username": u.Username, "NewEmail": u.Email},
+		})
+		if err != nil {
+			http.Error(w, "error sending notice to the old email", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+}
+
+// Replaces the password of the signed in user, who has to enter the current one.
+func changePassword(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		var req accountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error reading request", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if req.NewPassword == "" {
+			http.Error(w, "newPassword is required", http.StatusBadRequest)
+			return
+		}
+		if bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(req.Password)) != nil {
+			http.Error(w, "incorrect password", http.StatusBadRequest)
+			return
+		}
+
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "password preparation failed", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if err := users.ChangePassword(r.Context(), u.UserID, hashedPassword); err != nil {
+			http.Error(w, "error updating password", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Contains the tests for changing the username, email and password of an account.
+func (s *AuthTestSuite) TestAccount() {
+	s.Run("Test Change Username", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session := s.signupSession(router)
+		other := Credentials{Username: "Oski", Email: "oski@berkeley.edu", Password: "GoBears"}
+		s.request(router, "/api/auth/signup", other, nil)
+
+		rr := s.request(router, "/api/auth/account/username", accountRequest{Username: "Oski"}, session)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "took the username of another account")
+		rr = s.request(router, "/api/auth/account/username", accountRequest{Username: "oski@berkeley.edu"}, session)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "a username can look like an email")
+		rr = s.request(router, "/api/auth/account/username", accountRequest{Username: "Oski"}, nil)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "changed a username without signing in")
+
+		rr = s.request(router, "/api/auth/account/username", accountRequest{Username: "GoldenBear"}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "username change failed")
+		rr = s.request(router, "/api/auth/signin", Credentials{Username: "GoldenBear", Password: s.testCreds.Password}, nil)
+		s.verifyLoginCookies(rr.Result().Cookies())
+		rr = s.request(router, "/api/auth/signin", s.testCreds, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "the old username still works")
+	})
+
+	s.Run("Test Change Email", func() {
+		s.SetupTest()
+		m := NewCaptureMailer()
+		router := s.newRouter(m)
+		session := s.signupSession(router)
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		s.Require().NoError(s.users.VerifyEmail(context.Background(), u.VerifiedToken))
+		s.request(router, "/api/auth/signup", Credentials{Username: "Oski", Email: "oski@berkeley.edu", Password: "GoBears"}, nil)
+
+		rr := s.request(router, "/api/auth/account/email", accountRequest{Email: "bear@berkeley.edu", Password: "wrong"}, session)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "changed the email with the wrong password")
+		rr = s.request(router, "/api/auth/account/email", accountRequest{Email: "oski@berkeley.edu", Password: s.testCreds.Password}, session)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "took the email of another account")
+
+		sent := len(m.Emails())
+		rr = s.request(router, "/api/auth/account/email", accountRequest{Email: "bear@berkeley.edu", Password: s.testCreds.Password}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "email change failed")
+		s.Assert().False(s.accessClaims(rr.Result().Cookies()).EmailVerified, "the new email counts as verified")
+
+		emails := m.Emails()[sent:]
+		s.Require().Len(emails, 2, "expected a verification and a notice")
+		s.Assert().Equal("bear@berkeley.edu", emails[0].Recipient)
+		s.Assert().Equal(verifyEmailTemplate, emails[0].Template)
+		s.Assert().Equal(s.testCreds.Email, emails[1].Recipient)
+		s.Assert().Equal(emailChangedTemplate, emails[1].Template)
+		s.Assert().Contains(emails[1].Text, "bear@berkeley.edu")
+
+		u, err = s.users.UserByID(context.Background(), u.UserID)
+		s.Require().NoError(err)
+		s.Assert().Equal("bear@berkeley.edu", u.Email)
+		s.Assert().False(u.Verified, "the new email counts as verified")
+		token, _ := emails[0].Data["Token"].(string)
+		s.Assert().NoError(s.users.VerifyEmail(context.Background(), token), "the new email can't be verified")
+
+		rr = s.request(router, "/api/auth/signin", Credentials{Email: "bear@berkeley.edu", Password: s.testCreds.Password}, nil)
+		s.verifyLoginCookies(rr.Result().Cookies())
+	})
+
+	s.Run("Test Change Password", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session := s.signupSession(router)
+
+		rr := s.request(router, "/api/auth/account/password", accountRequest{Password: "wrong", NewPassword: "NewPassword1"}, session)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "changed the password without the current one")
+
+		rr = s.request(router, "/api/auth/account/password", accountRequest{Password: s.testCreds.Password, NewPassword: "NewPassword1"}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "password change failed")
+		rr = s.request(router, "/api/auth/signin", s.testCreds, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "the old password still works")
+		rr = s.request(router, "/api/auth/signin", Credentials{Username: s.testCreds.Username, Password: "NewPassword1"}, nil)
+		s.verifyLoginCookies(rr.Result().Cookies())
+	})
+
+	s.Run("Test Resolve Username", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session := s.signupSession(router)
+		userID := s.userID(session)
+		resolve := func(username string) (int, resolvedUsername) {
+			rr := s.request(router, "/api/auth/users/"+username, nil, nil)
+			var res resolvedUsername
+			if rr.Result().StatusCode == http.StatusOK {
+				s.Require().NoError(json.NewDecoder(rr.Body).Decode(&res))
+			}
+			return rr.Result().StatusCode, res
+		}
+
+		status, res := resolve(s.testCreds.Username)
+		s.Require().Equal(http.StatusOK, status)
+		s.Assert().Equal(resolvedUsername{UserID: userID, Username: s.testCreds.Username}, res)
+		status, _ = resolve("nobody")
+		s.Assert().Equal(http.StatusNotFound, status)
+
+		rr := s.request(router, "/api/auth/account/username", accountRequest{Username: "GoldenBear"}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "username change failed")
+		status, res = resolve(s.testCreds.Username)
+		s.Require().Equal(http.StatusOK, status, "the old username stopped working")
+		s.Assert().Equal(resolvedUsername{UserID: userID, Username: "GoldenBear"}, res, "the old username doesn't lead to the new one")
+
+		defer func(period time.Duration) { UsernameRedirectPeriod = period }(UsernameRedirectPeriod)
+		UsernameRedirectPeriod = 0
+		status, _ = resolve(s.testCreds.Username)
+		s.Assert().Equal(http.StatusNotFound, status, "the old username kept working past the redirect period")
+		UsernameRedirectPeriod = time.Hour
+
+		// Whoever takes the old username gets it back from the redirect.
+		other := Credentials{Username: s.testCreds.Username, Email: "oski@berkeley.edu", Password: "GoBears"}
+		otherID := s.userID(s.request(router, "/api/auth/signup", other, nil).Result().Cookies())
+		status, res = resolve(s.testCreds.Username)
+		s.Require().Equal(http.StatusOK, status)
+		s.Assert().Equal(otherID, res.UserID, "the old username still leads to its former owner")
+
+		s.Require().NoError(s.users.DeleteUser(context.Background(), userID))
+		status, _ = resolve("GoldenBear")
+		s.Assert().Equal(http.StatusNotFound, status, "a deleted user can still be found")
+	})
+
+	s.Run("Test Names Ignore Case", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session := s.signupSession(router)
+		other := Credentials{Username: "Oski", Email: "oski@berkeley.edu", Password: "GoBears"}
+		s.request(router, "/api/auth/signup", other, nil)
+
+		rr := s.request(router, "/api/auth/signup", Credentials{Username: strings.ToLower(s.testCreds.Username), Email: "bear@berkeley.edu", Password: "GoBears"}, nil)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "signed up with a username differing only by case")
+		rr = s.request(router, "/api/auth/signup", Credentials{Username: "Bear", Email: strings.ToUpper(s.testCreds.Email), Password: "GoBears"}, nil)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "signed up with an email differing only by case")
+		rr = s.request(router, "/api/auth/account/username", accountRequest{Username: "oski"}, session)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "took a username differing only by case")
+		rr = s.request(router, "/api/auth/account/email", accountRequest{Email: "OSKI@berkeley.edu", Password: s.testCreds.Password}, session)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "took an email differing only by case")
+
+		rr = s.request(router, "/api/auth/signin", Credentials{Username: strings.ToUpper(s.testCreds.Username), Password: s.testCreds.Password}, nil)
+		s.verifyLoginCookies(rr.Result().Cookies())
+
+		// The unique indexes catch what the checks before a write miss, like two signups at
+		// the same time.
+		if store, ok := s.users.(*SQLUserStore); ok {
+			_, err := store.db.Exec("UPDATE users SET username = ? WHERE email = ?", "OSKI", s.testCreds.Email)
+			s.Assert().ErrorIs(takenError(err), ErrUsernameTaken)
+			_, err = store.db.Exec("UPDATE users SET email = ? WHERE username = ?", "Oski@Berkeley.edu", s.testCreds.Username)
+			s.Assert().ErrorIs(takenError(err), ErrEmailTaken)
+		}
+	})
+
+	s.Run("Test Signup Rejects Email-Like Usernames", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		rr := s.request(router, "/api/auth/signup", Credentials{Username: "oski@berkeley.edu", Email: "oski@berkeley.edu", Password: "GoBears"}, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode)
+		rr = s.request(router, "/api/auth/signup", Credentials{Username: strings.Repeat("a", maxUsernameLength+1), Email: "oski@berkeley.edu", Password: "GoBears"}, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode)
+	})
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// emailsPerPage is how many emails listEmails returns at once.
+const emailsPerPage = 50
+
+// RegisterAdminRoutes adds the endpoints meant for admins and operators of the service. They
+// only answer users holding the admin role, and requests whose X-Admin-Key header is adminKey.
+// The key is turned off if it is empty. Everything done through them is audit-logged, reading
+// users and emails included.
+func RegisterAdminRoutes(router *mux.Router, adminKey string, outbox OutboxStore, users UserStore, audit AuditStore) {
+	admin := router.PathPrefix("/api/auth/admin").Subrouter()
+	admin.Use(requireAdmin(adminKey, users))
+	admin.HandleFunc("/emails", listEmails(outbox, audit)).Methods(http.MethodGet)
+	admin.HandleFunc("/emails/{id}/replay", replayEmail(outbox, audit)).Methods(http.MethodPost)
+	admin.HandleFunc("/users", listUsersWithRole(users, audit)).Methods(http.MethodGet)
+	admin.HandleFunc("/users/{id}", getUser(users, audit)).Methods(http.MethodGet)
+	admin.HandleFunc("/users/{id}", deleteUser(users, audit)).Methods(http.MethodDelete)
+	admin.HandleFunc("/users/{id}/roles/{role}", grantRole(users, audit)).Methods(http.MethodPost)
+	admin.HandleFunc("/users/{id}/roles/{role}", revokeRole(users, audit)).Methods(http.MethodDelete)
+	admin.HandleFunc("/audit", listAudit(audit)).Methods(http.MethodGet)
+}
+
+// Lists the emails in the outbox with the status in the "status" query parameter, dead ones
+// by default, starting from the "offset" query parameter.
+func listEmails(outbox OutboxStore, audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = EmailDead
+		}
+		if status != EmailPending && status != EmailSent && status != EmailDead {
+			http.Error(w, "status must be pending, sent or dead", http.StatusBadRequest)
+			return
+		}
+		offset := 0
+		if o := r.URL.Query().Get("offset"); o != "" {
+			var err error
+			offset, err = strconv.Atoi(o)
+			if err != nil || offset < 0 {
+				http.Error(w, "invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !recordAudit(w, r, audit, "email.list", "", "status "+status) {
+			return
+		}
+		emails, err := outbox.Emails(r.Context(), status, offset, emailsPerPage)
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if emails == nil {
+			emails = []OutboxEmail{}
+		}
+		json.NewEncoder(w).Encode(emails)
+	}
+}
+
+// Puts a dead email back in the queue so the worker tries it again.
+func replayEmail(outbox OutboxStore, audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !recordAudit(w, r, audit, "email.replay", id, "") {
+			return
+		}
+		err := outbox.Replay(r.Context(), id, time.Now())
+		if errors.Is(err, ErrEmailNotFound) {
+			http.Error(w, "no dead email with that id", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error replaying email", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+}
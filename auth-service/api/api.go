@@ -1,10 +1,12 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -14,56 +16,67 @@ import (
 )
 
 const (
-	verifyTokenSize = 6
-	resetTokenSize  = 6
+	// verifyTokenSize gives verification tokens about 190 bits of entropy, like reset tokens.
+	verifyTokenSize = 32
+	// resetTokenSize gives reset tokens about 190 bits of entropy.
+	resetTokenSize = 32
+)
+
+var (
+	// VerifyTokenExpiry is how long the link in a verification email stays valid.
+	VerifyTokenExpiry = 24 * time.Hour
+	// ResendVerifyLimit is how many verification emails can be requested for one email
+	// address, and from one client, within ResendVerifyWindow.
+	ResendVerifyLimit  = 3
+	ResendVerifyWindow = time.Hour
+	// VerifyAttemptLimit is how many tokens one client can try at /api/auth/verify within
+	// VerifyAttemptWindow.
+	VerifyAttemptLimit  = 10
+	VerifyAttemptWindow = 15 * time.Minute
+	// ResetTokenExpiry is how long the link in a password reset email stays valid.
+	ResetTokenExpiry = 1 * time.Hour
 )
 
 // RegisterRoutes initializes the api endpoints and maps the requests to specific functions. The API will
-// make use of the passed in Mailer and database connection. What HTTP methods would be most appropriate
+// make use of the passed in Mailer and UserStore. What HTTP methods would be most appropriate
 // for each route?
-func RegisterRoutes(router *mux.Router, m Mailer, db *sql.DB) {
-	router.HandleFunc("/api/auth/signup", signup(m, db)).Methods(http.MethodPost /*YOUR CODE HERE*/)
-	router.HandleFunc("/api/auth/signin", signin(db)).Methods(http.MethodPost /*YOUR CODE HERE*/)
+func RegisterRoutes(router *mux.Router, m Mailer, users UserStore, events EventBus) {
+	router.HandleFunc("/api/auth/signup", signup(m, users, events)).Methods(http.MethodPost /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/auth/signin", signin(users)).Methods(http.MethodPost /*YOUR CODE HERE*/)
 	router.HandleFunc("/api/auth/logout", logout).Methods(http.MethodPost, http.MethodGet /*YOUR CODE HERE*/)
-	router.HandleFunc("/api/auth/verify", verify(db)).Methods(http.MethodPost, http.MethodGet /*YOUR CODE HERE*/)
-	router.HandleFunc("/api/auth/sendreset", sendReset(m, db)).Methods(http.MethodPost /*YOUR CODE HERE*/)
-	router.HandleFunc("/api/auth/resetpw", resetPassword(db)).Methods(http.MethodPost /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/auth/refresh", refresh(users)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/verify", verify(users, newRateLimiter(VerifyAttemptLimit, VerifyAttemptWindow))).Methods(http.MethodPost, http.MethodGet /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/auth/resendverify", resendVerify(m, users, newRateLimiter(ResendVerifyLimit, ResendVerifyWindow))).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/sendreset", sendReset(m, users)).Methods(http.MethodPost /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/auth/resetpw", resetPassword(users)).Methods(http.MethodPost /*YOUR CODE HERE*/)
+	registerTwoFactorRoutes(router, users)
+	registerAccountRoutes(router, m, users)
+	registerDeletionRoutes(router, users)
+	registerUsernameRoutes(router, users)
 }
 
 // A function that handles signing a user up for Bearchat.
-func signup(m Mailer, DB *sql.DB) http.HandlerFunc {
+func signup(m Mailer, users UserStore, events EventBus) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Obtain the credentials from the request body
 		var c Credentials
 		err := json.NewDecoder(r.Body).Decode(&c)
-		// Check if the username already exists
-		row, err := DB.Query("SELECT * FROM users WHERE username = ?", c.Username)
-		// Check for any errors
 		if err != nil {
-			http.Error(w, "error querying database for username", http.StatusInternalServerError)
+			http.Error(w, "error reading credentials", http.StatusBadRequest)
 			log.Print(err.Error())
 			return
 		}
-		// Check boolean returned from query
-		if row.Next() {
-			http.Error(w, "username already exists", http.StatusBadRequest)
-			return
-		}
-		// Check if the email already exists
-		row, err = DB.Query("SELECT * FROM users WHERE email = ?", c.Email)
-		// Check for any errors
-		if err != nil {
-			http.Error(w, "error querying database for email", http.StatusInternalServerError)
-			log.Print(err.Error())
+		if c.Username == "" || c.Email == "" || c.Password == "" {
+			http.Error(w, "username, email and password are required", http.StatusBadRequest)
 			return
 		}
-		// Check boolean returned from query
-		if row.Next() {
-			http.Error(w, "email already exists", http.StatusBadRequest)
+		if err := validUsername(c.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+
 		// Hash the password using bcrypt and store the hashed password in a variable
-		pass, err := bcrypt.GenerateFromPassword([]byte(c.Password /*YOUR CODE HERE*/), bcrypt.DefaultCost)
+		pass, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
 
 		// Check for errors during hashing process
 		if err != nil {
@@ -72,84 +85,45 @@ func signup(m Mailer, DB *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Create a new user UUID, convert it to string, and store it within a variable
-		id, err := uuid.FromBytes([]byte(c.Password))
-		userID := id.String()
-		// Create new verification token with the default token size (look at GetRandomBase62 and our constants)
+		// Create a new user UUID and a verification token with the default token size
+		userID := uuid.New().String()
 		vertoken := GetRandomBase62(verifyTokenSize)
-		// Store credentials in database
-		_, err = DB.Exec("INSERT INTO users VALUES (?,?,?,?,?,?,?)", c.Username, c.Email, pass, 0, "", vertoken, userID)
-		// Check for errors in storing the credentials
-		if err != nil {
-			http.Error(w, "error inserting user into database", http.StatusInternalServerError)
-			log.Print(err.Error())
+
+		// Store the user. This fails if the username or the email already exists.
+		u := User{
+			UserID:                 userID,
+			Username:               c.Username,
+			Email:                  c.Email,
+			HashedPassword:         pass,
+			VerifiedToken:          vertoken,
+			VerifiedTokenExpiresAt: time.Now().Add(VerifyTokenExpiry),
+			Locale:                 requestLocale(r, c.Locale),
+		}
+		err = users.CreateUser(r.Context(), u)
+		if errors.Is(err, ErrUsernameTaken) || errors.Is(err, ErrEmailTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
-		// Generate an access token, expiry dates are in Unix time
-		accessExpiresAt := time.Now().Add(DefaultAccessJWTExpiry)
-		var accessToken string
-		accessToken, err = setClaims(AuthClaims{
-			UserID: userID, /*YOUR CODE HERE*/
-			StandardClaims: jwt.StandardClaims{
-				Subject:   "access",
-				ExpiresAt: accessExpiresAt.Unix(),
-				Issuer:    defaultJWTIssuer,
-				IssuedAt:  time.Now().Unix(),
-			},
-		})
-
-		// Check for error in generating an access token
 		if err != nil {
-			http.Error(w, "error generating access token", http.StatusInternalServerError)
+			http.Error(w, "error inserting user into database", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
+		// The other services set up their records for the user when they hear about it.
+		publishEvent(r.Context(), events, userCreated(u))
 
-		// Set the cookie, name it "access_token"
-		http.SetCookie(w, &http.Cookie{
-			Name:    "access_token",
-			Value:   accessToken,
-			Expires: accessExpiresAt,
-			// Since our website does not use HTTPS, we have this commented out.
-			// However, in an actual service you would definitely want this so no
-			// cookies get stolen!
-			//Secure:   true,
-			HttpOnly: true,
-			SameSite: http.SameSiteNoneMode,
-			Path:     "/",
-		})
-
-		// Generate refresh token
-		var refreshExpiresAt = time.Now().Add(DefaultRefreshJWTExpiry)
-		var refreshToken string
-		refreshToken, err = setClaims(AuthClaims{
-			UserID: userID,
-			StandardClaims: jwt.StandardClaims{
-				Subject:   "refresh",
-				ExpiresAt: refreshExpiresAt.Unix(),
-				Issuer:    defaultJWTIssuer,
-				IssuedAt:  time.Now().Unix(),
-			},
-		})
-
+		// Sign the user in by giving them an access_token and a refresh_token
+		err = setSessionCookies(w, u)
 		if err != nil {
-			http.Error(w, "error creating refreshToken", http.StatusInternalServerError)
+			http.Error(w, "error generating access token", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
 
-		// Set the refresh token ("refresh_token") as a cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:    "refresh_token",
-			Value:   refreshToken,
-			Expires: refreshExpiresAt,
-			Path:    "/",
-		})
-
-		// Send verification email. Fill in the blank with the email of the user.
-		err = m.SendEmail(c.Email /*YOUR CODE HERE*/, "Email Verification", "user-signup.html", map[string]interface{}{"Token": vertoken})
+		// Send verification email. The user exists by now, so they are told it worked either way
+		// and can ask for the email again with resendverify.
+		err = m.SendEmail(verifyEmail(u, vertoken))
 		if err != nil {
-			http.Error(w, "error sending verification email", http.StatusInternalServerError)
 			log.Print(err.Error())
 		}
 
@@ -157,102 +131,65 @@ func signup(m Mailer, DB *sql.DB) http.HandlerFunc {
 	}
 }
 
-func signin(DB *sql.DB) http.HandlerFunc {
+func signin(users UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Store the credentials in a instance of Credentials
 		var c Credentials
 		err := json.NewDecoder(r.Body).Decode(&c)
 		// Check for errors in storing credntials
 		if err != nil {
-			http.Error(w, "error reading credentials", http.StatusInternalServerError)
+			http.Error(w, "error reading credentials", http.StatusBadRequest)
 			log.Print(err.Error())
 			return
 		}
-		// Get the hashedPassword and userId of the user
-		row := DB.QueryRow("SELECT userId, hashedPassword FROM users WHERE username = ?", c.Username)
-		var userID string
-		var corrPass string
-		err = row.Scan(&userID, &corrPass)
 
-		if err != nil {
-			http.Error(w, "error querying database for user", http.StatusInternalServerError)
-			log.Print(err.Error())
+		// Get the hashedPassword and userId of the user. Users can sign in with their email
+		// in place of their username, in either field.
+		login := c.Username
+		if login == "" {
+			login = c.Email
+		}
+		u, err := users.UserByUsername(r.Context(), login)
+		if errors.Is(err, ErrUserNotFound) {
+			u, err = users.UserByEmail(r.Context(), login)
+		}
+		if errors.Is(err, ErrUserNotFound) || (err == nil && u.Deleted(time.Now())) {
+			http.Error(w, "incorrect username or password", http.StatusBadRequest)
 			return
 		}
-
-		thisPass, err := bcrypt.GenerateFromPassword([]byte(c.Password /*YOUR CODE HERE*/), bcrypt.DefaultCost)
-
-		// Check for errors during hashing process
 		if err != nil {
-			http.Error(w, "error preparing password for verification", http.StatusInternalServerError)
+			http.Error(w, "error querying database for user", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
-		// Process errors associated with emails
 
-		// Check if hashed password matches the one corresponding to the email
-		err = bcrypt.CompareHashAndPassword([]byte(thisPass /*YOUR CODE HERE*/), []byte(corrPass /*YOUR CODE HERE*/))
-
-		// Check error in comparing hashed passwords
+		// Check if the password matches the hash we stored when the user signed up
+		err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(c.Password))
 		if err != nil {
-			http.Error(w, "incorrect password", http.StatusBadRequest)
+			http.Error(w, "incorrect username or password", http.StatusBadRequest)
 			return
 		}
 
-		// Generate an access token and set it as a cookie
-		accessExpiresAt := time.Now().Add(DefaultAccessJWTExpiry)
-		var accessToken string
-		accessToken, err = setClaims(AuthClaims{
-			UserID: userID,
-			StandardClaims: jwt.StandardClaims{
-				Subject:   "access",
-				ExpiresAt: accessExpiresAt.Unix(),
-				Issuer:    defaultJWTIssuer,
-				IssuedAt:  time.Now().Unix(),
-			},
-		})
-
-		//Check for error in generating an access token
-		if err != nil {
-			http.Error(w, "error creating accessToken", http.StatusInternalServerError)
-			log.Print(err.Error())
+		// Users with two-factor authentication only get a challenge for now. They trade it for
+		// the cookies along with a code at /api/auth/2fa/verify.
+		if u.TOTPEnabled {
+			challenge, err := newTwoFactorChallenge(u)
+			if err != nil {
+				http.Error(w, "error creating challenge", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"twoFactorRequired": true, "challenge": challenge})
 			return
 		}
-		//Set the cookie, name it "access_token"
-		http.SetCookie(w, &http.Cookie{
-			Name:     "access_token",
-			Value:    accessToken,
-			Expires:  accessExpiresAt,
-			HttpOnly: true,
-			SameSite: http.SameSiteNoneMode,
-			Path:     "/",
-		})
-
-		// Generate a refresh token and set it as a cookie
-		var refreshExpiresAt = time.Now().Add(DefaultRefreshJWTExpiry)
-		var refreshToken string
-		refreshToken, err = setClaims(AuthClaims{
-			UserID: userID,
-			StandardClaims: jwt.StandardClaims{
-				Subject:   "refresh",
-				ExpiresAt: refreshExpiresAt.Unix(),
-				Issuer:    defaultJWTIssuer,
-				IssuedAt:  time.Now().Unix(),
-			},
-		})
 
+		// Generate an access token and a refresh token and set them as cookies
+		err = setSessionCookies(w, u)
 		if err != nil {
-			http.Error(w, "error creating refreshToken", http.StatusInternalServerError)
+			http.Error(w, "error creating accessToken", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
-
-		http.SetCookie(w, &http.Cookie{
-			Name:    "refresh_token",
-			Value:   refreshToken,
-			Expires: refreshExpiresAt,
-			Path:    "/",
-		})
 	}
 }
 
@@ -263,37 +200,144 @@ func logout(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Value: "", Expires: expiresAt})
 }
 
-func verify(DB *sql.DB) http.HandlerFunc {
+func verify(users UserStore, limiter *rateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.URL.Query().Get("token")
 		// Check that valid token exists
 		if len(token) == 0 {
-			http.Error(w, "url param 'token' is missing", http.StatusInternalServerError)
+			http.Error(w, "url param 'token' is missing", http.StatusBadRequest)
 			log.Print("url param 'token' is missing")
 			return
 		}
 
-		// Obtain the user with the verifiedToken from the query parameter and set their verification status to the integer "1"
-		result, err := DB.Exec("UPDATE users SET verified = ? where verifiedToken = ?", 1, token)
-		// Check for errors in executing the previous query
+		// Every attempt counts, so nobody can guess tokens quickly.
+		if !limiter.Allow("ip:" + clientIP(r)) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(limiter.window.Seconds())))
+			http.Error(w, "too many verification attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		// Obtain the user with the verifiedToken from the query parameter and set them as verified.
+		// If no user holds the token, return an error of type "StatusBadRequest".
+		err := users.VerifyEmail(r.Context(), token)
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "noone was verified", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrTokenExpired) {
+			http.Error(w, "verification link expired, ask for a new one", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, "error updating verification status", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
-		// Make sure there were some rows affected
-		// Check: https://golang.org/pkg/database/sql/#Result
-		// This is to make sure that there was an email that was actually changed by our query.
-		// If no rows were affected return an error of type "StatusBadRequest"
-		eff, err := result.RowsAffected()
-		if eff == 0 {
-			http.Error(w, "noone was verified", http.StatusBadRequest)
+	}
+}
+
+// verifyEmail returns the email with the link that verifies the address of u.
+func verifyEmail(u User, token string) Email {
+	return Email{
+		Recipient: u.Email,
+		Template:  verifyEmailTemplate,
+		Locale:    u.Locale,
+		Data:      map[string]interface{}{"Token": token, "Link": emailLink("/api/auth/verify", token)},
+	}
+}
+
+// Sends a new verification email to the address in the body, with a new token. The response
+// is the same whether or not the address belongs to an unverified user, so that it can't be
+// used to find out who has an account.
+func resendVerify(m Mailer, users UserStore, limiter *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c Credentials
+		err := json.NewDecoder(r.Body).Decode(&c)
+		if err != nil {
+			http.Error(w, "error reading credentials", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if c.Email == "" {
+			http.Error(w, "email is required", http.StatusBadRequest)
+			return
+		}
+
+		// Every request counts, even for unknown addresses, so nobody can flood an inbox or
+		// probe addresses quickly.
+		if !limiter.Allow("email:"+strings.ToLower(c.Email), "ip:"+clientIP(r)) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(limiter.window.Seconds())))
+			http.Error(w, "too many verification emails requested, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		u, err := users.UserByEmail(r.Context(), c.Email)
+		if errors.Is(err, ErrUserNotFound) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database for user", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if u.Verified {
+			return
+		}
+
+		// Replace the old token, so only the link in the newest email works.
+		token := GetRandomBase62(verifyTokenSize)
+		err = users.SetVerifiedToken(r.Context(), u.UserID, token, time.Now().Add(VerifyTokenExpiry))
+		if err != nil {
+			http.Error(w, "error updating verification token", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		err = m.SendEmail(verifyEmail(u, token))
+		if err != nil {
+			http.Error(w, "error sending verification email", http.StatusInternalServerError)
+			log.Print(err.Error())
+		}
+	}
+}
+
+// Swaps the refresh_token cookie for a new access_token and refresh_token. The claims come
+// from the database again, so this is also how a user who just verified their email gets an
+// access token that says so.
+func refresh(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("refresh_token")
+		if err != nil {
+			http.Error(w, "error obtaining refresh token", http.StatusUnauthorized)
+			return
+		}
+		claims, err := parseClaims(cookie.Value)
+		if err != nil || claims.Subject != "refresh" {
+			http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+
+		u, err := users.UserByID(r.Context(), claims.UserID)
+		if errors.Is(err, ErrUserNotFound) || (err == nil && u.Deleted(time.Now())) {
+			http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database for user", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		err = setSessionCookies(w, u)
+		if err != nil {
+			http.Error(w, "error creating accessToken", http.StatusInternalServerError)
+			log.Print(err.Error())
 			return
 		}
 	}
 }
 
-func sendReset(m Mailer, DB *sql.DB) http.HandlerFunc {
+func sendReset(m Mailer, users UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the email from the body (decode into an instance of Credentials)
 		var c Credentials
@@ -304,34 +348,49 @@ func sendReset(m Mailer, DB *sql.DB) http.HandlerFunc {
 			log.Print(err.Error())
 			return
 		}
-		// Check for other miscallenous errors that may occur
 		// What is considered an invalid input for an email?
+		if c.Email == "" {
+			http.Error(w, "email is required", http.StatusBadRequest)
+			return
+		}
 
 		// Generate reset token
 		token := GetRandomBase62(resetTokenSize)
-		// Obtain the user with the specified email and set their resetToken to the token we generated
-		result, err := DB.Exec("UPDATE users SET resetToken = ? where email = ?", token, c.Email)
-		// Check for errors executing the queries
+		// Obtain the user with the specified email and store the hash of the token we generated,
+		// which replaces any token sent before.
+		err = users.SetResetToken(r.Context(), c.Email, hashToken(token), time.Now().Add(ResetTokenExpiry))
+		if errors.Is(err, ErrUserNotFound) {
+			// Answer exactly like for a real account, so this can't be used to find out who
+			// has one.
+			return
+		}
 		if err != nil {
 			http.Error(w, "error sending reset", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
-		eff, err := result.RowsAffected()
-		if eff == 0 {
-			http.Error(w, "reset not sent", http.StatusBadRequest)
+
+		// Send the reset email in the language of the user
+		u, err := users.UserByEmail(r.Context(), c.Email)
+		if err != nil {
+			http.Error(w, "error querying database for user", http.StatusInternalServerError)
+			log.Print(err.Error())
 			return
 		}
-		// Send verification email
-		err = m.SendEmail(c.Email /*YOUR CODE HERE*/, "BearChat Password Reset", "password-reset.html", map[string]interface{}{"Token": token})
+		err = m.SendEmail(Email{
+			Recipient: u.Email,
+			Template:  resetEmailTemplate,
+			Locale:    u.Locale,
+			Data:      map[string]interface{}{"Token": token, "Link": emailLink("/reset", token)},
+		})
 		if err != nil {
-			http.Error(w, "error sending verification email", http.StatusInternalServerError)
+			http.Error(w, "error sending reset email", http.StatusInternalServerError)
 			log.Print(err.Error())
 		}
 	}
 }
 
-func resetPassword(DB *sql.DB) http.HandlerFunc {
+func resetPassword(users UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get token from query params
 		token := r.URL.Query().Get("token")
@@ -345,22 +404,13 @@ func resetPassword(DB *sql.DB) http.HandlerFunc {
 			return
 		}
 		// Check for invalid inputs, return an error if input is invalid
-
-		// Check if the username and token pair exist
-		row, err := DB.Query("SELECT * FROM users WHERE username = ? AND resetToken = ?", c.Username, token)
-		// Check for errors executing the query
-		if err != nil {
-			http.Error(w, "error querying database for user", http.StatusInternalServerError)
-			log.Print(err.Error())
-			return
-		}
-		// Check exists boolean. Call an error if the username-token pair doesn't exist
-		if !row.Next() {
-			http.Error(w, "Username or token invalid", http.StatusInternalServerError)
+		if token == "" || c.Username == "" || c.Password == "" {
+			http.Error(w, "token, username and password are required", http.StatusBadRequest)
 			return
 		}
+
 		// Hash the new password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(c.Password /*YOUR CODE HERE*/), bcrypt.DefaultCost)
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
 
 		// Check for errors in hashing the new password
 		if err != nil {
@@ -369,17 +419,76 @@ func resetPassword(DB *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Input new password and clear the reset token (set the token equal to empty string)
-		result, err := DB.Exec("UPDATE users SET hashedPassword = ?, resetToken = ? WHERE username = ?", hashedPassword, "", c.Username)
+		// Input new password and clear the reset token, as long as the username and token pair exist
+		err = users.ResetPassword(r.Context(), c.Username, hashToken(token), hashedPassword)
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "username or token invalid", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrTokenExpired) {
+			http.Error(w, "reset link expired, ask for a new one", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, "error updating password", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
-		eff, err := result.RowsAffected()
-		if eff == 0 {
-			http.Error(w, "no password was updated", http.StatusBadRequest)
-			return
-		}
 	}
 }
+
+// setSessionCookies signs the user in by issuing a new access token and refresh token and
+// setting them as the "access_token" and "refresh_token" cookies. Expiry dates are in Unix time.
+func setSessionCookies(w http.ResponseWriter, u User) error {
+	accessExpiresAt := time.Now().Add(DefaultAccessJWTExpiry)
+	accessToken, err := setClaims(AuthClaims{
+		UserID:        u.UserID,
+		EmailVerified: u.Verified,
+		Roles:         u.Roles,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "access",
+			ExpiresAt: accessExpiresAt.Unix(),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    "access_token",
+		Value:   accessToken,
+		Expires: accessExpiresAt,
+		// Since our website does not use HTTPS, we have this commented out.
+		// However, in an actual service you would definitely want this so no
+		// cookies get stolen!
+		//Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Path:     "/",
+	})
+
+	refreshExpiresAt := time.Now().Add(DefaultRefreshJWTExpiry)
+	refreshToken, err := setClaims(AuthClaims{
+		UserID:        u.UserID,
+		EmailVerified: u.Verified,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "refresh",
+			ExpiresAt: refreshExpiresAt.Unix(),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    "refresh_token",
+		Value:   refreshToken,
+		Expires: refreshExpiresAt,
+		Path:    "/",
+	})
+	return nil
+}
@@ -2,14 +2,17 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -30,24 +33,31 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-// Runs every test that uses the database.
+// Runs every test against each of the UserStore implementations.
 func TestAll(t *testing.T) {
-	suite.Run(t, new(AuthTestSuite))
+	t.Run("Memory", func(t *testing.T) {
+		suite.Run(t, &AuthTestSuite{backend: memoryBackend{}})
+	})
+	t.Run("SQLite", func(t *testing.T) {
+		suite.Run(t, &AuthTestSuite{backend: &sqliteBackend{dir: t.TempDir()}})
+	})
+	t.Run("MySQL", func(t *testing.T) {
+		suite.Run(t, &AuthTestSuite{backend: &mysqlBackend{}})
+	})
 }
 
-// Makes sure the database starts in a clean state before each test.
+// Makes sure the store starts in a clean state before each test.
 func (s *AuthTestSuite) SetupTest() {
-	err := s.db.Ping()
+	stores, err := s.backend.open()
 	if err != nil {
-		s.T().Logf("could not connect to database. skipping test. %s", err)
-		s.T().SkipNow()
-	}
-
-	err = s.clearDatabase()
-	if err != nil {
-		s.T().Logf("could not clear database. skipping test. %s", err)
+		s.T().Logf("could not set up the store. skipping test. %s", err)
 		s.T().SkipNow()
 	}
+	s.users = stores.users
+	s.outbox = stores.outbox
+	s.exports = stores.exports
+	s.audit = stores.audit
+	s.events = &recordingBus{}
 }
 
 // Contains the tests for signing up to Bearchat.
@@ -59,10 +69,10 @@ func (s *AuthTestSuite) TestSignup() {
 		// Make a fake request and response to probe the function with.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Call the function with our fake stuff.
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Make sure the database has an entry for our new user.
 		s.checkExists(s.testCreds.Username, s.testCreds.Email)
@@ -71,7 +81,28 @@ func (s *AuthTestSuite) TestSignup() {
 		s.verifyLoginCookies(rr.Result().Cookies())
 
 		// Lastly, make sure that the mailer was called to send an email.
-		s.Assert().True(m.sendEmailCalled, "code did not call SendEmail with mailer")
+		s.Assert().NotEmpty(m.Emails(), "code did not call SendEmail with mailer")
+
+		// The other services were told about the new user.
+		events := s.events.Events()
+		s.Require().Len(events, 1, "user.created was not published")
+		s.Assert().Equal(EventUserCreated, events[0].Type)
+		s.Assert().Equal(s.accessClaims(rr.Result().Cookies()).UserID, events[0].UserID)
+		s.Assert().Equal(s.testCreds.Email, events[0].Data["email"])
+	})
+
+	s.Run("Test Signup When Email Fails", func() {
+		s.SetupTest()
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
+		rr := httptest.NewRecorder()
+		m := &flakyMailer{failures: 1, CaptureMailer: NewCaptureMailer()}
+
+		signup(m, s.users, s.events)(rr, r)
+
+		// The user was created, so the signup still worked. The email can be asked for again.
+		s.Assert().Equal(http.StatusCreated, rr.Result().StatusCode, "incorrect status code")
+		s.checkExists(s.testCreds.Username, s.testCreds.Email)
+		s.verifyLoginCookies(rr.Result().Cookies())
 	})
 
 	//Test Multiple Signups
@@ -84,10 +115,10 @@ func (s *AuthTestSuite) TestSignup() {
 
 			r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(credJson))
 			rr := httptest.NewRecorder()
-			m := newRecordMailer()
+			m := NewCaptureMailer()
 
 			// Call the function with our fake stuff.
-			signup(m, s.db)(rr, r)
+			signup(m, s.users, s.events)(rr, r)
 
 			// Make sure the database has an entry for our new user.
 			s.checkExists(strconv.Itoa(i), strconv.Itoa(i))
@@ -96,7 +127,34 @@ func (s *AuthTestSuite) TestSignup() {
 			s.verifyLoginCookies(rr.Result().Cookies())
 
 			// Lastly, make sure that the mailer was called to send an email.
-			s.Assert().True(m.sendEmailCalled, "code did not call SendEmail with mailer")
+			s.Assert().NotEmpty(m.Emails(), "code did not call SendEmail with mailer")
+		}
+	})
+
+	s.Run("Test Signup Locale", func() {
+		defer func(url string) { PublicBaseURL = url }(PublicBaseURL)
+		PublicBaseURL = "https://bearchat.com/"
+
+		for _, test := range []struct {
+			locale, acceptLanguage, subject string
+		}{
+			{"", "es-MX,es;q=0.9,en;q=0.8", "Verificación de correo"},
+			{"es", "en-US", "Verificación de correo"},
+			{"", "fr", "Email Verification"},
+			{"", "", "Email Verification"},
+		} {
+			s.SetupTest()
+			creds := s.testCreds
+			creds.Locale = test.locale
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(creds)))
+			r.Header.Set("Accept-Language", test.acceptLanguage)
+			m := NewCaptureMailer()
+			signup(m, s.users, s.events)(httptest.NewRecorder(), r)
+
+			last, ok := m.Last()
+			s.Require().True(ok, "code did not call SendEmail with mailer")
+			s.Assert().Equal(test.subject, last.Subject, "wrong language for locale %q and Accept-Language %q", test.locale, test.acceptLanguage)
+			s.Assert().Contains(last.Text, "https://bearchat.com/api/auth/verify?token="+m.Token(), "the link does not use PublicBaseURL")
 		}
 	})
 
@@ -105,10 +163,10 @@ func (s *AuthTestSuite) TestSignup() {
 		// Make a fake request and response to probe the function with.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up for the first time.
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Make sure the database has an entry for our new user.
 		s.checkExists(s.testCreds.Username, s.testCreds.Email)
@@ -126,7 +184,7 @@ func (s *AuthTestSuite) TestSignup() {
 		rr = httptest.NewRecorder()
 
 		//Signup with a duplicate username.
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		s.Assert().Equal(http.StatusConflict, rr.Code, "incorrect status code returned")
 	})
@@ -136,10 +194,10 @@ func (s *AuthTestSuite) TestSignup() {
 		// Make a fake request and response to probe the function with.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up for the first time.
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Make sure the database has an entry for our new user.
 		s.checkExists(s.testCreds.Username, s.testCreds.Email)
@@ -157,7 +215,7 @@ func (s *AuthTestSuite) TestSignup() {
 		rr = httptest.NewRecorder()
 
 		// Signup with a duplicate username.
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		s.Assert().Equal(http.StatusConflict, rr.Code, "incorrect status code returned")
 	})
@@ -169,10 +227,10 @@ func (s *AuthTestSuite) TestSignin() {
 		//First create an user and have it sign up.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up for the first time.
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Make sure the database has an entry for our new user.
 		s.checkExists(s.testCreds.Username, s.testCreds.Email)
@@ -183,7 +241,7 @@ func (s *AuthTestSuite) TestSignin() {
 		//Let user sign in.
 		r = httptest.NewRequest(http.MethodPost, "/api/auth/signin", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr = httptest.NewRecorder()
-		signin(s.db)(rr, r)
+		signin(s.users)(rr, r)
 
 		// Check that the user was given an access_token and a refresh_token.
 		s.verifyLoginCookies(rr.Result().Cookies())
@@ -199,22 +257,37 @@ func (s *AuthTestSuite) TestSignin() {
 			Password: "DaddyDenero123",
 		})))
 		rr := httptest.NewRecorder()
-		signin(s.db)(rr, r)
+		signin(s.users)(rr, r)
 
 		//Check correct status returned.
 		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
 	})
 
+	s.Run("Test Signin With Email", func() {
+		s.SetupTest()
+		signup(NewCaptureMailer(), s.users, s.events)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+
+		// The email works in either field.
+		for _, creds := range []Credentials{
+			{Email: s.testCreds.Email, Password: s.testCreds.Password},
+			{Username: s.testCreds.Email, Password: s.testCreds.Password},
+		} {
+			rr := httptest.NewRecorder()
+			signin(s.users)(rr, httptest.NewRequest(http.MethodPost, "/api/auth/signin", bytes.NewBuffer(s.credsJSON(creds))))
+			s.verifyLoginCookies(rr.Result().Cookies())
+		}
+	})
+
 	// Makes sure that a user cannot sign in with the wrong password
 	s.Run(("Test Wrong Password"), func() {
 		s.SetupTest()
 		//First create an user and have it sign up.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up for the first time.
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Make sure the database has an entry for our new user.
 		s.checkExists(s.testCreds.Username, s.testCreds.Email)
@@ -229,7 +302,7 @@ func (s *AuthTestSuite) TestSignin() {
 			Password: "DaddyHilfinger123",
 		})))
 		rr = httptest.NewRecorder()
-		signin(s.db)(rr, r)
+		signin(s.users)(rr, r)
 
 		//Check correct status returned.
 		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
@@ -240,10 +313,10 @@ func (s *AuthTestSuite) TestLogout() {
 	//First create an user and have it sign up.
 	r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 	rr := httptest.NewRecorder()
-	m := newRecordMailer()
+	m := NewCaptureMailer()
 
 	// Sign up for the first time.
-	signup(m, s.db)(rr, r)
+	signup(m, s.users, s.events)(rr, r)
 
 	// Make sure the database has an entry for our new user.
 	s.checkExists(s.testCreds.Username, s.testCreds.Email)
@@ -275,22 +348,20 @@ func (s *AuthTestSuite) TestVerify() {
 		// First create a user and have it sign up.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Make sure user is not yet verified
-		var verified bool
-		err := s.db.QueryRow("SELECT verified FROM users WHERE email=?", s.testCreds.Email).Scan(&verified)
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
 		if s.Assert().NoError(err) {
-			s.Assert().False(verified, "user started out verified already")
+			s.Assert().False(u.Verified, "user started out verified already")
 		}
 
-		// Get verification token from database
-		var token string
-		err = s.db.QueryRow("SELECT verifiedToken FROM users WHERE email=?", s.testCreds.Email).Scan(&token)
-		s.Assert().NoError(err, "an error occurred while checking the database")
+		// Get verification token from database. It must be the one in the email.
+		token := u.VerifiedToken
+		s.Assert().Equal(token, m.Token(), "verification email has the wrong token")
 
 		// Create a fake request and response to probe the function with
 		r = httptest.NewRequest(http.MethodPost, "/api/auth/verify", nil)
@@ -300,12 +371,39 @@ func (s *AuthTestSuite) TestVerify() {
 		r.URL.RawQuery = q.Encode()
 
 		// Call the function with our fake stuff
-		verify(s.db)(rr, r)
+		verify(s.users, newRateLimiter(VerifyAttemptLimit, VerifyAttemptWindow))(rr, r)
 
 		// Make sure user is now verified
-		err = s.db.QueryRow("SELECT verified FROM users WHERE email=?", s.testCreds.Email).Scan(&verified)
+		u, err = s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		if s.Assert().NoError(err) {
+			s.Assert().True(u.Verified, "user was not verified")
+		}
+
+		// The token only works once.
+		err = s.users.VerifyEmail(context.Background(), token)
+		s.Assert().ErrorIs(err, ErrUserNotFound, "token can be used again")
+	})
+
+	s.Run("Test Expired Token", func() {
+		s.SetupTest()
+		// Store a user whose token expired a minute ago.
+		err := s.users.CreateUser(context.Background(), User{
+			UserID:                 "expired",
+			Username:               s.testCreds.Username,
+			Email:                  s.testCreds.Email,
+			VerifiedToken:          "expiredToken",
+			VerifiedTokenExpiresAt: time.Now().Add(-time.Minute),
+		})
+		s.Require().NoError(err)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/verify?token=expiredToken", nil)
+		rr := httptest.NewRecorder()
+		verify(s.users, newRateLimiter(VerifyAttemptLimit, VerifyAttemptWindow))(rr, r)
+
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
+		u, err := s.users.UserByID(context.Background(), "expired")
 		if s.Assert().NoError(err) {
-			s.Assert().True(verified, "user was not verified")
+			s.Assert().False(u.Verified, "user was verified with an expired token")
 		}
 	})
 
@@ -320,17 +418,135 @@ func (s *AuthTestSuite) TestVerify() {
 		r.URL.RawQuery = q.Encode()
 
 		// Call the function with our fake stuff
-		verify(s.db)(rr, r)
+		verify(s.users, newRateLimiter(VerifyAttemptLimit, VerifyAttemptWindow))(rr, r)
 
 		// Make sure the correct status code is returned
 		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
 
 		// Make sure invalid token doesn't get stored in the database
-		var exists bool
-		err := s.db.QueryRow("SELECT EXISTS(SELECT * FROM users WHERE verifiedToken=?)", invalidToken).Scan(&exists)
-		if s.Assert().NoError(err, "an error occurred while checking the database") {
-			s.Assert().False(exists, "invalid token was saved in the database")
+		err := s.users.VerifyEmail(context.Background(), invalidToken)
+		s.Assert().ErrorIs(err, ErrUserNotFound, "invalid token was saved in the database")
+	})
+
+	s.Run("Test Rate Limit", func() {
+		s.SetupTest()
+		limiter := newRateLimiter(3, time.Hour)
+		for i := 0; i < 4; i++ {
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/verify?token=guess"+strconv.Itoa(i), nil)
+			rr := httptest.NewRecorder()
+			verify(s.users, limiter)(rr, r)
+			if i < 3 {
+				s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "attempt %d was limited", i)
+			} else {
+				s.Assert().Equal(http.StatusTooManyRequests, rr.Result().StatusCode, "attempt %d was not limited", i)
+				s.Assert().NotEmpty(rr.Result().Header.Get("Retry-After"))
+			}
+		}
+	})
+}
+
+func (s *AuthTestSuite) TestResendVerify() {
+	s.Run("Test Unverified User", func() {
+		s.SetupTest()
+		m := NewCaptureMailer()
+		signup(m, s.users, s.events)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		oldToken := u.VerifiedToken
+
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/resendverify", bytes.NewBuffer(s.credsJSON(Credentials{Email: s.testCreds.Email})))
+		rr := httptest.NewRecorder()
+		m = NewCaptureMailer()
+		resendVerify(m, s.users, newRateLimiter(3, time.Hour))(rr, r)
+
+		s.Assert().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+		s.Require().NotEmpty(m.Emails(), "code did not call SendEmail with mailer")
+		last, _ := m.Last()
+		s.Assert().Equal(s.testCreds.Email, last.Recipient)
+
+		// Only the new token works.
+		token := m.Token()
+		s.Assert().NotEqual(oldToken, token, "token was not replaced")
+		s.Assert().ErrorIs(s.users.VerifyEmail(context.Background(), oldToken), ErrUserNotFound, "old token still works")
+		s.Assert().NoError(s.users.VerifyEmail(context.Background(), token), "new token does not work")
+	})
+
+	s.Run("Test No Email For Unknown Or Verified Users", func() {
+		s.SetupTest()
+		signup(NewCaptureMailer(), s.users, s.events)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		s.Require().NoError(s.users.VerifyEmail(context.Background(), u.VerifiedToken))
+
+		for _, email := range []string{s.testCreds.Email, "nobody@berkeley.edu"} {
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/resendverify", bytes.NewBuffer(s.credsJSON(Credentials{Email: email})))
+			rr := httptest.NewRecorder()
+			m := NewCaptureMailer()
+			resendVerify(m, s.users, newRateLimiter(3, time.Hour))(rr, r)
+
+			// The response must not give away whether the address has an account.
+			s.Assert().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned for %s", email)
+			s.Assert().Empty(m.Emails(), "email sent to %s", email)
+		}
+	})
+
+	s.Run("Test Rate Limit", func() {
+		s.SetupTest()
+		limiter := newRateLimiter(3, time.Hour)
+		for i := 0; i < 4; i++ {
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/resendverify", bytes.NewBuffer(s.credsJSON(Credentials{Email: s.testCreds.Email})))
+			rr := httptest.NewRecorder()
+			resendVerify(NewCaptureMailer(), s.users, limiter)(rr, r)
+			if i < 3 {
+				s.Assert().Equal(http.StatusOK, rr.Result().StatusCode, "request %d was limited", i)
+			} else {
+				s.Assert().Equal(http.StatusTooManyRequests, rr.Result().StatusCode, "request %d was not limited", i)
+				s.Assert().NotEmpty(rr.Result().Header.Get("Retry-After"))
+			}
+		}
+	})
+}
+
+func (s *AuthTestSuite) TestRefresh() {
+	s.Run("Test Picks Up Verification", func() {
+		s.SetupTest()
+		rr := httptest.NewRecorder()
+		signup(NewCaptureMailer(), s.users, s.events)(rr, httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+		s.Assert().False(s.accessClaims(rr.Result().Cookies()).EmailVerified, "new user is verified in their token")
+
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		s.Require().NoError(s.users.VerifyEmail(context.Background(), u.VerifiedToken))
+
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "refresh_token" {
+				r.AddCookie(c)
+			}
+		}
+		rr = httptest.NewRecorder()
+		refresh(s.users)(rr, r)
+
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+		s.verifyLoginCookies(rr.Result().Cookies())
+		s.Assert().True(s.accessClaims(rr.Result().Cookies()).EmailVerified, "refreshed token does not say the user is verified")
+	})
+
+	s.Run("Test Access Token Is Not A Refresh Token", func() {
+		s.SetupTest()
+		rr := httptest.NewRecorder()
+		signup(NewCaptureMailer(), s.users, s.events)(rr, httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "access_token" {
+				r.AddCookie(&http.Cookie{Name: "refresh_token", Value: c.Value})
+			}
 		}
+		rr = httptest.NewRecorder()
+		refresh(s.users)(rr, r)
+
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code returned")
 	})
 }
 
@@ -346,20 +562,33 @@ func (s *AuthTestSuite) TestReset() {
 		// First create a user and have it sign up.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		r = httptest.NewRequest(http.MethodPost, "/api/auth/sendreset", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr = httptest.NewRecorder()
-		m = newRecordMailer()
+		m = NewCaptureMailer()
 
 		// Make request
-		sendReset(m, s.db)(rr, r)
+		sendReset(m, s.users)(rr, r)
 
 		// Make sure that the mailer was called to send an email.
-		s.Assert().True(m.sendEmailCalled, "code did not call SendEmail with mailer")
+		s.Assert().NotEmpty(m.Emails(), "code did not call SendEmail with mailer")
+	})
+
+	s.Run("Test sendReset Unknown Email", func() {
+		s.SetupTest()
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/sendreset", bytes.NewBuffer(s.credsJSON(s.testCreds)))
+		rr := httptest.NewRecorder()
+		m := NewCaptureMailer()
+
+		sendReset(m, s.users)(rr, r)
+
+		// The response must not give away that there is no such account.
+		s.Assert().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+		s.Assert().Empty(m.Emails(), "email sent for an unknown account")
 	})
 
 	s.Run("Test sendReset Invalid Email", func() {
@@ -370,10 +599,10 @@ func (s *AuthTestSuite) TestReset() {
 			Password: "asdf",
 		})))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Make request
-		sendReset(m, s.db)(rr, r)
+		sendReset(m, s.users)(rr, r)
 
 		// Make sure the correct status code is returned
 		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
@@ -384,25 +613,27 @@ func (s *AuthTestSuite) TestReset() {
 		// First create a user and have it sign up.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Now call sendReset
 		r = httptest.NewRequest(http.MethodPost, "/api/auth/sendreset", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr = httptest.NewRecorder()
-		m = newRecordMailer()
+		m = NewCaptureMailer()
 
-		sendReset(m, s.db)(rr, r)
+		sendReset(m, s.users)(rr, r)
 
 		// Make sure that the mailer was called to send an email.
-		s.Assert().True(m.sendEmailCalled, "code did not call SendEmail with mailer")
+		s.Assert().NotEmpty(m.Emails(), "code did not call SendEmail with mailer")
 
-		// Get reset token from database
-		var token string
-		err := s.db.QueryRow("SELECT resetToken FROM users WHERE email=?", s.testCreds.Email).Scan(&token)
+		// Get reset token from the email. The database only has its hash.
+		token := m.Token()
+		s.Require().Len(token, resetTokenSize, "reset token has the wrong size")
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
 		s.Assert().NoError(err, "an error occurred while checking the database")
+		s.Assert().NotContains(u.ResetTokenHash, token, "reset token is stored in plaintext")
 
 		// Now make the request
 		r = httptest.NewRequest(http.MethodPost, "/api/auth/resetpw", bytes.NewBuffer(s.credsJSON(newPassCreds)))
@@ -411,15 +642,59 @@ func (s *AuthTestSuite) TestReset() {
 		q.Add("token", token)
 		r.URL.RawQuery = q.Encode()
 
-		resetPassword(s.db)(rr, r)
+		resetPassword(s.users)(rr, r)
 
 		// Make sure password was changed
-		var hashedPassword string
-		err = s.db.QueryRow("SELECT hashedPassword FROM users WHERE email=?", s.testCreds.Email).Scan(&hashedPassword)
+		u, err = s.users.UserByEmail(context.Background(), s.testCreds.Email)
 		s.Assert().NoError(err, "an error occurred while checking the database")
 
-		err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(newPassCreds.Password))
+		err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(newPassCreds.Password))
 		s.Assert().NoError(err, "password hash check failed")
+
+		// The token only works once.
+		r = httptest.NewRequest(http.MethodPost, "/api/auth/resetpw", bytes.NewBuffer(s.credsJSON(s.testCreds)))
+		rr = httptest.NewRecorder()
+		r.URL.RawQuery = q.Encode()
+		resetPassword(s.users)(rr, r)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "token could be used twice")
+	})
+
+	s.Run("Test resetPassword Old Token", func() {
+		s.SetupTest()
+		signup(NewCaptureMailer(), s.users, s.events)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+
+		// Ask for two resets. Only the newest token works.
+		var tokens []string
+		for i := 0; i < 2; i++ {
+			m := NewCaptureMailer()
+			sendReset(m, s.users)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/sendreset", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+			token := m.Token()
+			tokens = append(tokens, token)
+		}
+		s.Require().NotEqual(tokens[0], tokens[1], "the same token was sent twice")
+
+		for i, expected := range []int{http.StatusBadRequest, http.StatusOK} {
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/resetpw?token="+tokens[i], bytes.NewBuffer(s.credsJSON(newPassCreds)))
+			rr := httptest.NewRecorder()
+			resetPassword(s.users)(rr, r)
+			s.Assert().Equal(expected, rr.Result().StatusCode, "incorrect status code returned for token %d", i)
+		}
+	})
+
+	s.Run("Test resetPassword Expired Token", func() {
+		s.SetupTest()
+		signup(NewCaptureMailer(), s.users, s.events)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+		err := s.users.SetResetToken(context.Background(), s.testCreds.Email, hashToken("expiredToken"), time.Now().Add(-time.Minute))
+		s.Require().NoError(err)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/resetpw?token=expiredToken", bytes.NewBuffer(s.credsJSON(newPassCreds)))
+		rr := httptest.NewRecorder()
+		resetPassword(s.users)(rr, r)
+
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		s.Assert().NoError(bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(s.testCreds.Password)), "password was changed with an expired token")
 	})
 
 	s.Run("Test resetPassword Invalid Token", func() {
@@ -427,20 +702,20 @@ func (s *AuthTestSuite) TestReset() {
 		// First create a user and have it sign up.
 		r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr := httptest.NewRecorder()
-		m := newRecordMailer()
+		m := NewCaptureMailer()
 
 		// Sign up
-		signup(m, s.db)(rr, r)
+		signup(m, s.users, s.events)(rr, r)
 
 		// Now call sendReset
 		r = httptest.NewRequest(http.MethodPost, "/api/auth/sendreset", bytes.NewBuffer(s.credsJSON(s.testCreds)))
 		rr = httptest.NewRecorder()
-		m = newRecordMailer()
+		m = NewCaptureMailer()
 
-		sendReset(m, s.db)(rr, r)
+		sendReset(m, s.users)(rr, r)
 
 		// Make sure that the mailer was called to send an email.
-		s.Assert().True(m.sendEmailCalled, "code did not call SendEmail with mailer")
+		s.Assert().NotEmpty(m.Emails(), "code did not call SendEmail with mailer")
 
 		// Now resetPassword
 		invalidToken := "hehehe"
@@ -450,17 +725,16 @@ func (s *AuthTestSuite) TestReset() {
 		q.Add("token", invalidToken)
 		r.URL.RawQuery = q.Encode()
 
-		resetPassword(s.db)(rr, r)
+		resetPassword(s.users)(rr, r)
 
 		// Make sure status code is correct
 		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
 
 		// Make sure password was not changed
-		var hashedPassword string
-		err := s.db.QueryRow("SELECT hashedPassword FROM users WHERE email=?", newPassCreds.Email).Scan(&hashedPassword)
+		u, err := s.users.UserByEmail(context.Background(), newPassCreds.Email)
 		s.Assert().NoError(err, "an error occurred while checking the database")
 
-		err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(s.testCreds.Password))
+		err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(s.testCreds.Password))
 		s.Assert().NoError(err)
 	})
 }
@@ -470,13 +744,110 @@ func (s *AuthTestSuite) TestReset() {
 // Makes a Suite for all of the auth-service tests to live in
 type AuthTestSuite struct {
 	suite.Suite
-	db        *sql.DB
+	backend   storeBackend
+	users     UserStore
+	outbox    OutboxStore
+	exports   ExportStore
+	audit     AuditStore
+	events    *recordingBus
 	testCreds Credentials
 }
 
-// Clears the users database so the tests remain independent.
-func (s *AuthTestSuite) clearDatabase() (err error) {
-	_, err = s.db.Exec("TRUNCATE TABLE users")
+// testStores are the stores a suite runs against.
+type testStores struct {
+	users   UserStore
+	outbox  OutboxStore
+	exports ExportStore
+	audit   AuditStore
+}
+
+// A storeBackend hands out the stores a suite runs against.
+type storeBackend interface {
+	// open returns empty stores, or an error if the backend isn't available.
+	open() (testStores, error)
+}
+
+// Runs the tests against fresh memory stores every time.
+type memoryBackend struct{}
+
+func (memoryBackend) open() (testStores, error) {
+	return testStores{users: NewMemoryUserStore(), outbox: NewMemoryOutboxStore(), exports: NewMemoryExportStore(), audit: NewMemoryAuditStore()}, nil
+}
+
+// testTables are the tables the SQL backends empty before every test.
+var testTables = []string{"users", "email_outbox", "recovery_codes", "exports", "identities", "roles", "audit_log", "username_history"}
+
+// sqlStores returns the SQL stores on db.
+func sqlStores(db *sql.DB, dialect Dialect) testStores {
+	return testStores{users: NewSQLUserStore(db, dialect), outbox: NewSQLOutboxStore(db, dialect), exports: NewSQLExportStore(db, dialect), audit: NewSQLAuditStore(db, dialect)}
+}
+
+// Runs the tests against the MySQL Docker Container. This needs the database to be running.
+type mysqlBackend struct {
+	db *sql.DB
+}
+
+func (b *mysqlBackend) open() (testStores, error) {
+	if b.db == nil {
+		// Notice that we use localhost instead of the container's IP address since it is
+		// assumed these tests run outside of the container network.
+		db, err := sql.Open("mysql", "root:root@tcp(localhost:3306)/auth?clientFoundRows=true&parseTime=true")
+		if err != nil {
+			return testStores{}, err
+		}
+		if err := db.Ping(); err != nil {
+			return testStores{}, err
+		}
+		if err := migrateForTest(db, MySQL); err != nil {
+			return testStores{}, err
+		}
+		b.db = db
+	}
+
+	// Clears the tables so the tests remain independent.
+	for _, table := range testTables {
+		if _, err := b.db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return testStores{}, err
+		}
+	}
+	return sqlStores(b.db, MySQL), nil
+}
+
+// Runs the tests against a SQLite database in a temporary directory, so unlike MySQL it
+// needs nothing running.
+type sqliteBackend struct {
+	dir string
+	db  *sql.DB
+}
+
+func (b *sqliteBackend) open() (testStores, error) {
+	if b.db == nil {
+		db, err := sql.Open("sqlite3", "file:"+filepath.Join(b.dir, "auth.db")+"?_busy_timeout=5000")
+		if err != nil {
+			return testStores{}, err
+		}
+		if err := migrateForTest(db, SQLite); err != nil {
+			return testStores{}, err
+		}
+		b.db = db
+	}
+
+	// SQLite has no TRUNCATE.
+	for _, table := range testTables {
+		if _, err := b.db.Exec("DELETE FROM " + table); err != nil {
+			return testStores{}, err
+		}
+	}
+	return sqlStores(b.db, SQLite), nil
+}
+
+// Brings the schema of a test database up to date.
+func migrateForTest(db *sql.DB, dialect Dialect) error {
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(context.Background())
 	return err
 }
 
@@ -509,21 +880,18 @@ func (s *AuthTestSuite) credsJSON(c Credentials) []byte {
 
 // Verifies that a user with the passed in email and username is in the database.
 func (s *AuthTestSuite) checkExists(username, email string) {
-	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT * FROM users WHERE email=? AND username=?)", email, username).Scan(&exists)
+	u, err := s.users.UserByUsername(context.Background(), username)
+	if errors.Is(err, ErrUserNotFound) {
+		s.Fail("could not find the user in the database after signing up")
+		return
+	}
 	if s.Assert().NoError(err, "an error occurred while checking the database") {
-		s.Assert().True(exists, "could not find the user in the database after signing up")
+		s.Assert().Equal(email, u.Email, "could not find the user in the database after signing up")
 	}
 }
 
-// Setup the db variable before any tests are run.
+// Setup the test credentials before any tests are run.
 func (s *AuthTestSuite) SetupSuite() {
-	// Connects to the MySQL Docker Container. Notice that we use localhost
-	// instead of the container's IP address since it is assumed these
-	// tests run outside of the container network.
-	db, err := sql.Open("mysql", "root:root@tcp(localhost:3306)/auth")
-	s.Require().NoError(err, "could not connect to the database!")
-	s.db = db
 	s.testCreds = Credentials{
 		Username: "GoldenBear321",
 		Email:    "devops@berkeley.edu",
@@ -531,16 +899,15 @@ func (s *AuthTestSuite) SetupSuite() {
 	}
 }
 
-// Creates a Mailer that only records if SendEmail was called and does nothing else.
-type recordMailer struct {
-	sendEmailCalled bool
-}
-
-func newRecordMailer() *recordMailer {
-	return &recordMailer{sendEmailCalled: false}
-}
-
-func (m *recordMailer) SendEmail(recipient string, subject string, templatePath string, data map[string]interface{}) error {
-	m.sendEmailCalled = true
+// Returns the claims of the access_token cookie.
+func (s *AuthTestSuite) accessClaims(cookies []*http.Cookie) *AuthClaims {
+	for _, c := range cookies {
+		if c.Name == "access_token" {
+			claims, err := parseClaims(c.Value)
+			s.Require().NoError(err, "could not parse the access token")
+			return claims
+		}
+	}
+	s.FailNow("no access_token cookie")
 	return nil
 }
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// auditEntriesPerPage is how many entries listAudit returns at once.
+const auditEntriesPerPage = 50
+
+// AuditEntry records a privileged action taken by an admin or moderator, in auth-service or in
+// another service, as it is kept in the audit_log table.
+type AuditEntry struct {
+	ID string `json:"id"`
+	// ActorID is the user who took the action, or adminKeyActor for operators using the
+	// admin key.
+	ActorID string `json:"actorId"`
+	// Service is the service the action was taken in, like "auth" or "posts".
+	Service string `json:"service"`
+	// Action says what was done, like "role.grant" or "post.delete".
+	Action string `json:"action"`
+	// TargetID is what the action was taken on, like a user ID or a post ID.
+	TargetID  string    `json:"targetId"`
+	Details   string    `json:"details,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// An AuditStore keeps the audit log. Entries are only ever added.
+type AuditStore interface {
+	// RecordAudit adds an entry to the audit log.
+	RecordAudit(ctx context.Context, e AuditEntry) error
+
+	// AuditEntries returns up to limit entries, newest first, skipping the first offset.
+	AuditEntries(ctx context.Context, offset, limit int) ([]AuditEntry, error)
+}
+
+// recordAudit adds an entry for an action taken in auth-service. If it can't, it writes an
+// error to the Response and returns false, and the action must not be taken: nothing
+// privileged happens without a trace.
+func recordAudit(w http.ResponseWriter, r *http.Request, audit AuditStore, action, targetID, details string) bool {
+	err := audit.RecordAudit(r.Context(), AuditEntry{
+		ID:        uuid.NewString(),
+		ActorID:   actorID(r),
+		Service:   "auth",
+		Action:    action,
+		TargetID:  targetID,
+		Details:   details,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		http.Error(w, "error writing the audit log", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return false
+	}
+	return true
+}
+
+// Lists the audit log, newest first, starting from the "offset" query parameter.
+func listAudit(audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset := 0
+		if o := r.URL.Query().Get("offset"); o != "" {
+			var err error
+			offset, err = strconv.Atoi(o)
+			if err != nil || offset < 0 {
+				http.Error(w, "invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := audit.AuditEntries(r.Context(), offset, auditEntriesPerPage)
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+		json.NewEncoder(w).Encode(entries)
+	}
+}
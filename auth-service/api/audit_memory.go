@@ -0,0 +1,41 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryAuditStore is an AuditStore that keeps the audit log in memory. Like MemoryUserStore,
+// it is meant for tests.
+type MemoryAuditStore struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// NewMemoryAuditStore returns an empty MemoryAuditStore.
+func NewMemoryAuditStore() *MemoryAuditStore {
+	return &MemoryAuditStore{}
+}
+
+func (s *MemoryAuditStore) RecordAudit(ctx context.Context, e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *MemoryAuditStore) AuditEntries(ctx context.Context, offset, limit int) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := append([]AuditEntry(nil), s.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+	if offset >= len(entries) {
+		return nil, nil
+	}
+	entries = entries[offset:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SQLAuditStore is the AuditStore backed by the audit_log table of the auth database.
+type SQLAuditStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLAuditStore returns an AuditStore that uses db, which speaks the given Dialect.
+func NewSQLAuditStore(db *sql.DB, dialect Dialect) *SQLAuditStore {
+	return &SQLAuditStore{db: db, dialect: dialect}
+}
+
+const auditColumns = "id, actorId, service, action, targetId, details, createdAt"
+
+func (s *SQLAuditStore) RecordAudit(ctx context.Context, e AuditEntry) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO audit_log ("+auditColumns+") VALUES (?,?,?,?,?,?,?)",
+		e.ID, e.ActorID, e.Service, e.Action, e.TargetID, e.Details, nullTime(e.CreatedAt))
+	return err
+}
+
+func (s *SQLAuditStore) AuditEntries(ctx context.Context, offset, limit int) ([]AuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+auditColumns+" FROM audit_log ORDER BY createdAt DESC, id LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var details sql.NullString
+		var createdAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Service, &e.Action, &e.TargetID, &details, &createdAt); err != nil {
+			return nil, err
+		}
+		e.Details = details.String
+		e.CreatedAt = createdAt.Time
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
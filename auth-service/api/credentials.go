@@ -5,4 +5,7 @@ type Credentials struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Locale is the language tag the user wants emails in. When it is left out at signup,
+	// the Accept-Language header of the request is used instead.
+	Locale string `json:"locale,omitempty"`
 }
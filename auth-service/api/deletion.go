@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AccountDeletionGracePeriod is how long users have to change their mind after asking to
+// delete their account. Nothing is deleted before it is over.
+var AccountDeletionGracePeriod = 7 * 24 * time.Hour
+
+// registerDeletionRoutes adds the endpoints to delete an account and to cancel it during the
+// grace period.
+func registerDeletionRoutes(router *mux.Router, users UserStore) {
+	router.HandleFunc("/api/auth/account", deleteAccount(users)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/auth/account/cancel-deletion", cancelDeletion(users)).Methods(http.MethodPost)
+}
+
+// Schedules the account of the signed in user for deletion, once they entered their password
+// again, and signs them out. They can still sign in and cancel until the grace period is over.
+func deleteAccount(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		var req accountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error reading request", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(req.Password)) != nil {
+			http.Error(w, "incorrect password", http.StatusBadRequest)
+			return
+		}
+
+		// Asking twice doesn't push the deletion back.
+		deleteAfter := u.DeleteAfter
+		if deleteAfter.IsZero() {
+			deleteAfter = time.Now().Add(AccountDeletionGracePeriod)
+			if err := users.ScheduleDeletion(r.Context(), u.UserID, deleteAfter); err != nil {
+				http.Error(w, "error scheduling deletion", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
+
+		logout(w, r)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]time.Time{"deleteAfter": deleteAfter})
+	}
+}
+
+// Keeps the account of the signed in user, if it was scheduled for deletion.
+func cancelDeletion(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		err := users.CancelDeletion(r.Context(), u.UserID, time.Now())
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "the account is not scheduled for deletion", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error canceling deletion", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+}
+
+// A DeletionStep removes the data of a user from one service. Steps must be idempotent: the
+// reaper runs a step again if it doesn't know whether the previous attempt went through.
+type DeletionStep struct {
+	Name   string
+	Delete func(ctx context.Context, userID string) error
+}
+
+// RemoteDeletionStep returns the step that deletes a user from another service by calling its
+// internal endpoint, DELETE <baseURL>/internal/users/{uuid}, with internalKey in the
+// X-Internal-Token header.
+func RemoteDeletionStep(name, baseURL, internalKey string) DeletionStep {
+	return DeletionStep{
+		Name: name,
+		Delete: func(ctx context.Context, userID string) error {
+			_, err := callInternal(ctx, http.MethodDelete, baseURL, userID, "", internalKey)
+			return err
+		},
+	}
+}
+
+// OutboxDeletionStep returns the step that removes the emails to a user from the outbox, sent
+// or not, so that neither their address nor the tokens mailed to them outlive the account.
+func OutboxDeletionStep(users UserStore, outbox OutboxStore) DeletionStep {
+	return DeletionStep{
+		Name: "emails",
+		Delete: func(ctx context.Context, userID string) error {
+			u, err := users.UserByID(ctx, userID)
+			if errors.Is(err, ErrUserNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return outbox.DeleteEmailsTo(ctx, u.Email)
+		},
+	}
+}
+
+// AccountReaper deletes the accounts whose grace period is over. It runs every step for each of
+// them, recording the ones that succeeded, then removes the user from auth-service itself. A
+// failed step is retried with exponential backoff, and never given up on.
+type AccountReaper struct {
+	users UserStore
+	steps []DeletionStep
+
+	// PollInterval is how often the reaper looks for due accounts.
+	PollInterval time.Duration
+	// BatchSize is how many accounts it claims at once.
+	BatchSize int
+	// BaseBackoff is the wait after the first failure. It doubles with every failure after
+	// that, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	now func() time.Time
+}
+
+// NewAccountReaper returns an AccountReaper with default settings that runs steps, in order,
+// for every account.
+func NewAccountReaper(users UserStore, steps ...DeletionStep) *AccountReaper {
+	return &AccountReaper{
+		users:        users,
+		steps:        steps,
+		PollInterval: time.Minute,
+		BatchSize:    20,
+		BaseBackoff:  time.Minute,
+		MaxBackoff:   6 * time.Hour,
+		now:          time.Now,
+	}
+}
+
+// Run deletes accounts until ctx is done.
+func (a *AccountReaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := a.RunOnce(ctx)
+			if err != nil {
+				log.Printf("account reaper: %s", err)
+			}
+			if err != nil || n < a.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce works on one batch of due accounts and returns how many it tried.
+func (a *AccountReaper) RunOnce(ctx context.Context) (int, error) {
+	users, err := a.users.ClaimDueDeletions(ctx, a.now(), 10*time.Minute, a.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		if err := a.delete(ctx, u); err != nil {
+			log.Printf("account reaper: deleting %s failed after %d attempts: %s", u.UserID, u.DeletionAttempts+1, err)
+			retryAt := a.now().Add(a.backoff(u.DeletionAttempts + 1))
+			if err := a.users.MarkDeletionFailed(ctx, u.UserID, err.Error(), retryAt); err != nil {
+				log.Printf("account reaper: could not record failure of %s: %s", u.UserID, err)
+			}
+		}
+	}
+	return len(users), nil
+}
+
+// delete runs the steps u still needs, then removes u.
+func (a *AccountReaper) delete(ctx context.Context, u User) error {
+	done := make(map[string]bool, len(u.DeletionSteps))
+	for _, step := range u.DeletionSteps {
+		done[step] = true
+	}
+	for _, step := range a.steps {
+		if done[step.Name] {
+			continue
+		}
+		if err := step.Delete(ctx, u.UserID); err != nil {
+			return fmt.Errorf("%s: %w", step.Name, err)
+		}
+		if err := a.users.MarkDeletionStep(ctx, u.UserID, step.Name); err != nil {
+			return err
+		}
+	}
+	if err := a.users.DeleteUser(ctx, u.UserID); err != nil {
+		return err
+	}
+	log.Printf("account reaper: deleted %s", u.UserID)
+	return nil
+}
+
+// backoff returns how long to wait before trying an account that failed attempts times.
+func (a *AccountReaper) backoff(attempts int) time.Duration {
+	d := a.BaseBackoff
+	for i := 1; i < attempts && d < a.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > a.MaxBackoff {
+		d = a.MaxBackoff
+	}
+	return d
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// Contains the tests for deleting accounts.
+func (s *AuthTestSuite) TestDeletion() {
+	s.Run("Test Schedule And Cancel", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session := s.signupSession(router)
+
+		rr := s.deleteAccount(router, "wrong", session)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "scheduled a deletion with the wrong password")
+		rr = s.deleteAccount(router, s.testCreds.Password, nil)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "scheduled a deletion without signing in")
+
+		rr = s.deleteAccount(router, s.testCreds.Password, session)
+		s.Require().Equal(http.StatusAccepted, rr.Result().StatusCode, "deletion failed")
+		var body map[string]time.Time
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&body))
+		s.Assert().WithinDuration(time.Now().Add(AccountDeletionGracePeriod), body["deleteAfter"], time.Minute)
+		for _, c := range rr.Result().Cookies() {
+			s.Assert().Empty(c.Value, "the session was kept")
+		}
+
+		// Asking again doesn't push the deletion back.
+		rr = s.deleteAccount(router, s.testCreds.Password, session)
+		s.Require().Equal(http.StatusAccepted, rr.Result().StatusCode)
+		var again map[string]time.Time
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&again))
+		s.Assert().True(body["deleteAfter"].Equal(again["deleteAfter"]), "the deletion was pushed back")
+
+		// During the grace period users can still sign in and change their mind.
+		rr = s.request(router, "/api/auth/signin", s.testCreds, nil)
+		s.verifyLoginCookies(rr.Result().Cookies())
+		session = rr.Result().Cookies()
+		rr = s.request(router, "/api/auth/account/cancel-deletion", accountRequest{}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "cancel failed")
+		rr = s.request(router, "/api/auth/account/cancel-deletion", accountRequest{}, session)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "canceled a deletion that wasn't scheduled")
+
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		s.Assert().True(u.DeleteAfter.IsZero(), "the deletion is still scheduled")
+	})
+
+	s.Run("Test Signin Blocked After Grace Period", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session := s.signupSession(router)
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		s.Require().NoError(s.users.ScheduleDeletion(context.Background(), u.UserID, time.Now().Add(-time.Hour)))
+
+		rr := s.request(router, "/api/auth/signin", s.testCreds, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "a deleted user signed in")
+		rr = s.request(router, "/api/auth/2fa", nil, session)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "the session of a deleted user still works")
+		rr = s.request(router, "/api/auth/account/cancel-deletion", accountRequest{}, session)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "canceled after the grace period")
+	})
+
+	s.Run("Test Reaper Resumes", func() {
+		s.SetupTest()
+		router := s.newRouter(NewOutboxMailer(s.outbox))
+		s.signupSession(router)
+		s.Require().NoError(NewOutboxMailer(s.outbox).SendEmail(resetEmail))
+		u, err := s.users.UserByEmail(context.Background(), s.testCreds.Email)
+		s.Require().NoError(err)
+		now := time.Now().Truncate(time.Second)
+		s.Require().NoError(s.users.ScheduleDeletion(context.Background(), u.UserID, now.Add(-time.Hour)))
+
+		calls := map[string]int{}
+		step := func(name string, fail bool) DeletionStep {
+			return DeletionStep{Name: name, Delete: func(ctx context.Context, userID string) error {
+				s.Assert().Equal(u.UserID, userID)
+				calls[name]++
+				if fail && calls[name] == 1 {
+					return errors.New("service unavailable")
+				}
+				return nil
+			}}
+		}
+		reaper := NewAccountReaper(s.users, step("posts", false), step("profiles", true), step("friends", false), OutboxDeletionStep(s.users, s.outbox))
+		reaper.now = func() time.Time { return now }
+
+		n, err := reaper.RunOnce(context.Background())
+		s.Require().NoError(err)
+		s.Require().Equal(1, n)
+		u, err = s.users.UserByID(context.Background(), u.UserID)
+		s.Require().NoError(err, "the user was deleted although a step failed")
+		s.Assert().Equal([]string{"posts"}, u.DeletionSteps)
+		s.Assert().Equal(1, u.DeletionAttempts)
+		s.Assert().Contains(u.DeletionLastError, "service unavailable")
+
+		// Nothing happens before the backoff is over.
+		n, err = reaper.RunOnce(context.Background())
+		s.Require().NoError(err)
+		s.Assert().Equal(0, n)
+
+		now = now.Add(reaper.BaseBackoff + time.Second)
+		n, err = reaper.RunOnce(context.Background())
+		s.Require().NoError(err)
+		s.Require().Equal(1, n)
+		s.Assert().Equal(map[string]int{"posts": 1, "profiles": 2, "friends": 1}, calls, "steps that succeeded were run again")
+		_, err = s.users.UserByID(context.Background(), u.UserID)
+		s.Assert().ErrorIs(err, ErrUserNotFound, "the user was not deleted")
+
+		// The emails to the user are gone, but not the ones to anyone else.
+		emails, err := s.outbox.Emails(context.Background(), EmailPending, 0, 10)
+		s.Require().NoError(err)
+		if s.Len(emails, 1, "the emails to the user were kept") {
+			s.Assert().Equal(resetEmail.Recipient, emails[0].Recipient)
+		}
+	})
+}
+
+func TestReaperBackoff(t *testing.T) {
+	reaper := NewAccountReaper(NewMemoryUserStore())
+	reaper.BaseBackoff = time.Minute
+	reaper.MaxBackoff = 10 * time.Minute
+	for attempts, expected := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 5: 10 * time.Minute, 100: 10 * time.Minute} {
+		assert.Equal(t, expected, reaper.backoff(attempts), "wrong backoff after %d attempts", attempts)
+	}
+}
+
+// Asks for the account with the given cookies to be deleted.
+func (s *AuthTestSuite) deleteAccount(router *mux.Router, password string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	b, err := json.Marshal(accountRequest{Password: password})
+	s.Require().NoError(err)
+	r := httptest.NewRequest(http.MethodDelete, "/api/auth/account", bytes.NewBuffer(b))
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	return rr
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+)
+
+// The email templates live in templates/<locale>/. Every email has a <name>.txt template for
+// the plain-text part, which also defines the subject in a "subject" template, and a
+// <name>.html template for the HTML part.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+// DefaultLocale is the locale emails fall back to. It has a version of every template.
+const DefaultLocale = "en"
+
+// The templates of the emails auth-service sends.
+const (
+	verifyEmailTemplate = "user-signup"
+	resetEmailTemplate  = "password-reset"
+)
+
+// PublicBaseURL is the address users reach BearChat at. The links in emails start with it.
+// main overrides it with PUBLIC_BASE_URL.
+var PublicBaseURL = "http://localhost"
+
+// An Email is a message for a Mailer to send. Template and Locale pick the templates it is
+// rendered with, and Data is what they are executed with.
+type Email struct {
+	Recipient string
+	Template  string
+	// Locale is the preference of the recipient, like "es-MX". The closest locale we have
+	// templates for is used.
+	Locale string
+	Data   map[string]interface{}
+}
+
+// A renderedEmail is an Email whose templates ran.
+type renderedEmail struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// emailTemplates maps locales to the templates they have, by name. They are parsed once, when
+// the service starts.
+var emailTemplates = mustLoadEmailTemplates(templateFiles, "templates")
+
+func mustLoadEmailTemplates(fsys fs.FS, dir string) map[string]map[string]emailTemplate {
+	templates, err := loadEmailTemplates(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}
+
+// loadEmailTemplates parses the templates of every locale in dir and checks that they are
+// complete.
+func loadEmailTemplates(fsys fs.FS, dir string) (map[string]map[string]emailTemplate, error) {
+	locales, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[string]map[string]emailTemplate)
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+		files, err := fs.Glob(fsys, path.Join(dir, locale.Name(), "*.txt"))
+		if err != nil {
+			return nil, err
+		}
+		templates[locale.Name()] = make(map[string]emailTemplate)
+		for _, file := range files {
+			name := strings.TrimSuffix(path.Base(file), ".txt")
+			text, err := texttemplate.ParseFS(fsys, file)
+			if err != nil {
+				return nil, err
+			}
+			if text.Lookup("subject") == nil {
+				return nil, fmt.Errorf("%s does not define a subject", file)
+			}
+			html, err := htmltemplate.ParseFS(fsys, strings.TrimSuffix(file, ".txt")+".html")
+			if err != nil {
+				return nil, fmt.Errorf("%s has no HTML template: %w", file, err)
+			}
+			templates[locale.Name()][name] = emailTemplate{text: text, html: html}
+		}
+	}
+
+	for locale, byName := range templates {
+		for name := range byName {
+			if _, ok := templates[DefaultLocale][name]; !ok {
+				return nil, fmt.Errorf("%s/%s has no %s version to fall back to", locale, name, DefaultLocale)
+			}
+		}
+	}
+	return templates, nil
+}
+
+// renderEmail executes the templates of e, in the locale closest to e.Locale that has them.
+func renderEmail(e Email) (renderedEmail, error) {
+	tmpl, ok := emailTemplates[matchLocale(e.Locale, e.Template)][e.Template]
+	if !ok {
+		return renderedEmail{}, fmt.Errorf("no email template named %q", e.Template)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", e.Data); err != nil {
+		return renderedEmail{}, err
+	}
+	if err := tmpl.text.Execute(&text, e.Data); err != nil {
+		return renderedEmail{}, err
+	}
+	if err := tmpl.html.Execute(&html, e.Data); err != nil {
+		return renderedEmail{}, err
+	}
+	return renderedEmail{Subject: strings.TrimSpace(subject.String()), Text: text.String(), HTML: html.String()}, nil
+}
+
+// matchLocale returns the locale to render the template in: the preferred locale itself
+// ("es-mx"), then its language ("es"), then DefaultLocale.
+func matchLocale(preferred, template string) string {
+	preferred = strings.ToLower(strings.ReplaceAll(preferred, "_", "-"))
+	for _, locale := range []string{preferred, strings.SplitN(preferred, "-", 2)[0]} {
+		if _, ok := emailTemplates[locale][template]; ok {
+			return locale
+		}
+	}
+	return DefaultLocale
+}
+
+// localeTag matches what we accept as a locale preference: a language tag like "en" or
+// "pt-BR".
+var localeTag = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// requestLocale returns the locale preference of a user: the one they asked for if it is
+// valid, otherwise the first language of the Accept-Language header of their browser.
+func requestLocale(r *http.Request, requested string) string {
+	if len(requested) <= 35 && localeTag.MatchString(requested) {
+		return requested
+	}
+	for _, lang := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		lang = strings.TrimSpace(strings.SplitN(lang, ";", 2)[0])
+		if len(lang) <= 35 && localeTag.MatchString(lang) {
+			return lang
+		}
+	}
+	return ""
+}
+
+// emailLink returns the link to put in an email: PublicBaseURL followed by path and the token.
+func emailLink(path, token string) string {
+	return strings.TrimSuffix(PublicBaseURL, "/") + path + "?token=" + token
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The types of the events auth-service publishes.
+const (
+	// EventUserCreated is published once a new account exists, whether it was made by signing
+	// up or by signing in with another account. Its Data holds the "username" and "email".
+	EventUserCreated = "user.created"
+)
+
+// An Event tells the other services that something happened in auth-service.
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	UserID    string                 `json:"userId"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+// newEvent returns an event of the given type about a user, with a fresh ID.
+func newEvent(eventType, userID string, data map[string]interface{}) Event {
+	return Event{ID: uuid.NewString(), Type: eventType, UserID: userID, Data: data, CreatedAt: time.Now()}
+}
+
+// userCreated returns the EventUserCreated event for u.
+func userCreated(u User) Event {
+	return newEvent(EventUserCreated, u.UserID, map[string]interface{}{"username": u.Username, "email": u.Email})
+}
+
+// An EventBus delivers events to whoever subscribed to them. Publish only hands the event
+// over; it is delivered in the background, so that a slow or failing subscriber never fails
+// the request that published it. Subscribers may get an event more than once, and must
+// handle that.
+type EventBus interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// An EventHandler receives the events a subscriber asked for. Returning an error makes the bus
+// try again later.
+type EventHandler func(ctx context.Context, e Event) error
+
+// publishEvent publishes e on bus. Subscribers can't tell when an event was lost, so failing
+// to publish it is only logged: the request that caused it already happened.
+func publishEvent(ctx context.Context, bus EventBus, e Event) {
+	if err := bus.Publish(ctx, e); err != nil {
+		log.Printf("could not publish %s event %s: %s", e.Type, e.ID, err)
+	}
+}
+
+// errBusClosed is returned by LocalEventBus.Publish once the bus was closed.
+var errBusClosed = errors.New("event bus is closed")
+
+// LocalEventBus is the EventBus that delivers events from memory, each one in its own
+// goroutine. Failed deliveries are retried with exponential backoff, up to MaxAttempts times.
+// Events that weren't delivered when the process exits are lost, so subscribers must cope with
+// missing some, for example by creating what they need on first use.
+type LocalEventBus struct {
+	// MaxAttempts is how many times an event is delivered to a subscriber before giving up.
+	MaxAttempts int
+	// BaseBackoff is the wait after the first failure. It doubles with every failure after
+	// that, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	mu          sync.Mutex
+	subscribers []subscriber
+	closed      bool
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+type subscriber struct {
+	name    string
+	types   map[string]bool
+	handler EventHandler
+}
+
+// NewLocalEventBus returns a LocalEventBus with default settings and no subscribers.
+func NewLocalEventBus() *LocalEventBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LocalEventBus{
+		MaxAttempts: 8,
+		BaseBackoff: 1 * time.Second,
+		MaxBackoff:  5 * time.Minute,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Subscribe makes handler receive the events of the given types. name tells subscribers apart
+// in the logs.
+func (b *LocalEventBus) Subscribe(name string, handler EventHandler, types ...string) {
+	s := subscriber{name: name, types: make(map[string]bool), handler: handler}
+	for _, t := range types {
+		s.types[t] = true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, s)
+}
+
+func (b *LocalEventBus) Publish(ctx context.Context, e Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBusClosed
+	}
+	for _, s := range b.subscribers {
+		if s.types[e.Type] {
+			b.wg.Add(1)
+			go b.deliver(s, e)
+		}
+	}
+	return nil
+}
+
+// deliver hands e to s until it succeeds, the bus is closed or it gave up.
+func (b *LocalEventBus) deliver(s subscriber, e Event) {
+	defer b.wg.Done()
+	backoff := b.BaseBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.handler(b.ctx, e)
+		if err == nil {
+			return
+		}
+		if attempt >= b.MaxAttempts {
+			log.Printf("event bus: giving up on %s event %s for %s after %d attempts: %s", e.Type, e.ID, s.name, attempt, err)
+			return
+		}
+		log.Printf("event bus: %s event %s for %s failed, retrying in %s: %s", e.Type, e.ID, s.name, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+			log.Printf("event bus: dropping %s event %s for %s on shutdown", e.Type, e.ID, s.name)
+			return
+		}
+		if backoff *= 2; backoff > b.MaxBackoff {
+			backoff = b.MaxBackoff
+		}
+	}
+}
+
+// Wait blocks until every event published so far was delivered or given up on.
+func (b *LocalEventBus) Wait() {
+	b.wg.Wait()
+}
+
+// Close stops accepting events and waits for the deliveries in progress. Deliveries still
+// waiting to be retried are dropped.
+func (b *LocalEventBus) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cancel()
+	b.wg.Wait()
+}
+
+// eventClient makes the calls that deliver events to the other services.
+var eventClient = &http.Client{Timeout: 10 * time.Second}
+
+// RemoteEventHandler returns an EventHandler that delivers events to POST /internal/events of
+// the service at baseURL, with internalKey.
+func RemoteEventHandler(service, baseURL, internalKey string) EventHandler {
+	endpoint := strings.TrimSuffix(baseURL, "/") + "/internal/events"
+	return func(ctx context.Context, e Event) error {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Internal-Token", internalKey)
+		resp, err := eventClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("%s returned %s: %s", service, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalEventBus(t *testing.T) {
+	bus := NewLocalEventBus()
+	bus.BaseBackoff = time.Millisecond
+	bus.MaxAttempts = 3
+
+	var mu sync.Mutex
+	delivered := map[string][]string{}
+	failures := 2
+	bus.Subscribe("profiles", func(ctx context.Context, e Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return errors.New("profiles is down")
+		}
+		delivered["profiles"] = append(delivered["profiles"], e.ID)
+		return nil
+	}, EventUserCreated)
+	bus.Subscribe("friends", func(ctx context.Context, e Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered["friends"] = append(delivered["friends"], e.ID)
+		return nil
+	}, "user.other")
+
+	e := userCreated(User{UserID: "1", Username: "oski", Email: "oski@berkeley.edu"})
+	require.NoError(t, bus.Publish(context.Background(), e))
+	bus.Wait()
+	assert.Equal(t, []string{e.ID}, delivered["profiles"], "the event was not retried until delivered")
+	assert.Empty(t, delivered["friends"], "an event was delivered to a subscriber that didn't ask for it")
+
+	bus.Close()
+	assert.ErrorIs(t, bus.Publish(context.Background(), e), errBusClosed)
+}
+
+func TestRemoteEventHandler(t *testing.T) {
+	var received Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/internal/events" || r.Header.Get("X-Internal-Token") != "internalKey" {
+			http.Error(w, "internal token required", http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	e := userCreated(User{UserID: "1", Username: "oski", Email: "oski@berkeley.edu"})
+	require.NoError(t, RemoteEventHandler("profiles", server.URL+"/", "internalKey")(context.Background(), e))
+	assert.Equal(t, e.ID, received.ID)
+	assert.Equal(t, "oski", received.Data["username"])
+
+	err := RemoteEventHandler("profiles", server.URL, "wrong")(context.Background(), e)
+	assert.Error(t, err, "a refused event counted as delivered")
+}
+
+// recordingBus is an EventBus that keeps the events published on it, for the tests to check.
+type recordingBus struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (b *recordingBus) Publish(ctx context.Context, e Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, e)
+	return nil
+}
+
+// Events returns everything published so far, oldest first.
+func (b *recordingBus) Events() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Event(nil), b.events...)
+}
@@ -0,0 +1,457 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ExportRetention is how long the archive of an export can be downloaded once it is ready.
+	ExportRetention = 7 * 24 * time.Hour
+	// ExportLinkExpiry is how long a download link handed out by the status endpoint works.
+	ExportLinkExpiry = time.Hour
+)
+
+// ErrExportNotFound is returned by an ExportStore when no export matches the lookup.
+var ErrExportNotFound = errors.New("export not found")
+
+// The statuses an export goes through. Every export starts out pending. It becomes ready once
+// the worker built its archive, or failed once the worker gave up on it.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export is a request of a user for an archive of their data, as it is kept in the exports
+// table.
+type Export struct {
+	ID       string
+	UserID   string
+	Status   string
+	Attempts int
+	// NextAttemptAt is when the worker may try to build a pending export.
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	FinishedAt    time.Time
+	// ExpiresAt is when the archive of a ready export gets deleted.
+	ExpiresAt time.Time
+}
+
+// An ExportStore holds the exports and their archives.
+type ExportStore interface {
+	// CreateExport adds a pending export.
+	CreateExport(ctx context.Context, e Export) error
+
+	// Export returns the export with the given id, or ErrExportNotFound.
+	Export(ctx context.Context, id string) (Export, error)
+
+	// LatestExport returns the most recent export of the user, or ErrExportNotFound.
+	LatestExport(ctx context.Context, userID string) (Export, error)
+
+	// Archive returns the zip of a ready export, or ErrExportNotFound.
+	Archive(ctx context.Context, id string) ([]byte, error)
+
+	// ClaimDueExports returns up to limit pending exports whose NextAttemptAt has passed, and
+	// pushes their NextAttemptAt back by lease so that no other worker picks them up
+	// meanwhile.
+	ClaimDueExports(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Export, error)
+
+	// FinishExport stores the archive of an export and makes it ready until expiresAt.
+	FinishExport(ctx context.Context, id string, archive []byte, finishedAt, expiresAt time.Time) error
+
+	// MarkExportFailed records a failed attempt. The export is retried at retryAt, unless
+	// failed is set.
+	MarkExportFailed(ctx context.Context, id, lastError string, retryAt time.Time, failed bool) error
+
+	// DeleteExpiredExports removes the exports that expired by now, along with their archives.
+	DeleteExpiredExports(ctx context.Context, now time.Time) error
+
+	// DeleteUserExports removes every export of the user. Deleting a user without exports
+	// isn't an error.
+	DeleteUserExports(ctx context.Context, userID string) error
+}
+
+// exportResponse is what the export endpoints answer with.
+type exportResponse struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// DownloadURL is only set once the export is ready. It works for ExportLinkExpiry.
+	DownloadURL string `json:"downloadUrl,omitempty"`
+}
+
+// RegisterExportRoutes adds the endpoints users ask for an archive of their data with.
+func RegisterExportRoutes(router *mux.Router, users UserStore, exports ExportStore) {
+	router.HandleFunc("/api/auth/export", requestExport(users, exports)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/export/{id}", getExport(users, exports)).Methods(http.MethodGet)
+	router.HandleFunc("/api/auth/export/{id}/download", downloadExport(users, exports)).Methods(http.MethodGet)
+}
+
+// Asks for an archive of the data of the signed in user. The archive is built in the
+// background, so this only answers with the id to check on it with. Asking again while an
+// export is pending returns that export.
+func requestExport(users UserStore, exports ExportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		e, err := exports.LatestExport(r.Context(), u.UserID)
+		if err != nil && !errors.Is(err, ErrExportNotFound) {
+			http.Error(w, "error querying database for exports", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if err != nil || e.Status != ExportPending {
+			now := time.Now()
+			e = Export{ID: uuid.NewString(), UserID: u.UserID, Status: ExportPending, NextAttemptAt: now, CreatedAt: now}
+			if err := exports.CreateExport(r.Context(), e); err != nil {
+				http.Error(w, "error creating export", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(exportResponse{ID: e.ID, Status: e.Status, CreatedAt: e.CreatedAt})
+	}
+}
+
+// Tells the signed in user how their export is going. Once it is ready, the answer holds a
+// link to download it.
+func getExport(users UserStore, exports ExportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		e, ok := userExport(w, r, exports, u.UserID)
+		if !ok {
+			return
+		}
+
+		res := exportResponse{ID: e.ID, Status: e.Status, CreatedAt: e.CreatedAt}
+		if e.Status == ExportReady {
+			link, err := newExportLink(e)
+			if err != nil {
+				http.Error(w, "error creating download link", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+			res.ExpiresAt = &e.ExpiresAt
+			res.DownloadURL = link
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// Sends the archive of a ready export. It takes the token of a link from getExport instead of
+// the session cookies, so the link can be opened anywhere until it expires.
+func downloadExport(users UserStore, exports ExportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := parseClaimsWithKey(r.URL.Query().Get("token"), exportLinkKey)
+		if err != nil || claims.Subject != "export" || claims.Id != mux.Vars(r)["id"] {
+			http.Error(w, "invalid or expired link", http.StatusUnauthorized)
+			return
+		}
+		u, err := users.UserByID(r.Context(), claims.UserID)
+		if errors.Is(err, ErrUserNotFound) || (err == nil && u.Deleted(time.Now())) {
+			http.Error(w, "invalid or expired link", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database for user", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		e, ok := userExport(w, r, exports, u.UserID)
+		if !ok {
+			return
+		}
+		if e.Status != ExportReady {
+			http.Error(w, "the export is not ready", http.StatusConflict)
+			return
+		}
+
+		archive, err := exports.Archive(r.Context(), e.ID)
+		if errors.Is(err, ErrExportNotFound) {
+			http.Error(w, "no such export", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database for the archive", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="bearchat-%s.zip"`, e.CreatedAt.Format("2006-01-02")))
+		w.Write(archive)
+	}
+}
+
+// userExport returns the export in the path of the request if it belongs to userID and hasn't
+// expired. Otherwise it writes an error to the Response and returns false.
+func userExport(w http.ResponseWriter, r *http.Request, exports ExportStore, userID string) (Export, bool) {
+	e, err := exports.Export(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrExportNotFound) || (err == nil && e.UserID != userID) ||
+		(err == nil && !e.ExpiresAt.IsZero() && !time.Now().Before(e.ExpiresAt)) {
+		http.Error(w, "no such export", http.StatusNotFound)
+		return Export{}, false
+	}
+	if err != nil {
+		http.Error(w, "error querying database for export", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return Export{}, false
+	}
+	return e, true
+}
+
+// newExportLink returns a link to download the archive of e, which works for ExportLinkExpiry
+// or until the archive expires.
+func newExportLink(e Export) (string, error) {
+	expiresAt := time.Now().Add(ExportLinkExpiry)
+	if e.ExpiresAt.Before(expiresAt) {
+		expiresAt = e.ExpiresAt
+	}
+	token, err := signClaims(AuthClaims{
+		UserID: e.UserID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        e.ID,
+			Subject:   "export",
+			ExpiresAt: expiresAt.Unix(),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  time.Now().Unix(),
+		},
+	}, exportLinkKey)
+	if err != nil {
+		return "", err
+	}
+	return PublicBaseURL + "/api/auth/export/" + url.PathEscape(e.ID) + "/download?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// An ExportSource returns the data another service holds about a user, as JSON. It goes in the
+// archive as <Name>.json.
+type ExportSource struct {
+	Name  string
+	Fetch func(ctx context.Context, userID string) (json.RawMessage, error)
+}
+
+// RemoteExportSource returns the source that calls the internal endpoint of another service,
+// GET <baseURL>/internal/users/{uuid}/export, with internalKey in the X-Internal-Token header.
+func RemoteExportSource(name, baseURL, internalKey string) ExportSource {
+	return ExportSource{
+		Name: name,
+		Fetch: func(ctx context.Context, userID string) (json.RawMessage, error) {
+			body, err := callInternal(ctx, http.MethodGet, baseURL, userID, "/export", internalKey)
+			if err != nil {
+				return nil, err
+			}
+			if !json.Valid(body) {
+				return nil, fmt.Errorf("%s did not answer with JSON", name)
+			}
+			return body, nil
+		},
+	}
+}
+
+// accountExport is what the archive holds about the account itself. Password hashes, tokens
+// and two-factor secrets are left out on purpose.
+type accountExport struct {
+	UserID           string     `json:"userId"`
+	Username         string     `json:"username"`
+	Email            string     `json:"email"`
+	EmailVerified    bool       `json:"emailVerified"`
+	Locale           string     `json:"locale,omitempty"`
+	TwoFactorEnabled bool       `json:"twoFactorEnabled"`
+	DeleteAfter      *time.Time `json:"deleteAfter,omitempty"`
+	ExportedAt       time.Time  `json:"exportedAt"`
+}
+
+// ExportWorker builds the archives of pending exports. It puts the account in account.json,
+// then asks every source for what it holds. An export whose archive couldn't be built is
+// retried with exponential backoff, and failed after MaxAttempts attempts.
+type ExportWorker struct {
+	users   UserStore
+	exports ExportStore
+	sources []ExportSource
+
+	// PollInterval is how often the worker looks for pending exports.
+	PollInterval time.Duration
+	// BatchSize is how many exports it claims at once.
+	BatchSize int
+	// MaxAttempts is how many times an export is tried before it fails.
+	MaxAttempts int
+	// BaseBackoff is the wait after the first failure. It doubles with every failure after
+	// that, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	now func() time.Time
+}
+
+// NewExportWorker returns an ExportWorker with default settings that puts the data of sources
+// in every archive.
+func NewExportWorker(users UserStore, exports ExportStore, sources ...ExportSource) *ExportWorker {
+	return &ExportWorker{
+		users:        users,
+		exports:      exports,
+		sources:      sources,
+		PollInterval: 10 * time.Second,
+		BatchSize:    5,
+		MaxAttempts:  5,
+		BaseBackoff:  time.Minute,
+		MaxBackoff:   time.Hour,
+		now:          time.Now,
+	}
+}
+
+// Run builds archives until ctx is done.
+func (w *ExportWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := w.RunOnce(ctx)
+			if err != nil {
+				log.Printf("export worker: %s", err)
+			}
+			if err != nil || n < w.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce removes the expired archives, then builds one batch of pending exports and returns
+// how many it tried.
+func (w *ExportWorker) RunOnce(ctx context.Context) (int, error) {
+	if err := w.exports.DeleteExpiredExports(ctx, w.now()); err != nil {
+		return 0, err
+	}
+	exports, err := w.exports.ClaimDueExports(ctx, w.now(), 10*time.Minute, w.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range exports {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		w.build(ctx, e)
+	}
+	return len(exports), nil
+}
+
+func (w *ExportWorker) build(ctx context.Context, e Export) {
+	archive, buildErr := w.archive(ctx, e.UserID)
+	if buildErr == nil {
+		now := w.now()
+		if err := w.exports.FinishExport(ctx, e.ID, archive, now, now.Add(ExportRetention)); err != nil {
+			log.Printf("export worker: could not store the archive of %s: %s", e.ID, err)
+		}
+		return
+	}
+
+	attempts := e.Attempts + 1
+	// Accounts that are gone have nothing left to export.
+	failed := attempts >= w.MaxAttempts || errors.Is(buildErr, ErrUserNotFound)
+	if failed {
+		log.Printf("export worker: giving up on %s after %d attempts: %s", e.ID, attempts, buildErr)
+	}
+	err := w.exports.MarkExportFailed(ctx, e.ID, buildErr.Error(), w.now().Add(w.backoff(attempts)), failed)
+	if err != nil {
+		log.Printf("export worker: could not record failure of %s: %s", e.ID, err)
+	}
+}
+
+// archive returns the zip of the data of the user.
+func (w *ExportWorker) archive(ctx context.Context, userID string) ([]byte, error) {
+	u, err := w.users.UserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Deleted(w.now()) {
+		return nil, ErrUserNotFound
+	}
+	account := accountExport{
+		UserID:           u.UserID,
+		Username:         u.Username,
+		Email:            u.Email,
+		EmailVerified:    u.Verified,
+		Locale:           u.Locale,
+		TwoFactorEnabled: u.TOTPEnabled,
+		ExportedAt:       w.now(),
+	}
+	if !u.DeleteAfter.IsZero() {
+		account.DeleteAfter = &u.DeleteAfter
+	}
+	accountJSON, err := json.Marshal(account)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if err := writeJSONFile(zw, "account.json", accountJSON); err != nil {
+		return nil, err
+	}
+	for _, source := range w.sources {
+		data, err := source.Fetch(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source.Name, err)
+		}
+		if err := writeJSONFile(zw, source.Name+".json", data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJSONFile adds a file to the zip with data indented, so that it is readable as is.
+func writeJSONFile(zw *zip.Writer, name string, data []byte) error {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		return err
+	}
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = indented.WriteTo(f)
+	return err
+}
+
+// backoff returns how long to wait before trying an export that failed attempts times.
+func (w *ExportWorker) backoff(attempts int) time.Duration {
+	d := w.BaseBackoff
+	for i := 1; i < attempts && d < w.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > w.MaxBackoff {
+		d = w.MaxBackoff
+	}
+	return d
+}
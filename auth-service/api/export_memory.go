@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryExportStore is an ExportStore that keeps exports in memory. Like MemoryUserStore, it
+// is meant for tests.
+type MemoryExportStore struct {
+	mu       sync.Mutex
+	exports  map[string]Export
+	archives map[string][]byte
+}
+
+// NewMemoryExportStore returns an empty MemoryExportStore.
+func NewMemoryExportStore() *MemoryExportStore {
+	return &MemoryExportStore{exports: make(map[string]Export), archives: make(map[string][]byte)}
+}
+
+func (s *MemoryExportStore) CreateExport(ctx context.Context, e Export) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exports[e.ID] = e
+	return nil
+}
+
+func (s *MemoryExportStore) Export(ctx context.Context, id string) (Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.exports[id]
+	if !ok {
+		return Export{}, ErrExportNotFound
+	}
+	return e, nil
+}
+
+func (s *MemoryExportStore) LatestExport(ctx context.Context, userID string) (Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var latest Export
+	found := false
+	for _, e := range s.exports {
+		if e.UserID == userID && (!found || e.CreatedAt.After(latest.CreatedAt)) {
+			latest, found = e, true
+		}
+	}
+	if !found {
+		return Export{}, ErrExportNotFound
+	}
+	return latest, nil
+}
+
+func (s *MemoryExportStore) Archive(ctx context.Context, id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archive, ok := s.archives[id]
+	if !ok {
+		return nil, ErrExportNotFound
+	}
+	return archive, nil
+}
+
+func (s *MemoryExportStore) ClaimDueExports(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []Export
+	for _, e := range s.exports {
+		if e.Status == ExportPending && !e.NextAttemptAt.After(now) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, e := range due {
+		e.NextAttemptAt = now.Add(lease)
+		s.exports[e.ID] = e
+	}
+	return due, nil
+}
+
+func (s *MemoryExportStore) FinishExport(ctx context.Context, id string, archive []byte, finishedAt, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.exports[id]
+	if !ok {
+		return ErrExportNotFound
+	}
+	e.Status = ExportReady
+	e.Attempts++
+	e.NextAttemptAt = time.Time{}
+	e.FinishedAt = finishedAt
+	e.ExpiresAt = expiresAt
+	s.exports[id] = e
+	s.archives[id] = archive
+	return nil
+}
+
+func (s *MemoryExportStore) MarkExportFailed(ctx context.Context, id, lastError string, retryAt time.Time, failed bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.exports[id]
+	if !ok {
+		return ErrExportNotFound
+	}
+	e.Attempts++
+	e.LastError = lastError
+	e.NextAttemptAt = retryAt
+	if failed {
+		e.Status = ExportFailed
+		e.NextAttemptAt = time.Time{}
+	}
+	s.exports[id] = e
+	return nil
+}
+
+func (s *MemoryExportStore) DeleteExpiredExports(ctx context.Context, now time.Time) error {
+	s.deleteWhere(func(e Export) bool { return !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(now) })
+	return nil
+}
+
+func (s *MemoryExportStore) DeleteUserExports(ctx context.Context, userID string) error {
+	s.deleteWhere(func(e Export) bool { return e.UserID == userID })
+	return nil
+}
+
+// deleteWhere removes the exports matching the predicate, along with their archives.
+func (s *MemoryExportStore) deleteWhere(match func(Export) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.exports {
+		if match(e) {
+			delete(s.exports, id)
+			delete(s.archives, id)
+		}
+	}
+}
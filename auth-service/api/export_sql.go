@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SQLExportStore is the ExportStore backed by the exports table of the auth database.
+type SQLExportStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLExportStore returns an ExportStore that uses db, which speaks the given Dialect.
+func NewSQLExportStore(db *sql.DB, dialect Dialect) *SQLExportStore {
+	return &SQLExportStore{db: db, dialect: dialect}
+}
+
+// exportColumns leaves out the archive, which is only read when it is downloaded.
+const exportColumns = "id, userId, status, attempts, nextAttemptAt, lastError, createdAt, finishedAt, expiresAt"
+
+func (s *SQLExportStore) CreateExport(ctx context.Context, e Export) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO exports ("+exportColumns+") VALUES (?,?,?,?,?,?,?,?,?)",
+		e.ID, e.UserID, e.Status, e.Attempts, nullTime(e.NextAttemptAt), e.LastError,
+		nullTime(e.CreatedAt), nullTime(e.FinishedAt), nullTime(e.ExpiresAt))
+	return err
+}
+
+func (s *SQLExportStore) Export(ctx context.Context, id string) (Export, error) {
+	return s.exportWhere(ctx, "id = ?", id)
+}
+
+func (s *SQLExportStore) LatestExport(ctx context.Context, userID string) (Export, error) {
+	return s.exportWhere(ctx, "userId = ? ORDER BY createdAt DESC", userID)
+}
+
+func (s *SQLExportStore) Archive(ctx context.Context, id string) ([]byte, error) {
+	var archive []byte
+	err := s.db.QueryRowContext(ctx, "SELECT archive FROM exports WHERE id = ? AND status = ?", id, ExportReady).Scan(&archive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrExportNotFound
+	}
+	return archive, err
+}
+
+func (s *SQLExportStore) ClaimDueExports(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Export, error) {
+	due, err := s.query(ctx, "SELECT "+exportColumns+" FROM exports WHERE status = ? AND nextAttemptAt <= ? ORDER BY nextAttemptAt LIMIT ?",
+		ExportPending, nullTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like SQLOutboxStore.ClaimDue, only the exports whose NextAttemptAt we managed to push
+	// back are ours.
+	var claimed []Export
+	for _, e := range due {
+		result, err := s.db.ExecContext(ctx, "UPDATE exports SET nextAttemptAt = ? WHERE id = ? AND status = ? AND nextAttemptAt = ?",
+			nullTime(now.Add(lease)), e.ID, ExportPending, nullTime(e.NextAttemptAt))
+		if err != nil {
+			return nil, err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			claimed = append(claimed, e)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *SQLExportStore) FinishExport(ctx context.Context, id string, archive []byte, finishedAt, expiresAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE exports SET status = ?, attempts = attempts + 1, nextAttemptAt = NULL, finishedAt = ?, expiresAt = ?, archive = ? WHERE id = ?",
+		ExportReady, nullTime(finishedAt), nullTime(expiresAt), archive, id)
+	return affectedExport(result, err)
+}
+
+func (s *SQLExportStore) MarkExportFailed(ctx context.Context, id, lastError string, retryAt time.Time, failed bool) error {
+	status := ExportPending
+	if failed {
+		status = ExportFailed
+		retryAt = time.Time{}
+	}
+	result, err := s.db.ExecContext(ctx, "UPDATE exports SET status = ?, attempts = attempts + 1, lastError = ?, nextAttemptAt = ? WHERE id = ?",
+		status, lastError, nullTime(retryAt), id)
+	return affectedExport(result, err)
+}
+
+func (s *SQLExportStore) DeleteExpiredExports(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM exports WHERE expiresAt <= ?", nullTime(now))
+	return err
+}
+
+func (s *SQLExportStore) DeleteUserExports(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM exports WHERE userId = ?", userID)
+	return err
+}
+
+// exportWhere returns the first export matching the WHERE clause, or ErrExportNotFound.
+func (s *SQLExportStore) exportWhere(ctx context.Context, where string, args ...interface{}) (Export, error) {
+	exports, err := s.query(ctx, "SELECT "+exportColumns+" FROM exports WHERE "+where+" LIMIT 1", args...)
+	if err != nil {
+		return Export{}, err
+	}
+	if len(exports) == 0 {
+		return Export{}, ErrExportNotFound
+	}
+	return exports[0], nil
+}
+
+// query runs a query selecting exportColumns and scans every row into an Export.
+func (s *SQLExportStore) query(ctx context.Context, query string, args ...interface{}) ([]Export, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []Export
+	for rows.Next() {
+		var e Export
+		var lastError sql.NullString
+		var nextAttemptAt, createdAt, finishedAt, expiresAt sql.NullTime
+		err := rows.Scan(&e.ID, &e.UserID, &e.Status, &e.Attempts, &nextAttemptAt, &lastError, &createdAt, &finishedAt, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		e.LastError = lastError.String
+		e.NextAttemptAt = nextAttemptAt.Time
+		e.CreatedAt = createdAt.Time
+		e.FinishedAt = finishedAt.Time
+		e.ExpiresAt = expiresAt.Time
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+// affectedExport turns the result of an UPDATE into ErrExportNotFound if it didn't match any
+// row.
+func affectedExport(result sql.Result, err error) error {
+	if err := affectedUser(result, err); err == ErrUserNotFound {
+		return ErrExportNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Contains the tests for exporting the data of a user.
+func (s *AuthTestSuite) TestExport() {
+	s.Run("Test Request And Download", func() {
+		s.SetupTest()
+		router := s.newExportRouter()
+		session := s.signupSession(router)
+
+		rr := s.request(router, "/api/auth/export", accountRequest{}, nil)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "exported without signing in")
+
+		requested := s.requestExport(router, session)
+		s.Assert().Equal(ExportPending, requested.Status)
+		s.Assert().Equal(requested.ID, s.requestExport(router, session).ID, "asking twice made a second export")
+		s.Assert().Equal(ExportPending, s.exportStatus(router, requested.ID, session).Status)
+
+		worker, _ := s.newExportWorker(ExportSource{Name: "posts", Fetch: func(ctx context.Context, userID string) (json.RawMessage, error) {
+			return json.RawMessage(`[{"postBody":"Go Bears!"}]`), nil
+		}})
+		n, err := worker.RunOnce(context.Background())
+		s.Require().NoError(err)
+		s.Require().Equal(1, n)
+
+		status := s.exportStatus(router, requested.ID, session)
+		s.Require().Equal(ExportReady, status.Status)
+		s.Require().True(strings.HasPrefix(status.DownloadURL, PublicBaseURL+"/api/auth/export/"+requested.ID+"/download?token="), "wrong link %s", status.DownloadURL)
+
+		// The link works without the session cookies.
+		rr = s.request(router, strings.TrimPrefix(status.DownloadURL, PublicBaseURL), nil, nil)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "download failed")
+		s.Assert().Equal("application/zip", rr.Result().Header.Get("Content-Type"))
+		files := s.unzip(rr.Body.Bytes())
+		s.Assert().Contains(files, "account.json")
+		s.Assert().Contains(files["account.json"], `"username": "GoldenBear321"`)
+		s.Assert().Contains(files["posts.json"], `"postBody": "Go Bears!"`)
+		for name, content := range files {
+			for _, secret := range []string{"assword", "oken", "totp", "ecret"} {
+				s.Assert().NotContains(content, secret, "%s holds secrets", name)
+			}
+		}
+
+		rr = s.request(router, "/api/auth/export/"+requested.ID+"/download?token=forged", nil, nil)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "downloaded with a forged link")
+	})
+
+	s.Run("Test Other Users", func() {
+		s.SetupTest()
+		router := s.newExportRouter()
+		session := s.signupSession(router)
+		requested := s.requestExport(router, session)
+
+		rr := s.request(router, "/api/auth/signup", Credentials{Username: "Oski", Email: "oski@berkeley.edu", Password: "GoBears"}, nil)
+		s.Require().Equal(http.StatusCreated, rr.Result().StatusCode)
+		rr = s.request(router, "/api/auth/export/"+requested.ID, nil, rr.Result().Cookies())
+		s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode, "saw the export of another user")
+	})
+
+	s.Run("Test Retries Then Fails", func() {
+		s.SetupTest()
+		router := s.newExportRouter()
+		session := s.signupSession(router)
+		requested := s.requestExport(router, session)
+
+		worker, clock := s.newExportWorker(ExportSource{Name: "posts", Fetch: func(ctx context.Context, userID string) (json.RawMessage, error) {
+			return nil, errors.New("service unavailable")
+		}})
+		for i := 1; i <= worker.MaxAttempts; i++ {
+			n, err := worker.RunOnce(context.Background())
+			s.Require().NoError(err)
+			s.Require().Equal(1, n, "attempt %d did not happen", i)
+			e, err := s.exports.Export(context.Background(), requested.ID)
+			s.Require().NoError(err)
+			s.Assert().Equal(i, e.Attempts)
+			s.Assert().Contains(e.LastError, "service unavailable")
+			*clock = clock.Add(worker.MaxBackoff)
+		}
+		s.Assert().Equal(ExportFailed, s.exportStatus(router, requested.ID, session).Status)
+
+		// A new export can be asked for once the last one failed.
+		s.Assert().NotEqual(requested.ID, s.requestExport(router, session).ID)
+	})
+
+	s.Run("Test Expiry", func() {
+		s.SetupTest()
+		router := s.newExportRouter()
+		session := s.signupSession(router)
+		requested := s.requestExport(router, session)
+		worker, clock := s.newExportWorker()
+		_, err := worker.RunOnce(context.Background())
+		s.Require().NoError(err)
+		s.Require().Equal(ExportReady, s.exportStatus(router, requested.ID, session).Status)
+
+		*clock = clock.Add(ExportRetention + time.Minute)
+		_, err = worker.RunOnce(context.Background())
+		s.Require().NoError(err)
+		_, err = s.exports.Export(context.Background(), requested.ID)
+		s.Assert().ErrorIs(err, ErrExportNotFound, "the export was kept after it expired")
+		rr := s.request(router, "/api/auth/export/"+requested.ID, nil, session)
+		s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode)
+	})
+}
+
+// Returns a router with the auth and export endpoints.
+func (s *AuthTestSuite) newExportRouter() *mux.Router {
+	router := s.newRouter(NewCaptureMailer())
+	RegisterExportRoutes(router, s.users, s.exports)
+	return router
+}
+
+// Returns an ExportWorker over the test stores whose clock only moves when told to. It starts
+// a second ahead, so that the exports just asked for are due even once MySQL rounded their times.
+func (s *AuthTestSuite) newExportWorker(sources ...ExportSource) (*ExportWorker, *time.Time) {
+	clock := time.Now().Add(time.Second)
+	worker := NewExportWorker(s.users, s.exports, sources...)
+	worker.now = func() time.Time { return clock }
+	return worker, &clock
+}
+
+// Asks for an export with the given session cookies.
+func (s *AuthTestSuite) requestExport(router *mux.Router, session []*http.Cookie) exportResponse {
+	rr := s.request(router, "/api/auth/export", accountRequest{}, session)
+	s.Require().Equal(http.StatusAccepted, rr.Result().StatusCode, "export request failed")
+	var res exportResponse
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&res))
+	return res
+}
+
+// Returns the status of an export.
+func (s *AuthTestSuite) exportStatus(router *mux.Router, id string, session []*http.Cookie) exportResponse {
+	rr := s.request(router, "/api/auth/export/"+id, nil, session)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "export status failed")
+	var res exportResponse
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&res))
+	return res
+}
+
+// Returns the files in a zip by name.
+func (s *AuthTestSuite) unzip(archive []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	s.Require().NoError(err, "the download is not a zip")
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		s.Require().NoError(err)
+		content, err := io.ReadAll(r)
+		r.Close()
+		s.Require().NoError(err)
+		files[f.Name] = string(content)
+	}
+	return files
+}
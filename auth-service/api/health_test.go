@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Makes a router serving only the health endpoints of h.
+func healthRouter(h *Health) *mux.Router {
+	router := mux.NewRouter()
+	h.RegisterRoutes(router)
+	return router
+}
+
+func TestHealth(t *testing.T) {
+	t.Run("Liveness", func(t *testing.T) {
+		h := NewHealth()
+		h.AddCheck("broken", func(ctx context.Context) error { return errors.New("down") })
+
+		rr := httptest.NewRecorder()
+		healthRouter(h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+		// Liveness never depends on the checks.
+		assert.Equal(t, http.StatusOK, rr.Code, "incorrect status code returned")
+	})
+
+	t.Run("Ready", func(t *testing.T) {
+		h := NewHealth()
+		h.AddCheck("database", func(ctx context.Context) error { return nil })
+
+		rr := httptest.NewRecorder()
+		healthRouter(h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code, "incorrect status code returned")
+		var status healthStatus
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+		assert.Equal(t, "ok", status.Checks["database"])
+	})
+
+	t.Run("Failing Check", func(t *testing.T) {
+		h := NewHealth()
+		h.AddCheck("database", func(ctx context.Context) error { return nil })
+		h.AddCheck("mailer", func(ctx context.Context) error { return errors.New("no api key") })
+
+		rr := httptest.NewRecorder()
+		healthRouter(h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "incorrect status code returned")
+		var status healthStatus
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+		assert.Equal(t, "ok", status.Checks["database"])
+		assert.Equal(t, "no api key", status.Checks["mailer"])
+	})
+
+	t.Run("Draining", func(t *testing.T) {
+		h := NewHealth()
+		h.Drain()
+
+		rr := httptest.NewRecorder()
+		healthRouter(h).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "incorrect status code returned")
+	})
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// RegisterInternalRoutes adds the endpoints the other services call. Like theirs, they only
+// answer requests whose X-Internal-Token header is internalKey, and are turned off if it is
+// empty.
+func RegisterInternalRoutes(router *mux.Router, internalKey string, users UserStore, audit AuditStore) {
+	internal := router.PathPrefix("/internal").Subrouter()
+	internal.Use(requireInternalToken(internalKey))
+	internal.HandleFunc("/audit", recordRemoteAudit(audit)).Methods(http.MethodPost)
+	internal.HandleFunc("/users/{id}", getInternalUser(users)).Methods(http.MethodGet)
+}
+
+// requireInternalToken turns away every request that doesn't carry the internal key.
+func requireInternalToken(internalKey string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("X-Internal-Token")
+			if internalKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(internalKey)) != 1 {
+				http.Error(w, "internal token required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Adds an entry to the audit log for a privileged action taken in another service. The
+// services call it before taking the action, and don't take it if it fails.
+func recordRemoteAudit(audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var e AuditEntry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, "error reading entry", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if e.ActorID == "" || e.Service == "" || e.Action == "" || e.TargetID == "" {
+			http.Error(w, "actorId, service, action and targetId are required", http.StatusBadRequest)
+			return
+		}
+		e.ID = uuid.NewString()
+		e.CreatedAt = time.Now()
+		if err := audit.RecordAudit(r.Context(), e); err != nil {
+			http.Error(w, "error writing the audit log", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// internalUser is what the other services learn about an account from GET /internal/users/{id}.
+type internalUser struct {
+	UserID        string `json:"userId"`
+	Username      string `json:"username"`
+	EmailVerified bool   `json:"emailVerified"`
+}
+
+// Tells another service about an account, like whether its email was verified, which profiles
+// shows new users as a step of their onboarding. Deleted accounts are not found.
+func getInternalUser(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := users.UserByID(r.Context(), mux.Vars(r)["id"])
+		if errors.Is(err, ErrUserNotFound) || (err == nil && u.Deleted(time.Now())) {
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(internalUser{UserID: u.UserID, Username: u.Username, EmailVerified: u.Verified})
+	}
+}
+
+// internalClient makes the calls to the internal endpoints of the other services.
+var internalClient = &http.Client{Timeout: 30 * time.Second}
+
+// callInternal calls the internal endpoint <baseURL>/internal/users/{userID}<suffix> of
+// another service with internalKey in the X-Internal-Token header, and returns the body of
+// the response. Any status but 2xx is an error.
+func callInternal(ctx context.Context, method, baseURL, userID, suffix, internalKey string) ([]byte, error) {
+	endpoint := strings.TrimSuffix(baseURL, "/") + "/internal/users/" + url.PathEscape(userID) + suffix
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Internal-Token", internalKey)
+	resp, err := internalClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s returned %s: %s", endpoint, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -1,7 +1,13 @@
 package api
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -14,30 +20,97 @@ var (
 	DefaultRefreshJWTExpiry = 30 * 1440 * time.Minute
 	defaultJWTIssuer        = "CalChat"
 	jwtKey                  = []byte("my_secret_key")
+	// twoFactorChallengeKey signs the challenges handed out by signin. The other services
+	// accept every token signed with jwtKey, so a challenge signed with it would work as an
+	// access token and skip the second step.
+	twoFactorChallengeKey = append([]byte("2fa:"), jwtKey...)
+	// exportLinkKey signs the links to download exports, for the same reason.
+	exportLinkKey = append([]byte("export:"), jwtKey...)
+	// oidcFlowKey signs the cookie that keeps track of a sign in at an OpenID Connect provider.
+	oidcFlowKey = append([]byte("oidc:"), jwtKey...)
 )
 
 // AuthClaims represents the claims in the access token
 type AuthClaims struct {
 	UserID string
+	// EmailVerified tells the other services whether the user has verified their email,
+	// as of when the token was issued.
+	EmailVerified bool
+	// Roles are the roles of the user as of when the token was issued. The other services
+	// check them with HasRole.
+	Roles []string `json:",omitempty"`
 	jwt.StandardClaims
 }
 
 func setClaims(claims AuthClaims) (tokenString string, Error error) {
+	return signClaims(claims, jwtKey)
+}
+
+func signClaims(claims AuthClaims, key []byte) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, err
 }
 
-// GetRandomBase62 returns a string of random base62 characters
+// parseClaims checks the signature and expiry of a token issued by setClaims and returns
+// its claims.
+func parseClaims(tokenString string) (*AuthClaims, error) {
+	return parseClaimsWithKey(tokenString, jwtKey)
+}
+
+func parseClaimsWithKey(tokenString string, key []byte) (*AuthClaims, error) {
+	var claims AuthClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// sessionClaims returns the claims of the access_token cookie of a signed in user.
+func sessionClaims(r *http.Request) (*AuthClaims, error) {
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		return nil, err
+	}
+	claims, err := parseClaims(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject != "access" {
+		return nil, errors.New("not an access token")
+	}
+	return claims, nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a token, which is what gets stored in
+// place of the token. Tokens are long and random, so unlike passwords they don't need a slow,
+// salted hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetRandomBase62 returns a string of random base62 characters. They come from crypto/rand,
+// so tokens made from them can't be guessed from the time they were made.
 func GetRandomBase62(length int) string {
 	const base62 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
-	rand.Seed(time.Now().Unix())
 	r := make([]byte, length)
 	for i := range r {
-		r[i] = base62[rand.Intn(len(base62))]
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(base62))))
+		if err != nil {
+			// The system's source of randomness is broken; no token is safe to hand out.
+			panic(err)
+		}
+		r[i] = base62[n.Int64()]
 	}
 	return string(r)
 }
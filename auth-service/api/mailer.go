@@ -1,15 +1,16 @@
 package api
 
 import (
-	"bytes"
-	"html/template"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
-// A Mailer is something that allows us to send emails that use an HTML template using the files in `/templates`.
+// A Mailer is something that allows us to send emails that use the templates in `/templates`.
 // Note our project is configured to only have a single Mailer which is from SendGrid, so why is
 // it that we made our code work with this interface instead of just using SendGrid directly?
 //
@@ -20,13 +21,29 @@ import (
 // ban you if you make too many requests). This is part of a software engineering technique
 // called a Dependency Injection.
 type Mailer interface {
-	// SendEmail sends an email to the recipient with the specified subject
-	SendEmail(recipient string, subject string, templatePath string, data map[string]interface{}) error
+	// SendEmail renders the templates of the email in the locale of the recipient and sends it.
+	SendEmail(e Email) error
+}
+
+// NewMailer returns the Mailer picked by the MAILER setting: "sendgrid" (the default),
+// "smtp", or "dev" for development machines that shouldn't send real emails.
+func NewMailer() (Mailer, error) {
+	switch kind := os.Getenv("MAILER"); kind {
+	case "", "sendgrid":
+		return NewSendGridMailer(), nil
+	case "smtp":
+		return NewSMTPMailer(), nil
+	case "dev":
+		return NewDevMailer(os.Getenv("MAIL_DIR")), nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", kind)
+	}
 }
 
 // A Struct that contains all the information needed to send an email using SendGrid.
 type SendGridMailer struct {
 	client *sendgrid.Client
+	apiKey string
 	sender *mail.Email
 	scheme string
 }
@@ -35,30 +52,33 @@ type SendGridMailer struct {
 // into an .env file next to main.go so the code can log you in! Also add in a SENDER_EMAIL!
 func NewSendGridMailer() SendGridMailer {
 	return SendGridMailer{sendgrid.NewSendClient(os.Getenv("SENDGRID_KEY")),
+		os.Getenv("SENDGRID_KEY"),
 		mail.NewEmail("DevOps At Berkeley", os.Getenv("SENDER_EMAIL")),
 		"http",
 	}
 }
 
-// This SendEmail function uses SendGrid to send an email.
-func (m SendGridMailer) SendEmail(recipient string, subject string, templatePath string, data map[string]interface{}) error {
-	// Parse template file and execute with data.
-	var html bytes.Buffer
-	tmpl, err := template.ParseFiles("./api/templates/" + templatePath)
-	if err != nil {
-		return err
+// Check reports whether the mailer has what it needs to send emails. It is used as a readiness check.
+func (m SendGridMailer) Check(ctx context.Context) error {
+	if m.apiKey == "" {
+		return errors.New("SENDGRID_KEY is not set")
 	}
-	err = tmpl.Execute(&html, data)
+	if m.sender.Address == "" {
+		return errors.New("SENDER_EMAIL is not set")
+	}
+	return nil
+}
+
+// This SendEmail function uses SendGrid to send an email.
+func (m SendGridMailer) SendEmail(e Email) error {
+	rendered, err := renderEmail(e)
 	if err != nil {
 		return err
 	}
-
-	//turn our html page buffer into a string
-	plainTextContent := html.String()
-	recipientEmail := mail.NewEmail("recipient", recipient)
+	recipientEmail := mail.NewEmail("recipient", e.Recipient)
 
 	// Construct and send email via Sendgrid.
-	message := mail.NewSingleEmail(m.sender, subject, recipientEmail, plainTextContent, html.String())
+	message := mail.NewSingleEmail(m.sender, rendered.Subject, recipientEmail, rendered.Text, rendered.HTML)
 
 	_, err = m.client.Send(message)
 	return err
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// DevMailer renders emails like a real Mailer would but never sends them. Instead, it saves
+// them as text and HTML files in a directory, or writes them to the log if it has no directory. It lets
+// the whole signup and reset flow run on a development machine.
+type DevMailer struct {
+	dir string
+}
+
+// NewDevMailer returns a DevMailer that saves emails in dir, or logs them if dir is empty.
+func NewDevMailer(dir string) DevMailer {
+	return DevMailer{dir: dir}
+}
+
+// Check reports whether the mailer can save emails. It is used as a readiness check.
+func (m DevMailer) Check(ctx context.Context) error {
+	if m.dir == "" {
+		return nil
+	}
+	return os.MkdirAll(m.dir, 0o755)
+}
+
+// unsafeFileChars matches everything we don't want in a file name.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9@._-]+`)
+
+func (m DevMailer) SendEmail(e Email) error {
+	rendered, err := renderEmail(e)
+	if err != nil {
+		return err
+	}
+	if m.dir == "" {
+		log.Printf("email to %s: %s\n%s", e.Recipient, rendered.Subject, rendered.Text)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+	// Names start with the time so that the newest email is listed last.
+	name := fmt.Sprintf("%s-%s-%s", time.Now().Format("20060102T150405.000000000"),
+		unsafeFileChars.ReplaceAllString(e.Recipient, "_"), unsafeFileChars.ReplaceAllString(rendered.Subject, "_"))
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path+".txt", []byte(rendered.Text), 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".html", []byte(rendered.HTML), 0o644); err != nil {
+		return err
+	}
+	log.Printf("email to %s saved in %s.html", e.Recipient, path)
+	return nil
+}
+
+// A CapturedEmail is an email passed to CaptureMailer.SendEmail, along with what it rendered to.
+type CapturedEmail struct {
+	Email
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// CaptureMailer renders every email it is asked to send and keeps it in memory, so that tests
+// can check what was sent, and with which token.
+type CaptureMailer struct {
+	mu     sync.Mutex
+	emails []CapturedEmail
+}
+
+// NewCaptureMailer returns a CaptureMailer that hasn't captured anything yet.
+func NewCaptureMailer() *CaptureMailer {
+	return &CaptureMailer{}
+}
+
+func (m *CaptureMailer) SendEmail(e Email) error {
+	rendered, err := renderEmail(e)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emails = append(m.emails, CapturedEmail{
+		Email:   e,
+		Subject: rendered.Subject,
+		Text:    rendered.Text,
+		HTML:    rendered.HTML,
+	})
+	return nil
+}
+
+// Emails returns everything captured so far, oldest first.
+func (m *CaptureMailer) Emails() []CapturedEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]CapturedEmail(nil), m.emails...)
+}
+
+// Last returns the most recent email and whether there was any.
+func (m *CaptureMailer) Last() (CapturedEmail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.emails) == 0 {
+		return CapturedEmail{}, false
+	}
+	return m.emails[len(m.emails)-1], true
+}
+
+// Token returns the "Token" passed to the template of the most recent email, or "" if there
+// is none.
+func (m *CaptureMailer) Token() string {
+	last, _ := m.Last()
+	token, _ := last.Data["Token"].(string)
+	return token
+}
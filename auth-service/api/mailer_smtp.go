@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"time"
+)
+
+// SMTPMailer sends emails through any SMTP server, such as the one of a university or company
+// account, or a local catcher like MailHog.
+type SMTPMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	sender   string
+	// startTLS makes the mailer refuse servers that can't upgrade the connection to TLS.
+	// Only local catchers should need it turned off.
+	startTLS bool
+	timeout  time.Duration
+}
+
+// NewSMTPMailer configures an SMTPMailer from SMTP_HOST, SMTP_PORT (587 by default),
+// SMTP_USERNAME, SMTP_PASSWORD and SENDER_EMAIL. Set SMTP_STARTTLS to "false" for servers
+// without TLS.
+func NewSMTPMailer() SMTPMailer {
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return SMTPMailer{
+		host:     os.Getenv("SMTP_HOST"),
+		port:     port,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		sender:   os.Getenv("SENDER_EMAIL"),
+		startTLS: os.Getenv("SMTP_STARTTLS") != "false",
+		timeout:  30 * time.Second,
+	}
+}
+
+// Check reports whether the mailer has what it needs to send emails. It is used as a readiness check.
+func (m SMTPMailer) Check(ctx context.Context) error {
+	if m.host == "" {
+		return errors.New("SMTP_HOST is not set")
+	}
+	if m.sender == "" {
+		return errors.New("SENDER_EMAIL is not set")
+	}
+	return nil
+}
+
+func (m SMTPMailer) SendEmail(e Email) error {
+	rendered, err := renderEmail(e)
+	if err != nil {
+		return err
+	}
+	recipient := e.Recipient
+	msg, err := buildMessage(m.sender, recipient, rendered)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(m.host, m.port), m.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(m.timeout))
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.startTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", m.host)
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		// PlainAuth refuses to send the password over a connection that isn't encrypted,
+		// unless the server is on localhost.
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.sender); err != nil {
+		return err
+	}
+	if err := c.Rcpt(recipient); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMessage assembles a multipart/alternative email with a plain-text and an HTML part,
+// ready to be sent over SMTP.
+func buildMessage(sender, recipient string, rendered renderedEmail) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	// Clients show the last part they understand, so the HTML goes last.
+	for _, part := range [][2]string{{"text/plain", rendered.Text}, {"text/html", rendered.HTML}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part[0] + `; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Quoted-printable keeps lines short enough for every server along the way.
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part[1])); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", sender},
+		{"To", recipient},
+		{"Subject", mime.QEncoding.Encode("utf-8", rendered.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": parts.Boundary()})},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
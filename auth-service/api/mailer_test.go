@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetEmail is the email the tests send.
+var resetEmail = Email{
+	Recipient: "oski@berkeley.edu",
+	Template:  resetEmailTemplate,
+	Data:      map[string]interface{}{"Token": "t0ken", "Link": "https://bearchat.com/reset?token=t0ken"},
+}
+
+func TestRenderEmail(t *testing.T) {
+	for _, test := range []struct {
+		locale  string
+		subject string
+	}{
+		{"", "BearChat Password Reset"},
+		{"en-US", "BearChat Password Reset"},
+		{"es", "Restablecer contraseña de BearChat"},
+		{"es-MX", "Restablecer contraseña de BearChat"},
+		{"ES_mx", "Restablecer contraseña de BearChat"},
+		{"fr-FR", "BearChat Password Reset"},
+	} {
+		e := resetEmail
+		e.Locale = test.locale
+		rendered, err := renderEmail(e)
+		require.NoError(t, err)
+		assert.Equal(t, test.subject, rendered.Subject, "wrong subject for locale %q", test.locale)
+		assert.Contains(t, rendered.Text, "https://bearchat.com/reset?token=t0ken", "the link is not in the text part")
+		assert.NotContains(t, rendered.Text, "<", "the text part is HTML")
+		assert.Contains(t, rendered.HTML, `href="https://bearchat.com/reset?token=t0ken"`, "the link is not in the HTML part")
+	}
+
+	_, err := renderEmail(Email{Recipient: "oski@berkeley.edu", Template: "no-such-email"})
+	assert.Error(t, err, "an unknown template was rendered")
+}
+
+func TestEmailTemplatesComplete(t *testing.T) {
+	// Every email the service sends exists in the default locale.
+	for _, name := range []string{verifyEmailTemplate, resetEmailTemplate} {
+		assert.Contains(t, emailTemplates[DefaultLocale], name)
+	}
+}
+
+func TestDevMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := NewDevMailer(dir)
+	require.NoError(t, m.Check(context.Background()))
+	require.NoError(t, m.SendEmail(resetEmail))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2, "the mailer did not save a text and an HTML file")
+	for _, file := range files {
+		assert.Contains(t, file.Name(), "oski@berkeley.edu")
+		body, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "token=t0ken", "the template was not rendered")
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	m := SMTPMailer{
+		host:     "127.0.0.1",
+		port:     server.port,
+		username: "oski",
+		password: "golden bear",
+		sender:   "noreply@bearchat.com",
+		timeout:  defaultTestTimeout,
+	}
+	require.NoError(t, m.SendEmail(resetEmail))
+
+	session := <-server.sessions
+	assert.Contains(t, session, "AUTH PLAIN", "the mailer did not log in")
+	assert.Contains(t, session, "MAIL FROM:<noreply@bearchat.com>")
+	assert.Contains(t, session, "RCPT TO:<oski@berkeley.edu>")
+	assert.Contains(t, session, "Subject: BearChat Password Reset")
+	assert.Contains(t, session, "Content-Type: multipart/alternative")
+	assert.Contains(t, session, "Content-Type: text/plain")
+	assert.Contains(t, session, "Content-Type: text/html")
+	assert.Contains(t, session, "=3Dt0ken", "the body is not the rendered template")
+}
+
+func TestSMTPMailerRequiresSTARTTLS(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	m := SMTPMailer{host: "127.0.0.1", port: server.port, sender: "noreply@bearchat.com", startTLS: true, timeout: defaultTestTimeout}
+
+	err := m.SendEmail(resetEmail)
+	assert.Error(t, err, "the mailer sent an email without TLS")
+}
+
+const defaultTestTimeout = 5 * time.Second
+
+// fakeSMTPServer accepts one connection, answers just enough SMTP for net/smtp to send an
+// email and hands the whole session back on sessions.
+type fakeSMTPServer struct {
+	port     string
+	sessions chan string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	s := &fakeSMTPServer{port: port, sessions: make(chan string, 1)}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var session strings.Builder
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "220 localhost ESMTP\r\n")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			session.WriteString(line)
+			switch {
+			case inData:
+				if line == ".\r\n" {
+					inData = false
+					io.WriteString(conn, "250 OK\r\n")
+				}
+			case strings.HasPrefix(line, "EHLO"):
+				io.WriteString(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+			case strings.HasPrefix(line, "AUTH"):
+				io.WriteString(conn, "235 OK\r\n")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				io.WriteString(conn, "354 go ahead\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				io.WriteString(conn, "221 bye\r\n")
+				s.sessions <- session.String()
+				return
+			default:
+				io.WriteString(conn, "250 OK\r\n")
+			}
+		}
+		s.sessions <- session.String()
+	}()
+	return s
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Makes sure the migrations shipped with the service are well formed.
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, migration := range migrations {
+		assert.Equal(t, i+1, migration.Version, "migration versions should have no gaps")
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("Sorted By Version", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"m/002_second.up.sql":   {Data: []byte("CREATE TABLE b (id INT);")},
+			"m/002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+			"m/001_first.up.sql":    {Data: []byte("CREATE TABLE a (id INT);")},
+			"m/001_first.down.sql":  {Data: []byte("DROP TABLE a;")},
+			"m/README.md":           {Data: []byte("not a migration")},
+		}
+		migrations, err := loadMigrations(fsys, "m")
+		require.NoError(t, err)
+		require.Len(t, migrations, 2)
+		assert.Equal(t, Migration{1, "first", "CREATE TABLE a (id INT);", "DROP TABLE a;"}, migrations[0])
+		assert.Equal(t, Migration{2, "second", "CREATE TABLE b (id INT);", "DROP TABLE b;"}, migrations[1])
+	})
+
+	t.Run("Missing Down", func(t *testing.T) {
+		fsys := fstest.MapFS{"m/001_first.up.sql": {Data: []byte("CREATE TABLE a (id INT);")}}
+		_, err := loadMigrations(fsys, "m")
+		assert.Error(t, err)
+	})
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- A comment
+CREATE TABLE a (
+    id INT
+);
+
+-- Another comment
+INSERT INTO a VALUES (1);
+UPDATE a SET id = 2`
+	assert.Equal(t, []string{
+		"CREATE TABLE a (\n    id INT\n)",
+		"INSERT INTO a VALUES (1)",
+		"UPDATE a SET id = 2",
+	}, splitStatements(script))
+}
@@ -0,0 +1,11 @@
+-- The original schema that used to live in db-server/initdb.sql. IF NOT EXISTS lets databases
+-- created from that script adopt this migration as already applied.
+CREATE TABLE IF NOT EXISTS users (
+    username VARCHAR(20),
+    email VARCHAR(320),
+    hashedPassword TEXT,
+    verified boolean,
+    resetToken TEXT,
+    verifiedToken TEXT,
+    userId VARCHAR(128) PRIMARY KEY
+);
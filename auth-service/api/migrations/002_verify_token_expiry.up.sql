@@ -0,0 +1,3 @@
+-- Verification tokens expire. Tokens handed out before this migration have no expiry time and
+-- count as expired; their owners can ask for a new one at /api/auth/resendverify.
+ALTER TABLE users ADD COLUMN verifiedTokenExpiresAt DATETIME;
@@ -0,0 +1,3 @@
+-- Hashed tokens are useless to the old code, so they are dropped as well.
+UPDATE users SET resetToken = NULL;
+ALTER TABLE users DROP COLUMN resetTokenExpiresAt;
@@ -0,0 +1,4 @@
+-- resetToken now holds the SHA-256 hash of the token instead of the token itself, and tokens
+-- expire. Tokens handed out before this migration were stored in plaintext, so they are dropped.
+UPDATE users SET resetToken = NULL;
+ALTER TABLE users ADD COLUMN resetTokenExpiresAt DATETIME;
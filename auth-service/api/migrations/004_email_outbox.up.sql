@@ -0,0 +1,15 @@
+-- Emails waiting to be sent, or given up on, by the outbox worker.
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id VARCHAR(36) PRIMARY KEY,
+    recipient VARCHAR(320) NOT NULL,
+    subject TEXT NOT NULL,
+    template VARCHAR(255) NOT NULL,
+    data TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL,
+    nextAttemptAt DATETIME,
+    lastError TEXT,
+    createdAt DATETIME NOT NULL,
+    sentAt DATETIME
+);
+CREATE INDEX email_outbox_due ON email_outbox (status, nextAttemptAt);
@@ -0,0 +1,4 @@
+UPDATE email_outbox SET template = 'user-signup.html' WHERE template = 'user-signup';
+UPDATE email_outbox SET template = 'password-reset.html' WHERE template = 'password-reset';
+ALTER TABLE email_outbox DROP COLUMN locale;
+ALTER TABLE users DROP COLUMN locale;
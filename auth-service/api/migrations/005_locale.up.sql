@@ -0,0 +1,6 @@
+-- Emails are sent in the locale users prefer. An empty locale means English.
+ALTER TABLE users ADD COLUMN locale VARCHAR(35) NOT NULL DEFAULT '';
+ALTER TABLE email_outbox ADD COLUMN locale VARCHAR(35) NOT NULL DEFAULT '';
+-- Templates are now named without their extension, since every email has a text and an HTML one.
+UPDATE email_outbox SET template = 'user-signup' WHERE template = 'user-signup.html';
+UPDATE email_outbox SET template = 'password-reset' WHERE template = 'password-reset.html';
@@ -0,0 +1,12 @@
+-- Optional TOTP two-factor authentication. totpSecret is set as soon as the user starts
+-- enrolling, but only counts once totpEnabled is set. totpLastStep is the time step of the last
+-- code used, so that no code works twice.
+ALTER TABLE users ADD COLUMN totpSecret VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totpEnabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totpLastStep BIGINT NOT NULL DEFAULT 0;
+-- The SHA-256 hashes of the recovery codes users have left. A code is deleted when it is used.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    userId VARCHAR(128) NOT NULL,
+    codeHash CHAR(64) NOT NULL,
+    PRIMARY KEY (userId, codeHash)
+);
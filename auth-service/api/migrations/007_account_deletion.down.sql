@@ -0,0 +1,5 @@
+ALTER TABLE users DROP COLUMN deletionRetryAt;
+ALTER TABLE users DROP COLUMN deletionLastError;
+ALTER TABLE users DROP COLUMN deletionAttempts;
+ALTER TABLE users DROP COLUMN deletionSteps;
+ALTER TABLE users DROP COLUMN deleteAfter;
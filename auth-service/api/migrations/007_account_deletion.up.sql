@@ -0,0 +1,8 @@
+-- Accounts scheduled for deletion. deleteAfter is the end of the grace period. Once it passes,
+-- the reaper removes the data of the user in every service. deletionSteps lists the services
+-- already done, comma separated, so that an interrupted deletion picks up where it stopped.
+ALTER TABLE users ADD COLUMN deleteAfter DATETIME;
+ALTER TABLE users ADD COLUMN deletionSteps TEXT;
+ALTER TABLE users ADD COLUMN deletionAttempts INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN deletionLastError TEXT;
+ALTER TABLE users ADD COLUMN deletionRetryAt DATETIME;
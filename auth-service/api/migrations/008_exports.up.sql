@@ -0,0 +1,16 @@
+-- Archives of the data of a user, built in the background by the export worker. archive is
+-- only set once the export is ready, and the row is removed once it expires.
+CREATE TABLE IF NOT EXISTS exports (
+    id VARCHAR(36) PRIMARY KEY,
+    userId VARCHAR(128) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL,
+    nextAttemptAt DATETIME,
+    lastError TEXT,
+    createdAt DATETIME NOT NULL,
+    finishedAt DATETIME,
+    expiresAt DATETIME,
+    archive LONGBLOB
+);
+CREATE INDEX exports_user ON exports (userId, createdAt);
+CREATE INDEX exports_due ON exports (status, nextAttemptAt);
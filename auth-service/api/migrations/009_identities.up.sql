@@ -0,0 +1,10 @@
+-- The accounts at OpenID Connect providers that users sign in with. subject is the "sub" claim
+-- of the provider, which unlike the email never changes for a user.
+CREATE TABLE IF NOT EXISTS identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    userId VARCHAR(128) NOT NULL,
+    createdAt DATETIME NOT NULL,
+    PRIMARY KEY (provider, subject)
+);
+CREATE INDEX identities_user ON identities (userId);
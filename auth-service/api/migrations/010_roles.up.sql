@@ -0,0 +1,21 @@
+-- The roles granted to users, like "admin" or "moderator". They are copied into the access
+-- tokens so that the other services can check them.
+CREATE TABLE IF NOT EXISTS roles (
+    userId VARCHAR(128) NOT NULL,
+    role VARCHAR(32) NOT NULL,
+    grantedAt DATETIME NOT NULL,
+    PRIMARY KEY (userId, role)
+);
+
+-- Every privileged action taken by an admin or moderator, in any service. Rows are never
+-- updated or removed, not even when the actor or target account is deleted.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id VARCHAR(36) PRIMARY KEY,
+    actorId VARCHAR(128) NOT NULL,
+    service VARCHAR(32) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    targetId VARCHAR(128) NOT NULL,
+    details TEXT,
+    createdAt DATETIME NOT NULL
+);
+CREATE INDEX audit_log_created ON audit_log (createdAt);
@@ -0,0 +1,8 @@
+-- The usernames users gave up by renaming themselves, so that links to the old name can still
+-- find them for a while. Only the last user to give up a username is kept.
+CREATE TABLE IF NOT EXISTS username_history (
+    username VARCHAR(20) PRIMARY KEY,
+    userId VARCHAR(128) NOT NULL,
+    changedAt DATETIME NOT NULL
+);
+CREATE INDEX username_history_user ON username_history (userId);
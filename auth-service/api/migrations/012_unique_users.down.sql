@@ -0,0 +1,4 @@
+-- MySQL needs to be told the table of the index, which SQLite doesn't accept. SQLite skips
+-- the /*! */ comment, and MySQL runs what is inside it.
+DROP INDEX users_email /*! ON users */;
+DROP INDEX users_username /*! ON users */;
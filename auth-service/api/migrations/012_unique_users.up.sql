@@ -0,0 +1,5 @@
+-- Usernames and emails are unique, whatever their case. MySQL compares them without case by
+-- default, but SQLite doesn't, so both index and look them up in lower case. Databases that
+-- already hold two accounts differing only by case need one of them renamed first.
+CREATE UNIQUE INDEX users_username ON users ((LOWER(username)));
+CREATE UNIQUE INDEX users_email ON users ((LOWER(email)));
@@ -0,0 +1,539 @@
+package api
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// OIDCFlowExpiry is how long users have to sign in at the provider once they left for it.
+	OIDCFlowExpiry = 10 * time.Minute
+	// OIDCClockSkew is how far the clock of a provider may be off from ours when checking the
+	// expiry of its ID tokens.
+	OIDCClockSkew = time.Minute
+)
+
+// oidcClient makes the calls to OpenID Connect providers.
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcFlowCookie holds the state, nonce and PKCE verifier of a sign in that is going on at a
+// provider, so that nothing has to be stored until it comes back.
+const oidcFlowCookie = "oidc_flow"
+
+// OIDCProvider is an OpenID Connect provider users can sign in with. Its endpoints and keys
+// are discovered from the issuer the first time they are needed.
+type OIDCProvider struct {
+	// Name identifies the provider in the URLs of auth-service, like "google".
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	config *oidcConfig
+	keys   map[string]*rsa.PublicKey
+}
+
+// NewOIDCProvider returns the provider with the given issuer, where auth-service is registered
+// as clientID.
+func NewOIDCProvider(name, issuer, clientID, clientSecret string) *OIDCProvider {
+	return &OIDCProvider{Name: name, Issuer: strings.TrimSuffix(issuer, "/"), ClientID: clientID, ClientSecret: clientSecret}
+}
+
+// oidcConfig is the part of the discovery document of a provider we use.
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcFlowClaims are the claims of the flow cookie.
+type oidcFlowClaims struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+	jwt.StandardClaims
+}
+
+// idTokenClaims are the claims of an ID token we use. They are checked by verifyIDToken, so
+// Valid doesn't do anything.
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	ExpiresAt         int64    `json:"exp"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Locale            string   `json:"locale"`
+}
+
+func (idTokenClaims) Valid() error { return nil }
+
+// audience is the "aud" claim, which is either a string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// RegisterOIDCRoutes adds the endpoints to sign in through the given providers.
+func RegisterOIDCRoutes(router *mux.Router, users UserStore, events EventBus, providers ...*OIDCProvider) {
+	byName := make(map[string]*OIDCProvider, len(providers))
+	names := make([]string, 0, len(providers))
+	for _, p := range providers {
+		byName[p.Name] = p
+		names = append(names, p.Name)
+	}
+	router.HandleFunc("/api/auth/oidc", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{"providers": names})
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/api/auth/oidc/{provider}/login", oidcLogin(byName)).Methods(http.MethodGet)
+	router.HandleFunc("/api/auth/oidc/{provider}/callback", oidcCallback(users, events, byName)).Methods(http.MethodGet)
+}
+
+// Sends the user to the provider to sign in, with a PKCE challenge and a fresh state and nonce
+// that are kept in the flow cookie.
+func oidcLogin(providers map[string]*OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := providers[mux.Vars(r)["provider"]]
+		if !ok {
+			http.Error(w, "unknown provider", http.StatusNotFound)
+			return
+		}
+		config, err := p.discover(r.Context())
+		if err != nil {
+			http.Error(w, "error reaching the provider", http.StatusBadGateway)
+			log.Print(err.Error())
+			return
+		}
+
+		flow := oidcFlowClaims{
+			Provider: p.Name,
+			State:    GetRandomBase62(32),
+			Nonce:    GetRandomBase62(32),
+			// PKCE verifiers have to be between 43 and 128 characters long.
+			Verifier: GetRandomBase62(64),
+			StandardClaims: jwt.StandardClaims{
+				ExpiresAt: time.Now().Add(OIDCFlowExpiry).Unix(),
+				Issuer:    defaultJWTIssuer,
+			},
+		}
+		cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, flow).SignedString(oidcFlowKey)
+		if err != nil {
+			http.Error(w, "error starting sign in", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		// Lax, since the provider sends the user back with a cross-site redirect.
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcFlowCookie,
+			Value:    cookie,
+			Path:     "/api/auth/oidc",
+			MaxAge:   int(OIDCFlowExpiry.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		challenge := sha256.Sum256([]byte(flow.Verifier))
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {p.ClientID},
+			"redirect_uri":          {p.redirectURI()},
+			"scope":                 {"openid email profile"},
+			"state":                 {flow.State},
+			"nonce":                 {flow.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		http.Redirect(w, r, config.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+	}
+}
+
+// Where the provider sends the user back. It checks the state against the flow cookie, trades
+// the code for an ID token and signs in the account linked to it, linking or creating one if
+// there is none yet.
+func oidcCallback(users UserStore, events EventBus, providers map[string]*OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := providers[mux.Vars(r)["provider"]]
+		if !ok {
+			http.Error(w, "unknown provider", http.StatusNotFound)
+			return
+		}
+		// The flow is over either way.
+		http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Value: "", Path: "/api/auth/oidc", MaxAge: -1})
+		if e := r.URL.Query().Get("error"); e != "" {
+			http.Error(w, "the provider refused to sign you in: "+e, http.StatusBadRequest)
+			return
+		}
+		flow, err := readOIDCFlow(r)
+		state := r.URL.Query().Get("state")
+		if err != nil || flow.Provider != p.Name || subtle.ConstantTimeCompare([]byte(state), []byte(flow.State)) != 1 {
+			http.Error(w, "invalid or expired sign in, try again", http.StatusBadRequest)
+			return
+		}
+
+		rawIDToken, err := p.exchange(r.Context(), r.URL.Query().Get("code"), flow.Verifier)
+		if err != nil {
+			http.Error(w, "error signing in with the provider", http.StatusBadGateway)
+			log.Print(err.Error())
+			return
+		}
+		claims, err := p.verifyIDToken(r.Context(), rawIDToken, flow.Nonce, time.Now())
+		if err != nil {
+			http.Error(w, "invalid ID token", http.StatusUnauthorized)
+			log.Print(err.Error())
+			return
+		}
+
+		u, status, err := oidcUser(r, users, events, p, claims)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			if status == http.StatusInternalServerError {
+				log.Print(err.Error())
+			}
+			return
+		}
+
+		// Users with two-factor authentication still need a code. The challenge is kept in a
+		// cookie rather than the URL, where it would end up in the history and logs, and the sign
+		// in page sends the code to /api/auth/2fa/verify along with it.
+		if u.TOTPEnabled {
+			challenge, err := newTwoFactorChallenge(u)
+			if err != nil {
+				http.Error(w, "error creating challenge", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     twoFactorChallengeCookie,
+				Value:    challenge,
+				Path:     "/api/auth/2fa",
+				MaxAge:   int(TwoFactorChallengeExpiry.Seconds()),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, PublicBaseURL+"/signin?twoFactor=1", http.StatusFound)
+			return
+		}
+		if err := setSessionCookies(w, u); err != nil {
+			http.Error(w, "error creating accessToken", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		http.Redirect(w, r, PublicBaseURL+"/", http.StatusFound)
+	}
+}
+
+// readOIDCFlow returns the claims of the flow cookie of the request.
+func readOIDCFlow(r *http.Request) (*oidcFlowClaims, error) {
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		return nil, err
+	}
+	var flow oidcFlowClaims
+	_, err = jwt.ParseWithClaims(cookie.Value, &flow, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return oidcFlowKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &flow, nil
+}
+
+// oidcUser returns the user to sign in with the identity in claims. An identity that was never
+// seen before is linked to the account with the same email, as long as both the provider and
+// we verified it. Otherwise it gets a new account. Errors come with the status to answer with.
+func oidcUser(r *http.Request, users UserStore, events EventBus, p *OIDCProvider, claims *idTokenClaims) (User, int, error) {
+	u, err := users.UserByIdentity(r.Context(), p.Name, claims.Subject)
+	if err == nil {
+		if u.Deleted(time.Now()) {
+			return User{}, http.StatusForbidden, errors.New("this account was deleted")
+		}
+		return u, 0, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return User{}, http.StatusInternalServerError, err
+	}
+	if claims.Email == "" {
+		return User{}, http.StatusBadRequest, errors.New("the provider didn't share your email")
+	}
+
+	u, err = users.UserByEmail(r.Context(), claims.Email)
+	if err == nil {
+		// Linking on an email that either side didn't verify would let whoever typed it in
+		// take over the account.
+		if !claims.EmailVerified || !u.Verified {
+			return User{}, http.StatusConflict, fmt.Errorf("an account already uses this email. Verify it on both sides, or sign in with your password")
+		}
+		if u.Deleted(time.Now()) {
+			return User{}, http.StatusForbidden, errors.New("this account was deleted")
+		}
+	} else if errors.Is(err, ErrUserNotFound) {
+		u, err = createOIDCUser(r, users, claims)
+		if err != nil {
+			return User{}, http.StatusInternalServerError, err
+		}
+		publishEvent(r.Context(), events, userCreated(u))
+	} else {
+		return User{}, http.StatusInternalServerError, err
+	}
+
+	if err := users.LinkIdentity(r.Context(), u.UserID, p.Name, claims.Subject); err != nil {
+		return User{}, http.StatusInternalServerError, err
+	}
+	return u, 0, nil
+}
+
+// usernameDisallowed matches the characters we leave out of the usernames made up for
+// accounts created through a provider.
+var usernameDisallowed = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// createOIDCUser creates the account of a user who signed in through a provider for the first
+// time. It has a random password, which they can replace with a password reset, and a username
+// made up from what the provider told us.
+func createOIDCUser(r *http.Request, users UserStore, claims *idTokenClaims) (User, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = usernameDisallowed.ReplaceAllString(base, "")
+	if base == "" {
+		base = "bear"
+	}
+	pass, err := bcrypt.GenerateFromPassword([]byte(GetRandomBase62(resetTokenSize)), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	u := User{
+		UserID:         uuid.NewString(),
+		Email:          claims.Email,
+		HashedPassword: pass,
+		Verified:       claims.EmailVerified,
+		Locale:         requestLocale(r, claims.Locale),
+	}
+	if len(base) > maxUsernameLength {
+		base = base[:maxUsernameLength]
+	}
+	// Add a random suffix to the username until it is free.
+	for attempt := 0; attempt < 5; attempt++ {
+		u.Username = base
+		if attempt > 0 {
+			suffix := GetRandomBase62(4)
+			if len(base)+len(suffix) > maxUsernameLength {
+				u.Username = base[:maxUsernameLength-len(suffix)]
+			}
+			u.Username += suffix
+		}
+		err = users.CreateUser(r.Context(), u)
+		if !errors.Is(err, ErrUsernameTaken) {
+			return u, err
+		}
+	}
+	return User{}, err
+}
+
+// redirectURI is where the provider sends users back to, which has to be registered with it.
+func (p *OIDCProvider) redirectURI() string {
+	return PublicBaseURL + "/api/auth/oidc/" + url.PathEscape(p.Name) + "/callback"
+}
+
+// discover returns the discovery document of the provider, fetching it the first time.
+func (p *OIDCProvider) discover(ctx context.Context) (oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return *p.config, nil
+	}
+
+	var config oidcConfig
+	if err := getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return oidcConfig{}, fmt.Errorf("discovering %s: %w", p.Name, err)
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != p.Issuer {
+		return oidcConfig{}, fmt.Errorf("discovering %s: the issuer is %q, not %q", p.Name, config.Issuer, p.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return oidcConfig{}, fmt.Errorf("discovering %s: endpoints are missing", p.Name)
+	}
+	p.config = &config
+	return config, nil
+}
+
+// exchange trades an authorization code for an ID token.
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI()},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("%s token endpoint returned %s: %s", p.Name, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("%s token endpoint returned no ID token", p.Name)
+	}
+	return tokens.IDToken, nil
+}
+
+// verifyIDToken checks the signature of an ID token against the keys of the provider, and that
+// it was issued by the provider, for us, for the sign in with the given nonce, and hasn't
+// expired.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string, now time.Time) (*idTokenClaims, error) {
+	var claims idTokenClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q, not %q", claims.Issuer, p.Issuer)
+	}
+	forUs := false
+	for _, aud := range claims.Audience {
+		forUs = forUs || aud == p.ClientID
+	}
+	if !forUs {
+		return nil, fmt.Errorf("ID token meant for %v", claims.Audience)
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0).Add(OIDCClockSkew)) {
+		return nil, errors.New("ID token expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token has the wrong nonce")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// key returns the signing key of the provider with the given ID. Providers rotate their keys,
+// so the keys are fetched again when the ID is unknown.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	config, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, config.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching the keys of %s: %w", p.Name, err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s of %s: %w", k.Kid, p.Name, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %s of %s: %w", k.Kid, p.Name, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%s has no key %q", p.Name, kid)
+	}
+	return key, nil
+}
+
+// getJSON decodes the JSON at endpoint into v.
+func getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,357 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// Contains the tests for signing in with an OpenID Connect provider.
+func (s *AuthTestSuite) TestOIDC() {
+	s.Run("Test New User", func() {
+		s.SetupTest()
+		provider := newMockOIDCProvider()
+		defer provider.Close()
+		router := s.newOIDCRouter(provider)
+
+		rr := s.oidcSignin(router, provider, nil)
+		s.Require().Equal(http.StatusFound, rr.Result().StatusCode, "sign in failed: %s", rr.Body.String())
+		s.Assert().Equal(PublicBaseURL+"/", rr.Result().Header.Get("Location"))
+		session := oidcSessionCookies(rr)
+		s.verifyLoginCookies(session)
+
+		u, err := s.users.UserByEmail(context.Background(), provider.email)
+		s.Require().NoError(err, "no account was created")
+		s.Assert().Equal("oski", u.Username)
+		s.Assert().True(u.Verified, "the provider verified the email")
+		s.Assert().Equal(u.UserID, s.accessClaims(session).UserID)
+		events := s.events.Events()
+		s.Require().Len(events, 1, "user.created was not published")
+		s.Assert().Equal(u.UserID, events[0].UserID)
+
+		// The next sign in finds the same account through the identity.
+		rr = s.oidcSignin(router, provider, nil)
+		s.Require().Equal(http.StatusFound, rr.Result().StatusCode)
+		s.Assert().Equal(u.UserID, s.accessClaims(oidcSessionCookies(rr)).UserID, "signed in to another account")
+		s.Assert().Len(s.events.Events(), 1, "user.created was published for an existing user")
+	})
+
+	s.Run("Test Username Taken", func() {
+		s.SetupTest()
+		provider := newMockOIDCProvider()
+		defer provider.Close()
+		router := s.newOIDCRouter(provider)
+		rr := s.request(router, "/api/auth/signup", Credentials{Username: "oski", Email: "other@berkeley.edu", Password: "GoBears"}, nil)
+		s.Require().Equal(http.StatusCreated, rr.Result().StatusCode)
+
+		rr = s.oidcSignin(router, provider, nil)
+		s.Require().Equal(http.StatusFound, rr.Result().StatusCode, "sign in failed: %s", rr.Body.String())
+		u, err := s.users.UserByEmail(context.Background(), provider.email)
+		s.Require().NoError(err)
+		s.Assert().NotEqual("oski", u.Username)
+		s.Assert().True(strings.HasPrefix(u.Username, "oski"), "unexpected username %s", u.Username)
+	})
+
+	s.Run("Test Links Verified Account", func() {
+		s.SetupTest()
+		provider := newMockOIDCProvider()
+		defer provider.Close()
+		router := s.newOIDCRouter(provider)
+		s.signupSession(router)
+		u := s.verifyTestUser()
+		provider.email = s.testCreds.Email
+
+		rr := s.oidcSignin(router, provider, nil)
+		s.Require().Equal(http.StatusFound, rr.Result().StatusCode, "sign in failed: %s", rr.Body.String())
+		s.Assert().Equal(u.UserID, s.accessClaims(oidcSessionCookies(rr)).UserID, "the identity was not linked")
+		linked, err := s.users.UserByIdentity(context.Background(), "mock", provider.subject)
+		s.Require().NoError(err)
+		s.Assert().Equal(u.UserID, linked.UserID)
+	})
+
+	s.Run("Test Unverified Email", func() {
+		s.SetupTest()
+		provider := newMockOIDCProvider()
+		defer provider.Close()
+		router := s.newOIDCRouter(provider)
+		s.signupSession(router)
+		provider.email = s.testCreds.Email
+
+		rr := s.oidcSignin(router, provider, nil)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "linked to an account whose email is not verified")
+
+		s.verifyTestUser()
+		provider.emailVerified = false
+		rr = s.oidcSignin(router, provider, nil)
+		s.Assert().Equal(http.StatusConflict, rr.Result().StatusCode, "linked with an email the provider did not verify")
+		_, err := s.users.UserByIdentity(context.Background(), "mock", provider.subject)
+		s.Assert().ErrorIs(err, ErrUserNotFound)
+	})
+
+	s.Run("Test Two Factor", func() {
+		s.SetupTest()
+		provider := newMockOIDCProvider()
+		defer provider.Close()
+		router := s.newOIDCRouter(provider)
+		_, secret, _ := s.enableTwoFactor(router)
+		s.verifyTestUser()
+		provider.email = s.testCreds.Email
+
+		rr := s.oidcSignin(router, provider, nil)
+		s.Require().Equal(http.StatusFound, rr.Result().StatusCode, "sign in failed: %s", rr.Body.String())
+		s.Assert().Empty(oidcSessionCookies(rr), "signed in without a code")
+		location, err := url.Parse(rr.Result().Header.Get("Location"))
+		s.Require().NoError(err)
+		s.Assert().Equal("/signin", location.Path)
+		s.Assert().NotContains(location.String(), "challenge", "the challenge was put in the URL")
+		var challenge *http.Cookie
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == twoFactorChallengeCookie {
+				challenge = c
+			}
+		}
+		s.Require().NotNil(challenge, "the challenge cookie was not set")
+		s.Assert().True(challenge.HttpOnly, "scripts can read the challenge")
+
+		rr = s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Code: s.totpCode(secret, totpStep(time.Now()))}, []*http.Cookie{challenge})
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "the challenge did not work")
+		s.verifyLoginCookies(oidcSessionCookies(rr))
+		cleared := false
+		for _, c := range rr.Result().Cookies() {
+			cleared = cleared || (c.Name == twoFactorChallengeCookie && c.MaxAge < 0)
+		}
+		s.Assert().True(cleared, "the challenge cookie was kept")
+	})
+
+	s.Run("Test Rejected", func() {
+		s.SetupTest()
+		provider := newMockOIDCProvider()
+		defer provider.Close()
+		router := s.newOIDCRouter(provider)
+
+		rr := s.oidcSignin(router, provider, func(callback url.Values, flow *http.Cookie) {
+			callback.Set("state", "forged")
+		})
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "accepted the wrong state")
+		rr = s.oidcSignin(router, provider, func(callback url.Values, flow *http.Cookie) {
+			flow.Value = ""
+		})
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "accepted a callback without the flow cookie")
+
+		provider.nonce = "replayed"
+		rr = s.oidcSignin(router, provider, nil)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "accepted the wrong nonce")
+		provider.nonce = ""
+
+		provider.audience = "someone-else"
+		rr = s.oidcSignin(router, provider, nil)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "accepted an ID token for another client")
+		provider.audience = ""
+
+		rr = s.oidcSignin(router, provider, func(callback url.Values, flow *http.Cookie) {
+			callback.Set("code", "forged")
+		})
+		s.Assert().Equal(http.StatusBadGateway, rr.Result().StatusCode, "accepted a forged code")
+
+		_, err := s.users.UserByEmail(context.Background(), provider.email)
+		s.Assert().ErrorIs(err, ErrUserNotFound, "an account was created")
+	})
+}
+
+// Returns a router with the auth endpoints and sign in through provider.
+func (s *AuthTestSuite) newOIDCRouter(provider *mockOIDCProvider) *mux.Router {
+	router := s.newRouter(NewCaptureMailer())
+	RegisterOIDCRoutes(router, s.users, s.events, NewOIDCProvider("mock", provider.URL, provider.clientID, provider.clientSecret))
+	return router
+}
+
+// Signs in through the mock provider, the way a browser would, and returns the answer of the
+// callback. tamper, if not nil, can change the callback and flow cookie before they are sent.
+func (s *AuthTestSuite) oidcSignin(router *mux.Router, provider *mockOIDCProvider, tamper func(callback url.Values, flow *http.Cookie)) *httptest.ResponseRecorder {
+	rr := s.request(router, "/api/auth/oidc/mock/login", nil, nil)
+	s.Require().Equal(http.StatusFound, rr.Result().StatusCode, "login failed: %s", rr.Body.String())
+	var flow *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == oidcFlowCookie {
+			flow = c
+		}
+	}
+	s.Require().NotNil(flow, "no flow cookie")
+
+	// The provider signs the user in right away and sends them back.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rr.Result().Header.Get("Location"))
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Require().Equal(http.StatusFound, resp.StatusCode, "the provider refused the request")
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	s.Require().NoError(err)
+	s.Require().True(strings.HasPrefix(callback.String(), PublicBaseURL+"/api/auth/oidc/mock/callback"), "wrong redirect %s", callback)
+
+	query := callback.Query()
+	if tamper != nil {
+		tamper(query, flow)
+	}
+	return s.request(router, callback.Path+"?"+query.Encode(), nil, []*http.Cookie{flow})
+}
+
+// Returns the cookies of the answer, leaving out the flow cookie being cleared and the
+// two-factor challenge.
+func oidcSessionCookies(rr *httptest.ResponseRecorder) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name != oidcFlowCookie && c.Name != twoFactorChallengeCookie {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+// Verifies the email of the test user and returns them.
+func (s *AuthTestSuite) verifyTestUser() User {
+	u, err := s.users.UserByUsername(context.Background(), s.testCreds.Username)
+	s.Require().NoError(err)
+	s.Require().NoError(s.users.VerifyEmail(context.Background(), u.VerifiedToken))
+	u, err = s.users.UserByUsername(context.Background(), s.testCreds.Username)
+	s.Require().NoError(err)
+	return u
+}
+
+// mockOIDCProvider is a minimal OpenID Connect provider that signs the same user in to every
+// request, so the whole flow can be tested offline.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+
+	// The user that signs in.
+	subject       string
+	email         string
+	emailVerified bool
+	// nonce and audience replace the ones in the ID tokens when set.
+	nonce    string
+	audience string
+
+	mu     sync.Mutex
+	grants map[string]mockOIDCGrant
+}
+
+// mockOIDCGrant is what an authorization code was issued for.
+type mockOIDCGrant struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+func newMockOIDCProvider() *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p := &mockOIDCProvider{
+		key:           key,
+		clientID:      "bearchat",
+		clientSecret:  "GoBears",
+		subject:       "1234567890",
+		email:         "oski@berkeley.edu",
+		emailVerified: true,
+		grants:        make(map[string]mockOIDCGrant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcConfig{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// Hands out a code and sends the user back, as if they had signed in.
+func (p *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != p.clientID || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" || !strings.Contains(q.Get("scope"), "openid") {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	code := GetRandomBase62(16)
+	p.mu.Lock()
+	p.grants[code] = mockOIDCGrant{redirectURI: q.Get("redirect_uri"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	p.mu.Unlock()
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+// Trades a code for an ID token, once.
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != p.clientID || secret != p.clientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	p.mu.Lock()
+	grant, ok := p.grants[r.PostFormValue("code")]
+	delete(p.grants, r.PostFormValue("code"))
+	p.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != grant.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":                p.URL,
+		"sub":                p.subject,
+		"aud":                []string{p.clientID},
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              grant.nonce,
+		"email":              p.email,
+		"email_verified":     p.emailVerified,
+		"preferred_username": "oski",
+	}
+	if p.nonce != "" {
+		claims["nonce"] = p.nonce
+	}
+	if p.audience != "" {
+		claims["aud"] = p.audience
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": GetRandomBase62(16), "token_type": "Bearer", "id_token": idToken})
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OutboxRetention is how long sent and dead emails stay in the outbox before the worker
+// deletes them.
+var OutboxRetention = 7 * 24 * time.Hour
+
+// ErrEmailNotFound is returned by an OutboxStore when no email matches the lookup.
+var ErrEmailNotFound = errors.New("email not found")
+
+// The statuses an email goes through in the outbox. Every email starts out pending. It
+// becomes sent once the Mailer accepted it, or dead once the worker gave up on it.
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+// OutboxEmail is an email as it is kept in the email_outbox table.
+type OutboxEmail struct {
+	ID        string `json:"id"`
+	Recipient string `json:"recipient"`
+	// Subject is the subject the email had when it was enqueued. It is only kept so that
+	// operators can tell emails apart; the worker renders the email again when it sends it.
+	Subject  string `json:"subject"`
+	Template string `json:"template"`
+	Locale   string `json:"locale"`
+	// Data is the template data, which holds the tokens of verification and reset emails. It is
+	// left out of the admin listing, and cleared once the email is sent.
+	Data     map[string]interface{} `json:"-"`
+	Status   string                 `json:"status"`
+	Attempts int                    `json:"attempts"`
+	// NextAttemptAt is when the worker may try to send a pending email.
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	LastError     string    `json:"lastError,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	SentAt        time.Time `json:"sentAt"`
+}
+
+// An OutboxStore persists the emails waiting to be sent, so that they survive restarts and
+// a slow or failing provider never fails the request that wanted to send one.
+type OutboxStore interface {
+	// Enqueue adds a pending email.
+	Enqueue(ctx context.Context, e OutboxEmail) error
+
+	// ClaimDue returns up to limit pending emails whose NextAttemptAt has passed, and pushes
+	// their NextAttemptAt back by lease so that no other worker picks them up meanwhile.
+	ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEmail, error)
+
+	// MarkSent records that an email was sent, and clears its Data.
+	MarkSent(ctx context.Context, id string, sentAt time.Time) error
+
+	// MarkFailed records a failed attempt. The email is retried at retryAt, unless dead is
+	// set, in which case it won't be retried until it is replayed.
+	MarkFailed(ctx context.Context, id, lastError string, retryAt time.Time, dead bool) error
+
+	// Emails lists the emails with the given status, oldest first.
+	Emails(ctx context.Context, status string, offset, limit int) ([]OutboxEmail, error)
+
+	// Replay makes a dead email pending again, with a fresh set of attempts. It returns
+	// ErrEmailNotFound if there is no dead email with that id.
+	Replay(ctx context.Context, id string, now time.Time) error
+
+	// DeleteOldEmails removes the emails sent before, and the dead emails enqueued before, the
+	// given time.
+	DeleteOldEmails(ctx context.Context, before time.Time) error
+
+	// DeleteEmailsTo removes every email to recipient, whatever its status.
+	DeleteEmailsTo(ctx context.Context, recipient string) error
+}
+
+// OutboxMailer is the Mailer the handlers use. It doesn't send anything itself; it only puts
+// the email in the outbox for an OutboxWorker to send.
+type OutboxMailer struct {
+	outbox OutboxStore
+}
+
+// NewOutboxMailer returns a Mailer that enqueues emails in outbox.
+func NewOutboxMailer(outbox OutboxStore) OutboxMailer {
+	return OutboxMailer{outbox: outbox}
+}
+
+// SendEmail renders e before enqueueing it, so that an email that can't be rendered fails the
+// request instead of ending up dead in the outbox.
+func (m OutboxMailer) SendEmail(e Email) error {
+	rendered, err := renderEmail(e)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return m.outbox.Enqueue(context.Background(), OutboxEmail{
+		ID:            uuid.NewString(),
+		Recipient:     e.Recipient,
+		Subject:       rendered.Subject,
+		Template:      e.Template,
+		Locale:        e.Locale,
+		Data:          e.Data,
+		Status:        EmailPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
+
+// OutboxWorker sends the emails in the outbox with the real Mailer. Failed emails are retried
+// with exponential backoff, and dead-lettered after MaxAttempts failures.
+type OutboxWorker struct {
+	outbox OutboxStore
+	mailer Mailer
+
+	// PollInterval is how often the worker looks for due emails.
+	PollInterval time.Duration
+	// BatchSize is how many emails it claims at once.
+	BatchSize int
+	// MaxAttempts is how many times an email is tried before it is dead-lettered.
+	MaxAttempts int
+	// BaseBackoff is the wait after the first failure. It doubles with every failure after
+	// that, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	now func() time.Time
+}
+
+// NewOutboxWorker returns an OutboxWorker with default settings.
+func NewOutboxWorker(outbox OutboxStore, mailer Mailer) *OutboxWorker {
+	return &OutboxWorker{
+		outbox:       outbox,
+		mailer:       mailer,
+		PollInterval: 5 * time.Second,
+		BatchSize:    20,
+		MaxAttempts:  8,
+		BaseBackoff:  30 * time.Second,
+		MaxBackoff:   1 * time.Hour,
+		now:          time.Now,
+	}
+}
+
+// Run sends emails until ctx is done.
+func (w *OutboxWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		// Keep going while there are full batches, so a backlog drains quickly.
+		for {
+			n, err := w.RunOnce(ctx)
+			if err != nil {
+				log.Printf("email outbox: %s", err)
+			}
+			if err != nil || n < w.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce removes the emails older than OutboxRetention, then tries to send one batch of due
+// emails and returns how many it tried.
+func (w *OutboxWorker) RunOnce(ctx context.Context) (int, error) {
+	if err := w.outbox.DeleteOldEmails(ctx, w.now().Add(-OutboxRetention)); err != nil {
+		return 0, err
+	}
+	// The lease only has to outlast one batch of sends.
+	emails, err := w.outbox.ClaimDue(ctx, w.now(), 10*time.Minute, w.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range emails {
+		if ctx.Err() != nil {
+			// Stopping; the lease runs out and the email is picked up again later.
+			return 0, nil
+		}
+		w.send(ctx, e)
+	}
+	return len(emails), nil
+}
+
+func (w *OutboxWorker) send(ctx context.Context, e OutboxEmail) {
+	sendErr := w.mailer.SendEmail(Email{Recipient: e.Recipient, Template: e.Template, Locale: e.Locale, Data: e.Data})
+	if sendErr == nil {
+		if err := w.outbox.MarkSent(ctx, e.ID, w.now()); err != nil {
+			log.Printf("email outbox: could not mark %s as sent: %s", e.ID, err)
+		}
+		return
+	}
+
+	attempts := e.Attempts + 1
+	dead := attempts >= w.MaxAttempts
+	if dead {
+		log.Printf("email outbox: giving up on %s to %s after %d attempts: %s", e.ID, e.Recipient, attempts, sendErr)
+	}
+	err := w.outbox.MarkFailed(ctx, e.ID, sendErr.Error(), w.now().Add(w.backoff(attempts)), dead)
+	if err != nil {
+		log.Printf("email outbox: could not record failure of %s: %s", e.ID, err)
+	}
+}
+
+// backoff returns how long to wait before trying an email that failed attempts times.
+func (w *OutboxWorker) backoff(attempts int) time.Duration {
+	d := w.BaseBackoff
+	for i := 1; i < attempts && d < w.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > w.MaxBackoff {
+		d = w.MaxBackoff
+	}
+	return d
+}
+
+// encodeEmailData and decodeEmailData store the template data of an email as JSON.
+func encodeEmailData(data map[string]interface{}) (string, error) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	b, err := json.Marshal(data)
+	return string(b), err
+}
+
+func decodeEmailData(s string) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	err := json.Unmarshal([]byte(s), &data)
+	return data, err
+}
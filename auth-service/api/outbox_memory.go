@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryOutboxStore is an OutboxStore that keeps emails in memory. Like MemoryUserStore, it
+// is meant for tests; pending emails are lost when the process exits.
+type MemoryOutboxStore struct {
+	mu     sync.Mutex
+	emails map[string]OutboxEmail
+}
+
+// NewMemoryOutboxStore returns an empty MemoryOutboxStore.
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{emails: make(map[string]OutboxEmail)}
+}
+
+func (s *MemoryOutboxStore) Enqueue(ctx context.Context, e OutboxEmail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emails[e.ID] = e
+	return nil
+}
+
+func (s *MemoryOutboxStore) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEmail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []OutboxEmail
+	for _, e := range s.emails {
+		if e.Status == EmailPending && !e.NextAttemptAt.After(now) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, e := range due {
+		e.NextAttemptAt = now.Add(lease)
+		s.emails[e.ID] = e
+	}
+	return due, nil
+}
+
+func (s *MemoryOutboxStore) MarkSent(ctx context.Context, id string, sentAt time.Time) error {
+	return s.update(id, func(e *OutboxEmail) bool {
+		e.Status = EmailSent
+		e.Attempts++
+		e.SentAt = sentAt
+		e.NextAttemptAt = time.Time{}
+		e.Data = map[string]interface{}{}
+		return true
+	})
+}
+
+func (s *MemoryOutboxStore) MarkFailed(ctx context.Context, id, lastError string, retryAt time.Time, dead bool) error {
+	return s.update(id, func(e *OutboxEmail) bool {
+		e.Status = EmailPending
+		if dead {
+			e.Status = EmailDead
+		}
+		e.Attempts++
+		e.LastError = lastError
+		e.NextAttemptAt = retryAt
+		return true
+	})
+}
+
+func (s *MemoryOutboxStore) Emails(ctx context.Context, status string, offset, limit int) ([]OutboxEmail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var emails []OutboxEmail
+	for _, e := range s.emails {
+		if e.Status == status {
+			emails = append(emails, e)
+		}
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].CreatedAt.Equal(emails[j].CreatedAt) {
+			return emails[i].CreatedAt.Before(emails[j].CreatedAt)
+		}
+		return emails[i].ID < emails[j].ID
+	})
+	if offset >= len(emails) {
+		return nil, nil
+	}
+	emails = emails[offset:]
+	if len(emails) > limit {
+		emails = emails[:limit]
+	}
+	return emails, nil
+}
+
+func (s *MemoryOutboxStore) Replay(ctx context.Context, id string, now time.Time) error {
+	return s.update(id, func(e *OutboxEmail) bool {
+		if e.Status != EmailDead {
+			return false
+		}
+		e.Status = EmailPending
+		e.Attempts = 0
+		e.NextAttemptAt = now
+		return true
+	})
+}
+
+func (s *MemoryOutboxStore) DeleteOldEmails(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.emails {
+		if (e.Status == EmailSent && !e.SentAt.After(before)) || (e.Status == EmailDead && !e.CreatedAt.After(before)) {
+			delete(s.emails, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryOutboxStore) DeleteEmailsTo(ctx context.Context, recipient string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.emails {
+		if e.Recipient == recipient {
+			delete(s.emails, id)
+		}
+	}
+	return nil
+}
+
+// update applies change to the email with the given id. It returns ErrEmailNotFound if there
+// is no such email or if change declines it by returning false.
+func (s *MemoryOutboxStore) update(id string, change func(*OutboxEmail) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.emails[id]
+	if !ok || !change(&e) {
+		return ErrEmailNotFound
+	}
+	s.emails[id] = e
+	return nil
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQLOutboxStore is the OutboxStore backed by the email_outbox table of the auth database.
+type SQLOutboxStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLOutboxStore returns an OutboxStore that uses db, which speaks the given Dialect.
+func NewSQLOutboxStore(db *sql.DB, dialect Dialect) *SQLOutboxStore {
+	return &SQLOutboxStore{db: db, dialect: dialect}
+}
+
+const outboxColumns = "id, recipient, subject, template, locale, data, status, attempts, nextAttemptAt, lastError, createdAt, sentAt"
+
+func (s *SQLOutboxStore) Enqueue(ctx context.Context, e OutboxEmail) error {
+	data, err := encodeEmailData(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "INSERT INTO email_outbox ("+outboxColumns+") VALUES (?,?,?,?,?,?,?,?,?,?,?,?)",
+		e.ID, e.Recipient, e.Subject, e.Template, e.Locale, data, e.Status, e.Attempts,
+		nullTime(e.NextAttemptAt), e.LastError, nullTime(e.CreatedAt), nullTime(e.SentAt))
+	return err
+}
+
+func (s *SQLOutboxStore) ClaimDue(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEmail, error) {
+	due, err := s.query(ctx, "SELECT "+outboxColumns+" FROM email_outbox WHERE status = ? AND nextAttemptAt <= ? ORDER BY nextAttemptAt LIMIT ?",
+		EmailPending, nullTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another worker may have claimed some of them since the SELECT. Only the emails whose
+	// NextAttemptAt we managed to push back are ours.
+	var claimed []OutboxEmail
+	for _, e := range due {
+		result, err := s.db.ExecContext(ctx, "UPDATE email_outbox SET nextAttemptAt = ? WHERE id = ? AND status = ? AND nextAttemptAt = ?",
+			nullTime(now.Add(lease)), e.ID, EmailPending, nullTime(e.NextAttemptAt))
+		if err != nil {
+			return nil, err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			claimed = append(claimed, e)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *SQLOutboxStore) MarkSent(ctx context.Context, id string, sentAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE email_outbox SET status = ?, attempts = attempts + 1, sentAt = ?, nextAttemptAt = NULL, data = ? WHERE id = ?",
+		EmailSent, nullTime(sentAt), "{}", id)
+	return affectedEmail(result, err)
+}
+
+func (s *SQLOutboxStore) MarkFailed(ctx context.Context, id, lastError string, retryAt time.Time, dead bool) error {
+	status := EmailPending
+	if dead {
+		status = EmailDead
+	}
+	result, err := s.db.ExecContext(ctx, "UPDATE email_outbox SET status = ?, attempts = attempts + 1, lastError = ?, nextAttemptAt = ? WHERE id = ?",
+		status, lastError, nullTime(retryAt), id)
+	return affectedEmail(result, err)
+}
+
+func (s *SQLOutboxStore) Emails(ctx context.Context, status string, offset, limit int) ([]OutboxEmail, error) {
+	return s.query(ctx, "SELECT "+outboxColumns+" FROM email_outbox WHERE status = ? ORDER BY createdAt, id LIMIT ? OFFSET ?", status, limit, offset)
+}
+
+func (s *SQLOutboxStore) Replay(ctx context.Context, id string, now time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE email_outbox SET status = ?, attempts = 0, nextAttemptAt = ? WHERE id = ? AND status = ?",
+		EmailPending, nullTime(now), id, EmailDead)
+	return affectedEmail(result, err)
+}
+
+func (s *SQLOutboxStore) DeleteOldEmails(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM email_outbox WHERE (status = ? AND sentAt <= ?) OR (status = ? AND createdAt <= ?)",
+		EmailSent, nullTime(before), EmailDead, nullTime(before))
+	return err
+}
+
+func (s *SQLOutboxStore) DeleteEmailsTo(ctx context.Context, recipient string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM email_outbox WHERE recipient = ?", recipient)
+	return err
+}
+
+// query runs a query selecting outboxColumns and scans every row into an OutboxEmail.
+func (s *SQLOutboxStore) query(ctx context.Context, query string, args ...interface{}) ([]OutboxEmail, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []OutboxEmail
+	for rows.Next() {
+		var e OutboxEmail
+		var data string
+		var lastError sql.NullString
+		var nextAttemptAt, createdAt, sentAt sql.NullTime
+		err := rows.Scan(&e.ID, &e.Recipient, &e.Subject, &e.Template, &e.Locale, &data, &e.Status, &e.Attempts,
+			&nextAttemptAt, &lastError, &createdAt, &sentAt)
+		if err != nil {
+			return nil, err
+		}
+		if e.Data, err = decodeEmailData(data); err != nil {
+			return nil, err
+		}
+		e.LastError = lastError.String
+		e.NextAttemptAt = nextAttemptAt.Time
+		e.CreatedAt = createdAt.Time
+		e.SentAt = sentAt.Time
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// affectedEmail turns the result of an UPDATE into ErrEmailNotFound if it didn't match any row.
+func affectedEmail(result sql.Result, err error) error {
+	if err := affectedUser(result, err); err == ErrUserNotFound {
+		return ErrEmailNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Contains the tests for the email outbox and its worker.
+func (s *AuthTestSuite) TestOutbox() {
+	s.Run("Test Signup Survives Failing Provider", func() {
+		s.SetupTest()
+		rr := httptest.NewRecorder()
+		signup(NewOutboxMailer(s.outbox), s.users, s.events)(rr, httptest.NewRequest(http.MethodPost, "/api/auth/signup", bytes.NewBuffer(s.credsJSON(s.testCreds))))
+		s.Require().Equal(http.StatusCreated, rr.Result().StatusCode, "signup failed")
+
+		worker, _ := s.newTestWorker(&flakyMailer{failures: 1, CaptureMailer: NewCaptureMailer()})
+		n, err := worker.RunOnce(context.Background())
+		s.Require().NoError(err)
+		s.Require().Equal(1, n, "the worker did not pick up the verification email")
+
+		pending, err := s.outbox.Emails(context.Background(), EmailPending, 0, 10)
+		s.Require().NoError(err)
+		if s.Len(pending, 1, "the email is not waiting for a retry") {
+			s.Assert().Equal(1, pending[0].Attempts)
+			s.Assert().Equal("provider unavailable", pending[0].LastError)
+			s.Assert().Equal(s.testCreds.Email, pending[0].Recipient)
+		}
+	})
+
+	s.Run("Test Retries With Backoff", func() {
+		s.SetupTest()
+		m := &flakyMailer{failures: 2, CaptureMailer: NewCaptureMailer()}
+		worker, clock := s.newTestWorker(m)
+		s.Require().NoError(NewOutboxMailer(s.outbox).SendEmail(resetEmail))
+
+		// First failure. The email isn't due again before the backoff is over.
+		s.runWorker(worker, 1)
+		*clock = clock.Add(worker.BaseBackoff - time.Second)
+		s.runWorker(worker, 0)
+
+		// Second failure. The backoff doubled.
+		*clock = clock.Add(time.Second)
+		s.runWorker(worker, 1)
+		*clock = clock.Add(2*worker.BaseBackoff - time.Second)
+		s.runWorker(worker, 0)
+
+		// Third time's the charm.
+		*clock = clock.Add(time.Second)
+		s.runWorker(worker, 1)
+		s.Assert().Equal("t0ken", m.Token(), "the email was not sent with its data")
+
+		sent, err := s.outbox.Emails(context.Background(), EmailSent, 0, 10)
+		s.Require().NoError(err)
+		if s.Len(sent, 1, "the email is not marked as sent") {
+			s.Assert().Equal(3, sent[0].Attempts)
+			s.Assert().Empty(sent[0].Data, "the token was kept after the email was sent")
+		}
+	})
+
+	s.Run("Test Dead Letter And Replay", func() {
+		s.SetupTest()
+		m := &flakyMailer{failures: 3, CaptureMailer: NewCaptureMailer()}
+		worker, clock := s.newTestWorker(m)
+		worker.MaxAttempts = 3
+		s.Require().NoError(NewOutboxMailer(s.outbox).SendEmail(resetEmail))
+
+		for i := 0; i < 3; i++ {
+			s.runWorker(worker, 1)
+			*clock = clock.Add(worker.MaxBackoff)
+		}
+		s.runWorker(worker, 0)
+
+		// The admin endpoints list the dead email and replay it.
+		router := mux.NewRouter()
+		RegisterAdminRoutes(router, "adminKey", s.outbox, s.users, s.audit)
+		r := httptest.NewRequest(http.MethodGet, "/api/auth/admin/emails?status=dead", nil)
+		r.Header.Set("X-Admin-Key", "adminKey")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode)
+		s.Assert().NotContains(rr.Body.String(), "t0ken", "the admin listing shows the token")
+		var dead []OutboxEmail
+		s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&dead))
+		s.Require().Len(dead, 1, "the email was not dead-lettered")
+		s.Assert().Equal(3, dead[0].Attempts)
+
+		r = httptest.NewRequest(http.MethodPost, "/api/auth/admin/emails/"+dead[0].ID+"/replay", nil)
+		r.Header.Set("X-Admin-Key", "adminKey")
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "replay failed")
+
+		// Replaying again fails since it is no longer dead.
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+		s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode)
+
+		s.runWorker(worker, 1)
+		s.Assert().Len(m.Emails(), 1, "the replayed email was not sent")
+	})
+
+	s.Run("Test Keeps Locale", func() {
+		s.SetupTest()
+		m := NewCaptureMailer()
+		worker, _ := s.newTestWorker(m)
+		e := resetEmail
+		e.Locale = "es-MX"
+		s.Require().NoError(NewOutboxMailer(s.outbox).SendEmail(e))
+		s.Assert().Error(NewOutboxMailer(s.outbox).SendEmail(Email{Recipient: "oski@berkeley.edu", Template: "no-such-email"}),
+			"an email that can't be rendered was enqueued")
+
+		s.runWorker(worker, 1)
+		last, _ := m.Last()
+		s.Assert().Equal("Restablecer contraseña de BearChat", last.Subject, "the email lost its locale in the outbox")
+		s.Assert().Equal("t0ken", m.Token())
+	})
+
+	s.Run("Test Deletes Old Emails", func() {
+		s.SetupTest()
+		m := &flakyMailer{failures: 1, CaptureMailer: NewCaptureMailer()}
+		worker, clock := s.newTestWorker(m)
+		worker.MaxAttempts = 1
+		mailer := NewOutboxMailer(s.outbox)
+		s.Require().NoError(mailer.SendEmail(resetEmail))
+		s.runWorker(worker, 1)
+		s.Require().NoError(mailer.SendEmail(resetEmail))
+		s.runWorker(worker, 1)
+
+		// One email is dead and the other sent. Both stay until the retention is over.
+		*clock = clock.Add(OutboxRetention - time.Minute)
+		s.runWorker(worker, 0)
+		for _, status := range []string{EmailSent, EmailDead} {
+			emails, err := s.outbox.Emails(context.Background(), status, 0, 10)
+			s.Require().NoError(err)
+			s.Assert().Len(emails, 1, "the %s email was deleted too early", status)
+		}
+
+		*clock = clock.Add(time.Minute)
+		s.runWorker(worker, 0)
+		for _, status := range []string{EmailSent, EmailDead} {
+			emails, err := s.outbox.Emails(context.Background(), status, 0, 10)
+			s.Require().NoError(err)
+			s.Assert().Empty(emails, "the %s email was not deleted", status)
+		}
+	})
+
+	s.Run("Test Admin Key Required", func() {
+		s.SetupTest()
+		for _, adminKey := range []string{"adminKey", ""} {
+			router := mux.NewRouter()
+			RegisterAdminRoutes(router, adminKey, s.outbox, s.users, s.audit)
+			for _, key := range []string{"", "wrongKey"} {
+				r := httptest.NewRequest(http.MethodGet, "/api/auth/admin/emails", nil)
+				r.Header.Set("X-Admin-Key", key)
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, r)
+				s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "admin endpoint open with key %q", key)
+			}
+		}
+	})
+}
+
+// Returns a worker that sends with m and whose clock only moves when the test says so.
+func (s *AuthTestSuite) newTestWorker(m Mailer) (*OutboxWorker, *time.Time) {
+	worker := NewOutboxWorker(s.outbox, m)
+	// Start a little ahead so the emails enqueued by the test are due right away.
+	clock := time.Now().Add(time.Second)
+	worker.now = func() time.Time { return clock }
+	return worker, &clock
+}
+
+// Runs one batch of the worker and checks how many emails it tried.
+func (s *AuthTestSuite) runWorker(worker *OutboxWorker, expected int) {
+	n, err := worker.RunOnce(context.Background())
+	s.Require().NoError(err)
+	s.Require().Equal(expected, n, "the worker tried the wrong number of emails")
+}
+
+// flakyMailer fails the first emails it is asked to send, then captures the rest.
+type flakyMailer struct {
+	failures int
+	*CaptureMailer
+}
+
+func (m *flakyMailer) SendEmail(e Email) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("provider unavailable")
+	}
+	return m.CaptureMailer.SendEmail(e)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A rateLimiter allows at most limit events per key within any window of time. It only lives
+// in memory, so every replica of the service counts on its own.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	events    map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow reports whether one more event for every key is within the limit, and if so records
+// it. An event that is refused doesn't count towards the limit.
+func (l *rateLimiter) Allow(keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	for _, key := range keys {
+		l.events[key] = l.recent(l.events[key], now)
+		if len(l.events[key]) >= l.limit {
+			return false
+		}
+	}
+	for _, key := range keys {
+		l.events[key] = append(l.events[key], now)
+	}
+	return true
+}
+
+// recent drops the events that fell out of the window.
+func (l *rateLimiter) recent(events []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(events) && !events[i].After(now.Add(-l.window)) {
+		i++
+	}
+	return events[i:]
+}
+
+// sweep forgets the keys that have no recent events, at most once per window, so that the
+// map doesn't grow forever.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, events := range l.events {
+		if len(l.recent(events, now)) == 0 {
+			delete(l.events, key)
+		}
+	}
+}
+
+// clientIP returns the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The roles that can be granted to users.
+const (
+	// RoleAdmin can manage users and their roles, and holds every other role too.
+	RoleAdmin = "admin"
+	// RoleModerator can remove what other users posted.
+	RoleModerator = "moderator"
+)
+
+// validRoles are the roles grantRole accepts.
+var validRoles = map[string]bool{RoleAdmin: true, RoleModerator: true}
+
+// adminKeyActor is the actor recorded in the audit log for requests made with the admin key.
+const adminKeyActor = "admin-key"
+
+// HasRole reports whether roles grant role. Admins hold every role.
+func HasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns the signed in user if they hold role. Unlike the other services, it
+// checks the roles in the database rather than the ones in the access token, so a role that
+// was revoked stops working here right away. Otherwise it writes an error to the Response and
+// returns false.
+func authorize(w http.ResponseWriter, r *http.Request, users UserStore, role string) (User, bool) {
+	u, ok := sessionUser(w, r, users)
+	if !ok {
+		return User{}, false
+	}
+	if !HasRole(u.Roles, role) {
+		http.Error(w, role+" role required", http.StatusForbidden)
+		return User{}, false
+	}
+	return u, true
+}
+
+// actorContextKey is the context key of the ID of whoever makes an admin request.
+type actorContextKey struct{}
+
+// actorID returns the actor requireAdmin let through.
+func actorID(r *http.Request) string {
+	actor, _ := r.Context().Value(actorContextKey{}).(string)
+	return actor
+}
+
+// requireAdmin turns away every request that is neither made by an admin nor carries the
+// admin key. The key is how operators grant the first admin role.
+func requireAdmin(adminKey string, users UserStore) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actor := adminKeyActor
+			if key, ok := r.Header["X-Admin-Key"]; ok {
+				if adminKey == "" || subtle.ConstantTimeCompare([]byte(key[0]), []byte(adminKey)) != 1 {
+					http.Error(w, "admin key required", http.StatusUnauthorized)
+					return
+				}
+			} else {
+				u, ok := authorize(w, r, users, RoleAdmin)
+				if !ok {
+					return
+				}
+				actor = u.UserID
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorContextKey{}, actor)))
+		})
+	}
+}
+
+// adminUser is what admins see of a user.
+type adminUser struct {
+	UserID      string     `json:"userId"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	Verified    bool       `json:"verified"`
+	Roles       []string   `json:"roles"`
+	DeleteAfter *time.Time `json:"deleteAfter,omitempty"`
+}
+
+func newAdminUser(u User) adminUser {
+	res := adminUser{UserID: u.UserID, Username: u.Username, Email: u.Email, Verified: u.Verified, Roles: u.Roles}
+	if res.Roles == nil {
+		res.Roles = []string{}
+	}
+	if !u.DeleteAfter.IsZero() {
+		res.DeleteAfter = &u.DeleteAfter
+	}
+	return res
+}
+
+// Lists the users holding the role in the "role" query parameter.
+func listUsersWithRole(users UserStore, audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := r.URL.Query().Get("role")
+		if !validRoles[role] {
+			http.Error(w, "role must be admin or moderator", http.StatusBadRequest)
+			return
+		}
+		if !recordAudit(w, r, audit, "user.list", "", "role "+role) {
+			return
+		}
+		found, err := users.UsersWithRole(r.Context(), role)
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		res := []adminUser{}
+		for _, u := range found {
+			res = append(res, newAdminUser(u))
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// Returns a user by ID.
+func getUser(users UserStore, audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !recordAudit(w, r, audit, "user.read", id, "") {
+			return
+		}
+		u, err := users.UserByID(r.Context(), id)
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(newAdminUser(u))
+	}
+}
+
+// Grants a role to a user. It takes effect in the other services once the user gets a new
+// access token, which happens at least once a day.
+func grantRole(users UserStore, audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, role := mux.Vars(r)["id"], mux.Vars(r)["role"]
+		if !validRoles[role] {
+			http.Error(w, "role must be admin or moderator", http.StatusBadRequest)
+			return
+		}
+		if _, err := users.UserByID(r.Context(), userID); errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if !recordAudit(w, r, audit, "role.grant", userID, role) {
+			return
+		}
+		if err := users.GrantRole(r.Context(), userID, role); err != nil {
+			http.Error(w, "error granting role", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Takes a role away from a user.
+func revokeRole(users UserStore, audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, role := mux.Vars(r)["id"], mux.Vars(r)["role"]
+		if !validRoles[role] {
+			http.Error(w, "role must be admin or moderator", http.StatusBadRequest)
+			return
+		}
+		if !recordAudit(w, r, audit, "role.revoke", userID, role) {
+			return
+		}
+		if err := users.RevokeRole(r.Context(), userID, role); err != nil {
+			http.Error(w, "error revoking role", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Deletes the account of a user right away, without a grace period. The reaper then removes
+// them from every service.
+func deleteUser(users UserStore, audit AuditStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := mux.Vars(r)["id"]
+		if _, err := users.UserByID(r.Context(), userID); errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "no such user", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if !recordAudit(w, r, audit, "user.delete", userID, "") {
+			return
+		}
+		if err := users.ScheduleDeletion(r.Context(), userID, time.Now()); err != nil {
+			http.Error(w, "error scheduling deletion", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
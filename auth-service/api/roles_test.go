@@ -0,0 +1,218 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+)
+
+// Contains the tests for roles and the endpoints of admins.
+func (s *AuthTestSuite) TestRoles() {
+	s.Run("Test Grant And Revoke", func() {
+		s.SetupTest()
+		router := s.newAdminRouter()
+		admin := s.userID(s.signupSession(router))
+		oski := Credentials{Username: "Oski", Email: "oski@berkeley.edu", Password: "GoBears"}
+		rr := s.request(router, "/api/auth/signup", oski, nil)
+		s.Require().Equal(http.StatusCreated, rr.Result().StatusCode)
+		moderator := s.userID(rr.Result().Cookies())
+
+		// The first admin is made with the admin key.
+		rr = s.adminRequest(router, http.MethodPost, "/api/auth/admin/users/"+admin+"/roles/admin", nil)
+		s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode, "grant failed: %s", rr.Body.String())
+		session := s.signin(router, s.testCreds)
+		s.Assert().Equal([]string{RoleAdmin}, s.accessClaims(session).Roles)
+
+		// Admins grant roles with their session.
+		rr = s.adminRequest(router, http.MethodPost, "/api/auth/admin/users/"+moderator+"/roles/moderator", session)
+		s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode, "grant failed: %s", rr.Body.String())
+		rr = s.adminRequest(router, http.MethodPost, "/api/auth/admin/users/"+moderator+"/roles/moderator", session)
+		s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode, "granting twice failed")
+		modSession := s.signin(router, oski)
+		s.Assert().Equal([]string{RoleModerator}, s.accessClaims(modSession).Roles)
+		s.Assert().True(HasRole(s.accessClaims(session).Roles, RoleModerator), "admins are not moderators")
+
+		rr = s.adminRequest(router, http.MethodGet, "/api/auth/admin/users?role=moderator", session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode)
+		var listed []adminUser
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&listed))
+		s.Require().Len(listed, 1)
+		s.Assert().Equal("Oski", listed[0].Username)
+
+		// Moderators are not admins.
+		rr = s.adminRequest(router, http.MethodPost, "/api/auth/admin/users/"+moderator+"/roles/admin", modSession)
+		s.Assert().Equal(http.StatusForbidden, rr.Result().StatusCode, "a moderator granted a role")
+
+		rr = s.adminRequest(router, http.MethodDelete, "/api/auth/admin/users/"+moderator+"/roles/moderator", session)
+		s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode, "revoke failed")
+		rr = s.adminRequest(router, http.MethodGet, "/api/auth/admin/users/"+moderator, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode)
+		var u adminUser
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&u))
+		s.Assert().Empty(u.Roles, "the role was not revoked")
+
+		rr = s.adminRequest(router, http.MethodGet, "/api/auth/admin/emails", session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode)
+
+		entries, err := s.audit.AuditEntries(context.Background(), 0, 10)
+		s.Require().NoError(err)
+		s.Require().Len(entries, 7, "not every action was audit-logged")
+		actions := map[string]string{}
+		details := map[string]string{}
+		for _, e := range entries {
+			actions[e.Action+" "+e.TargetID] = e.ActorID
+			details[e.Action] = e.Details
+			s.Assert().Equal("auth", e.Service)
+		}
+		s.Assert().Equal(adminKeyActor, actions["role.grant "+admin])
+		s.Assert().Equal(admin, actions["role.grant "+moderator])
+		s.Assert().Equal(admin, actions["role.revoke "+moderator])
+		s.Assert().Equal(admin, actions["user.list "], "listing users was not audit-logged")
+		s.Assert().Equal("role moderator", details["user.list"])
+		s.Assert().Equal(admin, actions["user.read "+moderator], "reading a user was not audit-logged")
+		s.Assert().Equal(admin, actions["email.list "], "listing emails was not audit-logged")
+		s.Assert().Equal("status dead", details["email.list"])
+	})
+
+	s.Run("Test Not Allowed", func() {
+		s.SetupTest()
+		router := s.newAdminRouter()
+		session := s.signupSession(router)
+		user := s.userID(session)
+
+		rr := s.adminRequest(router, http.MethodPost, "/api/auth/admin/users/"+user+"/roles/admin", session)
+		s.Assert().Equal(http.StatusForbidden, rr.Result().StatusCode, "a user made themselves admin")
+		rr = s.adminRequest(router, http.MethodPost, "/api/auth/admin/users/"+user+"/roles/root", nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "granted an unknown role")
+		rr = s.adminRequest(router, http.MethodPost, "/api/auth/admin/users/nobody/roles/admin", nil)
+		s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode)
+
+		entries, err := s.audit.AuditEntries(context.Background(), 0, 10)
+		s.Require().NoError(err)
+		s.Assert().Empty(entries, "refused requests were audit-logged")
+	})
+
+	s.Run("Test Delete User", func() {
+		s.SetupTest()
+		router := s.newAdminRouter()
+		user := s.userID(s.signupSession(router))
+
+		rr := s.adminRequest(router, http.MethodDelete, "/api/auth/admin/users/"+user, nil)
+		s.Require().Equal(http.StatusAccepted, rr.Result().StatusCode, "delete failed: %s", rr.Body.String())
+		rr = s.request(router, "/api/auth/signin", s.testCreds, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "signed in to a deleted account")
+
+		rr = s.adminRequest(router, http.MethodGet, "/api/auth/admin/audit", nil)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode)
+		var entries []AuditEntry
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&entries))
+		s.Require().Len(entries, 1)
+		s.Assert().Equal("user.delete", entries[0].Action)
+		s.Assert().Equal(user, entries[0].TargetID)
+	})
+
+	s.Run("Test Internal Audit", func() {
+		s.SetupTest()
+		router := mux.NewRouter()
+		RegisterInternalRoutes(router, "internalKey", s.users, s.audit)
+		post := func(key string, e AuditEntry) int {
+			b, err := json.Marshal(e)
+			s.Require().NoError(err)
+			r := httptest.NewRequest(http.MethodPost, "/internal/audit", bytes.NewReader(b))
+			r.Header.Set("X-Internal-Token", key)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, r)
+			return rr.Result().StatusCode
+		}
+		entry := AuditEntry{ActorID: "0", Service: "posts", Action: "post.delete", TargetID: "1", Details: "author 2"}
+
+		s.Assert().Equal(http.StatusUnauthorized, post("wrong", entry))
+		s.Assert().Equal(http.StatusBadRequest, post("internalKey", AuditEntry{Service: "posts"}))
+		s.Require().Equal(http.StatusCreated, post("internalKey", entry))
+		entries, err := s.audit.AuditEntries(context.Background(), 0, 10)
+		s.Require().NoError(err)
+		s.Require().Len(entries, 1)
+		s.Assert().Equal("posts", entries[0].Service)
+		s.Assert().Equal("author 2", entries[0].Details)
+		s.Assert().NotEmpty(entries[0].ID)
+	})
+
+	s.Run("Test Internal User", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		RegisterInternalRoutes(router, "internalKey", s.users, s.audit)
+		user := s.userID(s.signupSession(router))
+		get := func(id string) (int, internalUser) {
+			r := httptest.NewRequest(http.MethodGet, "/internal/users/"+id, nil)
+			r.Header.Set("X-Internal-Token", "internalKey")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, r)
+			var u internalUser
+			if rr.Result().StatusCode == http.StatusOK {
+				s.Require().NoError(json.NewDecoder(rr.Body).Decode(&u))
+			}
+			return rr.Result().StatusCode, u
+		}
+
+		status, u := get(user)
+		s.Require().Equal(http.StatusOK, status)
+		s.Assert().Equal(internalUser{UserID: user, Username: s.testCreds.Username}, u)
+		verified, err := s.users.UserByID(context.Background(), user)
+		s.Require().NoError(err)
+		s.Require().NoError(s.users.VerifyEmail(context.Background(), verified.VerifiedToken))
+		_, u = get(user)
+		s.Assert().True(u.EmailVerified, "a verified email is not reported")
+
+		status, _ = get("nobody")
+		s.Assert().Equal(http.StatusNotFound, status)
+	})
+
+	s.Run("Test Deleted With User", func() {
+		s.SetupTest()
+		router := s.newAdminRouter()
+		user := s.userID(s.signupSession(router))
+		s.Require().NoError(s.users.GrantRole(context.Background(), user, RoleModerator))
+		s.Require().NoError(s.users.DeleteUser(context.Background(), user))
+		found, err := s.users.UsersWithRole(context.Background(), RoleModerator)
+		s.Require().NoError(err)
+		s.Assert().Empty(found, "the roles of a deleted user were kept")
+	})
+}
+
+// Returns a router with the auth and admin endpoints, the admin key being "adminKey".
+func (s *AuthTestSuite) newAdminRouter() *mux.Router {
+	router := s.newRouter(NewCaptureMailer())
+	RegisterAdminRoutes(router, "adminKey", s.outbox, s.users, s.audit)
+	return router
+}
+
+// Makes a request to an admin endpoint with the given session cookies, or with the admin key
+// if there are none.
+func (s *AuthTestSuite) adminRequest(router *mux.Router, method, path string, session []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if session == nil {
+		r.Header.Set("X-Admin-Key", "adminKey")
+	}
+	for _, c := range session {
+		r.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	return rr
+}
+
+// Signs in with c and returns the session cookies.
+func (s *AuthTestSuite) signin(router *mux.Router, c Credentials) []*http.Cookie {
+	rr := s.request(router, "/api/auth/signin", c, nil)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "signin failed")
+	return rr.Result().Cookies()
+}
+
+// Returns the ID of the user the session cookies belong to.
+func (s *AuthTestSuite) userID(session []*http.Cookie) string {
+	return s.accessClaims(session).UserID
+}
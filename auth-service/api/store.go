@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned by a UserStore when no user matches the lookup.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUsernameTaken is returned by CreateUser when the username is already in use.
+	ErrUsernameTaken = errors.New("username already exists")
+	// ErrEmailTaken is returned by CreateUser when the email is already in use.
+	ErrEmailTaken = errors.New("email already exists")
+	// ErrTokenExpired is returned when a token matches a user but is past its expiry time.
+	ErrTokenExpired = errors.New("token expired")
+	// ErrCodeUsed is returned when a two-factor code doesn't match or was already used.
+	ErrCodeUsed = errors.New("invalid or already used code")
+	// ErrIdentityTaken is returned by LinkIdentity when the identity is already linked to an
+	// account.
+	ErrIdentityTaken = errors.New("identity already linked to an account")
+)
+
+// User is an account as it is kept in the users table.
+type User struct {
+	UserID         string
+	Username       string
+	Email          string
+	HashedPassword []byte
+	Verified       bool
+	VerifiedToken  string
+	// VerifiedTokenExpiresAt is when VerifiedToken stops being accepted.
+	VerifiedTokenExpiresAt time.Time
+	// ResetTokenHash is the hash of the password reset token (see hashToken). The token
+	// itself is only ever sent to the user.
+	ResetTokenHash      string
+	ResetTokenExpiresAt time.Time
+	// Locale is the language tag the user prefers emails in, like "es-MX". It is empty if
+	// we don't know, in which case they get English.
+	Locale string
+	// TOTPSecret is the base32 encoded secret of the authenticator app of the user. It is
+	// set when they start enrolling, and only asked for once TOTPEnabled is set.
+	TOTPSecret  string
+	TOTPEnabled bool
+	// TOTPLastStep is the time step of the last code the user signed in with.
+	TOTPLastStep int64
+
+	// DeleteAfter is when the grace period of a user who asked to delete their account
+	// ends, or the zero time if they didn't.
+	DeleteAfter time.Time
+	// DeletionSteps are the services the AccountReaper already removed the user from.
+	DeletionSteps []string
+	// DeletionAttempts, DeletionLastError and DeletionRetryAt track the failed attempts of
+	// the reaper. It tries again once DeletionRetryAt passes.
+	DeletionAttempts  int
+	DeletionLastError string
+	DeletionRetryAt   time.Time
+
+	// Roles are the roles granted to the user, sorted. Only the stores set them; CreateUser
+	// ignores them.
+	Roles []string
+}
+
+// Deleted reports whether the account is gone as far as the user is concerned: its grace
+// period is over, even if the reaper didn't get to it yet.
+func (u User) Deleted(now time.Time) bool {
+	return !u.DeleteAfter.IsZero() && !now.Before(u.DeleteAfter)
+}
+
+// A UserStore holds the accounts of auth-service. The handlers only ever talk to the
+// database through it, which lets the tests swap MySQL for an in-memory implementation.
+//
+// Usernames and emails are unique and looked up without regard to case.
+type UserStore interface {
+	// CreateUser adds a new user. It returns ErrUsernameTaken or ErrEmailTaken if another
+	// account already uses the username or email.
+	CreateUser(ctx context.Context, u User) error
+
+	// UserByID, UserByUsername and UserByEmail look up a single user. They return
+	// ErrUserNotFound if there is none.
+	UserByID(ctx context.Context, userID string) (User, error)
+	UserByUsername(ctx context.Context, username string) (User, error)
+	UserByEmail(ctx context.Context, email string) (User, error)
+
+	// VerifyEmail marks the user holding the verification token as verified and clears the
+	// token. It returns ErrUserNotFound if no user holds the token and ErrTokenExpired if the
+	// token is past its expiry time.
+	VerifyEmail(ctx context.Context, verifiedToken string) error
+
+	// SetVerifiedToken replaces the verification token of the user. It returns
+	// ErrUserNotFound if there is no such user.
+	SetVerifiedToken(ctx context.Context, userID, verifiedToken string, expiresAt time.Time) error
+
+	// SetResetToken stores the hash of a password reset token for the user with the given
+	// email, replacing any previous one. It returns ErrUserNotFound if there is no such user.
+	SetResetToken(ctx context.Context, email, resetTokenHash string, expiresAt time.Time) error
+
+	// ResetPassword replaces the password of the user if the reset token hash is theirs and
+	// clears it. It returns ErrUserNotFound if the username and hash don't match a user and
+	// ErrTokenExpired if the token is past its expiry time.
+	ResetPassword(ctx context.Context, username, resetTokenHash string, hashedPassword []byte) error
+
+	// ChangeUsername renames the user and remembers the old username for
+	// UserByFormerUsername. It returns ErrUsernameTaken if another account already uses the
+	// username.
+	ChangeUsername(ctx context.Context, userID, username string) error
+
+	// UserByFormerUsername returns the user who last gave up username by renaming themselves,
+	// if they did so after since. It returns ErrUserNotFound if there is none.
+	UserByFormerUsername(ctx context.Context, username string, since time.Time) (User, error)
+
+	// ChangeEmail moves the user to a new email, which they have to verify with the given
+	// token before it counts as verified. It returns ErrEmailTaken if another account already
+	// uses the email.
+	ChangeEmail(ctx context.Context, userID, email, verifiedToken string, expiresAt time.Time) error
+
+	// ChangePassword replaces the password of the user. Any pending reset token stops
+	// working.
+	ChangePassword(ctx context.Context, userID string, hashedPassword []byte) error
+
+	// SetTOTPSecret stores the secret of a user who started enrolling in two-factor
+	// authentication. Two-factor authentication stays off until EnableTOTP.
+	SetTOTPSecret(ctx context.Context, userID, secret string) error
+
+	// EnableTOTP turns on two-factor authentication with the stored secret. step is the time
+	// step of the code that confirmed it, which can't be used again.
+	EnableTOTP(ctx context.Context, userID string, step int64) error
+
+	// DisableTOTP turns off two-factor authentication and forgets the secret and the
+	// recovery codes of the user.
+	DisableTOTP(ctx context.Context, userID string) error
+
+	// UseTOTPStep records that the user signed in with the code of the given time step. It
+	// returns ErrCodeUsed if they already used a code of that step or a later one.
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+
+	// SetRecoveryCodes replaces the recovery codes of the user with the given hashes (see
+	// hashRecoveryCode).
+	SetRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error
+
+	// UseRecoveryCode deletes a recovery code of the user. It returns ErrCodeUsed if the user
+	// has no such code.
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+
+	// RecoveryCodesLeft returns how many recovery codes the user hasn't used.
+	RecoveryCodesLeft(ctx context.Context, userID string) (int, error)
+
+	// ScheduleDeletion marks the account of the user for deletion once deleteAfter passes.
+	ScheduleDeletion(ctx context.Context, userID string, deleteAfter time.Time) error
+
+	// CancelDeletion takes the account off the deletion schedule, as long as its grace period
+	// isn't over at now. It returns ErrUserNotFound if there is no such scheduled deletion.
+	CancelDeletion(ctx context.Context, userID string, now time.Time) error
+
+	// ClaimDueDeletions returns up to limit users whose grace period is over and who are due
+	// for an attempt, and pushes their DeletionRetryAt back by lease so that no other reaper
+	// picks them up meanwhile.
+	ClaimDueDeletions(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]User, error)
+
+	// MarkDeletionStep records that the user was removed from the service of the step.
+	MarkDeletionStep(ctx context.Context, userID, step string) error
+
+	// MarkDeletionFailed records a failed attempt at deleting the user, to be retried at
+	// retryAt.
+	MarkDeletionFailed(ctx context.Context, userID, lastError string, retryAt time.Time) error
+
+	// UserByIdentity returns the user linked to the subject at an OpenID Connect provider,
+	// or ErrUserNotFound.
+	UserByIdentity(ctx context.Context, provider, subject string) (User, error)
+
+	// LinkIdentity links the subject at an OpenID Connect provider to the user, so that they
+	// can sign in through it. It returns ErrIdentityTaken if it is already linked.
+	LinkIdentity(ctx context.Context, userID, provider, subject string) error
+
+	// GrantRole grants role to the user. Granting a role twice is not an error. It returns
+	// ErrUserNotFound if there is no such user.
+	GrantRole(ctx context.Context, userID, role string) error
+
+	// RevokeRole takes role away from the user. Revoking a role the user doesn't have is not
+	// an error.
+	RevokeRole(ctx context.Context, userID, role string) error
+
+	// UsersWithRole returns every user who was granted role, by username.
+	UsersWithRole(ctx context.Context, role string) ([]User, error)
+
+	// DeleteUser removes the user, their recovery codes, identities and roles for good.
+	// Deleting a user that doesn't exist is not an error, so that the reaper can safely try
+	// twice.
+	DeleteUser(ctx context.Context, userID string) error
+}
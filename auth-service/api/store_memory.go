@@ -0,0 +1,408 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryUserStore is a UserStore that keeps users in memory. It is meant for tests and for
+// running auth-service without a database; everything is lost when the process exits.
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+	// recoveryCodes holds the set of recovery code hashes of every user, by user ID.
+	recoveryCodes map[string]map[string]bool
+	// identities holds the user ID linked to every identity, by identityKey.
+	identities map[string]string
+	// roles holds the set of roles of every user, by user ID.
+	roles map[string]map[string]bool
+	// formerUsernames holds who last gave up every username, and when.
+	formerUsernames map[string]formerUsername
+}
+
+type formerUsername struct {
+	userID    string
+	changedAt time.Time
+}
+
+// NewMemoryUserStore returns an empty MemoryUserStore.
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:           make(map[string]User),
+		recoveryCodes:   make(map[string]map[string]bool),
+		identities:      make(map[string]string),
+		roles:           make(map[string]map[string]bool),
+		formerUsernames: make(map[string]formerUsername),
+	}
+}
+
+func (s *MemoryUserStore) CreateUser(ctx context.Context, u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.users {
+		if sameName(other.Username, u.Username) {
+			return ErrUsernameTaken
+		}
+		if sameName(other.Email, u.Email) {
+			return ErrEmailTaken
+		}
+	}
+	s.users[u.UserID] = u
+	return nil
+}
+
+func (s *MemoryUserStore) UserByID(ctx context.Context, userID string) (User, error) {
+	return s.find(func(u User) bool { return u.UserID == userID })
+}
+
+func (s *MemoryUserStore) UserByUsername(ctx context.Context, username string) (User, error) {
+	return s.find(func(u User) bool { return sameName(u.Username, username) })
+}
+
+func (s *MemoryUserStore) UserByEmail(ctx context.Context, email string) (User, error) {
+	return s.find(func(u User) bool { return sameName(u.Email, email) })
+}
+
+func (s *MemoryUserStore) VerifyEmail(ctx context.Context, verifiedToken string) error {
+	if verifiedToken == "" {
+		return ErrUserNotFound
+	}
+	u, err := s.find(func(u User) bool { return u.VerifiedToken == verifiedToken })
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(u.VerifiedTokenExpiresAt) {
+		return ErrTokenExpired
+	}
+	return s.update(func(other User) bool { return other.UserID == u.UserID && other.VerifiedToken == verifiedToken }, func(u *User) {
+		u.Verified = true
+		u.VerifiedToken = ""
+		u.VerifiedTokenExpiresAt = time.Time{}
+	})
+}
+
+func (s *MemoryUserStore) SetVerifiedToken(ctx context.Context, userID, verifiedToken string, expiresAt time.Time) error {
+	return s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.VerifiedToken = verifiedToken
+		u.VerifiedTokenExpiresAt = expiresAt
+	})
+}
+
+func (s *MemoryUserStore) SetResetToken(ctx context.Context, email, resetTokenHash string, expiresAt time.Time) error {
+	return s.update(func(u User) bool { return sameName(u.Email, email) }, func(u *User) {
+		u.ResetTokenHash = resetTokenHash
+		u.ResetTokenExpiresAt = expiresAt
+	})
+}
+
+func (s *MemoryUserStore) ResetPassword(ctx context.Context, username, resetTokenHash string, hashedPassword []byte) error {
+	if resetTokenHash == "" {
+		return ErrUserNotFound
+	}
+	match := func(u User) bool { return sameName(u.Username, username) && u.ResetTokenHash == resetTokenHash }
+	u, err := s.find(match)
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(u.ResetTokenExpiresAt) {
+		return ErrTokenExpired
+	}
+	return s.update(match, func(u *User) {
+		u.HashedPassword = hashedPassword
+		u.ResetTokenHash = ""
+		u.ResetTokenExpiresAt = time.Time{}
+	})
+}
+
+func (s *MemoryUserStore) ChangeUsername(ctx context.Context, userID, username string) error {
+	if u, err := s.UserByUsername(ctx, username); err == nil && u.UserID != userID {
+		return ErrUsernameTaken
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if u.Username != username {
+		s.formerUsernames[strings.ToLower(u.Username)] = formerUsername{userID: userID, changedAt: time.Now()}
+		u.Username = username
+		s.users[userID] = u
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) UserByFormerUsername(ctx context.Context, username string, since time.Time) (User, error) {
+	s.mu.RLock()
+	former, ok := s.formerUsernames[strings.ToLower(username)]
+	s.mu.RUnlock()
+	if !ok || !former.changedAt.After(since) {
+		return User{}, ErrUserNotFound
+	}
+	return s.UserByID(ctx, former.userID)
+}
+
+func (s *MemoryUserStore) ChangeEmail(ctx context.Context, userID, email, verifiedToken string, expiresAt time.Time) error {
+	if u, err := s.UserByEmail(ctx, email); err == nil && u.UserID != userID {
+		return ErrEmailTaken
+	}
+	return s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.Email = email
+		u.Verified = false
+		u.VerifiedToken = verifiedToken
+		u.VerifiedTokenExpiresAt = expiresAt
+	})
+}
+
+func (s *MemoryUserStore) ChangePassword(ctx context.Context, userID string, hashedPassword []byte) error {
+	return s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.HashedPassword = hashedPassword
+		u.ResetTokenHash = ""
+		u.ResetTokenExpiresAt = time.Time{}
+	})
+}
+
+func (s *MemoryUserStore) SetTOTPSecret(ctx context.Context, userID, secret string) error {
+	return s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.TOTPSecret = secret
+		u.TOTPEnabled = false
+	})
+}
+
+func (s *MemoryUserStore) EnableTOTP(ctx context.Context, userID string, step int64) error {
+	return s.update(func(u User) bool { return u.UserID == userID && u.TOTPSecret != "" }, func(u *User) {
+		u.TOTPEnabled = true
+		u.TOTPLastStep = step
+	})
+}
+
+func (s *MemoryUserStore) DisableTOTP(ctx context.Context, userID string) error {
+	err := s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.TOTPSecret = ""
+		u.TOTPEnabled = false
+		u.TOTPLastStep = 0
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.recoveryCodes, userID)
+	return nil
+}
+
+func (s *MemoryUserStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	err := s.update(func(u User) bool { return u.UserID == userID && u.TOTPLastStep < step }, func(u *User) {
+		u.TOTPLastStep = step
+	})
+	if err == ErrUserNotFound {
+		return ErrCodeUsed
+	}
+	return err
+}
+
+func (s *MemoryUserStore) SetRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := make(map[string]bool, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes[hash] = true
+	}
+	s.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (s *MemoryUserStore) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.recoveryCodes[userID][codeHash] {
+		return ErrCodeUsed
+	}
+	delete(s.recoveryCodes[userID], codeHash)
+	return nil
+}
+
+func (s *MemoryUserStore) RecoveryCodesLeft(ctx context.Context, userID string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.recoveryCodes[userID]), nil
+}
+
+func (s *MemoryUserStore) ScheduleDeletion(ctx context.Context, userID string, deleteAfter time.Time) error {
+	return s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.DeleteAfter = deleteAfter
+		u.DeletionSteps = nil
+		u.DeletionAttempts = 0
+		u.DeletionLastError = ""
+		u.DeletionRetryAt = deleteAfter
+	})
+}
+
+func (s *MemoryUserStore) CancelDeletion(ctx context.Context, userID string, now time.Time) error {
+	return s.update(func(u User) bool { return u.UserID == userID && u.DeleteAfter.After(now) }, func(u *User) {
+		u.DeleteAfter = time.Time{}
+		u.DeletionRetryAt = time.Time{}
+	})
+}
+
+func (s *MemoryUserStore) ClaimDueDeletions(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []User
+	for _, u := range s.users {
+		if u.Deleted(now) && !u.DeletionRetryAt.After(now) {
+			due = append(due, u)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].DeletionRetryAt.Before(due[j].DeletionRetryAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, u := range due {
+		u.DeletionRetryAt = now.Add(lease)
+		s.users[u.UserID] = u
+	}
+	return due, nil
+}
+
+func (s *MemoryUserStore) MarkDeletionStep(ctx context.Context, userID, step string) error {
+	return s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.DeletionSteps = append(append([]string(nil), u.DeletionSteps...), step)
+	})
+}
+
+func (s *MemoryUserStore) MarkDeletionFailed(ctx context.Context, userID, lastError string, retryAt time.Time) error {
+	return s.update(func(u User) bool { return u.UserID == userID }, func(u *User) {
+		u.DeletionAttempts++
+		u.DeletionLastError = lastError
+		u.DeletionRetryAt = retryAt
+	})
+}
+
+func (s *MemoryUserStore) UserByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	s.mu.RLock()
+	userID, ok := s.identities[identityKey(provider, subject)]
+	s.mu.RUnlock()
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return s.UserByID(ctx, userID)
+}
+
+func (s *MemoryUserStore) LinkIdentity(ctx context.Context, userID, provider, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := identityKey(provider, subject)
+	if _, ok := s.identities[key]; ok {
+		return ErrIdentityTaken
+	}
+	s.identities[key] = userID
+	return nil
+}
+
+func (s *MemoryUserStore) GrantRole(ctx context.Context, userID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	if s.roles[userID] == nil {
+		s.roles[userID] = make(map[string]bool)
+	}
+	s.roles[userID][role] = true
+	return nil
+}
+
+func (s *MemoryUserStore) RevokeRole(ctx context.Context, userID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.roles[userID], role)
+	return nil
+}
+
+func (s *MemoryUserStore) UsersWithRole(ctx context.Context, role string) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var users []User
+	for id, u := range s.users {
+		if s.roles[id][role] {
+			users = append(users, s.withRoles(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *MemoryUserStore) DeleteUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, userID)
+	delete(s.recoveryCodes, userID)
+	delete(s.roles, userID)
+	for name, former := range s.formerUsernames {
+		if former.userID == userID {
+			delete(s.formerUsernames, name)
+		}
+	}
+	for key, linked := range s.identities {
+		if linked == userID {
+			delete(s.identities, key)
+		}
+	}
+	return nil
+}
+
+// sameName reports whether two usernames or emails are the same. Like the unique indexes of
+// the SQL stores, it ignores case.
+func sameName(a, b string) bool {
+	return strings.ToLower(a) == strings.ToLower(b)
+}
+
+// identityKey is the key of an identity in MemoryUserStore.identities.
+func identityKey(provider, subject string) string {
+	return provider + "\x00" + subject
+}
+
+// find returns the first user matching the predicate.
+func (s *MemoryUserStore) find(match func(User) bool) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if match(u) {
+			return s.withRoles(u), nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// withRoles returns u with its roles filled in. The caller must hold s.mu.
+func (s *MemoryUserStore) withRoles(u User) User {
+	u.Roles = nil
+	for role := range s.roles[u.UserID] {
+		u.Roles = append(u.Roles, role)
+	}
+	sort.Strings(u.Roles)
+	return u
+}
+
+// update applies change to every user matching the predicate. It returns ErrUserNotFound if
+// no user matched.
+func (s *MemoryUserStore) update(match func(User) bool, change func(*User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for id, u := range s.users {
+		if match(u) {
+			change(&u)
+			s.users[id] = u
+			found = true
+		}
+	}
+	if !found {
+		return ErrUserNotFound
+	}
+	return nil
+}
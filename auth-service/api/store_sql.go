@@ -0,0 +1,438 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLUserStore is the UserStore backed by the users table of the auth database, which can
+// either live in MySQL or in SQLite.
+type SQLUserStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLUserStore returns a UserStore that uses db, which speaks the given Dialect.
+func NewSQLUserStore(db *sql.DB, dialect Dialect) *SQLUserStore {
+	return &SQLUserStore{db: db, dialect: dialect}
+}
+
+const userColumns = "userId, username, email, hashedPassword, verified, verifiedToken, verifiedTokenExpiresAt, resetToken, resetTokenExpiresAt, locale, totpSecret, totpEnabled, totpLastStep, " +
+	"deleteAfter, deletionSteps, deletionAttempts, deletionLastError, deletionRetryAt"
+
+// selectUserColumns are the userColumns followed by the roles of the user, which both MySQL
+// and SQLite can join with GROUP_CONCAT.
+const selectUserColumns = userColumns + ", (SELECT GROUP_CONCAT(role) FROM roles WHERE roles.userId = users.userId)"
+
+func (s *SQLUserStore) CreateUser(ctx context.Context, u User) error {
+	// Check if the username or the email already exists. The unique indexes still catch a
+	// signup racing this one.
+	if _, err := s.UserByUsername(ctx, u.Username); err == nil {
+		return ErrUsernameTaken
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if _, err := s.UserByEmail(ctx, u.Email); err == nil {
+		return ErrEmailTaken
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, "INSERT INTO users ("+userColumns+") VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		u.UserID, u.Username, u.Email, u.HashedPassword, u.Verified, u.VerifiedToken, nullTime(u.VerifiedTokenExpiresAt),
+		u.ResetTokenHash, nullTime(u.ResetTokenExpiresAt), u.Locale, u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep,
+		nullTime(u.DeleteAfter), strings.Join(u.DeletionSteps, ","), u.DeletionAttempts, u.DeletionLastError, nullTime(u.DeletionRetryAt))
+	return takenError(err)
+}
+
+func (s *SQLUserStore) UserByID(ctx context.Context, userID string) (User, error) {
+	return s.userWhere(ctx, "userId = ?", userID)
+}
+
+func (s *SQLUserStore) UserByUsername(ctx context.Context, username string) (User, error) {
+	return s.userWhere(ctx, "LOWER(username) = LOWER(?)", username)
+}
+
+func (s *SQLUserStore) UserByEmail(ctx context.Context, email string) (User, error) {
+	return s.userWhere(ctx, "LOWER(email) = LOWER(?)", email)
+}
+
+func (s *SQLUserStore) userWhere(ctx context.Context, where string, args ...interface{}) (User, error) {
+	users, err := s.query(ctx, "SELECT "+selectUserColumns+" FROM users WHERE "+where, args...)
+	if err != nil {
+		return User{}, err
+	}
+	if len(users) == 0 {
+		return User{}, ErrUserNotFound
+	}
+	return users[0], nil
+}
+
+// query runs a query selecting selectUserColumns and scans every row into a User.
+func (s *SQLUserStore) query(ctx context.Context, query string, args ...interface{}) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var verifiedToken, resetToken, deletionSteps, deletionLastError, roles sql.NullString
+		var verified sql.NullBool
+		var verifiedTokenExpiresAt, resetTokenExpiresAt, deleteAfter, deletionRetryAt sql.NullTime
+		err := rows.Scan(&u.UserID, &u.Username, &u.Email, &u.HashedPassword, &verified, &verifiedToken, &verifiedTokenExpiresAt, &resetToken, &resetTokenExpiresAt, &u.Locale,
+			&u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep,
+			&deleteAfter, &deletionSteps, &u.DeletionAttempts, &deletionLastError, &deletionRetryAt, &roles)
+		if err != nil {
+			return nil, err
+		}
+		u.Verified = verified.Bool
+		u.VerifiedToken = verifiedToken.String
+		u.VerifiedTokenExpiresAt = verifiedTokenExpiresAt.Time
+		u.ResetTokenHash = resetToken.String
+		u.ResetTokenExpiresAt = resetTokenExpiresAt.Time
+		u.DeleteAfter = deleteAfter.Time
+		if deletionSteps.String != "" {
+			u.DeletionSteps = strings.Split(deletionSteps.String, ",")
+		}
+		u.DeletionLastError = deletionLastError.String
+		u.DeletionRetryAt = deletionRetryAt.Time
+		if roles.String != "" {
+			u.Roles = strings.Split(roles.String, ",")
+			sort.Strings(u.Roles)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLUserStore) VerifyEmail(ctx context.Context, verifiedToken string) error {
+	// An empty token would match every user who has no token.
+	if verifiedToken == "" {
+		return ErrUserNotFound
+	}
+	u, err := s.userWhere(ctx, "verifiedToken = ?", verifiedToken)
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(u.VerifiedTokenExpiresAt) {
+		return ErrTokenExpired
+	}
+	// The token is single use. Matching on it again makes sure it wasn't used in the meantime.
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET verified = ?, verifiedToken = ?, verifiedTokenExpiresAt = NULL WHERE userId = ? AND verifiedToken = ?",
+		true, "", u.UserID, verifiedToken)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) SetVerifiedToken(ctx context.Context, userID, verifiedToken string, expiresAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET verifiedToken = ?, verifiedTokenExpiresAt = ? WHERE userId = ?",
+		verifiedToken, nullTime(expiresAt), userID)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) SetResetToken(ctx context.Context, email, resetTokenHash string, expiresAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET resetToken = ?, resetTokenExpiresAt = ? WHERE LOWER(email) = LOWER(?)",
+		resetTokenHash, nullTime(expiresAt), email)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) ResetPassword(ctx context.Context, username, resetTokenHash string, hashedPassword []byte) error {
+	if resetTokenHash == "" {
+		return ErrUserNotFound
+	}
+	u, err := s.userWhere(ctx, "LOWER(username) = LOWER(?) AND resetToken = ?", username, resetTokenHash)
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(u.ResetTokenExpiresAt) {
+		return ErrTokenExpired
+	}
+	// Matching on the hash again makes sure the token wasn't used in the meantime.
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET hashedPassword = ?, resetToken = ?, resetTokenExpiresAt = NULL WHERE userId = ? AND resetToken = ?",
+		hashedPassword, "", u.UserID, resetTokenHash)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) ChangeUsername(ctx context.Context, userID, username string) error {
+	if u, err := s.UserByUsername(ctx, username); err == nil && u.UserID != userID {
+		return ErrUsernameTaken
+	} else if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	u, err := s.UserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.Username == username {
+		return nil
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "UPDATE users SET username = ? WHERE userId = ?", username, userID)
+		if err := affectedUser(result, takenError(err)); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM username_history WHERE LOWER(username) = LOWER(?)", u.Username); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO username_history (username, userId, changedAt) VALUES (?,?,?)",
+			u.Username, userID, nullTime(time.Now()))
+		return err
+	})
+}
+
+func (s *SQLUserStore) UserByFormerUsername(ctx context.Context, username string, since time.Time) (User, error) {
+	return s.userWhere(ctx, "userId = (SELECT userId FROM username_history WHERE LOWER(username) = LOWER(?) AND changedAt > ?)", username, nullTime(since))
+}
+
+func (s *SQLUserStore) ChangeEmail(ctx context.Context, userID, email, verifiedToken string, expiresAt time.Time) error {
+	if u, err := s.UserByEmail(ctx, email); err == nil && u.UserID != userID {
+		return ErrEmailTaken
+	} else if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET email = ?, verified = ?, verifiedToken = ?, verifiedTokenExpiresAt = ? WHERE userId = ?",
+		email, false, verifiedToken, nullTime(expiresAt), userID)
+	return affectedUser(result, takenError(err))
+}
+
+func (s *SQLUserStore) ChangePassword(ctx context.Context, userID string, hashedPassword []byte) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET hashedPassword = ?, resetToken = NULL, resetTokenExpiresAt = NULL WHERE userId = ?",
+		hashedPassword, userID)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) SetTOTPSecret(ctx context.Context, userID, secret string) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET totpSecret = ?, totpEnabled = ? WHERE userId = ?", secret, false, userID)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) EnableTOTP(ctx context.Context, userID string, step int64) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET totpEnabled = ?, totpLastStep = ? WHERE userId = ? AND totpSecret <> ''", true, step, userID)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) DisableTOTP(ctx context.Context, userID string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "UPDATE users SET totpSecret = '', totpEnabled = ?, totpLastStep = 0 WHERE userId = ?", false, userID)
+		if err := affectedUser(result, err); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE userId = ?", userID)
+		return err
+	})
+}
+
+func (s *SQLUserStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	// Only moving totpLastStep forward makes sure two requests can't both use the same code.
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET totpLastStep = ? WHERE userId = ? AND totpLastStep < ?", step, userID, step)
+	if err := affectedUser(result, err); err == ErrUserNotFound {
+		return ErrCodeUsed
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SQLUserStore) SetRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE userId = ?", userID); err != nil {
+			return err
+		}
+		for _, hash := range codeHashes {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (userId, codeHash) VALUES (?, ?)", userID, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLUserStore) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE userId = ? AND codeHash = ?", userID, codeHash)
+	if err := affectedUser(result, err); err == ErrUserNotFound {
+		return ErrCodeUsed
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SQLUserStore) RecoveryCodesLeft(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM recovery_codes WHERE userId = ?", userID).Scan(&n)
+	return n, err
+}
+
+func (s *SQLUserStore) ScheduleDeletion(ctx context.Context, userID string, deleteAfter time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET deleteAfter = ?, deletionSteps = '', deletionAttempts = 0, deletionLastError = NULL, deletionRetryAt = ? WHERE userId = ?",
+		nullTime(deleteAfter), nullTime(deleteAfter), userID)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) CancelDeletion(ctx context.Context, userID string, now time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET deleteAfter = NULL, deletionRetryAt = NULL WHERE userId = ? AND deleteAfter > ?",
+		userID, nullTime(now))
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) ClaimDueDeletions(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]User, error) {
+	due, err := s.query(ctx, "SELECT "+selectUserColumns+" FROM users WHERE deleteAfter <= ? AND deletionRetryAt <= ? ORDER BY deletionRetryAt LIMIT ?",
+		nullTime(now), nullTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like SQLOutboxStore.ClaimDue, only the users whose DeletionRetryAt we managed to push
+	// back are ours.
+	var claimed []User
+	for _, u := range due {
+		result, err := s.db.ExecContext(ctx, "UPDATE users SET deletionRetryAt = ? WHERE userId = ? AND deletionRetryAt = ?",
+			nullTime(now.Add(lease)), u.UserID, nullTime(u.DeletionRetryAt))
+		if err != nil {
+			return nil, err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			claimed = append(claimed, u)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *SQLUserStore) MarkDeletionStep(ctx context.Context, userID, step string) error {
+	u, err := s.UserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	steps := strings.Join(append(u.DeletionSteps, step), ",")
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET deletionSteps = ? WHERE userId = ?", steps, userID)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) MarkDeletionFailed(ctx context.Context, userID, lastError string, retryAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET deletionAttempts = deletionAttempts + 1, deletionLastError = ?, deletionRetryAt = ? WHERE userId = ?",
+		lastError, nullTime(retryAt), userID)
+	return affectedUser(result, err)
+}
+
+func (s *SQLUserStore) UserByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	return s.userWhere(ctx, "userId = (SELECT userId FROM identities WHERE provider = ? AND subject = ?)", provider, subject)
+}
+
+func (s *SQLUserStore) LinkIdentity(ctx context.Context, userID, provider, subject string) error {
+	if _, err := s.UserByIdentity(ctx, provider, subject); err == nil {
+		return ErrIdentityTaken
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, "INSERT INTO identities (provider, subject, userId, createdAt) VALUES (?,?,?,?)",
+		provider, subject, userID, nullTime(time.Now()))
+	return err
+}
+
+func (s *SQLUserStore) GrantRole(ctx context.Context, userID, role string) error {
+	u, err := s.UserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, granted := range u.Roles {
+		if granted == role {
+			return nil
+		}
+	}
+	_, err = s.db.ExecContext(ctx, "INSERT INTO roles (userId, role, grantedAt) VALUES (?,?,?)", userID, role, nullTime(time.Now()))
+	return err
+}
+
+func (s *SQLUserStore) RevokeRole(ctx context.Context, userID, role string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM roles WHERE userId = ? AND role = ?", userID, role)
+	return err
+}
+
+func (s *SQLUserStore) UsersWithRole(ctx context.Context, role string) ([]User, error) {
+	return s.query(ctx, "SELECT "+selectUserColumns+" FROM users WHERE userId IN (SELECT userId FROM roles WHERE role = ?) ORDER BY username", role)
+}
+
+func (s *SQLUserStore) DeleteUser(ctx context.Context, userID string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM roles WHERE userId = ?", userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE userId = ?", userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM identities WHERE userId = ?", userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM username_history WHERE userId = ?", userID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM users WHERE userId = ?", userID)
+		return err
+	})
+}
+
+// takenError turns a violation of the unique index on usernames or emails into
+// ErrUsernameTaken or ErrEmailTaken. Any other error is returned as is.
+func takenError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	var sqliteErr sqlite3.Error
+	duplicate := (errors.As(err, &mysqlErr) && mysqlErr.Number == 1062) ||
+		(errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+	switch {
+	case duplicate && strings.Contains(err.Error(), "users_username"):
+		return ErrUsernameTaken
+	case duplicate && strings.Contains(err.Error(), "users_email"):
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// inTx runs f in a transaction, which is committed if f returns nil and rolled back otherwise.
+func (s *SQLUserStore) inTx(ctx context.Context, f func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullTime prepares t to be stored in a DATETIME column. The zero time becomes NULL, and
+// everything else is stored in UTC so that both dialects read back the same instant.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// affectedUser turns the result of an UPDATE into ErrUserNotFound if it didn't match any row.
+// On MySQL this relies on clientFoundRows being set in the DSN, otherwise it only counts the
+// rows that actually changed.
+func affectedUser(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	eff, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if eff == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
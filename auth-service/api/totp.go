@@ -0,0 +1,131 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The TOTP parameters (RFC 6238) are the ones every authenticator app supports: 6 digit codes
+// from HMAC-SHA1, changing every 30 seconds.
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	// totpSkew is how many periods a code may be off by, to allow for clock drift and for the
+	// time it takes to type the code.
+	totpSkew = 1
+	// totpSecretSize is the size of secrets in bytes, which is what RFC 4226 recommends.
+	totpSecretSize = 20
+	totpIssuer     = "BearChat"
+)
+
+// totpEncoding is how secrets are written out for authenticator apps.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random secret, base32 encoded.
+func newTOTPSecret() string {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		// The system's source of randomness is broken; no secret is safe to hand out.
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(secret)
+}
+
+// totpURI returns the otpauth:// URI that authenticator apps read, usually from a QR code,
+// to add an account.
+func totpURI(secret, account string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+account) + "?" + q.Encode()
+}
+
+// totpStep returns the number of the period t falls in.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// totpCode returns the code of the given step for a base32 encoded secret.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, from RFC 4226.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// matchTOTP checks code against the steps around now and returns the step it matched. Callers
+// must make sure the step is newer than the last one the user used, so that a code can't be
+// used twice.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// recoveryCodeCount is how many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+// newRecoveryCode returns a random recovery code like "k3m9p-x2wqa". The alphabet leaves out
+// the characters that are easy to mix up when copied by hand.
+func newRecoveryCode() string {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	code := make([]byte, 0, 11)
+	for i, c := range b {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		// 256 isn't a multiple of the alphabet size, so a few characters are very slightly
+		// more likely. That leaves about 49 bits per code, which is plenty for a code that
+		// only works once and behind a password.
+		code = append(code, alphabet[int(c)%len(alphabet)])
+	}
+	return string(code)
+}
+
+// hashRecoveryCode returns what is stored for a recovery code. Codes are compared without
+// their dashes, spaces and case, so they can be typed back however the user wrote them down.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
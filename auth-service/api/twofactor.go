@@ -0,0 +1,316 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// TwoFactorChallengeExpiry is how long users have to enter their code after signing in
+	// with their password.
+	TwoFactorChallengeExpiry = 5 * time.Minute
+	// TwoFactorAttemptLimit is how many codes can be tried for one account within
+	// TwoFactorAttemptWindow. Codes only have 6 digits, so guessing has to stay slow.
+	TwoFactorAttemptLimit  = 5
+	TwoFactorAttemptWindow = 5 * time.Minute
+)
+
+// twoFactorChallengeCookie holds the challenge of users signing in with a provider, who are
+// sent back to the sign in page instead of being answered with it.
+const twoFactorChallengeCookie = "two_factor_challenge"
+
+// twoFactorRequest is the body of the two-factor endpoints. Each of them only reads the fields
+// it needs.
+type twoFactorRequest struct {
+	// Challenge is the token signin answered with. verify reads it from
+	// twoFactorChallengeCookie when it is left out.
+	Challenge string `json:"challenge"`
+	// Code is a code from the authenticator app of the user.
+	Code string `json:"code"`
+	// RecoveryCode can be sent instead of Code by users who lost their authenticator.
+	RecoveryCode string `json:"recoveryCode"`
+	Password     string `json:"password"`
+}
+
+// registerTwoFactorRoutes adds the endpoints to set up two-factor authentication and to
+// finish signing in with it.
+func registerTwoFactorRoutes(router *mux.Router, users UserStore) {
+	attempts := newRateLimiter(TwoFactorAttemptLimit, TwoFactorAttemptWindow)
+	router.HandleFunc("/api/auth/2fa", twoFactorStatus(users)).Methods(http.MethodGet)
+	router.HandleFunc("/api/auth/2fa/enroll", enrollTwoFactor(users)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/2fa/confirm", confirmTwoFactor(users, attempts)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/2fa/verify", verifyTwoFactor(users, attempts)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/2fa/disable", disableTwoFactor(users)).Methods(http.MethodPost)
+	router.HandleFunc("/api/auth/2fa/recovery-codes", regenerateRecoveryCodes(users)).Methods(http.MethodPost)
+}
+
+// Tells the signed in user whether two-factor authentication is on and how many recovery codes
+// they have left.
+func twoFactorStatus(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		left, err := users.RecoveryCodesLeft(r.Context(), u.UserID)
+		if err != nil {
+			http.Error(w, "error querying database for recovery codes", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": u.TOTPEnabled, "recoveryCodesLeft": left})
+	}
+}
+
+// Starts enrolling the signed in user by generating a new secret. The answer holds the secret
+// and the otpauth:// URI to show as a QR code. Two-factor authentication only turns on once the
+// user confirms a code from their app.
+func enrollTwoFactor(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		if u.TOTPEnabled {
+			http.Error(w, "two-factor authentication is already on", http.StatusConflict)
+			return
+		}
+
+		secret := newTOTPSecret()
+		if err := users.SetTOTPSecret(r.Context(), u.UserID, secret); err != nil {
+			http.Error(w, "error storing secret", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"secret": secret, "uri": totpURI(secret, u.Username)})
+	}
+}
+
+// Turns two-factor authentication on once the user shows they can generate codes with the
+// secret from enrollTwoFactor. The answer holds their recovery codes, which are never shown
+// again.
+func confirmTwoFactor(users UserStore, attempts *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok {
+			return
+		}
+		var req twoFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error reading request", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if u.TOTPEnabled {
+			http.Error(w, "two-factor authentication is already on", http.StatusConflict)
+			return
+		}
+		if u.TOTPSecret == "" {
+			http.Error(w, "start enrolling first", http.StatusBadRequest)
+			return
+		}
+		if !allowAttempt(w, attempts, u) {
+			return
+		}
+		step, ok := matchTOTP(u.TOTPSecret, req.Code, time.Now())
+		if !ok {
+			http.Error(w, "incorrect code", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := replaceRecoveryCodes(r, users, u)
+		if err != nil {
+			http.Error(w, "error storing recovery codes", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if err := users.EnableTOTP(r.Context(), u.UserID, step); err != nil {
+			http.Error(w, "error turning on two-factor authentication", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+	}
+}
+
+// The second step of signing in for users with two-factor authentication. It takes the
+// challenge signin answered with, or the one in the cookie set after a provider, and a code
+// from their app, or one of their recovery codes, and signs them in.
+func verifyTwoFactor(users UserStore, attempts *rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req twoFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error reading request", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		fromCookie := false
+		if cookie, err := r.Cookie(twoFactorChallengeCookie); err == nil && req.Challenge == "" {
+			req.Challenge, fromCookie = cookie.Value, true
+		}
+		claims, err := parseClaimsWithKey(req.Challenge, twoFactorChallengeKey)
+		if err != nil || claims.Subject != "2fa" {
+			http.Error(w, "invalid or expired challenge, sign in again", http.StatusUnauthorized)
+			return
+		}
+		u, err := users.UserByID(r.Context(), claims.UserID)
+		if errors.Is(err, ErrUserNotFound) || (err == nil && (!u.TOTPEnabled || u.Deleted(time.Now()))) {
+			http.Error(w, "invalid or expired challenge, sign in again", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database for user", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if !allowAttempt(w, attempts, u) {
+			return
+		}
+
+		if req.RecoveryCode != "" {
+			err = users.UseRecoveryCode(r.Context(), u.UserID, hashRecoveryCode(req.RecoveryCode))
+		} else if step, ok := matchTOTP(u.TOTPSecret, req.Code, time.Now()); ok {
+			err = users.UseTOTPStep(r.Context(), u.UserID, step)
+		} else {
+			err = ErrCodeUsed
+		}
+		if errors.Is(err, ErrCodeUsed) {
+			http.Error(w, "incorrect code", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error checking code", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		err = setSessionCookies(w, u)
+		if err != nil {
+			http.Error(w, "error creating accessToken", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if fromCookie {
+			http.SetCookie(w, &http.Cookie{Name: twoFactorChallengeCookie, Value: "", Path: "/api/auth/2fa", MaxAge: -1})
+		}
+	}
+}
+
+// Turns two-factor authentication off. The user has to enter their password again, so that a
+// session left open somewhere isn't enough.
+func disableTwoFactor(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok || !checkPassword(w, r, u) {
+			return
+		}
+		if err := users.DisableTOTP(r.Context(), u.UserID); err != nil {
+			http.Error(w, "error turning off two-factor authentication", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+	}
+}
+
+// Replaces the recovery codes of the user with new ones, for when they ran out or lost them.
+// Like disabling, it needs the password.
+func regenerateRecoveryCodes(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := sessionUser(w, r, users)
+		if !ok || !checkPassword(w, r, u) {
+			return
+		}
+		if !u.TOTPEnabled {
+			http.Error(w, "two-factor authentication is off", http.StatusConflict)
+			return
+		}
+		codes, err := replaceRecoveryCodes(r, users, u)
+		if err != nil {
+			http.Error(w, "error storing recovery codes", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+	}
+}
+
+// newTwoFactorChallenge returns the token that signin hands to users with two-factor
+// authentication instead of session cookies.
+func newTwoFactorChallenge(u User) (string, error) {
+	return signClaims(AuthClaims{
+		UserID: u.UserID,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "2fa",
+			ExpiresAt: time.Now().Add(TwoFactorChallengeExpiry).Unix(),
+			Issuer:    defaultJWTIssuer,
+			IssuedAt:  time.Now().Unix(),
+		},
+	}, twoFactorChallengeKey)
+}
+
+// replaceRecoveryCodes generates new recovery codes for u, stores their hashes and returns them.
+func replaceRecoveryCodes(r *http.Request, users UserStore, u User) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, users.SetRecoveryCodes(r.Context(), u.UserID, hashes)
+}
+
+// sessionUser returns the user signed in with the access_token cookie. If there is none, it
+// writes an error to the Response and returns false.
+func sessionUser(w http.ResponseWriter, r *http.Request, users UserStore) (User, bool) {
+	claims, err := sessionClaims(r)
+	if err != nil {
+		http.Error(w, "sign in first", http.StatusUnauthorized)
+		return User{}, false
+	}
+	u, err := users.UserByID(r.Context(), claims.UserID)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && u.Deleted(time.Now())) {
+		http.Error(w, "sign in first", http.StatusUnauthorized)
+		return User{}, false
+	}
+	if err != nil {
+		http.Error(w, "error querying database for user", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return User{}, false
+	}
+	return u, true
+}
+
+// checkPassword reads the password in the body of the request and checks that it is the one
+// of u. If it isn't, it writes an error to the Response and returns false.
+func checkPassword(w http.ResponseWriter, r *http.Request, u User) bool {
+	var req twoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "error reading request", http.StatusBadRequest)
+		log.Print(err.Error())
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(req.Password)) != nil {
+		http.Error(w, "incorrect password", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// allowAttempt counts one attempt at a code for u. If they made too many, it writes an error
+// to the Response and returns false.
+func allowAttempt(w http.ResponseWriter, attempts *rateLimiter, u User) bool {
+	if !attempts.Allow("2fa:" + u.UserID) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(attempts.window.Seconds())))
+		http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
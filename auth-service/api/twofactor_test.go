@@ -0,0 +1,215 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, cut down to 6 digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, "wrong code at %d", unix)
+	}
+
+	step, ok := matchTOTP(secret, "287082", time.Unix(59+30, 0))
+	assert.True(t, ok, "a code from the previous step was refused")
+	assert.Equal(t, int64(1), step)
+	_, ok = matchTOTP(secret, "287082", time.Unix(59+90, 0))
+	assert.False(t, ok, "a code from long ago was accepted")
+}
+
+// Contains the tests for two-factor authentication.
+func (s *AuthTestSuite) TestTwoFactor() {
+	s.Run("Test Enroll And Sign In", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session := s.signupSession(router)
+
+		rr := s.request(router, "/api/auth/2fa/enroll", twoFactorRequest{}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "enroll failed")
+		var enrolled map[string]string
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&enrolled))
+		s.Assert().True(strings.HasPrefix(enrolled["uri"], "otpauth://totp/BearChat:GoldenBear321?"), "wrong URI %s", enrolled["uri"])
+		s.Assert().Contains(enrolled["uri"], "secret="+enrolled["secret"])
+
+		// Signing in doesn't ask for a code before it is confirmed.
+		rr = s.request(router, "/api/auth/signin", s.testCreds, nil)
+		s.verifyLoginCookies(rr.Result().Cookies())
+
+		rr = s.request(router, "/api/auth/2fa/confirm", twoFactorRequest{Code: "000000"}, session)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "a wrong code was confirmed")
+		now := totpStep(time.Now())
+		rr = s.request(router, "/api/auth/2fa/confirm", twoFactorRequest{Code: s.totpCode(enrolled["secret"], now)}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "confirm failed")
+		var confirmed map[string][]string
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&confirmed))
+		s.Assert().Len(confirmed["recoveryCodes"], recoveryCodeCount)
+
+		// Now signin only hands out a challenge.
+		challenge := s.signinChallenge(router)
+
+		rr = s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: challenge, Code: s.totpCode(enrolled["secret"], now)}, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "the code used to confirm was accepted again")
+		s.Assert().Empty(rr.Result().Cookies())
+
+		next := s.totpCode(enrolled["secret"], now+1)
+		rr = s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: challenge, Code: next}, nil)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "verify failed")
+		s.verifyLoginCookies(rr.Result().Cookies())
+
+		rr = s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: challenge, Code: next}, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "a code was accepted twice")
+	})
+
+	s.Run("Test Recovery Codes", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session, _, codes := s.enableTwoFactor(router)
+
+		// Codes can be typed back without the dash and in capitals.
+		code := strings.ToUpper(strings.ReplaceAll(codes[3], "-", ""))
+		rr := s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: s.signinChallenge(router), RecoveryCode: code}, nil)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "recovery code refused")
+		s.verifyLoginCookies(rr.Result().Cookies())
+
+		rr = s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: s.signinChallenge(router), RecoveryCode: code}, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "a recovery code was accepted twice")
+
+		rr = s.request(router, "/api/auth/2fa", nil, session)
+		var status map[string]interface{}
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&status))
+		s.Assert().Equal(true, status["enabled"])
+		s.Assert().Equal(float64(recoveryCodeCount-1), status["recoveryCodesLeft"])
+
+		// New codes replace the old ones.
+		rr = s.request(router, "/api/auth/2fa/recovery-codes", twoFactorRequest{Password: s.testCreds.Password}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode)
+		rr = s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: s.signinChallenge(router), RecoveryCode: codes[4]}, nil)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "an old recovery code still works")
+	})
+
+	s.Run("Test Challenge Is Not A Session", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		s.enableTwoFactor(router)
+		challenge := s.signinChallenge(router)
+
+		_, err := parseClaims(challenge)
+		s.Assert().Error(err, "the challenge is signed like an access token")
+		rr := s.request(router, "/api/auth/2fa", nil, []*http.Cookie{{Name: "access_token", Value: challenge}})
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode)
+	})
+
+	s.Run("Test Attempt Limit", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		_, secret, _ := s.enableTwoFactor(router)
+		challenge := s.signinChallenge(router)
+
+		// Confirming the code during enrolment was the first attempt.
+		for i := 1; i < TwoFactorAttemptLimit; i++ {
+			rr := s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: challenge, Code: "000000"}, nil)
+			s.Require().Equal(http.StatusBadRequest, rr.Result().StatusCode)
+		}
+		rr := s.request(router, "/api/auth/2fa/verify", twoFactorRequest{Challenge: challenge, Code: s.totpCode(secret, totpStep(time.Now())+1)}, nil)
+		s.Assert().Equal(http.StatusTooManyRequests, rr.Result().StatusCode, "codes can be guessed without limit")
+		s.Assert().NotEmpty(rr.Result().Header.Get("Retry-After"))
+	})
+
+	s.Run("Test Disable Needs Password", func() {
+		s.SetupTest()
+		router := s.newRouter(NewCaptureMailer())
+		session, _, _ := s.enableTwoFactor(router)
+
+		rr := s.request(router, "/api/auth/2fa/disable", twoFactorRequest{Password: "wrong"}, session)
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "disabled with the wrong password")
+		s.signinChallenge(router)
+
+		rr = s.request(router, "/api/auth/2fa/disable", twoFactorRequest{Password: s.testCreds.Password}, session)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "disable failed")
+		rr = s.request(router, "/api/auth/signin", s.testCreds, nil)
+		s.verifyLoginCookies(rr.Result().Cookies())
+	})
+}
+
+// Returns a router with the auth endpoints, which send emails with m.
+func (s *AuthTestSuite) newRouter(m Mailer) *mux.Router {
+	router := mux.NewRouter()
+	RegisterRoutes(router, m, s.users, s.events)
+	return router
+}
+
+// Makes a POST request, or a GET if body is nil, with the given cookies.
+func (s *AuthTestSuite) request(router *mux.Router, path string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if body != nil {
+		b, err := json.Marshal(body)
+		s.Require().NoError(err)
+		r = httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(b))
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	return rr
+}
+
+// Signs the test user up and returns their session cookies.
+func (s *AuthTestSuite) signupSession(router *mux.Router) []*http.Cookie {
+	rr := s.request(router, "/api/auth/signup", s.testCreds, nil)
+	s.Require().Equal(http.StatusCreated, rr.Result().StatusCode, "signup failed")
+	return rr.Result().Cookies()
+}
+
+// Signs the test user up and turns on two-factor authentication. It returns their session
+// cookies, their secret and their recovery codes.
+func (s *AuthTestSuite) enableTwoFactor(router *mux.Router) ([]*http.Cookie, string, []string) {
+	session := s.signupSession(router)
+	rr := s.request(router, "/api/auth/2fa/enroll", twoFactorRequest{}, session)
+	var enrolled map[string]string
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&enrolled))
+	// Confirm with an old code so the current ones can still be used to sign in.
+	code := s.totpCode(enrolled["secret"], totpStep(time.Now())-1)
+	rr = s.request(router, "/api/auth/2fa/confirm", twoFactorRequest{Code: code}, session)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "confirm failed")
+	var confirmed map[string][]string
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&confirmed))
+	return session, enrolled["secret"], confirmed["recoveryCodes"]
+}
+
+// Signs in as the test user, who has two-factor authentication, and returns the challenge.
+func (s *AuthTestSuite) signinChallenge(router *mux.Router) string {
+	rr := s.request(router, "/api/auth/signin", s.testCreds, nil)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "signin failed")
+	s.Require().Empty(rr.Result().Cookies(), "signin handed out cookies without a code")
+	var body map[string]interface{}
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&body))
+	s.Require().Equal(true, body["twoFactorRequired"])
+	challenge, _ := body["challenge"].(string)
+	s.Require().NotEmpty(challenge)
+	return challenge
+}
+
+func (s *AuthTestSuite) totpCode(secret string, step int64) string {
+	code, err := totpCode(secret, step)
+	s.Require().NoError(err)
+	return code
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UsernameRedirectPeriod is how long a username someone renamed away from keeps leading to
+// them, unless another user takes it.
+var UsernameRedirectPeriod = 90 * 24 * time.Hour
+
+// resolvedUsername is the body returned by GET /api/auth/users/{username}. Username is the
+// current username of the user, which differs from the one asked for if they renamed
+// themselves.
+type resolvedUsername struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// registerUsernameRoutes adds the public endpoints that look users up by username.
+func registerUsernameRoutes(router *mux.Router, users UserStore) {
+	router.HandleFunc("/api/auth/users/{username}", resolveUsername(users)).Methods(http.MethodGet)
+}
+
+// Finds the user who has a username, or who had it until they renamed themselves less than
+// UsernameRedirectPeriod ago. Usernames are public, so anyone can ask.
+func resolveUsername(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["username"]
+		now := time.Now()
+		u, err := users.UserByUsername(r.Context(), username)
+		if errors.Is(err, ErrUserNotFound) {
+			u, err = users.UserByFormerUsername(r.Context(), username, now.Add(-UsernameRedirectPeriod))
+		}
+		if errors.Is(err, ErrUserNotFound) || (err == nil && u.Deleted(now)) {
+			http.Error(w, "no user has this username", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database for user", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(resolvedUsername{UserID: u.UserID, Username: u.Username})
+	}
+}
@@ -1,33 +1,59 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/BearCloud/sp21-bearchat/auth-service/api"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish once we are asked to stop.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 
+	// Settings come from the environment, optionally through an .env file next to main.go.
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		log.Fatal(err.Error())
 	}
 
-	// Initialize the sendgrid client
-	mailer := api.NewSendGridMailer()
+	// Links in emails point at PUBLIC_BASE_URL
+	if url := os.Getenv("PUBLIC_BASE_URL"); url != "" {
+		api.PublicBaseURL = url
+	}
 
-	// Initialize our database connection
-	db := api.InitDB()
-	defer db.Close()
+	// Initialize the mailer picked by MAILER
+	mailer, err := api.NewMailer()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
-	// Ping the database to make sure it's up
-	err = db.Ping()
+	// Initialize our database connection. InitDB waits a bounded amount of time for the
+	// database to come up.
+	db, dialect, err := api.InitDB()
 	if err != nil {
-		log.Println("Failed to ping database! Exiting with error...")
-		panic(err.Error())
+		log.Fatalf("failed to connect to the database: %s", err)
+	}
+	defer db.Close()
+
+	// `./main migrate ...` only manages the schema and exits.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(db, dialect, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %s", err)
+		}
+		return
+	}
+	if err := autoMigrate(db, dialect); err != nil {
+		log.Fatalf("failed to migrate the database: %s", err)
 	}
 
 	// Create a new mux for routing api calls
@@ -35,10 +61,168 @@ func main() {
 	router.Use(CORS)
 	router.Methods(http.MethodOptions)
 
-	api.RegisterRoutes(router, mailer, db)
+	health := api.NewHealth()
+	health.AddCheck("database", db.PingContext)
+	if c, ok := mailer.(interface{ Check(context.Context) error }); ok {
+		health.AddCheck("mailer", c.Check)
+	}
+	health.RegisterRoutes(router)
+
+	// The handlers only put emails in the outbox. The worker sends them in the background and
+	// retries the ones that fail, so a slow or failing provider doesn't fail any request.
+	outbox := api.NewSQLOutboxStore(db, dialect)
+	worker := api.NewOutboxWorker(outbox, mailer)
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	workerDone := make(chan struct{})
+	go func() {
+		worker.Run(workerCtx)
+		close(workerDone)
+	}()
+
+	users := api.NewSQLUserStore(db, dialect)
+	exports := api.NewSQLExportStore(db, dialect)
+	audit := api.NewSQLAuditStore(db, dialect)
+
+	// The other services are reached through their internal endpoints, which only accept
+	// calls carrying INTERNAL_API_KEY.
+	internalKey := os.Getenv("INTERNAL_API_KEY")
+	if internalKey == "" {
+		log.Print("INTERNAL_API_KEY is empty, the other services will refuse exports and deletions")
+	}
+	postsURL := envOr("POSTS_URL", "http://172.28.1.3")
+	profilesURL := envOr("PROFILES_URL", "http://172.28.1.4")
+	friendsURL := envOr("FRIENDS_URL", "http://172.28.1.5")
+
+	// Accounts are only deleted once their grace period is over. The reaper then removes the
+	// user from every other service before removing them here.
+	reaper := api.NewAccountReaper(users,
+		api.DeletionStep{Name: "exports", Delete: exports.DeleteUserExports},
+		api.OutboxDeletionStep(users, outbox),
+		api.RemoteDeletionStep("posts", postsURL, internalKey),
+		api.RemoteDeletionStep("profiles", profilesURL, internalKey),
+		api.RemoteDeletionStep("friends", friendsURL, internalKey),
+	)
+	reaperDone := make(chan struct{})
+	go func() {
+		reaper.Run(workerCtx)
+		close(reaperDone)
+	}()
 
-	log.Println("starting go server")
-	http.ListenAndServe(":80", router)
+	// New users get their profile and their place in the friend graph through the
+	// user.created event, which is delivered to the internal endpoints of both services.
+	events := api.NewLocalEventBus()
+	events.Subscribe("profiles", api.RemoteEventHandler("profiles", profilesURL, internalKey), api.EventUserCreated)
+	events.Subscribe("friends", api.RemoteEventHandler("friends", friendsURL, internalKey), api.EventUserCreated)
+
+	// Exports are built in the background from the data every service holds.
+	exporter := api.NewExportWorker(users, exports,
+		api.RemoteExportSource("profile", profilesURL, internalKey),
+		api.RemoteExportSource("posts", postsURL, internalKey),
+		api.RemoteExportSource("friends", friendsURL, internalKey),
+	)
+	exporterDone := make(chan struct{})
+	go func() {
+		exporter.Run(workerCtx)
+		close(exporterDone)
+	}()
+
+	api.RegisterRoutes(router, api.NewOutboxMailer(outbox), users, events)
+	api.RegisterExportRoutes(router, users, exports)
+	api.RegisterOIDCRoutes(router, users, events, oidcProviders()...)
+	api.RegisterAdminRoutes(router, os.Getenv("ADMIN_API_KEY"), outbox, users, audit)
+	api.RegisterInternalRoutes(router, internalKey, users, audit)
+
+	serve(&http.Server{Addr: listenAddr(), Handler: router}, health)
+
+	// Let the workers finish what they are doing.
+	stopWorker()
+	events.Close()
+	<-workerDone
+	<-reaperDone
+	<-exporterDone
+}
+
+// oidcProviders returns the OpenID Connect providers named in OIDC_PROVIDERS, separated by
+// commas. Each of them is configured by OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and
+// OIDC_<NAME>_CLIENT_SECRET.
+func oidcProviders() []*api.OIDCProvider {
+	var providers []*api.OIDCProvider
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		issuer, clientID := os.Getenv(prefix+"ISSUER"), os.Getenv(prefix+"CLIENT_ID")
+		if issuer == "" || clientID == "" {
+			log.Printf("%sISSUER and %sCLIENT_ID are required, not signing in with %s", prefix, prefix, name)
+			continue
+		}
+		providers = append(providers, api.NewOIDCProvider(strings.ToLower(name), issuer, clientID, os.Getenv(prefix+"CLIENT_SECRET")))
+	}
+	return providers
+}
+
+// envOr returns the environment variable key, or fallback if it is empty.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// serve runs the server until it receives SIGINT or SIGTERM, then stops accepting new
+// connections and waits for in-flight requests to finish.
+func serve(srv *http.Server, health *api.Health) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Println("starting go server")
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err.Error())
+	case <-ctx.Done():
+	}
+
+	log.Println("shutting down, draining in-flight requests")
+	health.Drain()
+	// Keep answering while the load balancers notice that /readyz fails and stop sending
+	// requests here.
+	time.Sleep(drainDelay())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown failed: %s", err)
+	}
+}
+
+// drainDelay is how long the server waits between failing /readyz and shutting down. It is
+// 5 seconds unless DRAIN_DELAY, a duration like "10s", says otherwise.
+func drainDelay() time.Duration {
+	v := os.Getenv("DRAIN_DELAY")
+	if v == "" {
+		return 5 * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid DRAIN_DELAY %q, using 5s", v)
+		return 5 * time.Second
+	}
+	return d
+}
+
+// listenAddr is where the server listens. It is port 80 unless PORT says otherwise, which lets
+// several services run side by side outside of Docker.
+func listenAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":80"
 }
 
 func CORS(next http.Handler) http.Handler {
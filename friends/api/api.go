@@ -1,135 +1,159 @@
 package api
 
 import (
-	"net/http"
-	"github.com/gorilla/mux"
-	"log"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 )
 
-const NeptuneURL = "https://<your_neptune_writer_endpoint>:8182/gremlin"
+// NeptuneURL is the Gremlin HTTP endpoint of the graph database. main overrides it with
+// NEPTUNE_URL when that is set.
+var NeptuneURL = "https://<your_neptune_writer_endpoint>:8182/gremlin"
+
+// neptuneClient makes the calls to the graph database.
+var neptuneClient = &http.Client{Timeout: 10 * time.Second}
+
+// uuidRoute matches the UUIDs of users in the path of a route, as in "{uuid:" + uuidRoute + "}".
+// Anything else never reaches the handlers.
+const uuidRoute = "[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}"
 
 func RegisterRoutes(router *mux.Router) error {
-	router.HandleFunc("/api/friends/{uuid}", areFriends).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/friends/{uuid}", addFriend).Methods(http.MethodPost, http.MethodOptions)
+	registerListRoutes(router)
+	router.HandleFunc("/api/friends/{uuid:"+uuidRoute+"}", areFriends).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/api/friends/{uuid:"+uuidRoute+"}", addFriend).Methods(http.MethodPost, http.MethodOptions)
 	// router.HandleFunc("/api/friends/{uuid}", deleteFriend).Methods(http.MethodDelete)
 	// router.HandleFunc("/api/friends/{uuid}/mutual", mutualFriends).Methods(http.MethodGet)
 	router.HandleFunc("/api/friends", getFriends).Methods(http.MethodGet, http.MethodOptions)
 	router.HandleFunc("/api/friends", addUser).Methods(http.MethodPost, http.MethodOptions)
+	registerFollowRoutes(router)
 
 	return nil
 }
 
-func getUUID (w http.ResponseWriter, r *http.Request) (uuid string) {
+// RequireVerifiedEmail makes addFriend turn away users who haven't verified their email yet.
+// main turns it on when REQUIRE_VERIFIED_EMAIL is "true". addUser is left alone since it runs
+// right after signup, before anyone could have verified.
+var RequireVerifiedEmail = false
+
+// getUUID returns the user ID in the access_token cookie. If the cookie is missing or invalid,
+// it writes an error to the response and returns the error.
+func getUUID(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+	claims, err := getClaims(w, r)
+	if err != nil {
+		return "", err
+	}
+	return claims["UserID"].(string), nil
+}
+
+// getVerifiedUUID is getUUID for the endpoints that change friendships. When
+// RequireVerifiedEmail is set, it also refuses users who haven't verified their email.
+func getVerifiedUUID(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+	claims, err := getClaims(w, r)
+	if err != nil {
+		return "", err
+	}
+	if verified, _ := claims["EmailVerified"].(bool); RequireVerifiedEmail && !verified {
+		http.Error(w, "verify your email first", http.StatusForbidden)
+		return "", errors.New("email not verified")
+	}
+	return claims["UserID"].(string), nil
+}
+
+func getClaims(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, error) {
 	cookie, err := r.Cookie("access_token")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Print(err.Error())
+		return nil, err
 	}
 	//validate the cookie
 	claims, err := ValidateToken(cookie.Value)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		log.Print(err.Error())
+		return nil, err
 	}
-	log.Println(claims)
-
-	
-
-	return claims["UserID"].(string)
+	return claims, nil
 }
 
-func getFriends (w http.ResponseWriter, r *http.Request) {
-	uuid := getUUID(w, r)
-	gq := "g.V().has('uuid', '" + uuid + "').out('friends with').values('uuid')"
-	response, err := makeNeptuneRequest(gq)
-	// var req_body map[string]string
-	// req_body["gremlin"] = "g.V().has('uuid', '" + uuid + "').out('friends with').values('uuid')"
-
-	// jsonValue, _ := json.Marshal(req_body)
-
-	// resp, err := http.Post(NeptuneURL, "application/json", bytes.NewBuffer(jsonValue))
-	// defer resp.Body.Close()
-
-	// var response map[string]interface{}
-	
-	// err = json.NewDecoder(resp.Body).Decode(&response)
+func getFriends(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getUUID(w, r)
+	if err != nil {
+		return
+	}
+	friends, err := friendsOf(uuid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	result := response["result"].(map[string]interface{})
-	data := result["data"].(map[string]interface{})
-	values := data["@value"].([]interface{})
-
-	json.NewEncoder(w).Encode(values)
-	return
+	json.NewEncoder(w).Encode(friends)
 }
 
 func areFriends(w http.ResponseWriter, r *http.Request) {
 	otherUUID := mux.Vars(r)["uuid"]
-	uuid := getUUID(w, r)
-	gq := "g.V().has('uuid', '" + uuid + "').outE('friends with').where(otherV().has('uuid', '" + otherUUID + "')).count()"
-	response, err := makeNeptuneRequest(gq)
+	uuid, err := getUUID(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	result := response["result"].(map[string]interface{})
-	data := result["data"].(map[string]interface{})
-	values := data["@value"].([]interface{})
-	value := values[0].(map[string]interface{})
-	edges := value["@value"].(float64)
-
-	if edges < 1 {
-		fmt.Fprint(w, false)
-	} else {
-		fmt.Fprint(w, true)
+	gq := "g.V().has('uuid', uuid).outE('friends with').where(otherV().has('uuid', other)).count()"
+	edges, err := queryCount(gq, map[string]interface{}{"uuid": uuid, "other": otherUUID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	return
-
+	fmt.Fprint(w, edges > 0)
 }
 
 func addFriend(w http.ResponseWriter, r *http.Request) {
 	otherUUID := mux.Vars(r)["uuid"]
-	uuid := getUUID(w, r)
-	gq := "g.addE('friends with').from(g.V().has('uuid', '" + uuid + "')).to(g.V().has('uuid', '" + otherUUID + "'))"
-	_, err := makeNeptuneRequest(gq)
+	uuid, err := getVerifiedUUID(w, r)
+	if err != nil {
+		return
+	}
+	gq := "g.addE('friends with').from(g.V().has('uuid', from)).to(g.V().has('uuid', to))"
+	_, err = makeNeptuneRequest(gq, map[string]interface{}{"from": uuid, "to": otherUUID})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	gq = "g.addE('friends with').from(g.V().has('uuid', '" + otherUUID + "')).to(g.V().has('uuid', '" + uuid + "'))"
-	_, err = makeNeptuneRequest(gq)
+	_, err = makeNeptuneRequest(gq, map[string]interface{}{"from": otherUUID, "to": uuid})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	return
 }
 
-func addUser (w http.ResponseWriter, r *http.Request) {
-	uuid := getUUID(w, r)
-	gq := "g.addV().property('uuid', '" + uuid + "')"
-	_, err := makeNeptuneRequest(gq)
+func addUser(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getUUID(w, r)
 	if err != nil {
+		return
+	}
+	if err := addVertex(uuid); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	
-	return
+}
+
+// addVertex adds the vertex of a user, unless it is already there. auth-service adds it when
+// the user signs up, so the frontend calling addUser afterwards does nothing.
+func addVertex(uuid string) error {
+	gq := "g.V().has('uuid', uuid).fold().coalesce(unfold(), addV().property('uuid', uuid))"
+	_, err := makeNeptuneRequest(gq, map[string]interface{}{"uuid": uuid})
+	return err
 }
 
 // func deleteFriend(w http.ResponseWriter, r *http.Request) {
 // 	otherUUID := mux.Vars(r)["uuid"]
 // 	uuid := getUUID(w, r)
-//   _, err := gremlinClient.Execute("g.V().bothE().filter(hasLabel('friends with')).where(inV().has('uuid', '" + uuid + "')).where(otherV().has('uuid', '" + otherUUID + "')).drop()")
+//   _, err := makeNeptuneRequest("g.V().bothE().filter(hasLabel('friends with')).where(inV().has('uuid', uuid)).where(otherV().has('uuid', other)).drop()", map[string]interface{}{"uuid": uuid, "other": otherUUID})
 // 	if err != nil {
 // 		http.Error(w, err.Error(), http.StatusInternalServerError)
 // 		log.Print(err.Error())
@@ -140,7 +164,7 @@ func addUser (w http.ResponseWriter, r *http.Request) {
 // func mutualFriends(w http.ResponseWriter, r *http.Request) {
 // 	otherUUID := mux.Vars(r)["uuid"]
 // 	uuid := getUUID(w, r)
-// 	isFriend, err := gremlinClient.Execute("g.V().has('uuid', '" + uuid + "').both('friends with').and(both('friends with').has('uuid', '" +  otherUUID + "'))")
+// 	isFriend, err := makeNeptuneRequest("g.V().has('uuid', uuid).both('friends with').and(both('friends with').has('uuid', other))", map[string]interface{}{"uuid": uuid, "other": otherUUID})
 // 	if err != nil {
 // 		http.Error(w, err.Error(), http.StatusInternalServerError)
 // 		log.Print(err.Error())
@@ -149,15 +173,44 @@ func addUser (w http.ResponseWriter, r *http.Request) {
 // 	json.NewEncoder(w).Encode(isFriend[0].Result.Data)
 // }
 
-func makeNeptuneRequest(gremlinQuery string) (map[string]interface{}, error) {
-	req_body := make(map[string]string)
+// PingGraph runs a trivial traversal against the graph database to make sure it is reachable.
+// It is used as a readiness check.
+func PingGraph(ctx context.Context) error {
+	jsonValue, _ := json.Marshal(map[string]string{"gremlin": "g.inject(0)"})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, NeptuneURL, bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := neptuneClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("graph database returned %s", resp.Status)
+	}
+	return nil
+}
+
+// makeNeptuneRequest runs a Gremlin query against the graph database. Every value that comes
+// from a request, like UUIDs, goes into bindings and is only named in the query, so that it is
+// never read as Gremlin. A query the graph database doesn't answer with 200 is an error.
+func makeNeptuneRequest(gremlinQuery string, bindings map[string]interface{}) (map[string]interface{}, error) {
+	req_body := make(map[string]interface{})
 	req_body["gremlin"] = gremlinQuery
+	if len(bindings) > 0 {
+		req_body["bindings"] = bindings
+	}
 	jsonValue, _ := json.Marshal(req_body)
-	resp, err := http.Post(NeptuneURL, "application/json", bytes.NewBuffer(jsonValue))
+	resp, err := neptuneClient.Post(NeptuneURL, "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("graph database returned %s", resp.Status)
+	}
 	response := make(map[string]interface{})
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+)
+
+// TESTS
+
+func TestMain(m *testing.M) {
+	// Makes it so any log statements are discarded. Comment these two lines
+	// if you want to see the logs.
+	log.SetFlags(0)
+	log.SetOutput(io.Discard)
+
+	// Runs the tests to completion then exits.
+	os.Exit(m.Run())
+}
+
+// Runs all of the tests against a stand-in for the graph database.
+func TestFriends(t *testing.T) {
+	suite.Run(t, new(FriendsSuite))
+}
+
+// Makes sure paths that aren't UUIDs never reach the handlers, let alone the graph database.
+func (s *FriendsSuite) TestInjectionInPath() {
+	injections := []string{
+		"x')).drop().V(('",
+		testOther + "').drop().V('",
+		"') or 1=1 --",
+		strings.Repeat("-", 36),
+		"00000000-0000-0000-0000-00000000000g",
+	}
+	for _, injection := range injections {
+		escaped := url.PathEscape(injection)
+		for _, req := range []struct{ method, path string }{
+			{http.MethodGet, "/api/friends/" + escaped},
+			{http.MethodPost, "/api/friends/" + escaped},
+			{http.MethodPost, "/api/friends/" + escaped + "/follow"},
+			{http.MethodGet, "/api/friends/" + escaped + "/followers"},
+			{http.MethodPut, "/api/friends/lists/" + testListID + "/members/" + escaped},
+			{http.MethodDelete, "/internal/users/" + escaped},
+			{http.MethodGet, "/internal/users/" + escaped + "/friends"},
+			{http.MethodGet, "/internal/lists/" + escaped},
+		} {
+			rr := s.serve(req.method, req.path, testUser, nil)
+			s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode, "%s %s was let through", req.method, req.path)
+		}
+	}
+	s.Assert().Empty(s.graph.requests(), "a query was sent for a path that isn't a UUID")
+}
+
+// Makes sure every value that comes from a request is sent as a binding, so that none of them
+// can change the query, even values we trust like the user in the access token.
+func (s *FriendsSuite) TestBindings() {
+	name := "Family'); g.V().drop(); ('"
+	user := "x').drop().V('"
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+		// bound are the values that must be among the bindings.
+		bound []string
+	}{
+		{http.MethodGet, "/api/friends/" + testOther, nil, []string{user, testOther}},
+		{http.MethodPost, "/api/friends/" + testOther, nil, []string{user, testOther}},
+		{http.MethodGet, "/api/friends", nil, []string{user}},
+		{http.MethodPost, "/api/friends", nil, []string{user}},
+		{http.MethodPost, "/api/friends/" + testOther + "/follow", nil, []string{user, testOther}},
+		{http.MethodDelete, "/api/friends/" + testOther + "/follow", nil, []string{user, testOther}},
+		{http.MethodGet, "/api/friends/" + testOther + "/followers?offset=5", nil, []string{testOther}},
+		{http.MethodGet, "/api/friends/" + testOther + "/following", nil, []string{testOther}},
+		{http.MethodGet, "/api/friends/lists", nil, []string{user}},
+		{http.MethodPost, "/api/friends/lists", map[string]string{"name": name}, []string{user, name}},
+		{http.MethodPatch, "/api/friends/lists/" + testListID, map[string]string{"name": name}, []string{user, testListID, name}},
+		{http.MethodDelete, "/api/friends/lists/" + testListID, nil, []string{user, testListID}},
+		{http.MethodPut, "/api/friends/lists/" + testListID + "/members/" + testOther, nil, []string{user, testListID, testOther}},
+		{http.MethodDelete, "/api/friends/lists/" + testListID + "/members/" + testOther, nil, []string{user, testListID, testOther}},
+		{http.MethodDelete, "/internal/users/" + testOther, nil, []string{testOther}},
+		{http.MethodGet, "/internal/users/" + testOther + "/export", nil, []string{testOther}},
+		{http.MethodGet, "/internal/users/" + testOther + "/friends", nil, []string{testOther}},
+		{http.MethodGet, "/internal/users/" + testOther + "/following", nil, []string{testOther}},
+		{http.MethodGet, "/internal/users/" + testOther + "/lists", nil, []string{testOther}},
+		{http.MethodGet, "/internal/lists/" + testListID, nil, []string{testListID}},
+		{http.MethodPost, "/internal/events", event{ID: "1", Type: "user.created", UserID: testOther}, []string{testOther}},
+	} {
+		s.Run(req.method+" "+req.path, func() {
+			s.graph.reset()
+			rr := s.serve(req.method, req.path, user, req.body)
+			s.Require().NotEqual(http.StatusInternalServerError, rr.Result().StatusCode, "request failed: %s", rr.Body.String())
+
+			requests := s.graph.requests()
+			s.Require().NotEmpty(requests, "the graph database wasn't queried")
+			var bound []interface{}
+			for _, gr := range requests {
+				for _, value := range []string{user, testOther, testListID, name, "5"} {
+					s.Assert().NotContains(gr.Gremlin, value, "a value was written into the query")
+				}
+				for _, value := range gr.Bindings {
+					bound = append(bound, value)
+				}
+			}
+			for _, value := range req.bound {
+				s.Assert().Contains(bound, value, "a value wasn't sent as a binding")
+			}
+		})
+	}
+}
+
+// Makes sure events about users who don't have a UUID are turned away.
+func (s *FriendsSuite) TestInjectionInEvent() {
+	rr := s.serve(http.MethodPost, "/internal/events", "", event{ID: "1", Type: "user.created", UserID: "x').drop().V('"})
+	s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code")
+	s.Assert().Empty(s.graph.requests(), "a query was sent for an event without a UUID")
+}
+
+// Makes sure areFriends tells from the count of edges whether two users are friends.
+func (s *FriendsSuite) TestAreFriends() {
+	for count, expected := range map[int]string{0: "false", 2: "true"} {
+		s.graph.count = count
+		rr := s.serve(http.MethodGet, "/api/friends/"+testOther, testUser, nil)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code")
+		s.Assert().Equal(expected, rr.Body.String())
+	}
+}
+
+// Makes sure nothing is reported as done when the graph database fails the query.
+func (s *FriendsSuite) TestGraphFails() {
+	s.graph.failing = true
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPost, "/api/friends/" + testOther},
+		{http.MethodDelete, "/api/friends/" + testOther + "/follow"},
+		{http.MethodDelete, "/api/friends/lists/" + testListID},
+		{http.MethodDelete, "/api/friends/lists/" + testListID + "/members/" + testOther},
+		{http.MethodDelete, "/internal/users/" + testOther},
+	} {
+		rr := s.serve(req.method, req.path, testUser, nil)
+		s.Assert().Equal(http.StatusInternalServerError, rr.Result().StatusCode, "%s %s succeeded although the graph database failed", req.method, req.path)
+	}
+}
+
+// HELPER METHODS AND DEFINITIONS
+
+// The users and list the tests ask about.
+const (
+	testUser   = "3f5b6c1e-8a2d-4f7e-9b0c-1d2e3f4a5b6c"
+	testOther  = "7a8b9c0d-1e2f-4a3b-8c4d-5e6f7a8b9c0d"
+	testListID = "0123456789abcdef0123456789abcdef"
+)
+
+// Defines the suite of tests for the friends service.
+type FriendsSuite struct {
+	suite.Suite
+	graph      *fakeGraph
+	server     *httptest.Server
+	router     *mux.Router
+	neptuneURL string
+}
+
+// A gremlinRequest is the body of a query sent to the graph database.
+type gremlinRequest struct {
+	Gremlin  string                 `json:"gremlin"`
+	Bindings map[string]interface{} `json:"bindings"`
+}
+
+// fakeGraph stands in for the Gremlin endpoint of the graph database. It keeps every query it
+// is sent, and answers the values in answers to the queries containing their key. It answers
+// count to other queries ending with count(), and an empty list to every other. It fails every
+// query, the way the graph database does, while failing is set.
+type fakeGraph struct {
+	mu       sync.Mutex
+	received []gremlinRequest
+	count    int
+	answers  map[string][]interface{}
+	failing  bool
+}
+
+func (g *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var gr gremlinRequest
+	if err := json.NewDecoder(r.Body).Decode(&gr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.received = append(g.received, gr)
+	if g.failing {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"code": "InternalFailureException", "detailedMessage": "the query failed"})
+		return
+	}
+	values := []interface{}{}
+	if strings.HasSuffix(gr.Gremlin, ".count()") {
+		values = append(values, graphCount(g.count))
+	}
+	for part, answer := range g.answers {
+		if strings.Contains(gr.Gremlin, part) {
+			values = answer
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": map[string]interface{}{
+			"data": map[string]interface{}{"@type": "g:List", "@value": values},
+		},
+	})
+}
+
+// graphCount returns a count as the graph database writes it.
+func graphCount(n int) interface{} {
+	return map[string]interface{}{"@type": "g:Int64", "@value": n}
+}
+
+// requests returns the queries the graph database was sent.
+func (g *fakeGraph) requests() []gremlinRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]gremlinRequest(nil), g.received...)
+}
+
+// reset forgets the queries the graph database was sent.
+func (g *fakeGraph) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.received = nil
+}
+
+// Points the handlers at a fresh stand-in for the graph database before each test.
+func (s *FriendsSuite) SetupTest() {
+	s.graph = &fakeGraph{count: 1}
+	s.server = httptest.NewServer(s.graph)
+	s.neptuneURL = NeptuneURL
+	NeptuneURL = s.server.URL
+	s.router = mux.NewRouter()
+	s.Require().NoError(RegisterRoutes(s.router))
+	RegisterInternalRoutes(s.router, "internalKey")
+}
+
+func (s *FriendsSuite) TearDownTest() {
+	s.server.Close()
+	NeptuneURL = s.neptuneURL
+}
+
+// Sends a request to the router, signed in as uuid and with the internal key. body, if not
+// nil, is sent as JSON.
+func (s *FriendsSuite) serve(method, path, uuid string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewBufferString(s.jsonString(body))
+	}
+	r := httptest.NewRequest(method, path, reader)
+	r.AddCookie(s.generateFakeAccessToken(uuid))
+	r.Header.Set("X-Internal-Token", "internalKey")
+	rr := httptest.NewRecorder()
+	s.router.ServeHTTP(rr, r)
+	return rr
+}
+
+// Returns v written as JSON.
+func (s *FriendsSuite) jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	s.Require().NoError(err)
+	return string(b)
+}
+
+// Given a UUID, generates an access_token cookie that can be used to make requests
+// for that UUID.
+func (s *FriendsSuite) generateFakeAccessToken(uuid string) *http.Cookie {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, AuthClaims{
+		UserID:        uuid,
+		EmailVerified: true,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "access",
+			ExpiresAt: time.Now().AddDate(0, 0, 1).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
+	tokenString, err := token.SignedString(jwtKey)
+	s.Require().NoError(err, "could not make fake access token")
+	return &http.Cookie{Name: "access_token", Value: tokenString}
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// followsPerPage is how many users listFollowers and listFollowing return at once.
+const followsPerPage = 50
+
+// followList is the body returned by the endpoints listing followers and followed users.
+// Count is the total, not the number of users on the page.
+type followList struct {
+	Count int           `json:"count"`
+	Users []interface{} `json:"users"`
+}
+
+// registerFollowRoutes adds the endpoints of follows. Unlike friendships, a follow goes one
+// way and doesn't need the other user, so public accounts can have followers they never
+// approved.
+func registerFollowRoutes(router *mux.Router) {
+	router.HandleFunc("/api/friends/{uuid:"+uuidRoute+"}/follow", follow).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/friends/{uuid:"+uuidRoute+"}/follow", unfollow).Methods(http.MethodDelete)
+	router.HandleFunc("/api/friends/{uuid:"+uuidRoute+"}/followers", listFollowers).Methods(http.MethodGet)
+	router.HandleFunc("/api/friends/{uuid:"+uuidRoute+"}/following", listFollowing).Methods(http.MethodGet)
+}
+
+// Makes the signed in user follow the user in the path. Following someone twice does nothing.
+func follow(w http.ResponseWriter, r *http.Request) {
+	otherUUID := mux.Vars(r)["uuid"]
+	uuid, err := getVerifiedUUID(w, r)
+	if err != nil {
+		return
+	}
+	if uuid == otherUUID {
+		http.Error(w, "users can't follow themselves", http.StatusBadRequest)
+		return
+	}
+	// The edge is only added if it isn't there yet, and the count is 0 if either user is missing.
+	// Edges keep when they were made, in milliseconds, so the lists show the newest first.
+	gq := "g.V().has('uuid', follower).as('follower').V().has('uuid', followed)" +
+		".coalesce(inE('follows').where(outV().as('follower')), addE('follows').from('follower').property('since', since)).count()"
+	bindings := map[string]interface{}{"follower": uuid, "followed": otherUUID, "since": time.Now().UnixNano() / int64(time.Millisecond)}
+	followed, err := queryCount(gq, bindings)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if followed == 0 {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Makes the signed in user stop following the user in the path. Unfollowing someone who wasn't
+// followed does nothing.
+func unfollow(w http.ResponseWriter, r *http.Request) {
+	otherUUID := mux.Vars(r)["uuid"]
+	uuid, err := getUUID(w, r)
+	if err != nil {
+		return
+	}
+	gq := "g.V().has('uuid', follower).outE('follows').where(inV().has('uuid', followed)).drop()"
+	if _, err := makeNeptuneRequest(gq, map[string]interface{}{"follower": uuid, "followed": otherUUID}); err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lists the users following the user in the path, most recent first, starting from the
+// "offset" query parameter.
+func listFollowers(w http.ResponseWriter, r *http.Request) {
+	listFollows(w, r, "inE", "outV")
+}
+
+// Lists the users the user in the path follows, most recent first, starting from the "offset"
+// query parameter.
+func listFollowing(w http.ResponseWriter, r *http.Request) {
+	listFollows(w, r, "outE", "inV")
+}
+
+// listFollows writes a page of the users at the other end of the follows edges of the user in
+// the path. edges and other are the Gremlin steps that pick the edges and their other end.
+func listFollows(w http.ResponseWriter, r *http.Request, edges, other string) {
+	if _, err := getUUID(w, r); err != nil {
+		return
+	}
+	offset := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		var err error
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	user := "g.V().has('uuid', uuid)." + edges + "('follows')"
+	bindings := map[string]interface{}{"uuid": mux.Vars(r)["uuid"], "low": offset, "high": offset + followsPerPage}
+	count, err := queryCount(user+".count()", bindings)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	users, err := queryValues(user+".order().by('since', desc).range(low, high)."+other+"().values('uuid')", bindings)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(followList{Count: count, Users: users})
+}
+
+// followingOf returns the UUIDs of every user a user follows.
+func followingOf(uuid string) ([]interface{}, error) {
+	return queryValues("g.V().has('uuid', uuid).out('follows').values('uuid')", map[string]interface{}{"uuid": uuid})
+}
+
+// queryValues runs a Gremlin query with the given bindings, like makeNeptuneRequest, and
+// returns the values it answered with. It returns an error rather than an empty list if the
+// graph database didn't answer with values.
+func queryValues(gq string, bindings map[string]interface{}) ([]interface{}, error) {
+	response, err := makeNeptuneRequest(gq, bindings)
+	if err != nil {
+		return nil, err
+	}
+	result, _ := response["result"].(map[string]interface{})
+	data, _ := result["data"].(map[string]interface{})
+	values, ok := data["@value"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected answer from the graph database: %v", response)
+	}
+	return values, nil
+}
+
+// queryCount runs a Gremlin query ending with count() and returns the count.
+func queryCount(gq string, bindings map[string]interface{}) (int, error) {
+	values, err := queryValues(gq, bindings)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 1 {
+		if value, ok := values[0].(map[string]interface{}); ok {
+			if count, ok := value["@value"].(float64); ok {
+				return int(count), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unexpected count from the graph database: %v", values)
+}
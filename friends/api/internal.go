@@ -0,0 +1,180 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// RegisterInternalRoutes adds the endpoints the other services call. They are never reached
+// by browsers and only answer requests whose X-Internal-Token header is internalKey. They are
+// turned off if internalKey is empty.
+func RegisterInternalRoutes(router *mux.Router, internalKey string) {
+	internal := router.PathPrefix("/internal").Subrouter()
+	internal.Use(requireInternalToken(internalKey))
+	internal.HandleFunc("/users/{uuid:"+uuidRoute+"}", deleteUser).Methods(http.MethodDelete)
+	internal.HandleFunc("/users/{uuid:"+uuidRoute+"}/export", exportUser).Methods(http.MethodGet)
+	internal.HandleFunc("/users/{uuid:"+uuidRoute+"}/friends", listUserFriends).Methods(http.MethodGet)
+	internal.HandleFunc("/users/{uuid:"+uuidRoute+"}/following", listUserFollowing).Methods(http.MethodGet)
+	internal.HandleFunc("/users/{uuid:"+uuidRoute+"}/lists", listUserMemberships).Methods(http.MethodGet)
+	internal.HandleFunc("/lists/{listID:[0-9a-f]+}", getListOwner).Methods(http.MethodGet)
+	internal.HandleFunc("/events", handleEvent).Methods(http.MethodPost)
+}
+
+// requireInternalToken turns away every request that doesn't carry the internal key.
+func requireInternalToken(internalKey string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("X-Internal-Token")
+			if internalKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(internalKey)) != 1 {
+				http.Error(w, "internal token required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Removes the vertex of a user whose account was deleted, along with all of their friendships
+// and lists. Dropping a vertex that isn't there does nothing, so auth-service can call it again.
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	bindings := map[string]interface{}{"uuid": uuid}
+	_, err := makeNeptuneRequest("g.V().has('uuid', uuid).out('owns').hasLabel('list').drop()", bindings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	_, err = makeNeptuneRequest("g.V().has('uuid', uuid).drop()", bindings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the UUIDs of the friends of a user, and of the users they follow, along with their
+// lists, for the archive of their data.
+func exportUser(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	friends, err := friendsOf(uuid)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	following, err := followingOf(uuid)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	lists, err := listsOf(uuid)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"friends": friends, "following": following, "lists": lists})
+}
+
+// Returns the UUIDs of the friends of a user. profiles uses it to tell which fields of a
+// profile the viewer may see.
+func listUserFriends(w http.ResponseWriter, r *http.Request) {
+	friends, err := friendsOf(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(friends)
+}
+
+// Returns the UUIDs of every user a user follows. posts uses it to show the posts of followed
+// users in their feed.
+func listUserFollowing(w http.ResponseWriter, r *http.Request) {
+	following, err := followingOf(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(following)
+}
+
+// Returns the IDs of the lists a user is a member of. posts uses it to tell which of the posts
+// shared with a list the user may see.
+func listUserMemberships(w http.ResponseWriter, r *http.Request) {
+	lists, err := queryValues("g.V().has('uuid', member).in('includes').hasLabel('list').values('listId')", map[string]interface{}{"member": mux.Vars(r)["uuid"]})
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(lists)
+}
+
+// Returns the UUID of the owner of a list. posts uses it to make sure users only share posts
+// with their own lists.
+func getListOwner(w http.ResponseWriter, r *http.Request) {
+	owners, err := queryValues("g.V().hasLabel('list').has('listId', listId).in('owns').values('uuid')", map[string]interface{}{"listId": mux.Vars(r)["listID"]})
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if len(owners) == 0 {
+		http.Error(w, "no such list", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"owner": owners[0]})
+}
+
+// friendsOf returns the UUIDs of the friends of a user. It returns an error rather than an
+// empty list if the graph database didn't answer with values, so that the friends are never
+// silently missed.
+func friendsOf(uuid string) ([]interface{}, error) {
+	return queryValues("g.V().has('uuid', uuid).out('friends with').values('uuid')", map[string]interface{}{"uuid": uuid})
+}
+
+// uuidPattern matches UUIDs, like uuidRoute does in routes.
+var uuidPattern = regexp.MustCompile("^" + uuidRoute + "$")
+
+// An event published by auth-service. Only the fields friends uses are decoded.
+type event struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	UserID string `json:"userId"`
+}
+
+// Receives the events of auth-service. A new user gets their vertex in the graph, unless they
+// already have one, since events may come more than once. Events friends doesn't care about
+// are ignored.
+func handleEvent(w http.ResponseWriter, r *http.Request) {
+	var e event
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "error reading event", http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+	if e.Type != "user.created" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !uuidPattern.MatchString(e.UserID) {
+		http.Error(w, "userId must be a UUID", http.StatusBadRequest)
+		return
+	}
+	if err := addVertex(e.UserID); err != nil {
+		http.Error(w, "error adding user to the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// maxListNameLength is the longest name a list can have, in characters.
+const maxListNameLength = 50
+
+// A friendList is a named group of friends, like "close friends" or "family", that only its
+// owner sees. Posts can be shared with the members of a list alone.
+type friendList struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Members []interface{} `json:"members"`
+}
+
+// ownedList is the Gremlin traversal to the list with ID listId, if it belongs to the user
+// with UUID owner. Lists are vertices of their own, with an "owns" edge from their owner and
+// an "includes" edge to each member.
+const ownedList = "g.V().has('uuid', owner).out('owns').hasLabel('list').has('listId', listId)"
+
+// registerListRoutes adds the endpoints owners manage their lists with.
+func registerListRoutes(router *mux.Router) {
+	router.HandleFunc("/api/friends/lists", getLists).Methods(http.MethodGet)
+	router.HandleFunc("/api/friends/lists", createList).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/api/friends/lists/{listID:[0-9a-f]+}", renameList).Methods(http.MethodPatch, http.MethodOptions)
+	router.HandleFunc("/api/friends/lists/{listID:[0-9a-f]+}", deleteList).Methods(http.MethodDelete)
+	router.HandleFunc("/api/friends/lists/{listID:[0-9a-f]+}/members/{uuid:"+uuidRoute+"}", addListMember).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/api/friends/lists/{listID:[0-9a-f]+}/members/{uuid:"+uuidRoute+"}", removeListMember).Methods(http.MethodDelete)
+}
+
+// Returns the lists of the signed in user, sorted by name, along with their members.
+func getLists(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getUUID(w, r)
+	if err != nil {
+		return
+	}
+	lists, err := listsOf(uuid)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(lists)
+}
+
+// Creates an empty list for the signed in user, named after the "name" field of the body.
+func createList(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getVerifiedUUID(w, r)
+	if err != nil {
+		return
+	}
+	name, ok := readListName(w, r)
+	if !ok {
+		return
+	}
+	list := friendList{ID: randomHex(16), Name: name, Members: []interface{}{}}
+	gq := "g.V().has('uuid', owner).as('owner').addV('list').property('listId', listId).property('name', name).addE('owns').from('owner').count()"
+	created, err := queryCount(gq, map[string]interface{}{"owner": uuid, "listId": list.ID, "name": name})
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if created == 0 {
+		http.Error(w, "user is not in the graph yet", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list)
+}
+
+// Renames a list of the signed in user to the "name" field of the body.
+func renameList(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getVerifiedUUID(w, r)
+	if err != nil {
+		return
+	}
+	name, ok := readListName(w, r)
+	if !ok {
+		return
+	}
+	// Properties can hold several values in the graph database, so the old name is replaced
+	// rather than added to.
+	bindings := map[string]interface{}{"owner": uuid, "listId": mux.Vars(r)["listID"], "name": name}
+	renamed, err := queryCount(ownedList+".property(single, 'name', name).count()", bindings)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if renamed == 0 {
+		http.Error(w, "no such list", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Deletes a list of the signed in user. Posts shared with the list aren't shown to anyone but
+// their author anymore.
+func deleteList(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getVerifiedUUID(w, r)
+	if err != nil {
+		return
+	}
+	bindings := map[string]interface{}{"owner": uuid, "listId": mux.Vars(r)["listID"]}
+	if !requireList(w, bindings) {
+		return
+	}
+	if _, err := makeNeptuneRequest(ownedList+".drop()", bindings); err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Adds the user in the path to a list of the signed in user. Only friends can be added, and
+// adding someone twice does nothing.
+func addListMember(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getVerifiedUUID(w, r)
+	if err != nil {
+		return
+	}
+	bindings := map[string]interface{}{"owner": uuid, "listId": mux.Vars(r)["listID"], "member": mux.Vars(r)["uuid"]}
+	if !requireList(w, bindings) {
+		return
+	}
+	gq := ownedList + ".as('list').V().has('uuid', owner).out('friends with').has('uuid', member)" +
+		".coalesce(inE('includes').where(outV().as('list')), addE('includes').from('list')).count()"
+	added, err := queryCount(gq, bindings)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	if added == 0 {
+		http.Error(w, "only friends can be added to lists", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Removes the user in the path from a list of the signed in user. Removing someone who isn't
+// in the list does nothing.
+func removeListMember(w http.ResponseWriter, r *http.Request) {
+	uuid, err := getVerifiedUUID(w, r)
+	if err != nil {
+		return
+	}
+	bindings := map[string]interface{}{"owner": uuid, "listId": mux.Vars(r)["listID"], "member": mux.Vars(r)["uuid"]}
+	if !requireList(w, bindings) {
+		return
+	}
+	if _, err := makeNeptuneRequest(ownedList+".outE('includes').where(inV().has('uuid', member)).drop()", bindings); err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readListName reads the name of a list from the body of the request. If it is missing or too
+// long, it writes an error to the response and returns false.
+func readListName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "error reading list", http.StatusBadRequest)
+		log.Print(err.Error())
+		return "", false
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxListNameLength {
+		http.Error(w, fmt.Sprintf("name must be between 1 and %d characters", maxListNameLength), http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// requireList checks that the list in bindings belongs to the owner in bindings. If it doesn't,
+// or the graph database can't tell, it writes an error to the response and returns false.
+func requireList(w http.ResponseWriter, bindings map[string]interface{}) bool {
+	lists, err := queryCount(ownedList+".count()", bindings)
+	if err != nil {
+		http.Error(w, "error querying the graph database", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return false
+	}
+	if lists == 0 {
+		http.Error(w, "no such list", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// listsOf returns the lists of a user, sorted by name, along with their members.
+func listsOf(uuid string) ([]friendList, error) {
+	gq := "g.V().has('uuid', owner).out('owns').hasLabel('list').order().by('name')" +
+		".project('id', 'name', 'members').by('listId').by('name').by(out('includes').values('uuid').fold())"
+	values, err := queryValues(gq, map[string]interface{}{"owner": uuid})
+	if err != nil {
+		return nil, err
+	}
+	lists := make([]friendList, 0, len(values))
+	for _, v := range values {
+		fields, err := graphMap(v)
+		if err != nil {
+			return nil, err
+		}
+		id, _ := fields["id"].(string)
+		name, _ := fields["name"].(string)
+		members, err := graphList(fields["members"])
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, friendList{ID: id, Name: name, Members: members})
+	}
+	return lists, nil
+}
+
+// graphMap returns the entries of a map answered by the graph database, which writes maps as
+// a list of keys each followed by its value.
+func graphMap(v interface{}) (map[string]interface{}, error) {
+	m, _ := v.(map[string]interface{})
+	entries, ok := m["@value"].([]interface{})
+	if !ok || m["@type"] != "g:Map" || len(entries)%2 != 0 {
+		return nil, fmt.Errorf("unexpected map from the graph database: %v", v)
+	}
+	res := make(map[string]interface{}, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		key, ok := entries[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected map key from the graph database: %v", entries[i])
+		}
+		res[key] = entries[i+1]
+	}
+	return res, nil
+}
+
+// graphList returns the items of a list answered by the graph database.
+func graphList(v interface{}) ([]interface{}, error) {
+	m, _ := v.(map[string]interface{})
+	items, ok := m["@value"].([]interface{})
+	if !ok || m["@type"] != "g:List" {
+		return nil, fmt.Errorf("unexpected list from the graph database: %v", v)
+	}
+	return items, nil
+}
+
+// randomHex returns n random bytes written in hexadecimal.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Makes sure users can only change their own lists, and that nothing is changed when the list
+// isn't theirs.
+func (s *FriendsSuite) TestListOwnership() {
+	s.graph.count = 0
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPatch, "/api/friends/lists/" + testListID, map[string]string{"name": "Family"}},
+		{http.MethodDelete, "/api/friends/lists/" + testListID, nil},
+		{http.MethodPut, "/api/friends/lists/" + testListID + "/members/" + testOther, nil},
+		{http.MethodDelete, "/api/friends/lists/" + testListID + "/members/" + testOther, nil},
+	} {
+		s.Run(req.method+" "+req.path, func() {
+			s.graph.reset()
+			rr := s.serve(req.method, req.path, testUser, req.body)
+			s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode, "changed a list of someone else")
+
+			requests := s.graph.requests()
+			s.Require().Len(requests, 1, "the list was changed before its owner was checked")
+			s.Assert().True(strings.HasPrefix(requests[0].Gremlin, ownedList), "the query doesn't look for a list of the user")
+			s.Assert().Equal(testUser, requests[0].Bindings["owner"], "the list wasn't looked for among the lists of the signed in user")
+			s.Assert().Equal(testListID, requests[0].Bindings["listId"])
+		})
+	}
+}
+
+// Makes sure only friends of the owner can be added to a list.
+func (s *FriendsSuite) TestListMembership() {
+	path := "/api/friends/lists/" + testListID + "/members/" + testOther
+	rr := s.serve(http.MethodPut, path, testUser, nil)
+	s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode, "could not add a friend: %s", rr.Body.String())
+	requests := s.graph.requests()
+	s.Require().Len(requests, 2)
+	s.Assert().Contains(requests[1].Gremlin, "out('friends with').has('uuid', member)", "the member isn't looked for among the friends of the owner")
+	s.Assert().Equal(testOther, requests[1].Bindings["member"])
+
+	// The query adds nothing when the user isn't a friend of the owner.
+	s.graph.answers = map[string][]interface{}{"addE('includes')": {graphCount(0)}}
+	rr = s.serve(http.MethodPut, path, testUser, nil)
+	s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "added someone who isn't a friend")
+}
+
+// Makes sure the lists are returned with their members.
+func (s *FriendsSuite) TestGetLists() {
+	s.graph.answers = map[string][]interface{}{"project(": {
+		map[string]interface{}{"@type": "g:Map", "@value": []interface{}{
+			"id", testListID,
+			"name", "Family",
+			"members", map[string]interface{}{"@type": "g:List", "@value": []interface{}{testOther}},
+		}},
+	}}
+	rr := s.serve(http.MethodGet, "/api/friends/lists", testUser, nil)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code")
+	var lists []friendList
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&lists))
+	s.Assert().Equal([]friendList{{ID: testListID, Name: "Family", Members: []interface{}{testOther}}}, lists)
+
+	s.graph.answers = map[string][]interface{}{"project(": {"not a map"}}
+	rr = s.serve(http.MethodGet, "/api/friends/lists", testUser, nil)
+	s.Assert().Equal(http.StatusInternalServerError, rr.Result().StatusCode, "an answer that isn't a list was accepted")
+}
+
+// Makes sure the internal endpoints tell posts which lists a user is in and who owns a list.
+func (s *FriendsSuite) TestInternalLists() {
+	s.graph.answers = map[string][]interface{}{
+		"in('includes')": {testListID, "fedcba9876543210fedcba9876543210"},
+		"in('owns')":     {testUser},
+	}
+	rr := s.serve(http.MethodGet, "/internal/users/"+testOther+"/lists", "", nil)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code")
+	var lists []string
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&lists))
+	s.Assert().Equal([]string{testListID, "fedcba9876543210fedcba9876543210"}, lists)
+
+	rr = s.serve(http.MethodGet, "/internal/lists/"+testListID, "", nil)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code")
+	s.Assert().JSONEq(`{"owner": "`+testUser+`"}`, rr.Body.String())
+
+	s.graph.answers = nil
+	rr = s.serve(http.MethodGet, "/internal/lists/"+testListID, "", nil)
+	s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode, "found the owner of a list that doesn't exist")
+}
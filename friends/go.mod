@@ -1,8 +1,9 @@
 module github.com/BearCloud/fa20-project-dev/backend/friends
 
-go 1.15
+go 1.16
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.8.0
+	github.com/stretchr/testify v1.7.0
 )
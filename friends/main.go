@@ -1,27 +1,88 @@
 package main
 
 import (
+	"context"
 	"log"
-	_ "log"
 	"net/http"
-	_ "net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/BearCloud/fa20-project-dev/backend/friends/api"
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish once we are asked to stop.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	if url := os.Getenv("NEPTUNE_URL"); url != "" {
+		api.NeptuneURL = url
+	}
+	api.RequireVerifiedEmail = os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
 
 	// Create a new mux for routing api calls
 	router := mux.NewRouter()
 	router.Use(CORS)
-	
+
+	health := api.NewHealth()
+	health.AddCheck("graph", api.PingGraph)
+	health.RegisterRoutes(router)
+
 	err := api.RegisterRoutes(router)
 	if err != nil {
 		log.Fatal("Error registering API endpoints")
 	}
+	// auth-service removes deleted accounts from the graph through the internal endpoints.
+	api.RegisterInternalRoutes(router, os.Getenv("INTERNAL_API_KEY"))
+
+	serve(&http.Server{Addr: ":80", Handler: router}, health)
+}
+
+// serve runs the server until it receives SIGINT or SIGTERM, then stops accepting new
+// connections and waits for in-flight requests to finish.
+func serve(srv *http.Server, health *api.Health) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Print("starting friends service")
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err.Error())
+	case <-ctx.Done():
+	}
+
+	log.Print("shutting down, draining in-flight requests")
+	health.Drain()
+	// Keep answering while the load balancers notice that /readyz fails and stop sending
+	// requests here.
+	time.Sleep(drainDelay())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown failed: %s", err)
+	}
+}
 
-	http.ListenAndServe(":80", router)
+// drainDelay is how long the server waits between failing /readyz and shutting down. It is
+// 5 seconds unless DRAIN_DELAY, a duration like "10s", says otherwise.
+func drainDelay() time.Duration {
+	v := os.Getenv("DRAIN_DELAY")
+	if v == "" {
+		return 5 * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid DRAIN_DELAY %q, using 5s", v)
+		return 5 * time.Second
+	}
+	return d
 }
 
 func CORS(next http.Handler) http.Handler {
@@ -30,7 +91,7 @@ func CORS(next http.Handler) http.Handler {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 		w.Header().Set("Access-Control-Allow-Origin", "<YOUR EC2 IP HERE>:3000")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
@@ -42,4 +103,4 @@ func CORS(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 		return
 	})
-}
\ No newline at end of file
+}
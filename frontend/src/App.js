@@ -18,6 +18,7 @@ function App() {
         <Route exact path='/signin' component={Signin}></Route>
         <Route exact path='/logout' component={LogOut}></Route>
         <Route path='/profile/:uuid?' component={Profile}></Route>
+        <Route exact path='/u/:username' component={Profile}></Route>
       </Switch>
     </Layout>
   );
@@ -1,5 +1,6 @@
 import React from 'react';
 import PostFeed from './PostFeed';
+import Onboarding from './Onboarding';
 
 function Home(props) {
   return (
@@ -7,6 +8,7 @@ function Home(props) {
       <h2>Welcome to BearChat!</h2>
       <small>Your secure home for your social media presence.</small>
       <hr />
+      <Onboarding />
       <PostFeed />
     </>
   );
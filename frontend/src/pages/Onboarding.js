@@ -0,0 +1,57 @@
+import React, { useState }  from 'react';
+import { Card, ListGroup } from 'react-bootstrap';
+import { request, getUUID, HOST } from '../common/utils.js';
+
+// What each onboarding step asks of the user, and where they can do it.
+const STEPS = {
+  verifyEmail: { text: "Verify your email", href: null },
+  setName: { text: "Add your name to your profile", href: "/profile" },
+  uploadAvatar: { text: "Upload an avatar", href: "/profile" },
+  addFriend: { text: "Add your first friend", href: null },
+  makePost: { text: "Write your first post", href: null },
+};
+
+// Shows new users what they have left to set up, until they are done. It renders nothing once
+// onboarding is complete, or if the status can't be fetched.
+function Onboarding(props) {
+  const uuid = getUUID();
+
+  const [status, setStatus] = useState(null);
+
+  if (status === null && uuid) {
+    request('GET', `http://${HOST}:82/api/profile/${uuid}/onboarding`, {})
+      .then((res) => {
+        setStatus(JSON.parse(res.responseText));
+      })
+      .catch(() => {
+        setStatus(false);
+        console.error("Could not retrieve onboarding status!");
+      })
+    ;
+  }
+
+  if (!status || status.complete) {
+    return null;
+  }
+
+  return (
+    <Card style={{ width: '35rem' }} className="mb-3">
+      <Card.Body>
+        <Card.Title>Get started</Card.Title>
+        <ListGroup variant="flush">
+          {status.steps.map((step) => {
+            const { text, href } = STEPS[step.name] ?? { text: step.name, href: null };
+            const mark = step.done ? "✓" : (step.unknown ? "?" : "○");
+            return (
+              <ListGroup.Item key={step.name}>
+                {mark} {href && !step.done ? <a href={href}>{text}</a> : text}
+              </ListGroup.Item>
+            );
+          })}
+        </ListGroup>
+      </Card.Body>
+    </Card>
+  );
+}
+
+export default Onboarding;
@@ -6,9 +6,11 @@ import swal from 'sweetalert';
 function PostFeed(props) {
 
   const [posts, setPosts] = useState(null);
+  // Whether the feed only shows the posts of the people we follow.
+  const [following, setFollowing] = useState(false);
 
   if (posts === null) {
-    request('GET', `http://${HOST}:81/api/posts/0`, {})
+    request('GET', `http://${HOST}:81/api/posts/0${following ? '?following=true' : ''}`, {})
         .then((res) => {
           // console.log(res.responseText);
           setPosts(JSON.parse(res.responseText));
@@ -20,10 +22,25 @@ function PostFeed(props) {
   }
 
   const [content, setContent] = useState('');
+  // The friend list the post is shared with, or '' for everyone.
+  const [audience, setAudience] = useState('');
+  const [lists, setLists] = useState(null);
+
+  if (lists === null) {
+    request('GET', `http://${HOST}:83/api/friends/lists`, {})
+        .then((res) => {
+          setLists(JSON.parse(res.responseText));
+        })
+        .catch(() => {
+          setLists([]);
+          console.error("Could not retrieve lists!");
+        })
+    ;
+  }
 
   const send = (e) => {
     e.preventDefault();
-    request('POST', `http://${HOST}:81/api/posts/create`, {}, JSON.stringify({ content }))
+    request('POST', `http://${HOST}:81/api/posts/create`, {}, JSON.stringify(audience ? { content, audience } : { content }))
       .then((res) => {
         console.log(res.status);
         swal({
@@ -105,6 +122,14 @@ function PostFeed(props) {
             onChange={(e) => setContent(e.target.value)}
           />
         </Form.Group>
+        {lists && lists.length > 0 && (
+          <Form.Group controlId="formAudience">
+            <Form.Control as="select" value={audience} onChange={(e) => setAudience(e.target.value)}>
+              <option value="">Everyone</option>
+              {lists.map((list) => <option value={list.id} key={list.id}>{list.name}</option>)}
+            </Form.Control>
+          </Form.Group>
+        )}
         <Button variant="primary" type="submit">
           Post!
         </Button>
@@ -112,6 +137,13 @@ function PostFeed(props) {
 
       <hr />
       <h3>Your Feed</h3>
+      <Form.Check
+        type="switch"
+        id="feedFollowing"
+        label="Only people I follow"
+        checked={following}
+        onChange={(e) => { setFollowing(e.target.checked); setPosts(null); }}
+      />
       { postsHtml }
 
       <hr />
@@ -7,7 +7,8 @@ import { useParams } from "react-router-dom";
 
 function Profile(props) {
 
-  let { uuid } = useParams();
+  // Profiles are found by UUID at /profile/:uuid, or by username at /u/:username.
+  let { uuid, username } = useParams();
 
   const ourUUID = getUUID();
 
@@ -17,7 +18,10 @@ function Profile(props) {
   const [profile, setProfile] = useState(null);
 
   if (profile === null) {
-    request('GET', `http://${HOST}:82/api/profile/${ourUUID}`, {})
+    const profileURL = username
+      ? `http://${HOST}:82/api/profile/by-username/${encodeURIComponent(username)}`
+      : `http://${HOST}:82/api/profile/${uuid || ourUUID}`;
+    request('GET', profileURL, {})
         .then((res) => {
           // console.log(res.responseText);
           setProfile(JSON.parse(res.responseText));
@@ -31,16 +35,18 @@ function Profile(props) {
   const send = (e) => {
     e.preventDefault();
 
-    const content = {
-      "firstName": e.target[0].value,
-      "lastName": e.target[1].value,
-      "uuid": ourUUID,
-      "email": e.target[2].value
-    };
+    // Only the fields that were filled in are sent, so the others keep their value.
+    const content = {};
+    ["firstName", "lastName", "email", "pronouns", "location", "bio"].forEach((name) => {
+      const value = e.target.elements[name].value;
+      if (value) {
+        content[name] = value;
+      }
+    });
 
     console.log("Profile formContent:", content);
 
-    request('PUT', `http://${HOST}:82/api/profile/${ourUUID}`, {}, JSON.stringify(content))
+    request('PATCH', `http://${HOST}:82/api/profile/${ourUUID}`, {}, JSON.stringify(content))
       .then((res) => {
         console.log(res.status);
         swal({
@@ -63,15 +69,20 @@ function Profile(props) {
       });
   };
 
-  const thisIsUs = !uuid || ourUUID === uuid; // if we are looking at ourselves or not
+  if (username) {
+    uuid = profile?.uuid;
+  }
+  const thisIsUs = username ? uuid === ourUUID : (!uuid || ourUUID === uuid); // if we are looking at ourselves or not
 
   var profileHtml = [];
   if (profile) {
     profileHtml = (
       <Card style={{ width: '35rem' }}>
         <Card.Body>
-          <Card.Title>{profile.firstName} {profile.lastName}</Card.Title>
-          <Card.Subtitle className="mb-2 text-muted">User ID {profile.uuid}</Card.Subtitle>
+          {profile.avatarUrl && <img src={`http://${HOST}:82${profile.avatarUrl}`} alt="" width="100" height="100" className="mb-2" />}
+          <Card.Title>{profile.firstName} {profile.lastName} {profile.pronouns && <small className="text-muted">({profile.pronouns})</small>}</Card.Title>
+          <Card.Subtitle className="mb-2 text-muted">User ID {profile.uuid}{profile.location && ` · ${profile.location}`}</Card.Subtitle>
+          {profile.bio && <Card.Text>{profile.bio}</Card.Text>}
           <Card.Text>Email {profile.firstName} at <a href={`mailto:${profile.email}`}>{profile.email}</a>.</Card.Text>
         </Card.Body>
       </Card>
@@ -149,6 +160,47 @@ function Profile(props) {
     }
   }
 
+  // Anyone can be followed without approving it, unlike friends.
+  const [followers, setFollowers] = useState(null);
+
+  if (!thisIsUs && uuid && followers === null) {
+    request('GET', `http://${HOST}:83/api/friends/${uuid}/followers`, {})
+        .then((res) => {
+          setFollowers(JSON.parse(res.responseText));
+        })
+        .catch(() => {
+          setFollowers(false);
+          console.error("Could not retrieve followers!");
+        })
+    ;
+  }
+
+  const changeFollow = (method) => (e) => {
+    e.preventDefault();
+    request(method, `http://${HOST}:83/api/friends/${uuid}/follow`, {}, "")
+      .then(() => {
+        setFollowers(null);
+      })
+      .catch((res) => {
+        swal({
+          title: "Could not change follow!",
+          text: `Error (HTTP ${res.status}): ${res?.responseText?.trim()}.`,
+          icon: "error"
+        });
+      });
+  };
+
+  var followersHtml = "Loading...";
+  if (followers === false) {
+    followersHtml = "Error retrieving followers.";
+  } else if (followers) {
+    followersHtml = (<>
+      <p>{followers.count} {followers.count === 1 ? "follower" : "followers"}</p>
+      <Button onClick={changeFollow('POST')} variant="primary" className="mr-2">Follow</Button>
+      <Button onClick={changeFollow('DELETE')} variant="outline-secondary">Unfollow</Button>
+    </>);
+  }
+
   return (
     <>
       {thisIsUs ? (<>
@@ -170,6 +222,15 @@ function Profile(props) {
                 type="email"
               />
             </InputGroup>
+
+            <InputGroup className="mb-3">
+              <FormControl name="pronouns" placeholder={profile?.pronouns || "Pronouns"} />
+              <FormControl name="location" placeholder={profile?.location || "Location"} />
+            </InputGroup>
+
+            <InputGroup className="mb-3">
+              <FormControl as="textarea" name="bio" placeholder={profile?.bio || "Bio"} />
+            </InputGroup>
           </Form.Group>
           <Button variant="primary" type="submit">
             Update!
@@ -188,6 +249,11 @@ function Profile(props) {
 
         <h3>Friends</h3>
         { friendsHtml }
+
+        <hr />
+
+        <h3>Followers</h3>
+        { followersHtml }
       </>)}
     </>
   );
@@ -1,4 +1,4 @@
-import React, { useState }  from 'react';
+import React, { useEffect, useState }  from 'react';
 import { Button, Form } from 'react-bootstrap';
 import { request, HOST } from '../common/utils.js';
 import swal from 'sweetalert';
@@ -8,39 +8,80 @@ function Signin(props) {
   const [username, setUsername] = useState('');
   const [password, setPassword] = useState('' );
 
+  const [providers, setProviders] = useState([]);
+
+  // Accounts with two-factor authentication need a code before they get a session.
+  const verifyTwoFactor = (challenge) => swal({
+    title: "Two-factor authentication",
+    text: "Enter the code from your authenticator app, or one of your recovery codes.",
+    content: "input",
+    button: "Verify"
+  }).then((code) => {
+    code = (code || '').trim();
+    const isTOTP = /^[0-9]{6}$/.test(code);
+    return request('POST', `http://${HOST}:80/api/auth/2fa/verify`, {}, JSON.stringify({
+      challenge,
+      code: isTOTP ? code : '',
+      recoveryCode: isTOTP ? '' : code
+    }));
+  });
+
+  const signedIn = () => {
+    swal({
+      title: "Signed in!",
+      text: "You've successfully logged in!",
+      icon: "success",
+      timeout: 5000
+    }).then(() => {
+      window.location.href = '/';
+    });
+  };
+
+  const failed = (res) => {
+    console.log("err: ", res);
+    swal({
+      title: "Could not sign in!",
+      text: `Error when attempting to sign in (HTTP ${res.status}): ${res?.responseText?.trim()}.`,
+      icon: "error"
+    });
+  };
+
+  useEffect(() => {
+    request('GET', `http://${HOST}:80/api/auth/oidc`, {}, null)
+      .then((res) => setProviders(JSON.parse(res.responseText).providers || []))
+      .catch(() => setProviders([]));
+    // Signing in with a provider sends users with two-factor authentication back here. Their
+    // challenge is in a cookie, which the server reads when none is sent.
+    if (new URLSearchParams(window.location.search).get('twoFactor')) {
+      verifyTwoFactor().then(signedIn).catch(failed);
+    }
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, []);
+
   const send = (e) => {
     e.preventDefault();
     request('POST', `http://${HOST}:80/api/auth/signin`, {}, JSON.stringify({ username, password }))
       .then((res) => {
         console.log(res.status);
-        swal({
-          title: "Signed in!",
-          text: "You've successfully logged in!",
-          icon: "success",
-          timeout: 5000
-        }).then(() => {
-          window.location.href = '/';
-        });
+        const body = res.responseText ? JSON.parse(res.responseText) : {};
+        if (body.twoFactorRequired) {
+          return verifyTwoFactor(body.challenge);
+        }
+        return res;
       })
-      .catch((res) => {
-        console.log("err: ", res);
-        swal({
-          title: "Could not sign in!",
-          text: `Error when attempting to sign in (HTTP ${res.status}): ${res?.responseText?.trim()}.`,
-          icon: "error"
-        });
-      });
+      .then(signedIn)
+      .catch(failed);
   }
 
   return (
     <>
       <Form onSubmit={ send }>
         <Form.Group controlId="formUsername">
-          <Form.Label>Username</Form.Label>
+          <Form.Label>Username or email</Form.Label>
           <Form.Control
             type="text"
             name="username"
-            placeholder="Username"
+            placeholder="Username or email"
             onChange={(e) => setUsername(e.target.value)}
           />
         </Form.Group>
@@ -56,6 +97,11 @@ function Signin(props) {
         <Button variant="primary" type="submit">
           Sign In
         </Button>
+        {providers.map((name) => (
+          <Button key={name} variant="secondary" className="ml-2" href={`http://${HOST}:80/api/auth/oidc/${name}/login`}>
+            Sign in with {name}
+          </Button>
+        ))}
       </Form>
     </>
   );
@@ -3,195 +3,220 @@ package api
 // As usual, remove the underscore if you'd like to use the package.
 // You may use any packages you'd like.
 import (
-	"database/sql"
 	"encoding/json"
-	_ "encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
-	_ "strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
-func RegisterRoutes(router *mux.Router, db *sql.DB) {
+const (
+	// postsPerPage is how many posts getPosts and getFeed return at once.
+	postsPerPage = 25
+	// maxPostLength is the size of the content column of the posts table.
+	maxPostLength = 255
+)
+
+// RegisterRoutes adds the endpoints of posts. Privileged actions, like moderators deleting the
+// posts of others, are recorded in audit. follows says whose posts a user follows, and lists
+// who may see the posts shared with a friend list.
+func RegisterRoutes(router *mux.Router, posts PostStore, audit AuditLog, follows FollowGraph, lists ListGraph) {
 	// Spicy regex on the path names to help with integers :^).
-	router.HandleFunc("/api/posts/{startIndex:[0-9]+}", getFeed(db)).Methods(http.MethodGet /*YOUR CODE HERE*/)
-	router.HandleFunc("/api/posts/{uuid}/{startIndex:[0-9]+}", getPosts(db)).Methods(http.MethodGet /*YOUR CODE HERE*/)
-	router.HandleFunc("/api/posts/create", createPost(db)).Methods(http.MethodPost /*YOUR CODE HERE*/)
-	router.HandleFunc("/api/posts/delete/{postID}", deletePost(db)).Methods(http.MethodDelete, http.MethodPost /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/posts/{startIndex:[0-9]+}", getFeed(posts, follows, lists)).Methods(http.MethodGet /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/posts/{uuid}/{startIndex:[0-9]+}", getPosts(posts)).Methods(http.MethodGet /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/posts/create", createPost(posts, lists)).Methods(http.MethodPost /*YOUR CODE HERE*/)
+	router.HandleFunc("/api/posts/delete/{postID}", deletePost(posts, audit)).Methods(http.MethodDelete, http.MethodPost /*YOUR CODE HERE*/)
 }
 
 // Returns the earliest 25 posts made by the user with ID uuid starting from startIndex.
-func getPosts(db *sql.DB) http.HandlerFunc {
+func getPosts(posts PostStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// YOUR CODE HERE
-		var posts []Post
 		ind, err := strconv.Atoi(mux.Vars(r)["startIndex"])
-		id, err := getUUID(w, r)
-
 		if err != nil {
-			log.Print(err.Error())
+			http.Error(w, "invalid start index", http.StatusBadRequest)
 			return
 		}
 
-		rows, err := db.Query("SELECT * FROM posts WHERE authorID = ? ORDER BY postTime ASC", id)
-		i := 0
+		id, err := getUUID(w, r)
 		if err != nil {
-			http.Error(w, "error querying database", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
 
-		for rows.Next() {
-			if i < ind {
-				i += 1
-				continue
-			}
-			if i > ind+25 {
-				break
-			}
-			var p Post
-			if err := rows.Scan(&p.PostBody, &p.PostID, &p.AuthorID, &p.PostTime); err != nil {
-				http.Error(w, "error reading from database", http.StatusInternalServerError)
-				log.Print(err.Error())
-				return
-			}
-			posts = append(posts, p)
-			i += 1
+		// Users can only page through their own posts.
+		if mux.Vars(r)["uuid"] != id {
+			http.Error(w, "not allowed to view these posts", http.StatusUnauthorized)
+			return
 		}
 
-		err = rows.Close()
-		e := rows.Err()
-		if err != nil || e != nil {
-			http.Error(w, "error reading from database", http.StatusInternalServerError)
-			log.Print(e.Error())
+		result, err := posts.PostsByAuthor(r.Context(), id, ind, postsPerPage)
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
 			return
 		}
 
-		json.NewEncoder(w).Encode(posts)
+		json.NewEncoder(w).Encode(result)
 	}
 }
 
 // Given a JSON containing a field called `postBody` that contains a message (make sure to error check!),
 // adds the post to the database with the UUID of the author (which can be found using getUUID),
-// a unique ID, and the timestamp of the post.
-func createPost(db *sql.DB) http.HandlerFunc {
+// a unique ID, and the timestamp of the post. An `audience` field shares the post with one of
+// the friend lists of the author only, which lists is asked about.
+func createPost(posts PostStore, lists ListGraph) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// YOUR CODE HERE
-		var cont string
-		err := json.NewDecoder(r.Body).Decode(&cont)
-
+		id, err := getVerifiedUUID(w, r)
 		if err != nil {
-			http.Error(w, "error reading postBody", http.StatusBadRequest)
 			log.Print(err.Error())
 			return
 		}
 
-		id, err := getUUID(w, r)
-
+		var p Post
+		err = json.NewDecoder(r.Body).Decode(&p)
 		if err != nil {
+			http.Error(w, "error reading postBody", http.StatusBadRequest)
 			log.Print(err.Error())
 			return
 		}
+		if len(p.PostBody) == 0 || len(p.PostBody) > maxPostLength {
+			http.Error(w, "postBody must be between 1 and 255 characters", http.StatusBadRequest)
+			return
+		}
 
-		result, err := db.Exec("INSERT INTO posts VALUES (?,?,?,?)", cont, uuid.NewString(), id, time.Now())
+		if p.Audience != "" {
+			owner, err := lists.ListOwner(r.Context(), p.Audience)
+			if errors.Is(err, ErrListNotFound) || (err == nil && owner != id) {
+				http.Error(w, "audience must be one of your lists", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, "error looking up audience", http.StatusBadGateway)
+				log.Print(err.Error())
+				return
+			}
+		}
 
+		// Only the body and audience come from the client; everything else is decided here.
+		p = Post{
+			PostBody: p.PostBody,
+			PostID:   uuid.NewString(),
+			AuthorID: id,
+			PostTime: time.Now(),
+			Audience: p.Audience,
+		}
+		err = posts.CreatePost(r.Context(), p)
 		if err != nil {
 			http.Error(w, "error inserting post into database", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
 
-		rows, _ := result.RowsAffected()
-
-		if rows == 0 {
-			http.Error(w, "error inserting post into database", http.StatusInternalServerError)
-			return
-		}
+		w.WriteHeader(http.StatusCreated)
 	}
 }
 
 // Given the ID of a post, removes the post from the database if the person requesting
 // is the author of the post.
-func deletePost(db *sql.DB) http.HandlerFunc {
+func deletePost(posts PostStore, audit AuditLog) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// YOUR CODE HERE
-		id, err := getUUID(w, r)
+		claims, err := getVerifiedClaims(w, r)
 		if err != nil {
 			log.Print(err.Error())
 			return
 		}
+		id := claims["UserID"].(string)
 
-		postId := mux.Vars(r)["postID"]
-
-		result, err := db.Exec("DELETE FROM posts WHERE postID = ? AND authorID = ?", postId, id)
+		postID := mux.Vars(r)["postID"]
 
+		// Check if the given post exists and that the person deleting it is its author or a
+		// moderator.
+		p, err := posts.Post(r.Context(), postID)
+		if errors.Is(err, ErrPostNotFound) {
+			http.Error(w, "no post was deleted", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			http.Error(w, "error deleting post from database", http.StatusInternalServerError)
+			http.Error(w, "error querying database", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
+		if p.AuthorID != id {
+			if !HasRole(claimRoles(claims), RoleModerator) {
+				http.Error(w, "only the author of a post can delete it", http.StatusUnauthorized)
+				return
+			}
+			err := audit.Record(r.Context(), AuditEntry{ActorID: id, Action: "post.delete", TargetID: postID, Details: "author " + p.AuthorID})
+			if err != nil {
+				http.Error(w, "error writing the audit log", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
 
-		rows, _ := result.RowsAffected()
-
-		if rows == 0 {
-			http.Error(w, "no post was deleted", http.StatusBadRequest)
+		err = posts.DeletePost(r.Context(), postID)
+		if errors.Is(err, ErrPostNotFound) {
+			http.Error(w, "no post was deleted", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error deleting post from database", http.StatusInternalServerError)
+			log.Print(err.Error())
 			return
 		}
-
 	}
 }
 
-// Similar to getPosts except it gets the posts of everyone else *except* the author.
-func getFeed(db *sql.DB) http.HandlerFunc {
+// Similar to getPosts except it gets the posts of everyone else *except* the author. With
+// the "following" query parameter set to true, it only gets the posts of the users the author
+// follows, which follows asks the friends service about. Posts shared with a friend list are
+// only shown to its members, which lists is asked about on every request, so that removing
+// someone from a list hides the posts right away.
+func getFeed(posts PostStore, follows FollowGraph, lists ListGraph) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// YOUR CODE HERE
-		var posts []Post
 		ind, err := strconv.Atoi(mux.Vars(r)["startIndex"])
-		id, err := getUUID(w, r)
+		if err != nil {
+			http.Error(w, "invalid start index", http.StatusBadRequest)
+			return
+		}
 
+		id, err := getUUID(w, r)
 		if err != nil {
 			log.Print(err.Error())
 			return
 		}
 
-		rows, err := db.Query("SELECT * FROM posts WHERE authorID <> ? ORDER BY postTime ASC", id)
-		i := 0
+		// Without the lists the user is in, the feed would silently miss the posts shared with
+		// them, so it fails instead.
+		memberships, err := lists.ListsContaining(r.Context(), id)
 		if err != nil {
-			http.Error(w, "error querying database", http.StatusInternalServerError)
+			http.Error(w, "error fetching lists", http.StatusBadGateway)
 			log.Print(err.Error())
 			return
 		}
 
-		for rows.Next() {
-			if i < ind {
-				i += 1
-				continue
-			}
-			if i > ind+25 {
-				break
-			}
-			var p Post
-			if err := rows.Scan(&p.PostBody, &p.PostID, &p.AuthorID, &p.PostTime); err != nil {
-				http.Error(w, "error reading from database", http.StatusInternalServerError)
+		var result []Post
+		if r.URL.Query().Get("following") == "true" {
+			following, err := follows.Following(r.Context(), id)
+			if err != nil {
+				http.Error(w, "error fetching followed users", http.StatusBadGateway)
 				log.Print(err.Error())
 				return
 			}
-			posts = append(posts, p)
-			i += 1
+			result, err = posts.PostsByAuthors(r.Context(), following, memberships, ind, postsPerPage)
+		} else {
+			result, err = posts.Feed(r.Context(), id, memberships, ind, postsPerPage)
 		}
-
-		err = rows.Close()
-		e := rows.Err()
-		if err != nil || e != nil {
-			http.Error(w, "error reading from database", http.StatusInternalServerError)
-			log.Print(e.Error())
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
 			return
 		}
 
-		json.NewEncoder(w).Encode(posts)
+		json.NewEncoder(w).Encode(result)
 	}
 }
@@ -2,14 +2,18 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"strings"
+	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
@@ -31,24 +35,42 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// Runs the suite made by newSuite against each of the PostStore implementations.
+func runWithEachStore(t *testing.T, newSuite func(PostsSuite) suite.TestingSuite) {
+	t.Run("Memory", func(t *testing.T) {
+		suite.Run(t, newSuite(PostsSuite{backend: memoryBackend{}}))
+	})
+	t.Run("SQLite", func(t *testing.T) {
+		suite.Run(t, newSuite(PostsSuite{backend: &sqliteBackend{dir: t.TempDir()}}))
+	})
+	t.Run("MySQL", func(t *testing.T) {
+		suite.Run(t, newSuite(PostsSuite{backend: &mysqlBackend{}}))
+	})
+}
+
 // Runs all of the tests for the getPosts() function.
 func TestGetPosts(t *testing.T) {
-	suite.Run(t, new(GetPostsSuite))
+	runWithEachStore(t, func(s PostsSuite) suite.TestingSuite { return &GetPostsSuite{s} })
 }
 
 // Runs all of the tests for the createPost() function.
 func TestCreatePost(t *testing.T) {
-	suite.Run(t, new(CreatePostSuite))
+	runWithEachStore(t, func(s PostsSuite) suite.TestingSuite { return &CreatePostSuite{s} })
 }
 
 // Runs all of the tests for the getFeed() function.
 func TestGetFeed(t *testing.T) {
-	suite.Run(t, new(GetFeedSuite))
+	runWithEachStore(t, func(s PostsSuite) suite.TestingSuite { return &GetFeedSuite{s} })
 }
 
 // Runs all of the tests for the deletePost() function.
 func TestDeletePost(t *testing.T) {
-	suite.Run(t, new(DeletePostSuite))
+	runWithEachStore(t, func(s PostsSuite) suite.TestingSuite { return &DeletePostSuite{s} })
+}
+
+// Runs all of the tests for the internal endpoints.
+func TestInternal(t *testing.T) {
+	runWithEachStore(t, func(s PostsSuite) suite.TestingSuite { return &InternalSuite{s} })
 }
 
 // Tests that getPosts gives back the latest 25 posts in the database if there are
@@ -63,7 +85,7 @@ func (s *GetPostsSuite) TestBasic() {
 	r = mux.SetURLVars(r, map[string]string{"uuid": "0", "startIndex": "0"})
 
 	// Call the function.
-	getPosts(s.db)(rr, r)
+	getPosts(s.posts)(rr, r)
 
 	// Check the status code.
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
@@ -84,7 +106,7 @@ func (s *GetPostsSuite) TestUnauthorized() {
 		rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/posts/0/0", nil)
 		r = mux.SetURLVars(r, map[string]string{"uuid": "0", "startIndex": "0"})
 
-		getPosts(s.db)(rr, r)
+		getPosts(s.posts)(rr, r)
 
 		// When the cookie is missing, the server should return a Status Bad Request.
 		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code")
@@ -100,7 +122,7 @@ func (s *GetPostsSuite) TestUnauthorized() {
 		cookie.Value = cookie.Value[:len(cookie.Value)-4] + "000"
 		r.AddCookie(cookie)
 
-		getPosts(s.db)(rr, r)
+		getPosts(s.posts)(rr, r)
 
 		// When the cookie is invalid, we should get a Status Unauthorized.
 		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code")
@@ -112,7 +134,7 @@ func (s *GetPostsSuite) TestUnauthorized() {
 		r = mux.SetURLVars(r, map[string]string{"uuid": "0", "startIndex": "0"})
 		r.AddCookie(s.generateFakeAccessToken("1"))
 
-		getPosts(s.db)(rr, r)
+		getPosts(s.posts)(rr, r)
 
 		// When the cookie is for the wrong person, we should get a Status Unauthorized.
 		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code")
@@ -129,7 +151,7 @@ func (s *GetPostsSuite) TestLessThan25Posts() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 	r = mux.SetURLVars(r, map[string]string{"uuid": "0", "startIndex": "0"})
 
-	getPosts(s.db)(rr, r)
+	getPosts(s.posts)(rr, r)
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
 
 	// Make sure we got all 10 posts in the correct order.
@@ -155,7 +177,7 @@ func (s *GetPostsSuite) TestOnlyFromAuthor() {
 	r = mux.SetURLVars(r, map[string]string{"uuid": "10", "startIndex": "0"})
 
 	// Call the function.
-	getPosts(s.db)(rr, r)
+	getPosts(s.posts)(rr, r)
 
 	// Check the status code.
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
@@ -178,7 +200,7 @@ func (s *GetPostsSuite) TestOffset() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 	r = mux.SetURLVars(r, map[string]string{"uuid": "0", "startIndex": "10"})
 
-	getPosts(s.db)(rr, r)
+	getPosts(s.posts)(rr, r)
 
 	// Make sure we got 20 of the posts back.
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
@@ -197,9 +219,10 @@ func (s *CreatePostSuite) TestBasic() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 
 	// Call the function to create the post in the database.
-	createPost(s.db)(rr, r)
+	createPost(s.posts, s.lists)(rr, r)
 
 	s.Require().Equal(http.StatusCreated, rr.Result().StatusCode, "incorrect status code returned")
+	s.Assert().Empty(rr.Body.String(), "the response has a body")
 
 	// Make sure the post is in the database.
 	postToInsert.AuthorID = "0"
@@ -213,7 +236,7 @@ func (s *CreatePostSuite) TestUnauthorized() {
 	s.Run("No Cookie", func() {
 		postToInsert := s.randomPost()
 		rr, r := s.generateRequestAndResponse(http.MethodPost, "/api/posts/create", bytes.NewBuffer(s.postJSON(postToInsert)))
-		createPost(s.db)(rr, r)
+		createPost(s.posts, s.lists)(rr, r)
 		// No cookie should result in a StatusBadRequest.
 		s.Require().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
 		// Make sure the post is NOT in the database.
@@ -225,11 +248,73 @@ func (s *CreatePostSuite) TestUnauthorized() {
 	s.Run("Bad JSON", func() {
 		rr, r := s.generateRequestAndResponse(http.MethodPost, "/api/posts/create", bytes.NewBuffer([]byte(`{oops:a bad json`)))
 		r.AddCookie(s.generateFakeAccessToken("0"))
-		createPost(s.db)(rr, r)
+		createPost(s.posts, s.lists)(rr, r)
 		s.Require().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
 	})
 }
 
+// Makes sure posts can only be shared with the lists of their author.
+func (s *CreatePostSuite) TestAudience() {
+	s.lists.owners = map[string]string{"family": "0", "theirs": "1"}
+	for name, audience := range map[string]string{"Own List": "family", "List of Another": "theirs", "No Such List": "missing"} {
+		s.Run(name, func() {
+			p := s.randomPost()
+			p.Audience = audience
+			rr, r := s.generateRequestAndResponse(http.MethodPost, "/api/posts/create", bytes.NewBuffer(s.postJSON(p)))
+			r.AddCookie(s.generateFakeAccessToken("0"))
+			createPost(s.posts, s.lists)(rr, r)
+
+			p.AuthorID = "0"
+			if audience != "family" {
+				s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
+				s.Assert().False(s.verifyPostExists(p), "post was shared with a list that isn't the author's")
+				return
+			}
+			s.Require().Equal(http.StatusCreated, rr.Result().StatusCode, "incorrect status code returned")
+			stored, err := s.posts.PostsByAuthor(context.Background(), "0", 0, math.MaxInt32)
+			s.Require().NoError(err)
+			s.Require().Len(stored, 1, "post was not inserted")
+			s.Assert().Equal(audience, stored[0].Audience, "the audience wasn't kept")
+		})
+	}
+
+	s.Run("Friends Unavailable", func() {
+		s.lists.err = errors.New("friends is down")
+		p := s.randomPost()
+		p.Audience = "family"
+		rr, r := s.generateRequestAndResponse(http.MethodPost, "/api/posts/create", bytes.NewBuffer(s.postJSON(p)))
+		r.AddCookie(s.generateFakeAccessToken("0"))
+		createPost(s.posts, s.lists)(rr, r)
+		s.Assert().Equal(http.StatusBadGateway, rr.Result().StatusCode, "incorrect status code returned")
+	})
+}
+
+// Makes sure createPost() only lets verified users post when RequireVerifiedEmail is set.
+func (s *CreatePostSuite) TestRequireVerifiedEmail() {
+	RequireVerifiedEmail = true
+	defer func() { RequireVerifiedEmail = false }()
+
+	s.Run("Unverified", func() {
+		postToInsert := s.randomPost()
+		rr, r := s.generateRequestAndResponse(http.MethodPost, "/api/posts/create", bytes.NewBuffer(s.postJSON(postToInsert)))
+		r.AddCookie(s.generateFakeAccessTokenVerified("0", false))
+		createPost(s.posts, s.lists)(rr, r)
+		s.Require().Equal(http.StatusForbidden, rr.Result().StatusCode, "incorrect status code returned")
+		postToInsert.AuthorID = "0"
+		s.Require().False(s.verifyPostExists(postToInsert), "post was inserted")
+	})
+
+	s.Run("Verified", func() {
+		postToInsert := s.randomPost()
+		rr, r := s.generateRequestAndResponse(http.MethodPost, "/api/posts/create", bytes.NewBuffer(s.postJSON(postToInsert)))
+		r.AddCookie(s.generateFakeAccessTokenVerified("0", true))
+		createPost(s.posts, s.lists)(rr, r)
+		s.Require().Equal(http.StatusCreated, rr.Result().StatusCode, "incorrect status code returned")
+		postToInsert.AuthorID = "0"
+		s.Require().True(s.verifyPostExists(postToInsert), "post was not inserted")
+	})
+}
+
 // Makes sure that a basic SQL injection attack against createPost() fails.
 // If you are failing this test make sure you are using ? in your SQL
 // queries instead of directly inserting string values into queries!
@@ -248,7 +333,7 @@ func (s *CreatePostSuite) TestSQLInjection() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 
 	// Call the function to create the post in the database.
-	createPost(s.db)(rr, r)
+	createPost(s.posts, s.lists)(rr, r)
 
 	// Notice that this should NOT error. The post should be put in like normal even with the SQL.
 	s.Require().Equal(http.StatusCreated, rr.Result().StatusCode, "incorrect status code returned")
@@ -269,7 +354,7 @@ func (s *DeletePostSuite) TestBasic() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 
 	// Delete the post.
-	deletePost(s.db)(rr, r)
+	deletePost(s.posts, s.audit)(rr, r)
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
 
 	// Make sure the post was indeed deleted.
@@ -284,7 +369,7 @@ func (s *DeletePostSuite) TestNoPost() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 
 	// Delete the post.
-	deletePost(s.db)(rr, r)
+	deletePost(s.posts, s.audit)(rr, r)
 	s.Require().Equal(http.StatusNotFound, rr.Result().StatusCode, "incorrect status code returned")
 }
 
@@ -295,7 +380,7 @@ func (s *DeletePostSuite) TestUnauthorized() {
 		// Generate the request without putting a cookie in it.
 		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/api/posts/delete/"+postToDelete.PostID, nil)
 		r = mux.SetURLVars(r, map[string]string{"postID": postToDelete.PostID})
-		deletePost(s.db)(rr, r)
+		deletePost(s.posts, s.audit)(rr, r)
 
 		// No cookie means BadRequest.
 		s.Require().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code")
@@ -311,7 +396,7 @@ func (s *DeletePostSuite) TestUnauthorized() {
 		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/api/posts/delete/"+postToDelete.PostID, nil)
 		r = mux.SetURLVars(r, map[string]string{"postID": postToDelete.PostID})
 		r.AddCookie(s.generateFakeAccessToken("1"))
-		deletePost(s.db)(rr, r)
+		deletePost(s.posts, s.audit)(rr, r)
 
 		// Wrong author means they are Unauthorized
 		s.Require().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code")
@@ -321,6 +406,144 @@ func (s *DeletePostSuite) TestUnauthorized() {
 	})
 }
 
+// Makes sure moderators can delete the posts of others, and that doing so is audit-logged.
+func (s *DeletePostSuite) TestModerator() {
+	s.Run("Deletes Any Post", func() {
+		postToDelete := s.insertFakePosts(1, "0", true)[0]
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/api/posts/delete/"+postToDelete.PostID, nil)
+		r = mux.SetURLVars(r, map[string]string{"postID": postToDelete.PostID})
+		r.AddCookie(s.generateFakeAccessTokenWithRoles("1", RoleModerator))
+		deletePost(s.posts, s.audit)(rr, r)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+		s.Require().False(s.verifyPostExists(postToDelete), "post was not deleted")
+
+		s.Require().Len(s.audit.entries, 1, "the deletion was not audit-logged")
+		s.Assert().Equal(AuditEntry{ActorID: "1", Action: "post.delete", TargetID: postToDelete.PostID, Details: "author 0"}, s.audit.entries[0])
+	})
+
+	s.Run("Admins Too", func() {
+		postToDelete := s.insertFakePosts(1, "0", true)[0]
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/api/posts/delete/"+postToDelete.PostID, nil)
+		r = mux.SetURLVars(r, map[string]string{"postID": postToDelete.PostID})
+		r.AddCookie(s.generateFakeAccessTokenWithRoles("2", RoleAdmin))
+		deletePost(s.posts, s.audit)(rr, r)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	})
+
+	s.Run("Not Without Audit Log", func() {
+		postToDelete := s.insertFakePosts(1, "0", true)[0]
+		s.audit.err = errors.New("auth-service is down")
+		defer func() { s.audit.err = nil }()
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/api/posts/delete/"+postToDelete.PostID, nil)
+		r = mux.SetURLVars(r, map[string]string{"postID": postToDelete.PostID})
+		r.AddCookie(s.generateFakeAccessTokenWithRoles("1", RoleModerator))
+		deletePost(s.posts, s.audit)(rr, r)
+		s.Require().Equal(http.StatusInternalServerError, rr.Result().StatusCode, "incorrect status code returned")
+		s.Require().True(s.verifyPostExists(postToDelete), "post was deleted without a trace")
+	})
+
+	s.Run("Authors Are Not Logged", func() {
+		s.audit.entries = nil
+		postToDelete := s.insertFakePosts(1, "0", true)[0]
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/api/posts/delete/"+postToDelete.PostID, nil)
+		r = mux.SetURLVars(r, map[string]string{"postID": postToDelete.PostID})
+		r.AddCookie(s.generateFakeAccessTokenWithRoles("0", RoleModerator))
+		deletePost(s.posts, s.audit)(rr, r)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+		s.Assert().Empty(s.audit.entries, "deleting their own post was audit-logged")
+	})
+}
+
+// Makes sure deleting a user removes all of their posts and only theirs, and can be repeated.
+func (s *InternalSuite) TestDeleteUser() {
+	router := mux.NewRouter()
+	RegisterInternalRoutes(router, "internalKey", s.posts)
+	s.insertFakePosts(3, "0", true)
+	kept := s.insertFakePosts(2, "1", true)
+
+	for i := 0; i < 2; i++ {
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/internal/users/0", nil)
+		r.Header.Set("X-Internal-Token", "internalKey")
+		router.ServeHTTP(rr, r)
+		s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode, "incorrect status code returned")
+	}
+
+	posts, err := s.posts.PostsByAuthor(context.Background(), "0", 0, math.MaxInt32)
+	s.Require().NoError(err)
+	s.Assert().Empty(posts, "posts of the deleted user are left")
+	for _, p := range kept {
+		s.Assert().True(s.verifyPostExists(p), "posts of another user were deleted")
+	}
+}
+
+// Makes sure exporting a user returns all of their posts and only theirs.
+func (s *InternalSuite) TestExportUser() {
+	router := mux.NewRouter()
+	RegisterInternalRoutes(router, "internalKey", s.posts)
+	expected := s.insertFakePosts(30, "0", true)
+	s.insertFakePosts(2, "1", true)
+
+	rr, r := s.generateRequestAndResponse(http.MethodGet, "/internal/users/0/export", nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	var returnedPosts []Post
+	s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&returnedPosts), "could not decode response body")
+	s.verifyPosts(expected, returnedPosts)
+
+	// A user without posts gets an empty list rather than null.
+	rr, r = s.generateRequestAndResponse(http.MethodGet, "/internal/users/2/export", nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	s.Assert().Equal("[]\n", rr.Body.String())
+}
+
+// Makes sure the first post of a user is returned, and that users without posts have none.
+func (s *InternalSuite) TestFirstPost() {
+	router := mux.NewRouter()
+	RegisterInternalRoutes(router, "internalKey", s.posts)
+	expected := s.insertFakePosts(3, "0", true)
+	s.insertFakePosts(1, "1", true)
+
+	rr, r := s.generateRequestAndResponse(http.MethodGet, "/internal/users/0/first-post", nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	var first Post
+	s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&first), "could not decode response body")
+	s.verifyPosts(expected[:1], []Post{first})
+
+	rr, r = s.generateRequestAndResponse(http.MethodGet, "/internal/users/2/first-post", nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	router.ServeHTTP(rr, r)
+	s.Assert().Equal(http.StatusNotFound, rr.Result().StatusCode, "a user without posts has a first post")
+}
+
+// Makes sure the internal endpoints can't be called without the internal key.
+func (s *InternalSuite) TestUnauthorized() {
+	p := s.insertFakePosts(1, "0", true)[0]
+	for name, key := range map[string]string{"No Key": "", "Wrong Key": "wrong"} {
+		s.Run(name, func() {
+			router := mux.NewRouter()
+			RegisterInternalRoutes(router, "internalKey", s.posts)
+			rr, r := s.generateRequestAndResponse(http.MethodDelete, "/internal/users/0", nil)
+			r.Header.Set("X-Internal-Token", key)
+			router.ServeHTTP(rr, r)
+			s.Require().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code")
+		})
+	}
+
+	s.Run("Turned Off", func() {
+		router := mux.NewRouter()
+		RegisterInternalRoutes(router, "", s.posts)
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/internal/users/0", nil)
+		router.ServeHTTP(rr, r)
+		s.Require().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code")
+	})
+	s.Require().True(s.verifyPostExists(p), "post was deleted")
+}
+
 // Makes sure that getFeed() works when there are 25 posts from other users.
 func (s *GetFeedSuite) TestBasic() {
 	// Insert 25 posts from user 1 into the database.
@@ -332,7 +555,7 @@ func (s *GetFeedSuite) TestBasic() {
 	r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
 
 	// Call the function.
-	getFeed(s.db)(rr, r)
+	getFeed(s.posts, s.follows, s.lists)(rr, r)
 
 	// Check the status code.
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
@@ -355,7 +578,7 @@ func (s *GetFeedSuite) TestLessThan25Posts() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 	r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
 
-	getFeed(s.db)(rr, r)
+	getFeed(s.posts, s.follows, s.lists)(rr, r)
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
 
 	// Make sure we got exactly 10 posts back.
@@ -376,7 +599,7 @@ func (s *GetFeedSuite) TestMixed() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 	r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
 
-	getFeed(s.db)(rr, r)
+	getFeed(s.posts, s.follows, s.lists)(rr, r)
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
 
 	// Make sure we only got the post from user id 1 back.
@@ -391,7 +614,7 @@ func (s *GetFeedSuite) TestUnauthorized() {
 	rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/posts/0", nil)
 	r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
 
-	getFeed(s.db)(rr, r)
+	getFeed(s.posts, s.follows, s.lists)(rr, r)
 
 	// When the cookie is missing, the server should return a Status Bad Request.
 	s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code")
@@ -407,7 +630,7 @@ func (s *GetFeedSuite) TestOffset() {
 	r.AddCookie(s.generateFakeAccessToken("0"))
 	r = mux.SetURLVars(r, map[string]string{"startIndex": "50"})
 
-	getFeed(s.db)(rr, r)
+	getFeed(s.posts, s.follows, s.lists)(rr, r)
 	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
 
 	// Make sure we got exactly 25 posts back.
@@ -416,14 +639,265 @@ func (s *GetFeedSuite) TestOffset() {
 	s.verifyPosts(expectedPosts[50:75], returnedPosts)
 }
 
+// Makes sure the feed of followed users only holds their posts, and that following nobody
+// leaves it empty.
+func (s *GetFeedSuite) TestFollowing() {
+	s.insertFakePosts(5, "1", true)
+	followed := s.insertFakePosts(3, "2", true)
+	followed = append(followed, s.insertFakePosts(2, "3", false)...)
+	sort.SliceStable(followed, func(i, j int) bool { return followed[i].PostTime.Before(followed[j].PostTime) })
+	s.follows.following = map[string][]string{"0": {"2", "3"}}
+
+	rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/posts/0?following=true", nil)
+	r.AddCookie(s.generateFakeAccessToken("0"))
+	r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
+	getFeed(s.posts, s.follows, s.lists)(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	var returnedPosts []Post
+	s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&returnedPosts), "could not decode response body")
+	s.verifyPosts(followed, returnedPosts)
+
+	rr, r = s.generateRequestAndResponse(http.MethodGet, "/api/posts/0?following=true", nil)
+	r.AddCookie(s.generateFakeAccessToken("4"))
+	r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
+	getFeed(s.posts, s.follows, s.lists)(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	returnedPosts = nil
+	s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&returnedPosts), "could not decode response body")
+	s.Assert().Empty(returnedPosts, "a user following nobody got posts")
+
+	s.Run("Friends Unavailable", func() {
+		s.follows.err = errors.New("friends is down")
+		rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/posts/0?following=true", nil)
+		r.AddCookie(s.generateFakeAccessToken("0"))
+		r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
+		getFeed(s.posts, s.follows, s.lists)(rr, r)
+		s.Assert().Equal(http.StatusBadGateway, rr.Result().StatusCode, "incorrect status code")
+	})
+}
+
+// Makes sure posts shared with a list are only in the feeds of its members, and that everyone
+// still gets the posts shared with everyone when the friends service is down.
+func (s *GetFeedSuite) TestAudience() {
+	public := s.insertFakePosts(2, "1", true)
+	shared := s.randomPost()
+	shared.AuthorID, shared.PostID, shared.PostTime, shared.Audience = "1", gofakeit.UUID(), time.Now().AddDate(0, 0, 5), "family"
+	s.Require().NoError(s.posts.CreatePost(context.Background(), shared))
+	s.lists.memberships = map[string][]string{"0": {"family", "other"}}
+	s.follows.following = map[string][]string{"0": {"1"}, "2": {"1"}}
+
+	feed := func(uuid, query string) []Post {
+		rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/posts/0"+query, nil)
+		r.AddCookie(s.generateFakeAccessToken(uuid))
+		r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
+		getFeed(s.posts, s.follows, s.lists)(rr, r)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+		var returnedPosts []Post
+		s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&returnedPosts), "could not decode response body")
+		return returnedPosts
+	}
+	for _, query := range []string{"", "?following=true"} {
+		s.verifyPosts(append(public, shared), feed("0", query))
+		s.verifyPosts(public, feed("2", query))
+	}
+
+	s.lists.err = errors.New("friends is down")
+	for _, query := range []string{"", "?following=true"} {
+		rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/posts/0"+query, nil)
+		r.AddCookie(s.generateFakeAccessToken("0"))
+		r = mux.SetURLVars(r, map[string]string{"startIndex": "0"})
+		getFeed(s.posts, s.follows, s.lists)(rr, r)
+		s.Assert().Equal(http.StatusBadGateway, rr.Result().StatusCode, "the feed left out the shared posts without saying so")
+	}
+}
+
+// Makes sure RemoteFollowGraph asks the internal endpoint of the friends service.
+func (s *GetFeedSuite) TestRemoteFollowGraph() {
+	friends := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Internal-Token") != "internalKey" || r.URL.Path != "/internal/users/0/following" {
+			http.Error(w, "wrong request", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]string{"2", "3"})
+	}))
+	defer friends.Close()
+
+	following, err := RemoteFollowGraph(friends.URL+"/", "internalKey").Following(context.Background(), "0")
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"2", "3"}, following)
+	_, err = RemoteFollowGraph(friends.URL, "wrong").Following(context.Background(), "0")
+	s.Assert().Error(err, "an error from the friends service was ignored")
+}
+
+// Makes sure RemoteListGraph asks the internal endpoints of the friends service.
+func (s *GetFeedSuite) TestRemoteListGraph() {
+	friends := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Internal-Token") != "internalKey":
+			http.Error(w, "internal token required", http.StatusUnauthorized)
+		case r.URL.Path == "/internal/users/0/lists":
+			json.NewEncoder(w).Encode([]string{"family"})
+		case r.URL.Path == "/internal/lists/family":
+			json.NewEncoder(w).Encode(map[string]string{"owner": "1"})
+		default:
+			http.Error(w, "no such list", http.StatusNotFound)
+		}
+	}))
+	defer friends.Close()
+
+	lists := RemoteListGraph(friends.URL, "internalKey")
+	memberships, err := lists.ListsContaining(context.Background(), "0")
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"family"}, memberships)
+	owner, err := lists.ListOwner(context.Background(), "family")
+	s.Require().NoError(err)
+	s.Assert().Equal("1", owner)
+	_, err = lists.ListOwner(context.Background(), "missing")
+	s.Assert().ErrorIs(err, ErrListNotFound)
+	_, err = RemoteListGraph(friends.URL, "wrong").ListsContaining(context.Background(), "0")
+	s.Assert().Error(err, "an error from the friends service was ignored")
+}
+
 // HELPER METHODS AND DEFINITIONS
 
 // Defines the suite of tests for the entire Posts service.
 type PostsSuite struct {
 	suite.Suite
+	backend storeBackend
+	posts   PostStore
+	audit   *fakeAuditLog
+	follows *fakeFollowGraph
+	lists   *fakeListGraph
+}
+
+// fakeAuditLog keeps the entries recorded by the handlers, or fails to record them when err is
+// set.
+type fakeAuditLog struct {
+	entries []AuditEntry
+	err     error
+}
+
+func (l *fakeAuditLog) Record(ctx context.Context, e AuditEntry) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+// fakeFollowGraph says each user follows the users in following, or fails when err is set.
+type fakeFollowGraph struct {
+	following map[string][]string
+	err       error
+}
+
+func (g *fakeFollowGraph) Following(ctx context.Context, uuid string) ([]string, error) {
+	return g.following[uuid], g.err
+}
+
+// fakeListGraph says each user is in the lists in memberships, and each list belongs to the
+// user in owners, or fails when err is set.
+type fakeListGraph struct {
+	memberships map[string][]string
+	owners      map[string]string
+	err         error
+}
+
+func (g *fakeListGraph) ListsContaining(ctx context.Context, uuid string) ([]string, error) {
+	return g.memberships[uuid], g.err
+}
+
+func (g *fakeListGraph) ListOwner(ctx context.Context, listID string) (string, error) {
+	if g.err != nil {
+		return "", g.err
+	}
+	owner, ok := g.owners[listID]
+	if !ok {
+		return "", ErrListNotFound
+	}
+	return owner, nil
+}
+
+// A storeBackend hands out the PostStore a suite runs against.
+type storeBackend interface {
+	// open returns an empty store, or an error if the backend isn't available.
+	open() (PostStore, error)
+}
+
+// Runs the tests against a fresh MemoryPostStore every time.
+type memoryBackend struct{}
+
+func (memoryBackend) open() (PostStore, error) {
+	return NewMemoryPostStore(), nil
+}
+
+// Runs the tests against the MySQL Docker Container. This needs the database to be running.
+type mysqlBackend struct {
 	db *sql.DB
 }
 
+func (b *mysqlBackend) open() (PostStore, error) {
+	if b.db == nil {
+		// Notice that we use localhost instead of the container's IP address since it is
+		// assumed these tests run outside of the container network. If you weren't being lazy
+		// like us, you'd probably put this string into a .env file so it's secret
+		// and it's easy to change out if you change the database.
+		db, err := sql.Open("mysql", "root:root@tcp(localhost:3306)/postsDB?parseTime=true&loc=US%2FPacific")
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Ping(); err != nil {
+			return nil, err
+		}
+		if err := migrateForTest(db, MySQL); err != nil {
+			return nil, err
+		}
+		b.db = db
+	}
+
+	// Clears the posts table so the tests remain independent.
+	if _, err := b.db.Exec("TRUNCATE TABLE posts"); err != nil {
+		return nil, err
+	}
+	return NewSQLPostStore(b.db, MySQL), nil
+}
+
+// Runs the tests against a SQLite database in a temporary directory, so unlike MySQL it
+// needs nothing running.
+type sqliteBackend struct {
+	dir string
+	db  *sql.DB
+}
+
+func (b *sqliteBackend) open() (PostStore, error) {
+	if b.db == nil {
+		db, err := sql.Open("sqlite3", "file:"+filepath.Join(b.dir, "posts.db")+"?_busy_timeout=5000")
+		if err != nil {
+			return nil, err
+		}
+		if err := migrateForTest(db, SQLite); err != nil {
+			return nil, err
+		}
+		b.db = db
+	}
+
+	// SQLite has no TRUNCATE.
+	if _, err := b.db.Exec("DELETE FROM posts"); err != nil {
+		return nil, err
+	}
+	return NewSQLPostStore(b.db, SQLite), nil
+}
+
+// Brings the schema of a test database up to date.
+func migrateForTest(db *sql.DB, dialect Dialect) error {
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(context.Background())
+	return err
+}
+
 // Defines a suite of tests for getPosts().
 type GetPostsSuite struct {
 	PostsSuite
@@ -444,10 +918,9 @@ type DeletePostSuite struct {
 	PostsSuite
 }
 
-// Clears the posts database so the tests remain independent.
-func (s *PostsSuite) clearDatabase() (err error) {
-	_, err = s.db.Exec("TRUNCATE TABLE posts")
-	return err
+// Defines a suite of tests for the internal endpoints.
+type InternalSuite struct {
+	PostsSuite
 }
 
 // Returns a byte array with a JSON containing the passed in Post. Useful for making basic requests.
@@ -464,43 +937,33 @@ func (s *PostsSuite) randomPost() Post {
 }
 
 // Verifies that a post with the same body and AuthorID as the one passed in exists in the
-// database. It also makes sure the post doesn't have a NULL postID and time.
+// database. It also makes sure the post doesn't have an empty postID and time.
 // If the test fails or the post couldn't be found, this returns false.
 // Otherwise it returns true.
 func (s *PostsSuite) verifyPostExists(p Post) bool {
-	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT * FROM posts WHERE content=? AND authorID=? AND postID IS NOT NULL AND postTime IS NOT NULL)", p.PostBody, p.AuthorID).Scan(&exists)
-	if s.Assert().NoError(err, "error checking database for the post") {
-		return exists
+	posts, err := s.posts.PostsByAuthor(context.Background(), p.AuthorID, 0, math.MaxInt32)
+	if !s.Assert().NoError(err, "error checking database for the post") {
+		return false
+	}
+	for _, stored := range posts {
+		if stored.PostBody == p.PostBody && stored.PostID != "" && !stored.PostTime.IsZero() {
+			return true
+		}
 	}
 	return false
 }
 
-// Setup the db variable before any tests are run.
-func (s *PostsSuite) SetupSuite() {
-	// Connects to the MySQL Docker Container. Notice that we use localhost
-	// instead of the container's IP address since it is assumed these
-	// tests run outside of the container network. If you weren't being lazy
-	// like us, you'd probably put this string into a .env file so it's secret
-	// and it's easy to change out if you change the database.
-	db, err := sql.Open("mysql", "root:root@tcp(localhost:3306)/postsDB?parseTime=true&loc=US%2FPacific")
-	s.Require().NoError(err, "could not connect to the database!")
-	s.db = db
-}
-
-// Makes sure the database starts in a clean state before each test.
+// Makes sure the store starts in a clean state before each test.
 func (s *PostsSuite) SetupTest() {
-	err := s.db.Ping()
+	posts, err := s.backend.open()
 	if err != nil {
-		s.T().Logf("could not connect to database. skipping test. %s", err)
-		s.T().SkipNow()
-	}
-
-	err = s.clearDatabase()
-	if err != nil {
-		s.T().Logf("could not clear database. skipping test. %s", err)
+		s.T().Logf("could not set up the store. skipping test. %s", err)
 		s.T().SkipNow()
 	}
+	s.posts = posts
+	s.audit = &fakeAuditLog{}
+	s.follows = &fakeFollowGraph{}
+	s.lists = &fakeListGraph{}
 
 	// Seeds the random post generator so we can get consistent tests.
 	gofakeit.Seed(1)
@@ -525,12 +988,6 @@ func (s *PostsSuite) insertFakePosts(num int, authorID string, ascending bool) [
 	if num <= 0 {
 		return returnSlice
 	}
-	// Spicy query line. Just duplicates (?, ?, ?, ?) a bunch of times after the
-	// word VALUES so we can insert everything at once. See below why we do this.
-	query := "INSERT INTO posts VALUES " + strings.Repeat("(?, ?, ?, ?), ", num)
-	// Trims the last comma and space off the end.
-	query = query[:len(query)-2]
-	var queryParams []interface{}
 	for i := 0; i < num; i += 1 {
 		// Generate a random body for the post.
 		returnSlice[i] = s.randomPost()
@@ -552,17 +1009,11 @@ func (s *PostsSuite) insertFakePosts(num int, authorID string, ascending bool) [
 		// Also pick some non-conflicting IDs for the postIDs.
 		returnSlice[i].PostID = gofakeit.UUID()
 
-		// Now save the values from this Post so we can put them into a query.
-		queryParams = append(queryParams, returnSlice[i].PostBody, returnSlice[i].PostID, returnSlice[i].AuthorID, returnSlice[i].PostTime)
+		// Now insert the Post into the store.
+		err := s.posts.CreatePost(context.Background(), returnSlice[i])
+		s.Require().NoError(err, "failed to insert into the database")
 	}
 
-	// Now insert into the database. Notice that we do this after creating all the
-	// Posts instead of during the loop. This is an optimization since, if we did
-	// it during the loop, we would make NUM queries to the database and that takes longer
-	// than making one single query. This is often called an n+1 queries problem.
-	_, err := s.db.Exec(query, queryParams...)
-	s.Require().NoError(err, "failed to insert into the database")
-
 	// Return the posts.
 	return returnSlice
 }
@@ -574,8 +1025,24 @@ func (s *PostsSuite) insertFakePosts(num int, authorID string, ascending bool) [
 // Make sure to keep your cryptographic keys private at all times!!! We do this since it
 // is easy to test. We will likely not do it this way later on.
 func (s *PostsSuite) generateFakeAccessToken(uuid string) *http.Cookie {
+	return s.generateFakeAccessTokenVerified(uuid, false)
+}
+
+// Like generateFakeAccessToken, but also sets whether the user verified their email.
+func (s *PostsSuite) generateFakeAccessTokenVerified(uuid string, emailVerified bool) *http.Cookie {
+	return s.generateFakeAccessTokenClaims(uuid, emailVerified, nil)
+}
+
+// Like generateFakeAccessToken, but for a user holding the given roles.
+func (s *PostsSuite) generateFakeAccessTokenWithRoles(uuid string, roles ...string) *http.Cookie {
+	return s.generateFakeAccessTokenClaims(uuid, false, roles)
+}
+
+func (s *PostsSuite) generateFakeAccessTokenClaims(uuid string, emailVerified bool, roles []string) *http.Cookie {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, AuthClaims{
-		UserID: uuid,
+		UserID:        uuid,
+		EmailVerified: emailVerified,
+		Roles:         roles,
 		StandardClaims: jwt.StandardClaims{
 			Subject:   "access",
 			ExpiresAt: time.Now().AddDate(0, 0, 1).Unix(),
@@ -1,30 +1,103 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"os"
 	"time"
 
-	//MySQL driver
+	// MySQL driver
 	_ "github.com/go-sql-driver/mysql"
+	// SQLite driver
+	_ "github.com/mattn/go-sqlite3"
 )
 
-func InitDB() *sql.DB {
-	log.Println("attempting connections")
-	var err error
-	// We've decided to give the connection string for the rest of the microservices
-	DB, err := sql.Open("mysql", "root:root@tcp(172.28.1.2:3306)/postsDB?parseTime=true&loc=US%2FPacific")
+// A Dialect is the flavor of SQL spoken by the database behind the service. Its value is
+// the name of the database/sql driver for it.
+type Dialect string
 
+const (
+	// MySQL is the database running in the db-server container.
+	MySQL Dialect = "mysql"
+	// SQLite keeps the whole database in a single file, which is handy for running the
+	// service on its own or in CI.
+	SQLite Dialect = "sqlite3"
+)
+
+// Default DSNs for each Dialect. MySQL needs parseTime to scan postTime into a time.Time;
+// go-sqlite3 does that on its own for DATETIME columns.
+const (
+	defaultMySQLDSN  = "root:root@tcp(172.28.1.2:3306)/postsDB?parseTime=true&loc=US%2FPacific"
+	defaultSQLiteDSN = "file:posts.db?_busy_timeout=5000&_journal_mode=WAL"
+)
+
+var (
+	// DBConnectTimeout is how long InitDB keeps retrying before it gives up on the database.
+	DBConnectTimeout = 2 * time.Minute
+	// dbInitialBackoff and dbMaxBackoff bound the wait between two connection attempts.
+	dbInitialBackoff = 1 * time.Second
+	dbMaxBackoff     = 15 * time.Second
+)
+
+// InitDB creates the database connection. DB_DRIVER picks the Dialect ("mysql", the default,
+// or "sqlite3") and DB_DSN overrides the default data source name for it.
+func InitDB() (*sql.DB, Dialect, error) {
+	dialect := Dialect(os.Getenv("DB_DRIVER"))
+	dsn := os.Getenv("DB_DSN")
+	switch dialect {
+	case "", MySQL:
+		dialect = MySQL
+		if dsn == "" {
+			dsn = defaultMySQLDSN
+		}
+	case SQLite, "sqlite":
+		dialect = SQLite
+		if dsn == "" {
+			dsn = defaultSQLiteDSN
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown DB_DRIVER %q", dialect)
+	}
+
+	log.Printf("attempting connections to %s", dialect)
+	// Open a SQL connection to the database server
+	db, err := sql.Open(string(dialect), dsn)
 	if err != nil {
-		log.Print(err.Error())
-		panic(err)
+		return nil, "", err
 	}
 
-	// Repeatedly Ping the database until no error to ensure it is up.
-	for err = DB.Ping(); err != nil; err = DB.Ping() {
-		log.Println("couldnt connect, waiting 10 seconds before retrying")
-		time.Sleep(10 * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBConnectTimeout)
+	defer cancel()
+	if err := waitForDB(ctx, db); err != nil {
+		db.Close()
+		return nil, "", err
 	}
 
-	return DB
+	return db, dialect, nil
+}
+
+// waitForDB pings the database until it answers, backing off exponentially between
+// attempts. It returns the last ping error once ctx is done.
+func waitForDB(ctx context.Context, db *sql.DB) error {
+	backoff := dbInitialBackoff
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("couldnt connect, waiting %s before retrying: %s", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up on the database: %w", err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > dbMaxBackoff {
+			backoff = dbMaxBackoff
+		}
+	}
 }
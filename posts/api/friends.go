@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrListNotFound is returned by a ListGraph when no list has the requested ID.
+var ErrListNotFound = errors.New("list not found")
+
+// A FollowGraph tells posts who follows whom. Follows are kept by the friends service.
+type FollowGraph interface {
+	// Following returns the UUIDs of every user the user with the given UUID follows.
+	Following(ctx context.Context, uuid string) ([]string, error)
+}
+
+// A ListGraph tells posts about the lists users put their friends in, which posts can be
+// shared with. Lists are kept by the friends service.
+type ListGraph interface {
+	// ListsContaining returns the IDs of the lists the user with the given UUID is a member of.
+	ListsContaining(ctx context.Context, uuid string) ([]string, error)
+
+	// ListOwner returns the UUID of the owner of the list with the given ID, or
+	// ErrListNotFound.
+	ListOwner(ctx context.Context, listID string) (string, error)
+}
+
+// friendsClient makes the calls to the friends service.
+var friendsClient = &http.Client{Timeout: 10 * time.Second}
+
+// errFriendsNotFound is returned by getFriends when the friends service answers 404.
+var errFriendsNotFound = errors.New("not found by the friends service")
+
+// remoteFriends asks the friends service about follows and lists.
+type remoteFriends struct {
+	friendsURL  string
+	internalKey string
+}
+
+// RemoteFollowGraph returns the FollowGraph that asks the friends service at friendsURL,
+// through its internal endpoints, with internalKey.
+func RemoteFollowGraph(friendsURL, internalKey string) FollowGraph {
+	return remoteFriends{friendsURL: strings.TrimSuffix(friendsURL, "/"), internalKey: internalKey}
+}
+
+// RemoteListGraph returns the ListGraph that asks the friends service at friendsURL, through
+// its internal endpoints, with internalKey.
+func RemoteListGraph(friendsURL, internalKey string) ListGraph {
+	return remoteFriends{friendsURL: strings.TrimSuffix(friendsURL, "/"), internalKey: internalKey}
+}
+
+func (f remoteFriends) Following(ctx context.Context, uuid string) ([]string, error) {
+	var following []string
+	if err := f.get(ctx, "/internal/users/"+url.PathEscape(uuid)+"/following", &following); err != nil {
+		return nil, err
+	}
+	return following, nil
+}
+
+func (f remoteFriends) ListsContaining(ctx context.Context, uuid string) ([]string, error) {
+	var lists []string
+	if err := f.get(ctx, "/internal/users/"+url.PathEscape(uuid)+"/lists", &lists); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+func (f remoteFriends) ListOwner(ctx context.Context, listID string) (string, error) {
+	var list struct {
+		Owner string `json:"owner"`
+	}
+	err := f.get(ctx, "/internal/lists/"+url.PathEscape(listID), &list)
+	if errors.Is(err, errFriendsNotFound) {
+		return "", ErrListNotFound
+	}
+	return list.Owner, err
+}
+
+// get decodes the answer of the friends service to a GET of the internal endpoint at path
+// into v. It returns errFriendsNotFound if the friends service answers 404.
+func (f remoteFriends) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.friendsURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Internal-Token", f.internalKey)
+	resp, err := friendsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errFriendsNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("friends service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// RegisterInternalRoutes adds the endpoints the other services call. They are never reached
+// by browsers and only answer requests whose X-Internal-Token header is internalKey. They are
+// turned off if internalKey is empty.
+func RegisterInternalRoutes(router *mux.Router, internalKey string, posts PostStore) {
+	internal := router.PathPrefix("/internal").Subrouter()
+	internal.Use(requireInternalToken(internalKey))
+	internal.HandleFunc("/users/{uuid}", deleteUserPosts(posts)).Methods(http.MethodDelete)
+	internal.HandleFunc("/users/{uuid}/export", exportUserPosts(posts)).Methods(http.MethodGet)
+	internal.HandleFunc("/users/{uuid}/first-post", firstUserPost(posts)).Methods(http.MethodGet)
+}
+
+// requireInternalToken turns away every request that doesn't carry the internal key.
+func requireInternalToken(internalKey string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("X-Internal-Token")
+			if internalKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(internalKey)) != 1 {
+				http.Error(w, "internal token required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Removes every post of a user whose account was deleted. auth-service calls it until it
+// succeeds, so deleting a user without posts is not an error.
+func deleteUserPosts(posts PostStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := posts.DeletePostsByAuthor(r.Context(), mux.Vars(r)["uuid"]); err != nil {
+			http.Error(w, "error deleting posts from database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Returns every post of a user, oldest first, for the archive of their data.
+func exportUserPosts(posts PostStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := posts.PostsByAuthor(r.Context(), mux.Vars(r)["uuid"], 0, math.MaxInt32)
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if result == nil {
+			result = []Post{}
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// Returns the oldest post of a user, or 404 if they never posted. profiles uses it to tell
+// new users whether they made their first post yet.
+func firstUserPost(posts PostStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := posts.PostsByAuthor(r.Context(), mux.Vars(r)["uuid"], 0, 1)
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if len(result) == 0 {
+			http.Error(w, "no posts", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(result[0])
+	}
+}
@@ -15,9 +15,42 @@ type AuthClaims struct {
 	Email         string
 	EmailVerified bool
 	UserID        string
+	// Roles are the roles auth-service granted the user, like "moderator".
+	Roles []string `json:",omitempty"`
 	jwt.StandardClaims
 }
 
+// The roles auth-service grants that posts cares about.
+const (
+	// RoleAdmin holds every other role too.
+	RoleAdmin = "admin"
+	// RoleModerator can delete any post.
+	RoleModerator = "moderator"
+)
+
+// HasRole reports whether roles grant role. Admins hold every role.
+func HasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// claimRoles returns the roles in the claims of an access token. They are as of when the
+// token was issued, so a revoked role keeps working until the token expires.
+func claimRoles(claims jwt.MapClaims) []string {
+	list, _ := claims["Roles"].([]interface{})
+	var roles []string
+	for _, r := range list {
+		if role, ok := r.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
 func validateToken(tokenString string) (jwt.MapClaims, error) {
 
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
@@ -40,23 +73,59 @@ func validateToken(tokenString string) (jwt.MapClaims, error) {
 	return nil, errors.New("could not parse claims")
 }
 
+// RequireVerifiedEmail makes the endpoints that change data turn away users who haven't
+// verified their email yet. main turns it on when REQUIRE_VERIFIED_EMAIL is "true".
+var RequireVerifiedEmail = false
+
 // Given an HTTP request and ResponseWriter, takes the access_token cookie and makes sure it is valid. If it is valid
 // then this function will return the uuid and no error. Otherwise, it writes an error to the Response
 // and returns the error.
 var getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
 	// The weird syntax above for declaring the function above is so we can
 	// reassign getUUID to some other function when we test. Quite a neat hack :^).
+	claims, err := getClaims(w, r)
+	if err != nil {
+		return "", err
+	}
+	return claims["UserID"].(string), nil
+}
+
+// getVerifiedUUID is getUUID for the endpoints that change data. When RequireVerifiedEmail is
+// set, it also refuses users whose access token says they haven't verified their email.
+func getVerifiedUUID(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+	claims, err := getVerifiedClaims(w, r)
+	if err != nil {
+		return "", err
+	}
+	return claims["UserID"].(string), nil
+}
+
+// getVerifiedClaims is getClaims with the check of getVerifiedUUID.
+func getVerifiedClaims(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, error) {
+	claims, err := getClaims(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if verified, _ := claims["EmailVerified"].(bool); RequireVerifiedEmail && !verified {
+		http.Error(w, "verify your email first", http.StatusForbidden)
+		return nil, errors.New("email not verified")
+	}
+	return claims, nil
+}
+
+// getClaims returns the claims of the access_token cookie. If the cookie is missing or
+// invalid, it writes an error to the Response and returns the error.
+func getClaims(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, error) {
 	cookie, err := r.Cookie("access_token")
 	if err != nil {
 		http.Error(w, "error obtaining cookie: "+err.Error(), http.StatusBadRequest)
-		return "", err
+		return nil, err
 	}
 	// Validate the cookie
 	claims, err := validateToken(cookie.Value)
 	if err != nil {
 		http.Error(w, "error validating token: "+err.Error(), http.StatusUnauthorized)
-		return "", err
+		return nil, err
 	}
-
-	return claims["UserID"].(string), nil
+	return claims, nil
 }
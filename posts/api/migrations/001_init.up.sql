@@ -0,0 +1,8 @@
+-- The original schema that used to live in db-server/initdb.sql. IF NOT EXISTS lets databases
+-- created from that script adopt this migration as already applied.
+CREATE TABLE IF NOT EXISTS posts (
+    content VARCHAR(255),
+    postID VARCHAR(36) PRIMARY KEY,
+    authorID VARCHAR(36),
+    postTime DATETIME
+);
@@ -0,0 +1,3 @@
+-- Posts shared with a friend list, by the ID of the list in the friends service. Posts shared
+-- with everyone have none.
+ALTER TABLE posts ADD COLUMN audience VARCHAR(32) NOT NULL DEFAULT '';
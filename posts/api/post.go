@@ -7,4 +7,7 @@ type Post struct {
 	PostID   string    `json:"postID"`
 	AuthorID string    `json:"AuthorID"`
 	PostTime time.Time `json:"postTime"`
+	// Audience is the ID of the friend list the post is shared with. Posts without one are
+	// shared with everyone.
+	Audience string `json:"audience,omitempty"`
 }
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrPostNotFound is returned by a PostStore when no post has the requested ID.
+var ErrPostNotFound = errors.New("post not found")
+
+// A PostStore holds the posts of Bearchat. The handlers only ever talk to the database
+// through it, which lets the tests swap MySQL for an in-memory implementation.
+type PostStore interface {
+	// CreatePost adds a new post.
+	CreatePost(ctx context.Context, p Post) error
+
+	// Post returns the post with the given ID, or ErrPostNotFound.
+	Post(ctx context.Context, postID string) (Post, error)
+
+	// PostsByAuthor returns at most limit posts made by authorID sorted by post time in
+	// ascending order, skipping the first offset of them.
+	PostsByAuthor(ctx context.Context, authorID string, offset, limit int) ([]Post, error)
+
+	// Feed is like PostsByAuthor except it returns the posts of everyone *except* authorID.
+	// Posts shared with a list are left out unless the list is one of lists.
+	Feed(ctx context.Context, authorID string, lists []string, offset, limit int) ([]Post, error)
+
+	// PostsByAuthors is like Feed for the posts made by any of authorIDs.
+	PostsByAuthors(ctx context.Context, authorIDs, lists []string, offset, limit int) ([]Post, error)
+
+	// DeletePost removes the post with the given ID. It returns ErrPostNotFound if there
+	// was no such post.
+	DeletePost(ctx context.Context, postID string) error
+
+	// DeletePostsByAuthor removes every post made by authorID. It succeeds even if there
+	// were none, so it can be run again.
+	DeletePostsByAuthor(ctx context.Context, authorID string) error
+}
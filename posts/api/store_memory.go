@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryPostStore is a PostStore that keeps posts in memory. It is meant for tests and for
+// running the posts service without a database; everything is lost when the process exits.
+type MemoryPostStore struct {
+	mu    sync.RWMutex
+	posts []Post
+}
+
+// NewMemoryPostStore returns an empty MemoryPostStore.
+func NewMemoryPostStore() *MemoryPostStore {
+	return &MemoryPostStore{}
+}
+
+func (s *MemoryPostStore) CreatePost(ctx context.Context, p Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posts = append(s.posts, p)
+	// Keep the posts sorted by time so reads can page through them in order.
+	sort.SliceStable(s.posts, func(i, j int) bool { return s.posts[i].PostTime.Before(s.posts[j].PostTime) })
+	return nil
+}
+
+func (s *MemoryPostStore) Post(ctx context.Context, postID string) (Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.posts {
+		if p.PostID == postID {
+			return p, nil
+		}
+	}
+	return Post{}, ErrPostNotFound
+}
+
+func (s *MemoryPostStore) PostsByAuthor(ctx context.Context, authorID string, offset, limit int) ([]Post, error) {
+	return s.page(func(p Post) bool { return p.AuthorID == authorID }, offset, limit), nil
+}
+
+func (s *MemoryPostStore) Feed(ctx context.Context, authorID string, lists []string, offset, limit int) ([]Post, error) {
+	audiences := set(lists)
+	return s.page(func(p Post) bool { return p.AuthorID != authorID && (p.Audience == "" || audiences[p.Audience]) }, offset, limit), nil
+}
+
+func (s *MemoryPostStore) PostsByAuthors(ctx context.Context, authorIDs, lists []string, offset, limit int) ([]Post, error) {
+	authors, audiences := set(authorIDs), set(lists)
+	return s.page(func(p Post) bool { return authors[p.AuthorID] && (p.Audience == "" || audiences[p.Audience]) }, offset, limit), nil
+}
+
+func (s *MemoryPostStore) DeletePost(ctx context.Context, postID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.posts {
+		if p.PostID == postID {
+			s.posts = append(s.posts[:i], s.posts[i+1:]...)
+			return nil
+		}
+	}
+	return ErrPostNotFound
+}
+
+func (s *MemoryPostStore) DeletePostsByAuthor(ctx context.Context, authorID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.posts[:0]
+	for _, p := range s.posts {
+		if p.AuthorID != authorID {
+			kept = append(kept, p)
+		}
+	}
+	s.posts = kept
+	return nil
+}
+
+// page returns at most limit of the posts matching the predicate, skipping the first offset.
+func (s *MemoryPostStore) page(match func(Post) bool, offset, limit int) []Post {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var posts []Post
+	skipped := 0
+	for _, p := range s.posts {
+		if len(posts) == limit {
+			break
+		}
+		if !match(p) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		posts = append(posts, p)
+	}
+	return posts
+}
+
+// set returns a set holding every item of items.
+func set(items []string) map[string]bool {
+	res := make(map[string]bool, len(items))
+	for _, item := range items {
+		res[item] = true
+	}
+	return res
+}
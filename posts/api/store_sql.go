@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SQLPostStore is the PostStore backed by the posts table of the posts database, which can
+// either live in MySQL or in SQLite.
+type SQLPostStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLPostStore returns a PostStore that uses db, which speaks the given Dialect.
+func NewSQLPostStore(db *sql.DB, dialect Dialect) *SQLPostStore {
+	return &SQLPostStore{db: db, dialect: dialect}
+}
+
+const postColumns = "content, postID, authorID, postTime, audience"
+
+func (s *SQLPostStore) CreatePost(ctx context.Context, p Post) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO posts ("+postColumns+") VALUES (?,?,?,?,?)", p.PostBody, p.PostID, p.AuthorID, s.timeArg(p.PostTime), p.Audience)
+	return err
+}
+
+func (s *SQLPostStore) Post(ctx context.Context, postID string) (Post, error) {
+	var p Post
+	err := s.db.QueryRowContext(ctx, "SELECT "+postColumns+" FROM posts WHERE postID = ?", postID).
+		Scan(&p.PostBody, &p.PostID, &p.AuthorID, &p.PostTime, &p.Audience)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Post{}, ErrPostNotFound
+	}
+	return p, err
+}
+
+func (s *SQLPostStore) PostsByAuthor(ctx context.Context, authorID string, offset, limit int) ([]Post, error) {
+	return s.queryPosts(ctx, "SELECT "+postColumns+" FROM posts WHERE authorID = ? ORDER BY postTime ASC LIMIT ? OFFSET ?", authorID, limit, offset)
+}
+
+func (s *SQLPostStore) Feed(ctx context.Context, authorID string, lists []string, offset, limit int) ([]Post, error) {
+	audience, args := audienceCondition(lists)
+	args = append([]interface{}{authorID}, append(args, limit, offset)...)
+	return s.queryPosts(ctx, "SELECT "+postColumns+" FROM posts WHERE authorID <> ? AND "+audience+" ORDER BY postTime ASC LIMIT ? OFFSET ?", args...)
+}
+
+func (s *SQLPostStore) PostsByAuthors(ctx context.Context, authorIDs, lists []string, offset, limit int) ([]Post, error) {
+	if len(authorIDs) == 0 {
+		return nil, nil
+	}
+	audience, audienceArgs := audienceCondition(lists)
+	args := make([]interface{}, 0, len(authorIDs)+len(audienceArgs)+2)
+	for _, id := range authorIDs {
+		args = append(args, id)
+	}
+	args = append(append(args, audienceArgs...), limit, offset)
+	return s.queryPosts(ctx, "SELECT "+postColumns+" FROM posts WHERE authorID IN ("+placeholders(len(authorIDs))+") AND "+audience+" ORDER BY postTime ASC LIMIT ? OFFSET ?", args...)
+}
+
+func (s *SQLPostStore) DeletePost(ctx context.Context, postID string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM posts WHERE postID = ?", postID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrPostNotFound
+	}
+	return nil
+}
+
+func (s *SQLPostStore) DeletePostsByAuthor(ctx context.Context, authorID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM posts WHERE authorID = ?", authorID)
+	return err
+}
+
+// timeArg prepares t to be stored in a DATETIME column. SQLite keeps times as text and
+// compares them as strings, so they all go in as UTC for ORDER BY postTime to work.
+func (s *SQLPostStore) timeArg(t time.Time) time.Time {
+	if s.dialect == SQLite {
+		return t.UTC()
+	}
+	return t
+}
+
+// audienceCondition returns the condition matching the posts shared with everyone or with one
+// of lists, along with its arguments.
+func audienceCondition(lists []string) (string, []interface{}) {
+	if len(lists) == 0 {
+		return "audience = ''", nil
+	}
+	args := make([]interface{}, len(lists))
+	for i, id := range lists {
+		args[i] = id
+	}
+	return "(audience = '' OR audience IN (" + placeholders(len(lists)) + "))", args
+}
+
+// placeholders returns n comma-separated placeholders, for the values of an IN clause.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// queryPosts runs a query selecting postColumns and scans every row into a Post.
+func (s *SQLPostStore) queryPosts(ctx context.Context, query string, args ...interface{}) ([]Post, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.PostBody, &p.PostID, &p.AuthorID, &p.PostTime, &p.Audience); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
@@ -1,30 +1,123 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/BearCloud/sp21-bearchat/posts/api"
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish once we are asked to stop.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	DB := api.InitDB()
+	DB, dialect, err := api.InitDB()
+	if err != nil {
+		log.Fatalf("failed to connect to the database: %s", err)
+	}
 	defer DB.Close()
 
-	// Ping the database to make sure it's up
-	if err := DB.Ping(); err != nil {
-		panic(err.Error())
+	// `./main migrate ...` only manages the schema and exits.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(DB, dialect, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %s", err)
+		}
+		return
+	}
+	if err := autoMigrate(DB, dialect); err != nil {
+		log.Fatalf("failed to migrate the database: %s", err)
 	}
+
+	api.RequireVerifiedEmail = os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
+
 	// Create a new mux for routing api calls
 	router := mux.NewRouter()
 	router.Use(CORS)
 	router.Methods(http.MethodOptions)
 
-	api.RegisterRoutes(router, DB)
+	health := api.NewHealth()
+	health.AddCheck("database", DB.PingContext)
+	health.RegisterRoutes(router)
+
+	// Moderation is audit-logged by auth-service, through its internal endpoints.
+	internalKey := os.Getenv("INTERNAL_API_KEY")
+	authURL := os.Getenv("AUTH_URL")
+	if authURL == "" {
+		authURL = "http://172.28.1.1"
+	}
+
+	// The feed asks the friends service whom a user follows, and which lists they are in.
+	friendsURL := os.Getenv("FRIENDS_URL")
+	if friendsURL == "" {
+		friendsURL = "http://172.28.1.5"
+	}
+
+	posts := api.NewSQLPostStore(DB, dialect)
+	api.RegisterRoutes(router, posts, api.RemoteAuditLog(authURL, internalKey), api.RemoteFollowGraph(friendsURL, internalKey), api.RemoteListGraph(friendsURL, internalKey))
+	// auth-service removes the posts of deleted accounts through the internal endpoints.
+	api.RegisterInternalRoutes(router, internalKey, posts)
+
+	serve(&http.Server{Addr: listenAddr(), Handler: router}, health)
+}
 
-	log.Println("listening...")
-	log.Fatal(http.ListenAndServe(":80", router))
+// serve runs the server until it receives SIGINT or SIGTERM, then stops accepting new
+// connections and waits for in-flight requests to finish.
+func serve(srv *http.Server, health *api.Health) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Print("listening...")
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err.Error())
+	case <-ctx.Done():
+	}
+
+	log.Print("shutting down, draining in-flight requests")
+	health.Drain()
+	// Keep answering while the load balancers notice that /readyz fails and stop sending
+	// requests here.
+	time.Sleep(drainDelay())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown failed: %s", err)
+	}
+}
+
+// drainDelay is how long the server waits between failing /readyz and shutting down. It is
+// 5 seconds unless DRAIN_DELAY, a duration like "10s", says otherwise.
+func drainDelay() time.Duration {
+	v := os.Getenv("DRAIN_DELAY")
+	if v == "" {
+		return 5 * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid DRAIN_DELAY %q, using 5s", v)
+		return 5 * time.Second
+	}
+	return d
+}
+
+// listenAddr is where the server listens. It is port 80 unless PORT says otherwise, which lets
+// several services run side by side outside of Docker.
+func listenAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":80"
 }
 
 func CORS(next http.Handler) http.Handler {
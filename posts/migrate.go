@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/BearCloud/sp21-bearchat/posts/api"
+)
+
+// autoMigrate applies pending migrations when the service starts unless AUTO_MIGRATE is
+// set to "false", in which case they have to be applied with the migrate subcommand.
+func autoMigrate(db *sql.DB, dialect api.Dialect) error {
+	if os.Getenv("AUTO_MIGRATE") == "false" {
+		return nil
+	}
+	migrator, err := api.NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(context.Background())
+	return err
+}
+
+// migrateCommand implements `./main migrate up|down [steps]|status`.
+func migrateCommand(db *sql.DB, dialect api.Dialect, args []string) error {
+	migrator, err := api.NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if len(args) == 0 {
+		args = []string{"up"}
+	}
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		fmt.Printf("applied %d migration(s) %v\n", len(applied), applied)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		fmt.Printf("reverted %d migration(s) %v\n", len(reverted), reverted)
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%03d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
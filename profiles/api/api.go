@@ -2,83 +2,225 @@ package api
 
 // Some useful imports :^).
 import (
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	_ "encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 // Like before, think about what methods would be appropriate for these routes.
-func RegisterRoutes(router *mux.Router, db *sql.DB) {
-	router.HandleFunc("/api/profile/{uuid}", getProfile(db)).Methods( /* YOUR CODE HERE */ )
-	router.HandleFunc("/api/profile/{uuid}", updateProfile(db)).Methods( /* YOUR CODE HERE */ )
+func RegisterRoutes(router *mux.Router, profiles ProfileStore, blobs BlobStore, friends FriendGraph, usernames UsernameResolver, audit AuditLog) {
+	router.HandleFunc("/api/profile/images/{key:.+}", serveImage(blobs)).Methods(http.MethodGet)
+	router.HandleFunc("/api/profile/batch", getProfiles(profiles, friends)).Methods(http.MethodPost)
+	router.HandleFunc("/api/profile/by-username/{username}", getProfileByUsername(profiles, friends, usernames)).Methods(http.MethodGet)
+	router.HandleFunc("/api/profile/{uuid}", getProfile(profiles, friends)).Methods(http.MethodGet)
+	router.HandleFunc("/api/profile/{uuid}", updateProfile(profiles)).Methods(http.MethodPut)
+	router.HandleFunc("/api/profile/{uuid}", patchProfile(profiles)).Methods(http.MethodPatch)
+	router.HandleFunc("/api/profile/{uuid}/history", getHistory(profiles, audit)).Methods(http.MethodGet)
+	for _, kind := range []ImageKind{Avatar, Banner} {
+		router.HandleFunc("/api/profile/{uuid}/"+string(kind), uploadImage(profiles, blobs, kind)).Methods(http.MethodPut)
+		router.HandleFunc("/api/profile/{uuid}/"+string(kind), deleteImage(profiles, blobs, kind)).Methods(http.MethodDelete)
+	}
 }
 
-// Retrieves a Profile from the users database and returns it in the response as a JSON.
-func getProfile(db *sql.DB) http.HandlerFunc {
+// Retrieves a Profile from the users database and returns it in the response as a JSON. Only
+// the fields the viewer is allowed to see are filled in.
+func getProfile(profiles ProfileStore, friends FriendGraph) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var prof Profile
 		// Obtain the uuid from the url path and store it in a `uuid` variable
 		// (Hint: mux.Vars())
 		id := mux.Vars(r)["uuid"]
-		// Query the database and store a matching Profile into a variable. What errors might go wrong here?
-
-		row := db.QueryRow("SELECT * FROM users WHERE uuid = ?", id)
-		if err := row.Scan(&prof.Firstname, &prof.Lastname, &prof.Email, &prof.UUID); err != nil {
+		// Query the database for a matching Profile. What errors might go wrong here?
+		prof, err := profiles.Profile(r.Context(), id)
+		if errors.Is(err, ErrProfileNotFound) {
+			http.Error(w, "no profile for that uuid", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
 			http.Error(w, "error fetching profile", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
 
 		// Encode fetched data as JSON and serve to client
-		json.NewEncoder(w).Encode(prof)
+		rel := newViewer(getViewer(r), friends).relationTo(r.Context(), prof)
+		writeWithETag(w, r, prof.visibleTo(rel))
 	}
 }
 
-func updateProfile(db *sql.DB) http.HandlerFunc {
+// MaxBatchSize is the most profiles getProfiles returns at once.
+var MaxBatchSize = 100
+
+// Returns the profiles of the users whose UUIDs are in the "uuids" of the request, as an
+// object from UUIDs to profiles, in a single query. It lets the frontend show a whole feed or
+// friend list at once. Users without a profile are left out, and only the fields the viewer is
+// allowed to see are filled in.
+func getProfiles(profiles ProfileStore, friends FriendGraph) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			UUIDs []string `json:"uuids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "error reading uuids", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if len(req.UUIDs) > MaxBatchSize {
+			http.Error(w, fmt.Sprintf("at most %d profiles can be asked for at once", MaxBatchSize), http.StatusBadRequest)
+			return
+		}
+
+		found, err := profiles.Profiles(r.Context(), req.UUIDs)
+		if err != nil {
+			http.Error(w, "error fetching profiles", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		v := newViewer(getViewer(r), friends)
+		res := make(map[string]Profile, len(found))
+		for uuid, prof := range found {
+			res[uuid] = prof.visibleTo(v.relationTo(r.Context(), prof))
+		}
+		w.Header().Set("Cache-Control", "private, no-cache")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// writeWithETag writes v as JSON along with an ETag, or just http.StatusNotModified if the
+// client already has that version. Profiles look different to every viewer, so they may only
+// be kept by the browser, which has to check they are still current before using them.
+func writeWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "error encoding profile", http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	body = append(body, '\n')
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// etagMatches reports whether an If-None-Match header names etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func updateProfile(profiles ProfileStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Obtain the requested uuid from the url path and store it in a `uuid` variable
 		id := mux.Vars(r)["uuid"]
 
+		// Obtain the UUID from the cookie. See jwt.go. What errors should you check for?
+		// (Hint: What if the UUID from the cookie doesn't match the UUID in the request?)
 		otherID, err := getUUID(w, r)
 		if err != nil {
 			log.Print(err.Error())
 			return
 		}
-		// Obtain the UUID from the cookie. See jwt.go. What errors should you check for?
-		// (Hint: What if the UUID from the cookie doesn't match the UUID in the request?)
 		if id != otherID {
-			http.Error(w, "error verifyinh user ids", http.StatusUnauthorized)
+			http.Error(w, "error verifying user ids", http.StatusUnauthorized)
 			return
 		}
-		// Decode	 the Request Body's JSON data into a profile variable. Make sure to check for errors!
+
+		// Decode the Request Body's JSON data into a profile variable. Make sure to check for errors!
 		var prof Profile
 		err = json.NewDecoder(r.Body).Decode(&prof)
-
 		if err != nil {
-			http.Error(w, "error reading credentials", http.StatusInternalServerError)
+			http.Error(w, "error reading profile", http.StatusBadRequest)
 			log.Print(err.Error())
 			return
 		}
 
-		// Insert the profile data into the users table.
-		// (Hint: Make sure to use REPLACE INTO)
-
-		result, err := db.Exec("REPLACE INTO users (firstName,lastName, email,uuid) VALUES (?,?,?,?)", prof.Firstname, prof.Lastname, prof.Email, id)
-		// Check for errors in executing the previous query
+		// Save the profile under the uuid from the path, whatever the body says.
+		prof.UUID = id
+		now := time.Now()
+		if problems := prof.validate(now); problems != nil {
+			http.Error(w, problemsText(problems), http.StatusBadRequest)
+			return
+		}
+		old, err := profiles.Profile(r.Context(), id)
+		if errors.Is(err, ErrProfileNotFound) {
+			old, err = Profile{UUID: id}, nil
+		}
+		if err != nil {
+			http.Error(w, "error fetching profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		// The images are kept, whatever the body says, and so are the visibility settings if the
+		// body leaves them out.
+		prof.AvatarURL, prof.BannerURL = old.AvatarURL, old.BannerURL
+		if prof.Visibility == nil {
+			prof.Visibility = old.Visibility
+		}
+		err = profiles.SaveProfile(r.Context(), prof, profileChanges(old, prof, id, now)...)
 		if err != nil {
 			http.Error(w, "error updating profile", http.StatusInternalServerError)
 			log.Print(err.Error())
 			return
 		}
+	}
+}
+
+// Updates the fields of a profile that are in the body of the request, and leaves the others
+// alone. It creates the profile if there is none yet, and returns the updated profile.
+func patchProfile(profiles ProfileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := authorizeProfile(w, r)
+		if !ok {
+			return
+		}
+
+		var patch profilePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "error reading profile", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
 
-		eff, err := result.RowsAffected()
-		if eff == 0 {
-			http.Error(w, "nothing was updated", http.StatusBadRequest)
+		prof, err := profiles.Profile(r.Context(), id)
+		if errors.Is(err, ErrProfileNotFound) {
+			prof, err = Profile{UUID: id}, nil
+		}
+		if err != nil {
+			http.Error(w, "error fetching profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		old := prof
+		patch.apply(&prof)
+		now := time.Now()
+		if problems := prof.validate(now); problems != nil {
+			http.Error(w, problemsText(problems), http.StatusBadRequest)
+			return
+		}
+		if err := profiles.SaveProfile(r.Context(), prof, profileChanges(old, prof, id, now)...); err != nil {
+			http.Error(w, "error updating profile", http.StatusInternalServerError)
+			log.Print(err.Error())
 			return
 		}
+		json.NewEncoder(w).Encode(prof)
 	}
 }
@@ -2,14 +2,21 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/suite"
@@ -29,29 +36,70 @@ func TestMain(m *testing.M) {
 
 // Runs every test for getProfile()
 func TestGetProfile(t *testing.T) {
-	suite.Run(t, new(GetProfileTestSuite))
+	runWithEachStore(t, func(s ProfilesTestSuite) suite.TestingSuite { return &GetProfileTestSuite{s} })
 }
 
 // Runs every test for updateProfile()
 func TestUpdateProfile(t *testing.T) {
-	suite.Run(t, new(UpdateProfileTestSuite))
+	runWithEachStore(t, func(s ProfilesTestSuite) suite.TestingSuite { return &UpdateProfileTestSuite{s} })
+}
+
+// Runs every test for patchProfile()
+func TestPatchProfile(t *testing.T) {
+	runWithEachStore(t, func(s ProfilesTestSuite) suite.TestingSuite { return &PatchProfileTestSuite{s} })
+}
+
+// Runs every test for the avatar and banner endpoints
+func TestImages(t *testing.T) {
+	runWithEachStore(t, func(s ProfilesTestSuite) suite.TestingSuite { return &ImagesTestSuite{s} })
+}
+
+// Runs every test for the history of profiles
+func TestHistory(t *testing.T) {
+	runWithEachStore(t, func(s ProfilesTestSuite) suite.TestingSuite { return &HistoryTestSuite{s} })
+}
+
+// Runs every test for the onboarding checklist
+func TestOnboarding(t *testing.T) {
+	runWithEachStore(t, func(s ProfilesTestSuite) suite.TestingSuite { return &OnboardingTestSuite{s} })
+}
+
+// Runs every test for the internal endpoints
+func TestInternal(t *testing.T) {
+	runWithEachStore(t, func(s ProfilesTestSuite) suite.TestingSuite { return &InternalTestSuite{s} })
+}
+
+// Runs the suite made by newSuite against each of the ProfileStore implementations.
+func runWithEachStore(t *testing.T, newSuite func(ProfilesTestSuite) suite.TestingSuite) {
+	t.Run("Memory", func(t *testing.T) {
+		suite.Run(t, newSuite(ProfilesTestSuite{backend: memoryBackend{}}))
+	})
+	t.Run("SQLite", func(t *testing.T) {
+		suite.Run(t, newSuite(ProfilesTestSuite{backend: &sqliteBackend{dir: t.TempDir()}}))
+	})
+	t.Run("MySQL", func(t *testing.T) {
+		suite.Run(t, newSuite(ProfilesTestSuite{backend: &mysqlBackend{}}))
+	})
 }
 
 // Tests that getProfile() succeeds in retrieving a Profile that exists.
 func (s *GetProfileTestSuite) TestBasicGet() {
 	// Insert a fake profile into the users database.
-	_, err := s.db.Exec("INSERT INTO users VALUES (?, ?, ?, ?)", s.testProfile.Firstname, s.testProfile.Lastname, s.testProfile.Email, s.testProfile.UUID)
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
 	s.Require().NoError(err, "could not insert user into database")
 
 	rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/profile/"+s.testProfile.UUID, nil)
 	r = mux.SetURLVars(r, map[string]string{"uuid": s.testProfile.UUID})
 
-	getProfile(s.db)(rr, r)
+	getProfile(s.profiles, s.friends)(rr, r)
 
 	if s.Assert().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned") {
 		var p Profile
 		json.NewDecoder(rr.Result().Body).Decode(&p)
-		s.Assert().Equal(s.testProfile, p, "incorrect profile returned")
+		// Emails are hidden from everyone but the owner by default.
+		want := s.testProfile
+		want.Email = ""
+		s.Assert().Equal(want, p, "incorrect profile returned")
 	}
 
 }
@@ -62,11 +110,151 @@ func (s *GetProfileTestSuite) TestNoExistingUUID() {
 	rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/profile/aaaaaa", nil)
 	r = mux.SetURLVars(r, map[string]string{"uuid": "aaaaaa"})
 
-	getProfile(s.db)(rr, r)
+	getProfile(s.profiles, s.friends)(rr, r)
 
 	s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
 }
 
+// Makes sure getProfile() only shows each field to the viewers it is meant for.
+func (s *GetProfileTestSuite) TestVisibility() {
+	p := s.testProfile
+	p.Visibility = map[string]Visibility{"email": Public, "birthday": Friends, "location": Private}
+	err := s.profiles.SaveProfile(context.Background(), p)
+	s.Require().NoError(err, "could not insert user into database")
+	s.friends.friends = map[string][]string{"2": {p.UUID}, "3": {"2"}}
+
+	get := func(viewer string) Profile {
+		getViewer = func(r *http.Request) string { return viewer }
+		rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/profile/"+p.UUID, nil)
+		r = mux.SetURLVars(r, map[string]string{"uuid": p.UUID})
+		getProfile(s.profiles, s.friends)(rr, r)
+		s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+		var got Profile
+		s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&got))
+		return got
+	}
+
+	s.Assert().Equal(p, get(p.UUID), "the owner doesn't see everything")
+
+	asFriend := get("2")
+	s.Assert().Equal(p.Birthday, asFriend.Birthday, "a friend can't see the birthday")
+	s.Assert().Equal(p.Email, asFriend.Email, "a public email is hidden")
+	s.Assert().Empty(asFriend.Location, "a friend sees a private field")
+	s.Assert().Nil(asFriend.Visibility, "a friend sees the visibility settings")
+
+	for _, viewer := range []string{"3", ""} {
+		asStranger := get(viewer)
+		s.Assert().Empty(asStranger.Birthday, "%q sees a field for friends", viewer)
+		s.Assert().Empty(asStranger.Location, "%q sees a private field", viewer)
+		s.Assert().Equal(p.Bio, asStranger.Bio, "%q can't see a public field", viewer)
+	}
+
+	// Viewers are strangers when we can't tell whether they are friends.
+	s.friends.err = errors.New("friends service is down")
+	s.Assert().Empty(get("2").Birthday, "a field for friends was shown without knowing who the friends are")
+}
+
+// Makes sure getProfiles() returns the profiles that exist, as each viewer may see them.
+func (s *GetProfileTestSuite) TestBatch() {
+	for _, p := range []Profile{
+		s.testProfile,
+		{UUID: "2", Firstname: "Oski", Birthday: "2000-01-31", Visibility: map[string]Visibility{"birthday": Friends}},
+		{UUID: "3", Firstname: "Stanford", Birthday: "2000-01-31", Visibility: map[string]Visibility{"birthday": Friends}},
+	} {
+		s.Require().NoError(s.profiles.SaveProfile(context.Background(), p), "could not insert user into database")
+	}
+	s.friends.friends = map[string][]string{"1": {"2"}}
+	getViewer = func(r *http.Request) string { return "1" }
+	batch := func(uuids ...string) *httptest.ResponseRecorder {
+		b, err := json.Marshal(map[string][]string{"uuids": uuids})
+		s.Require().NoError(err)
+		rr, r := s.generateRequestAndResponse(http.MethodPost, "/api/profile/batch", bytes.NewReader(b))
+		getProfiles(s.profiles, s.friends)(rr, r)
+		return rr
+	}
+
+	rr := batch("1", "2", "3", "4")
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	var found map[string]Profile
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&found))
+	s.Require().Len(found, 3, "missing profiles were not skipped")
+	s.Assert().Equal(s.testProfile, found["1"], "the viewer doesn't see their own profile")
+	s.Assert().Equal("2000-01-31", found["2"].Birthday, "a friend's birthday is hidden")
+	s.Assert().Empty(found["3"].Birthday, "a stranger's birthday is shown")
+	s.Assert().Equal("Stanford", found["3"].Firstname)
+
+	uuids := make([]string, MaxBatchSize+1)
+	for i := range uuids {
+		uuids[i] = fmt.Sprint(i)
+	}
+	s.Assert().Equal(http.StatusBadRequest, batch(uuids...).Result().StatusCode, "too many profiles were asked for")
+}
+
+// Makes sure getProfile() answers with http.StatusNotModified while the profile doesn't change.
+func (s *GetProfileTestSuite) TestETag() {
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
+	s.Require().NoError(err, "could not insert user into database")
+	get := func(etag string) *httptest.ResponseRecorder {
+		rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/profile/"+s.testProfile.UUID, nil)
+		r = mux.SetURLVars(r, map[string]string{"uuid": s.testProfile.UUID})
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		getProfile(s.profiles, s.friends)(rr, r)
+		return rr
+	}
+
+	etag := get("").Result().Header.Get("ETag")
+	s.Require().NotEmpty(etag, "no ETag returned")
+	rr := get(etag)
+	s.Assert().Equal(http.StatusNotModified, rr.Result().StatusCode, "incorrect status code returned")
+	s.Assert().Empty(rr.Body.String(), "the profile was sent again")
+
+	// The owner sees more than visitors do, so they don't share the ETag.
+	getViewer = func(r *http.Request) string { return s.testProfile.UUID }
+	s.Assert().Equal(http.StatusOK, get(etag).Result().StatusCode, "the owner got the profile visitors see")
+	getViewer = s.getViewer
+
+	p := s.testProfile
+	p.Bio = "Changed"
+	s.Require().NoError(s.profiles.SaveProfile(context.Background(), p))
+	s.Assert().Equal(http.StatusOK, get(etag).Result().StatusCode, "a stale profile was not sent again")
+}
+
+// Makes sure profiles can be found by the current username of their owner, and that old
+// usernames redirect to it.
+func (s *GetProfileTestSuite) TestByUsername() {
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
+	s.Require().NoError(err, "could not insert user into database")
+	usernames := &fakeUsernameResolver{
+		uuids:   map[string]string{"oski": s.testProfile.UUID, "nobody": "2"},
+		renamed: map[string]string{"oldski": "oski"},
+	}
+	router := mux.NewRouter()
+	RegisterRoutes(router, s.profiles, s.blobs, s.friends, usernames, s.audit)
+	get := func(username string) *httptest.ResponseRecorder {
+		rr, r := s.generateRequestAndResponse(http.MethodGet, "/api/profile/by-username/"+username, nil)
+		router.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := get("oski")
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	var got Profile
+	s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&got))
+	s.Assert().Equal(s.testProfile.visibleTo(stranger), got, "the profile was not returned as visitors see it")
+
+	rr = get("oldski")
+	s.Assert().Equal(http.StatusFound, rr.Result().StatusCode, "an old username didn't redirect")
+	s.Assert().Equal("/api/profile/by-username/oski", rr.Result().Header.Get("Location"))
+
+	s.Assert().Equal(http.StatusNotFound, get("unknown").Result().StatusCode, "found a username nobody has")
+	s.Assert().Equal(http.StatusNotFound, get("nobody").Result().StatusCode, "found a user without a profile")
+
+	usernames.err = errors.New("auth-service is down")
+	s.Assert().Equal(http.StatusInternalServerError, get("oski").Result().StatusCode)
+}
+
 // Performs a basic test that updates the profile.
 func (s *UpdateProfileTestSuite) TestUpdateProfile() {
 	// Changes getUUID to a function that records that it's been called.
@@ -80,7 +268,7 @@ func (s *UpdateProfileTestSuite) TestUpdateProfile() {
 	rr, r := s.generateRequestAndResponse(http.MethodPut, "/api/profile/"+s.testProfile.UUID, bytes.NewBuffer(s.profileJSON(s.testProfile)))
 	r = mux.SetURLVars(r, map[string]string{"uuid": s.testProfile.UUID})
 
-	updateProfile(s.db)(rr, r)
+	updateProfile(s.profiles)(rr, r)
 
 	if s.Assert().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned") {
 		s.Assert().True(getUUIDCalled, "getUUID() not called in updateProfile()")
@@ -88,6 +276,35 @@ func (s *UpdateProfileTestSuite) TestUpdateProfile() {
 	}
 }
 
+// Makes sure a PUT that leaves out the visibility settings keeps them, so that private fields
+// don't become public.
+func (s *UpdateProfileTestSuite) TestKeepsVisibility() {
+	p := s.testProfile
+	p.Visibility = map[string]Visibility{"location": Private}
+	s.Require().NoError(s.profiles.SaveProfile(context.Background(), p), "could not insert user into database")
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return p.UUID, nil
+	}
+
+	update := s.testProfile
+	update.Bio = "Changed"
+	update.Visibility = nil
+	rr, r := s.generateRequestAndResponse(http.MethodPut, "/api/profile/"+p.UUID, bytes.NewBuffer(s.profileJSON(update)))
+	r = mux.SetURLVars(r, map[string]string{"uuid": p.UUID})
+	updateProfile(s.profiles)(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+
+	getViewer = func(r *http.Request) string { return "2" }
+	rr, r = s.generateRequestAndResponse(http.MethodGet, "/api/profile/"+p.UUID, nil)
+	r = mux.SetURLVars(r, map[string]string{"uuid": p.UUID})
+	getProfile(s.profiles, s.friends)(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	var got Profile
+	s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&got))
+	s.Assert().Equal("Changed", got.Bio, "the update was not saved")
+	s.Assert().Empty(got.Location, "a private field became public after an update without visibility")
+}
+
 // Makes sure updateProfile() errors with http.StatusUnauthorized if someone tries to
 // update a profile that isn't theirs.
 func (s *UpdateProfileTestSuite) TestMatchingUUID() {
@@ -101,27 +318,219 @@ func (s *UpdateProfileTestSuite) TestMatchingUUID() {
 		return s.testProfile.UUID, nil
 	}
 
-	updateProfile(s.db)(rr, r)
+	updateProfile(s.profiles)(rr, r)
 
 	s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code returned")
 	s.Assert().True(getUUIDCalled, "getUUID() function not called")
 	s.Assert().False(s.verifyProfileExists(s.testProfile), "profile was added to the database by wrong user")
 }
 
+// Makes sure updateProfile() refuses invalid profiles and saves nothing.
+func (s *UpdateProfileTestSuite) TestInvalidProfile() {
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return s.testProfile.UUID, nil
+	}
+
+	for _, invalid := range []func(p *Profile){
+		func(p *Profile) { p.Email = "not an email" },
+		func(p *Profile) { p.Bio = strings.Repeat("a", maxBioLength+1) },
+		func(p *Profile) { p.Links = []string{"javascript:alert(1)"} },
+		func(p *Profile) { p.Links = strings.Fields(strings.Repeat("https://a.com ", maxLinks+1)) },
+		func(p *Profile) { p.Birthday = "23/03/1999" },
+		func(p *Profile) { p.Birthday = time.Now().AddDate(0, 0, 2).Format(birthdayLayout) },
+		func(p *Profile) { p.Visibility = map[string]Visibility{"uuid": Private} },
+		func(p *Profile) { p.Visibility = map[string]Visibility{"email": "everyone"} },
+	} {
+		p := s.testProfile
+		invalid(&p)
+		rr, r := s.generateRequestAndResponse(http.MethodPut, "/api/profile/"+p.UUID, bytes.NewBuffer(s.profileJSON(p)))
+		r = mux.SetURLVars(r, map[string]string{"uuid": p.UUID})
+
+		updateProfile(s.profiles)(rr, r)
+
+		s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "invalid profile accepted: %+v", p)
+	}
+	_, err := s.profiles.Profile(context.Background(), s.testProfile.UUID)
+	s.Assert().ErrorIs(err, ErrProfileNotFound, "an invalid profile was saved")
+}
+
+// Makes sure patchProfile() only changes the fields in the request.
+func (s *PatchProfileTestSuite) TestPartialUpdate() {
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
+	s.Require().NoError(err, "could not insert user into database")
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return s.testProfile.UUID, nil
+	}
+
+	rr := s.patch(s.testProfile.UUID, `{"bio": "Gone fishing", "links": []}`)
+
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned: %s", rr.Body.String())
+	want := s.testProfile
+	want.Bio, want.Links = "Gone fishing", nil
+	s.Assert().True(s.verifyProfileExists(want), "profile was not patched")
+	var returned Profile
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&returned))
+	s.Assert().Equal(want, returned, "incorrect profile returned")
+}
+
+// Makes sure patchProfile() changes the visibility of the fields in the request only.
+func (s *PatchProfileTestSuite) TestVisibility() {
+	p := s.testProfile
+	p.Visibility = map[string]Visibility{"bio": Friends}
+	err := s.profiles.SaveProfile(context.Background(), p)
+	s.Require().NoError(err, "could not insert user into database")
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return p.UUID, nil
+	}
+
+	rr := s.patch(p.UUID, `{"visibility": {"email": "friends"}}`)
+
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned: %s", rr.Body.String())
+	p.Visibility = map[string]Visibility{"bio": Friends, "email": Friends}
+	s.Assert().True(s.verifyProfileExists(p), "visibility was not merged")
+}
+
+// Makes sure patchProfile() makes a profile for users who don't have one yet.
+func (s *PatchProfileTestSuite) TestNewProfile() {
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return s.testProfile.UUID, nil
+	}
+
+	rr := s.patch(s.testProfile.UUID, `{"pronouns": "she/her"}`)
+
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	s.Assert().True(s.verifyProfileExists(Profile{UUID: s.testProfile.UUID, Pronouns: "she/her"}), "profile was not made")
+}
+
+// Makes sure patchProfile() checks the patched profile, and keeps the old one if it is invalid.
+func (s *PatchProfileTestSuite) TestInvalidPatch() {
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
+	s.Require().NoError(err, "could not insert user into database")
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return s.testProfile.UUID, nil
+	}
+
+	rr := s.patch(s.testProfile.UUID, `{"bio": "Still here", "pronouns": "`+strings.Repeat("a", maxPronounsLength+1)+`"}`)
+
+	s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode, "incorrect status code returned")
+	s.Assert().Contains(rr.Body.String(), "pronouns")
+	s.Assert().True(s.verifyProfileExists(s.testProfile), "an invalid patch was saved")
+}
+
+// Makes sure patchProfile() errors with http.StatusUnauthorized if someone tries to patch a
+// profile that isn't theirs.
+func (s *PatchProfileTestSuite) TestMatchingUUID() {
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return s.testProfile.UUID, nil
+	}
+
+	rr := s.patch(s.testProfile.UUID+"1", `{"bio": "Not mine"}`)
+
+	s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code returned")
+	_, err := s.profiles.Profile(context.Background(), s.testProfile.UUID+"1")
+	s.Assert().ErrorIs(err, ErrProfileNotFound, "profile was added to the database by wrong user")
+}
+
+// Makes sure deleting a user removes their profile, and that doing it again still succeeds.
+func (s *InternalTestSuite) TestDeleteUser() {
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
+	s.Require().NoError(err, "could not insert user into database")
+	router := mux.NewRouter()
+	RegisterInternalRoutes(router, "internalKey", s.profiles, s.blobs)
+
+	for i := 0; i < 2; i++ {
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/internal/users/"+s.testProfile.UUID, nil)
+		r.Header.Set("X-Internal-Token", "internalKey")
+		router.ServeHTTP(rr, r)
+		s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode, "incorrect status code returned")
+	}
+	s.Assert().False(s.verifyProfileExists(s.testProfile), "profile was not deleted")
+}
+
+// Makes sure exporting a user returns their profile, or null if they have none.
+func (s *InternalTestSuite) TestExportUser() {
+	router := mux.NewRouter()
+	RegisterInternalRoutes(router, "internalKey", s.profiles, s.blobs)
+
+	rr, r := s.generateRequestAndResponse(http.MethodGet, "/internal/users/"+s.testProfile.UUID+"/export", nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	s.Assert().Equal("null\n", rr.Body.String(), "a missing profile was exported")
+
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
+	s.Require().NoError(err, "could not insert user into database")
+	rr, r = s.generateRequestAndResponse(http.MethodGet, "/internal/users/"+s.testProfile.UUID+"/export", nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned")
+	var p Profile
+	s.Require().NoError(json.NewDecoder(rr.Result().Body).Decode(&p))
+	s.Assert().Equal(s.testProfile, p, "incorrect profile returned")
+}
+
+// Makes sure a user.created event makes a profile, once.
+func (s *InternalTestSuite) TestUserCreated() {
+	router := mux.NewRouter()
+	RegisterInternalRoutes(router, "internalKey", s.profiles, s.blobs)
+	send := func(body string) int {
+		rr, r := s.generateRequestAndResponse(http.MethodPost, "/internal/events", strings.NewReader(body))
+		r.Header.Set("X-Internal-Token", "internalKey")
+		router.ServeHTTP(rr, r)
+		return rr.Result().StatusCode
+	}
+
+	created := `{"id": "e1", "type": "user.created", "userId": "1", "data": {"username": "oski", "email": "oski@berkeley.edu"}}`
+	s.Require().Equal(http.StatusNoContent, send(created), "incorrect status code returned")
+	s.Assert().True(s.verifyProfileExists(Profile{UUID: "1", Email: "oski@berkeley.edu"}), "no profile was made")
+
+	// Delivering the event again doesn't undo what the user changed since.
+	s.Require().NoError(s.profiles.SaveProfile(context.Background(), s.testProfile))
+	s.Require().Equal(http.StatusNoContent, send(created), "incorrect status code returned")
+	s.Assert().True(s.verifyProfileExists(s.testProfile), "the profile was overwritten")
+
+	s.Assert().Equal(http.StatusNoContent, send(`{"id": "e2", "type": "user.renamed", "userId": "2"}`), "an unknown event was not ignored")
+	s.Assert().False(s.verifyProfileExists(Profile{UUID: "2"}), "an unknown event made a profile")
+	s.Assert().Equal(http.StatusBadRequest, send(`{"id": "e3", "type": "user.created"}`))
+}
+
+// Makes sure the internal endpoints can't be called without the internal key.
+func (s *InternalTestSuite) TestUnauthorized() {
+	err := s.profiles.SaveProfile(context.Background(), s.testProfile)
+	s.Require().NoError(err, "could not insert user into database")
+
+	for _, keys := range [][2]string{{"internalKey", ""}, {"internalKey", "wrong"}, {"", ""}} {
+		router := mux.NewRouter()
+		RegisterInternalRoutes(router, keys[0], s.profiles, s.blobs)
+		rr, r := s.generateRequestAndResponse(http.MethodDelete, "/internal/users/"+s.testProfile.UUID, nil)
+		r.Header.Set("X-Internal-Token", keys[1])
+		router.ServeHTTP(rr, r)
+		s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "incorrect status code returned")
+	}
+	s.Assert().True(s.verifyProfileExists(s.testProfile), "profile was deleted")
+}
+
 // HELPER METHODS AND DEFINITIONS
 
 // Defines a test suite for the entire profiles microservice.
 type ProfilesTestSuite struct {
 	suite.Suite
 
-	// A connection to the sql database.
-	db *sql.DB
+	// Where the profiles are stored and the backend that provides it.
+	backend  storeBackend
+	profiles ProfileStore
+	blobs    *MemoryBlobStore
+	friends  *fakeFriendGraph
+	audit    *fakeAuditLog
 
 	// A test profile that contains fake information.
 	testProfile Profile
 
-	// Stored the original reference to getUUID so it can be restored after tests.
-	getUUID func(w http.ResponseWriter, r *http.Request) (uuid string, err error)
+	// Stored the original reference to getUUID, getViewer and getRoles so they can be restored
+	// after tests.
+	getUUID   func(w http.ResponseWriter, r *http.Request) (uuid string, err error)
+	getViewer func(r *http.Request) string
+	getRoles  func(r *http.Request) []string
 }
 
 // Defines a test suite for getProfile().
@@ -134,9 +543,161 @@ type UpdateProfileTestSuite struct {
 	ProfilesTestSuite
 }
 
-// Clears the users database so the tests remain independent.
-func (s *ProfilesTestSuite) clearDatabase() (err error) {
-	_, err = s.db.Exec("TRUNCATE TABLE users")
+// Defines a test suite for patchProfile().
+type PatchProfileTestSuite struct {
+	ProfilesTestSuite
+}
+
+// Defines a test suite for the avatar and banner endpoints.
+type ImagesTestSuite struct {
+	ProfilesTestSuite
+}
+
+// Defines a test suite for the history of profiles.
+type HistoryTestSuite struct {
+	ProfilesTestSuite
+}
+
+// Defines a test suite for the onboarding checklist.
+type OnboardingTestSuite struct {
+	ProfilesTestSuite
+}
+
+// Defines a test suite for the internal endpoints.
+type InternalTestSuite struct {
+	ProfilesTestSuite
+}
+
+// A fakeFriendGraph is a FriendGraph whose friendships are set by the tests.
+type fakeFriendGraph struct {
+	friends map[string][]string
+	err     error
+}
+
+func (g *fakeFriendGraph) FriendsOf(ctx context.Context, uuid string) ([]string, error) {
+	return g.friends[uuid], g.err
+}
+
+// fakeAuditLog keeps the entries recorded by the handlers, or fails to record them when err is
+// set.
+type fakeAuditLog struct {
+	entries []AuditEntry
+	err     error
+}
+
+func (l *fakeAuditLog) Record(ctx context.Context, e AuditEntry) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+// A fakeUsernameResolver is a UsernameResolver whose usernames are set by the tests. uuids
+// holds the UUID of every current username and renamed the current username of old ones.
+type fakeUsernameResolver struct {
+	uuids   map[string]string
+	renamed map[string]string
+	err     error
+}
+
+func (u *fakeUsernameResolver) ResolveUsername(ctx context.Context, username string) (string, string, error) {
+	if u.err != nil {
+		return "", "", u.err
+	}
+	current := username
+	if renamed, ok := u.renamed[username]; ok {
+		current = renamed
+	}
+	uuid, ok := u.uuids[current]
+	if !ok {
+		return "", "", ErrUsernameNotFound
+	}
+	return uuid, current, nil
+}
+
+// A storeBackend hands out the ProfileStore a suite runs against.
+type storeBackend interface {
+	// open returns an empty store, or an error if the backend isn't available.
+	open() (ProfileStore, error)
+}
+
+// Runs the tests against a fresh MemoryProfileStore every time.
+type memoryBackend struct{}
+
+func (memoryBackend) open() (ProfileStore, error) {
+	return NewMemoryProfileStore(), nil
+}
+
+// testTables are the tables the SQL backends empty before every test.
+var testTables = []string{"users", "profile_history"}
+
+// Runs the tests against the MySQL Docker Container. This needs the database to be running.
+type mysqlBackend struct {
+	db *sql.DB
+}
+
+func (b *mysqlBackend) open() (ProfileStore, error) {
+	if b.db == nil {
+		// Notice that we use localhost instead of the container's IP address since it is
+		// assumed these tests run outside of the container network.
+		db, err := sql.Open("mysql", "root:root@tcp(localhost:3306)/profiles?parseTime=true")
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Ping(); err != nil {
+			return nil, err
+		}
+		if err := migrateForTest(db, MySQL); err != nil {
+			return nil, err
+		}
+		b.db = db
+	}
+
+	// Clears the tables so the tests remain independent.
+	for _, table := range testTables {
+		if _, err := b.db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return nil, err
+		}
+	}
+	return NewSQLProfileStore(b.db, MySQL), nil
+}
+
+// Runs the tests against a SQLite database in a temporary directory, so unlike MySQL it
+// needs nothing running.
+type sqliteBackend struct {
+	dir string
+	db  *sql.DB
+}
+
+func (b *sqliteBackend) open() (ProfileStore, error) {
+	if b.db == nil {
+		db, err := sql.Open("sqlite3", "file:"+filepath.Join(b.dir, "profiles.db")+"?_busy_timeout=5000")
+		if err != nil {
+			return nil, err
+		}
+		if err := migrateForTest(db, SQLite); err != nil {
+			return nil, err
+		}
+		b.db = db
+	}
+
+	// SQLite has no TRUNCATE.
+	for _, table := range testTables {
+		if _, err := b.db.Exec("DELETE FROM " + table); err != nil {
+			return nil, err
+		}
+	}
+	return NewSQLProfileStore(b.db, SQLite), nil
+}
+
+// Brings the schema of a test database up to date.
+func migrateForTest(db *sql.DB, dialect Dialect) error {
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(context.Background())
 	return err
 }
 
@@ -150,40 +711,42 @@ func (s *ProfilesTestSuite) profileJSON(p Profile) []byte {
 	return testProfileJSON
 }
 
-// Setup the db variable before any tests are run.
+// Setup the test profile before any tests are run.
 func (s *ProfilesTestSuite) SetupSuite() {
-	// Connects to the MySQL Docker Container. Notice that we use localhost
-	// instead of the container's IP address since it is assumed these
-	// tests run outside of the container network.
-	db, err := sql.Open("mysql", "root:root@tcp(localhost:3306)/profiles")
-	s.Require().NoError(err, "could not connect to the database!")
-	s.db = db
 	s.testProfile = Profile{
-		"Dev",
-		"Ops",
-		"dab@berkeley.edu",
-		"1", // Yes we're number 1
+		Firstname: "Dev",
+		Lastname:  "Ops",
+		Email:     "dab@berkeley.edu",
+		UUID:      "1", // Yes we're number 1
+		Bio:       "Go Bears!",
+		Pronouns:  "they/them",
+		Location:  "Berkeley, CA",
+		Links:     []string{"https://berkeley.edu", "http://example.com/dev"},
+		Birthday:  "1999-03-23",
 	}
-	// Save the getUUID function so it can be restored.
+	// Save the getUUID, getViewer and getRoles functions so they can be restored.
 	s.getUUID = getUUID
+	s.getViewer = getViewer
+	s.getRoles = getRoles
 }
 
-// Makes sure the database starts in a clean state before each test.
+// Makes sure the store starts in a clean state before each test.
 func (s *ProfilesTestSuite) SetupTest() {
-	err := s.db.Ping()
-	if err != nil {
-		s.T().Logf("could not connect to database. skipping test. %s", err)
-		s.T().SkipNow()
-	}
-
-	err = s.clearDatabase()
+	profiles, err := s.backend.open()
 	if err != nil {
-		s.T().Logf("could not clear database. skipping test. %s", err)
+		s.T().Logf("could not set up the store. skipping test. %s", err)
 		s.T().SkipNow()
 	}
+	s.profiles = profiles
+	s.blobs = NewMemoryBlobStore()
+	s.friends = &fakeFriendGraph{}
+	s.audit = &fakeAuditLog{}
 
-	// Restore the original reference to getUUID so tests can use it if they want.
+	// Restore the original reference to getUUID, getViewer and getRoles so tests can use them if
+	// they want.
 	getUUID = s.getUUID
+	getViewer = s.getViewer
+	getRoles = s.getRoles
 }
 
 // Given an HTTP method, API endpoint, and io.Reader, returns a ResponseRecorder and a fake Request
@@ -196,13 +759,23 @@ func (s *ProfilesTestSuite) generateRequestAndResponse(method, endpoint string,
 	return rr, r
 }
 
+// Sends body to patchProfile() for the profile with the given uuid.
+func (s *ProfilesTestSuite) patch(uuid, body string) *httptest.ResponseRecorder {
+	rr, r := s.generateRequestAndResponse(http.MethodPatch, "/api/profile/"+uuid, strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"uuid": uuid})
+	patchProfile(s.profiles)(rr, r)
+	return rr
+}
+
 // Given a Profile, checks the profiles database to ensure it exists. Fails the current test if any error occurs while
 // querying the databse.
 func (s *ProfilesTestSuite) verifyProfileExists(p Profile) bool {
-	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT * FROM users WHERE firstName=? AND lastName=? AND email=? AND uuid=?)", p.Firstname, p.Lastname, p.Email, p.UUID).Scan(&exists)
+	stored, err := s.profiles.Profile(context.Background(), p.UUID)
+	if errors.Is(err, ErrProfileNotFound) {
+		return false
+	}
 	if s.Assert().NoError(err, "failed to query the sql database for the profile") {
-		return exists
+		return reflect.DeepEqual(stored, p)
 	}
 	return false
 }
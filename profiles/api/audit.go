@@ -0,0 +1,63 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AuditEntry is a privileged action taken in profiles, like an admin reading the history of
+// the profile of someone else.
+type AuditEntry struct {
+	ActorID  string `json:"actorId"`
+	Service  string `json:"service"`
+	Action   string `json:"action"`
+	TargetID string `json:"targetId"`
+	Details  string `json:"details,omitempty"`
+}
+
+// An AuditLog records the privileged actions taken in profiles. Handlers record an action
+// before taking it, and don't take it if it can't be recorded.
+type AuditLog interface {
+	Record(ctx context.Context, e AuditEntry) error
+}
+
+// remoteAuditLog is the audit log kept by auth-service, which admins read for every service.
+type remoteAuditLog struct {
+	authURL     string
+	internalKey string
+}
+
+// RemoteAuditLog returns the AuditLog kept by the auth-service at authURL. It is reached
+// through its internal endpoint, with internalKey.
+func RemoteAuditLog(authURL, internalKey string) AuditLog {
+	return remoteAuditLog{authURL: strings.TrimSuffix(authURL, "/"), internalKey: internalKey}
+}
+
+func (l remoteAuditLog) Record(ctx context.Context, e AuditEntry) error {
+	e.Service = "profiles"
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.authURL+"/internal/audit", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Token", l.internalKey)
+	resp, err := internalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("audit log returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when there is nothing under a key.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// errInvalidBlobKey is returned by a BlobStore asked to store something under a key that
+// isn't a relative path.
+var errInvalidBlobKey = errors.New("invalid blob key")
+
+// A BlobStore holds files, like the images of profiles, under keys that look like relative
+// paths such as "avatars/1-abc.jpg". Blobs are never changed once stored; a new version gets
+// a new key, which lets browsers cache them forever.
+type BlobStore interface {
+	// Put stores data under key.
+	Put(ctx context.Context, key string, data []byte) error
+
+	// Get returns what is stored under key, or ErrBlobNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Delete removes what is stored under key. It succeeds even if there was nothing, so it
+	// can be run again.
+	Delete(ctx context.Context, key string) error
+}
+
+// validBlobKey reports whether key is a relative path that stays inside the store.
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// FileBlobStore is the BlobStore that keeps blobs as files in a directory.
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore returns a BlobStore that keeps blobs in dir, which is made if it doesn't
+// exist.
+func NewFileBlobStore(dir string) *FileBlobStore {
+	return &FileBlobStore{dir: dir}
+}
+
+// Check reports whether blobs can be stored. It is used as a readiness check.
+func (s *FileBlobStore) Check(ctx context.Context) error {
+	return os.MkdirAll(s.dir, 0o755)
+}
+
+// path returns the file a key is stored in.
+func (s *FileBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", errInvalidBlobKey
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *FileBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Writes to a temporary file first, so that nobody ever reads half a blob.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, ErrBlobNotFound
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *FileBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -1,28 +1,103 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"os"
 	"time"
 
 	// MySQL driver
 	_ "github.com/go-sql-driver/mysql"
+	// SQLite driver
+	_ "github.com/mattn/go-sqlite3"
 )
 
-func InitDB() *sql.DB {
-	log.Println("attempting connections")
-	var err error
-	db, err := sql.Open("mysql", "root:root@tcp(172.28.1.2:3306)/profiles")
+// A Dialect is the flavor of SQL spoken by the database behind the service. Its value is
+// the name of the database/sql driver for it.
+type Dialect string
 
+const (
+	// MySQL is the database running in the db-server container.
+	MySQL Dialect = "mysql"
+	// SQLite keeps the whole database in a single file, which is handy for running the
+	// service on its own or in CI.
+	SQLite Dialect = "sqlite3"
+)
+
+// Default DSNs for each Dialect. The MySQL one needs parseTime to scan DATETIME columns into
+// a time.Time.
+const (
+	defaultMySQLDSN  = "root:root@tcp(172.28.1.2:3306)/profiles?parseTime=true"
+	defaultSQLiteDSN = "file:profiles.db?_busy_timeout=5000&_journal_mode=WAL"
+)
+
+var (
+	// DBConnectTimeout is how long InitDB keeps retrying before it gives up on the database.
+	DBConnectTimeout = 2 * time.Minute
+	// dbInitialBackoff and dbMaxBackoff bound the wait between two connection attempts.
+	dbInitialBackoff = 1 * time.Second
+	dbMaxBackoff     = 15 * time.Second
+)
+
+// InitDB creates the database connection. DB_DRIVER picks the Dialect ("mysql", the default,
+// or "sqlite3") and DB_DSN overrides the default data source name for it.
+func InitDB() (*sql.DB, Dialect, error) {
+	dialect := Dialect(os.Getenv("DB_DRIVER"))
+	dsn := os.Getenv("DB_DSN")
+	switch dialect {
+	case "", MySQL:
+		dialect = MySQL
+		if dsn == "" {
+			dsn = defaultMySQLDSN
+		}
+	case SQLite, "sqlite":
+		dialect = SQLite
+		if dsn == "" {
+			dsn = defaultSQLiteDSN
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown DB_DRIVER %q", dialect)
+	}
+
+	log.Printf("attempting connections to %s", dialect)
+	// Open a SQL connection to the database server
+	db, err := sql.Open(string(dialect), dsn)
 	if err != nil {
-		log.Print(err.Error())
-		panic(err.Error())
+		return nil, "", err
 	}
 
-	for err = db.Ping(); err != nil; err = db.Ping() {
-		log.Println("couldnt connect, waiting 10 seconds before retrying")
-		time.Sleep(10 * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBConnectTimeout)
+	defer cancel()
+	if err := waitForDB(ctx, db); err != nil {
+		db.Close()
+		return nil, "", err
 	}
 
-	return db
+	return db, dialect, nil
+}
+
+// waitForDB pings the database until it answers, backing off exponentially between
+// attempts. It returns the last ping error once ctx is done.
+func waitForDB(ctx context.Context, db *sql.DB) error {
+	backoff := dbInitialBackoff
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("couldnt connect, waiting %s before retrying: %s", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up on the database: %w", err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > dbMaxBackoff {
+			backoff = dbMaxBackoff
+		}
+	}
 }
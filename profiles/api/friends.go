@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// A FriendGraph tells who is friends with whom. The profiles service uses it to decide which
+// fields of a profile a viewer can see.
+type FriendGraph interface {
+	// FriendsOf returns the UUIDs of the friends of the user with the given UUID.
+	FriendsOf(ctx context.Context, uuid string) ([]string, error)
+}
+
+// remoteFriendGraph is the graph kept by the friends service.
+type remoteFriendGraph struct {
+	friendsURL  string
+	internalKey string
+}
+
+// RemoteFriendGraph returns the FriendGraph kept by the friends service at friendsURL. It is
+// reached through its internal endpoints, with internalKey.
+func RemoteFriendGraph(friendsURL, internalKey string) FriendGraph {
+	return remoteFriendGraph{friendsURL: strings.TrimSuffix(friendsURL, "/"), internalKey: internalKey}
+}
+
+func (g remoteFriendGraph) FriendsOf(ctx context.Context, uuid string) ([]string, error) {
+	var friends []string
+	if err := getInternal(ctx, g.friendsURL, uuid, "/friends", g.internalKey, &friends); err != nil {
+		return nil, err
+	}
+	return friends, nil
+}
+
+// A viewer is someone looking at profiles, or nobody if they aren't signed in.
+type viewer struct {
+	uuid    string
+	graph   FriendGraph
+	friends map[string]bool
+	asked   bool
+}
+
+func newViewer(uuid string, graph FriendGraph) *viewer {
+	return &viewer{uuid: uuid, graph: graph}
+}
+
+// relationTo returns how the viewer is related to the owner of p. The friend graph is only
+// asked when the answer changes what the viewer gets to see, and at most once, however many
+// profiles they look at. If it can't be asked, the viewer is treated as a stranger, so that
+// nothing is shown by mistake.
+func (v *viewer) relationTo(ctx context.Context, p Profile) relation {
+	if v.uuid == "" {
+		return stranger
+	}
+	if v.uuid == p.UUID {
+		return owner
+	}
+	if !p.hasFriendsFields() {
+		return stranger
+	}
+	if !v.asked {
+		v.asked = true
+		uuids, err := v.graph.FriendsOf(ctx, v.uuid)
+		if err != nil {
+			log.Printf("could not get the friends of %s: %s", v.uuid, err)
+			uuids = nil
+		}
+		v.friends = make(map[string]bool, len(uuids))
+		for _, uuid := range uuids {
+			v.friends[uuid] = true
+		}
+	}
+	if v.friends[p.UUID] {
+		return friend
+	}
+	return stranger
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ReadinessTimeout bounds how long all of the readiness checks together may take.
+var ReadinessTimeout = 2 * time.Second
+
+// A HealthCheck reports whether something the service depends on (the database, the mailer, ...)
+// is usable. It should give up once ctx is done.
+type HealthCheck func(ctx context.Context) error
+
+// Health serves the liveness (/healthz) and readiness (/readyz) endpoints of the service.
+// Liveness only says that the process is up and serving HTTP, while readiness runs every
+// registered HealthCheck and reports the service as unavailable while it is shutting down.
+type Health struct {
+	mu       sync.RWMutex
+	checks   map[string]HealthCheck
+	draining int32
+}
+
+// NewHealth returns a Health with no checks registered.
+func NewHealth() *Health {
+	return &Health{checks: make(map[string]HealthCheck)}
+}
+
+// AddCheck registers a readiness check under the given name.
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Drain marks the service as not ready so load balancers stop sending it new requests.
+func (h *Health) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// RegisterRoutes adds /healthz and /readyz to the router.
+func (h *Health) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/healthz", h.liveness).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/readyz", h.readiness).Methods(http.MethodGet, http.MethodHead)
+}
+
+// healthStatus is the JSON body returned by the readiness endpoint.
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (h *Health) liveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+func (h *Health) readiness(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.draining) == 1 {
+		writeHealth(w, http.StatusServiceUnavailable, healthStatus{Status: "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+	defer cancel()
+
+	h.mu.RLock()
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	h.mu.RUnlock()
+	sort.Strings(names)
+
+	// Run the checks concurrently so one slow dependency doesn't eat the whole timeout.
+	results := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		h.mu.RLock()
+		check := h.checks[name]
+		h.mu.RUnlock()
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			results[i] = check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	status := healthStatus{Status: "ready", Checks: make(map[string]string, len(names))}
+	code := http.StatusOK
+	for i, name := range names {
+		if results[i] != nil {
+			status.Checks[name] = results[i].Error()
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		status.Checks[name] = "ok"
+	}
+	writeHealth(w, code, status)
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
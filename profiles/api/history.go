@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// historyEntriesPerPage is how many changes getHistory returns at once.
+const historyEntriesPerPage = 50
+
+// A ProfileChange is a change made to one field of a profile, as it is kept in the
+// profile_history table. Field is the JSON name of the field, and lists and objects, like the
+// links, are written as JSON.
+type ProfileChange struct {
+	ID       string `json:"id"`
+	UUID     string `json:"uuid"`
+	Field    string `json:"field"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+	// ActorID is the user who made the change, which is the owner of the profile for every
+	// change made through the public endpoints.
+	ActorID   string    `json:"actorId"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// historyFields are the fields of a profile whose changes are kept, by their JSON name, along
+// with how to write their value.
+var historyFields = map[string]func(p Profile) string{
+	"firstName":  func(p Profile) string { return p.Firstname },
+	"lastName":   func(p Profile) string { return p.Lastname },
+	"email":      func(p Profile) string { return p.Email },
+	"bio":        func(p Profile) string { return p.Bio },
+	"pronouns":   func(p Profile) string { return p.Pronouns },
+	"location":   func(p Profile) string { return p.Location },
+	"links":      func(p Profile) string { return historyJSON(p.Links, len(p.Links)) },
+	"birthday":   func(p Profile) string { return p.Birthday },
+	"avatarUrl":  func(p Profile) string { return p.AvatarURL },
+	"bannerUrl":  func(p Profile) string { return p.BannerURL },
+	"visibility": func(p Profile) string { return historyJSON(p.Visibility, len(p.Visibility)) },
+}
+
+// displayNameFields are the fields moderators can see the history of. They make up the name
+// shown next to posts, which is what someone impersonating another user changes.
+var displayNameFields = []string{"firstName", "lastName"}
+
+// profileChanges returns a change for every field that differs between old and updated,
+// made by actorID.
+func profileChanges(old, updated Profile, actorID string, now time.Time) []ProfileChange {
+	var changes []ProfileChange
+	for field, value := range historyFields {
+		if oldValue, newValue := value(old), value(updated); oldValue != newValue {
+			changes = append(changes, ProfileChange{
+				ID:        randomHex(16),
+				UUID:      updated.UUID,
+				Field:     field,
+				OldValue:  oldValue,
+				NewValue:  newValue,
+				ActorID:   actorID,
+				ChangedAt: now,
+			})
+		}
+	}
+	return changes
+}
+
+// historyJSON writes v as JSON, or "" if it holds no items, like jsonColumn.
+func historyJSON(v interface{}, items int) string {
+	s, err := jsonColumn(v, items)
+	if err != nil {
+		log.Printf("could not write %v for the history: %s", v, err)
+	}
+	return s
+}
+
+// Lists the changes made to a profile, newest first, starting from the "offset" query
+// parameter. Owners and admins see every change. Moderators only see changes to the display
+// name, so they can tell whether a user who was reported took the name of someone else.
+// Admins and moderators reading the history of someone else are recorded in audit.
+func getHistory(profiles ProfileStore, audit AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getUUID(w, r)
+		if err != nil {
+			log.Print(err.Error())
+			return
+		}
+		uuid := mux.Vars(r)["uuid"]
+		var fields []string
+		roles := getRoles(r)
+		switch {
+		case id == uuid || HasRole(roles, RoleAdmin):
+		case HasRole(roles, RoleModerator):
+			fields = displayNameFields
+		default:
+			http.Error(w, "only the owner of a profile can see its history", http.StatusForbidden)
+			return
+		}
+
+		offset := 0
+		if o := r.URL.Query().Get("offset"); o != "" {
+			offset, err = strconv.Atoi(o)
+			if err != nil || offset < 0 {
+				http.Error(w, "invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+		if id != uuid {
+			err := audit.Record(r.Context(), AuditEntry{ActorID: id, Action: "profile_history.read", TargetID: uuid})
+			if err != nil {
+				http.Error(w, "error writing the audit log", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
+		changes, err := profiles.History(r.Context(), uuid, fields, offset, historyEntriesPerPage)
+		if err != nil {
+			http.Error(w, "error fetching history", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if changes == nil {
+			changes = []ProfileChange{}
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		json.NewEncoder(w).Encode(changes)
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Makes sure every change made through the public endpoints is kept, and shown to whoever may
+// see it.
+func (s *HistoryTestSuite) TestHistory() {
+	router := mux.NewRouter()
+	RegisterRoutes(router, s.profiles, s.blobs, s.friends, &fakeUsernameResolver{}, s.audit)
+	RegisterInternalRoutes(router, "internalKey", s.profiles, s.blobs)
+	s.signIn(s.testProfile.UUID)
+
+	r := httptest.NewRequest(http.MethodPut, "/api/profile/"+s.testProfile.UUID, bytes.NewReader(s.profileJSON(s.testProfile)))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "update failed: %s", rr.Body.String())
+	r = httptest.NewRequest(http.MethodPatch, "/api/profile/"+s.testProfile.UUID, bytes.NewBufferString(`{"firstName": "Impostor", "bio": "Same"}`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "patch failed: %s", rr.Body.String())
+	r = httptest.NewRequest(http.MethodPatch, "/api/profile/"+s.testProfile.UUID, bytes.NewBufferString(`{"bio": "Same"}`))
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	status, changes := s.history(router, s.testProfile.UUID)
+	s.Require().Equal(http.StatusOK, status)
+	firstNames := s.changesTo(changes, "firstName")
+	s.Require().Len(firstNames, 2, "expected the first name to be set, then changed")
+	renamed := firstNames["Impostor"]
+	s.Assert().Equal(s.testProfile.Firstname, renamed.OldValue)
+	s.Assert().Equal(s.testProfile.UUID, renamed.ActorID)
+	s.Assert().Len(s.changesTo(changes, "bio"), 2, "a field that didn't change was added to the history")
+	s.Assert().Len(s.changesTo(changes, "links"), 1)
+	s.Assert().Empty(s.changesTo(changes, "avatarUrl"), "a field that was never set is in the history")
+
+	s.Assert().Empty(s.audit.entries, "the owner reading their history was audit-logged")
+
+	s.signIn("2")
+	status, _ = s.history(router, s.testProfile.UUID)
+	s.Assert().Equal(http.StatusForbidden, status, "a stranger saw the history")
+
+	getRoles = func(r *http.Request) []string { return []string{RoleModerator} }
+	status, asModerator := s.history(router, s.testProfile.UUID)
+	s.Require().Equal(http.StatusOK, status)
+	s.Assert().Len(asModerator, 3, "a moderator doesn't see exactly the changes to the display name")
+	s.Assert().Len(s.changesTo(asModerator, "firstName"), 2)
+
+	getRoles = func(r *http.Request) []string { return []string{RoleAdmin} }
+	status, asAdmin := s.history(router, s.testProfile.UUID)
+	s.Require().Equal(http.StatusOK, status)
+	s.Assert().Len(asAdmin, len(changes), "an admin doesn't see every change")
+
+	read := AuditEntry{ActorID: "2", Action: "profile_history.read", TargetID: s.testProfile.UUID}
+	s.Assert().Equal([]AuditEntry{read, read}, s.audit.entries, "reading the history of someone else was not audit-logged")
+	s.audit.err = errors.New("auth-service is down")
+	status, _ = s.history(router, s.testProfile.UUID)
+	s.Assert().Equal(http.StatusInternalServerError, status, "the history was shown without being audit-logged")
+	s.audit.err = nil
+
+	r = httptest.NewRequest(http.MethodDelete, "/internal/users/"+s.testProfile.UUID, nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode)
+	_, changes = s.history(router, s.testProfile.UUID)
+	s.Assert().Empty(changes, "the history of a deleted profile was kept")
+}
+
+// Makes sure changing images is kept in the history too.
+func (s *HistoryTestSuite) TestImages() {
+	router := mux.NewRouter()
+	RegisterRoutes(router, s.profiles, s.blobs, s.friends, &fakeUsernameResolver{}, s.audit)
+	s.signIn(s.testProfile.UUID)
+	images := ImagesTestSuite{s.ProfilesTestSuite}
+
+	rr := images.upload(router, "/api/profile/"+s.testProfile.UUID+"/avatar", images.testPNG(10, 10))
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "upload failed: %s", rr.Body.String())
+	r := httptest.NewRequest(http.MethodDelete, "/api/profile/"+s.testProfile.UUID+"/avatar", nil)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	_, changes := s.history(router, s.testProfile.UUID)
+	avatars := s.changesTo(changes, "avatarUrl")
+	s.Require().Len(avatars, 2, "expected the avatar to be set, then removed")
+	removed := avatars[""]
+	s.Assert().NotEmpty(removed.OldValue)
+	s.Assert().Contains(avatars, removed.OldValue, "the avatar that was removed isn't the one that was set")
+}
+
+// Makes sure the history comes a page at a time.
+func (s *HistoryTestSuite) TestPages() {
+	for i := 0; i < historyEntriesPerPage+1; i++ {
+		p := s.testProfile
+		p.Bio = string(rune('a' + i%26))
+		c := ProfileChange{ID: randomHex(16), UUID: p.UUID, Field: "bio", NewValue: p.Bio, ActorID: p.UUID, ChangedAt: time.Now()}
+		s.Require().NoError(s.profiles.SaveProfile(context.Background(), p, c))
+	}
+	page, err := s.profiles.History(context.Background(), s.testProfile.UUID, nil, 0, historyEntriesPerPage)
+	s.Require().NoError(err)
+	s.Assert().Len(page, historyEntriesPerPage)
+	page, err = s.profiles.History(context.Background(), s.testProfile.UUID, nil, historyEntriesPerPage, historyEntriesPerPage)
+	s.Require().NoError(err)
+	s.Assert().Len(page, 1)
+
+	router := mux.NewRouter()
+	RegisterRoutes(router, s.profiles, s.blobs, s.friends, &fakeUsernameResolver{}, s.audit)
+	s.signIn(s.testProfile.UUID)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/profile/"+s.testProfile.UUID+"/history?offset=-1", nil))
+	s.Assert().Equal(http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+// Makes sure RemoteAuditLog posts entries to the internal endpoint of auth-service.
+func (s *HistoryTestSuite) TestRemoteAuditLog() {
+	var received AuditEntry
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Assert().Equal("/internal/audit", r.URL.Path)
+		s.Assert().Equal("internalKey", r.Header.Get("X-Internal-Token"))
+		s.Assert().NoError(json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer auth.Close()
+
+	entry := AuditEntry{ActorID: "2", Action: "profile_history.read", TargetID: s.testProfile.UUID}
+	s.Require().NoError(RemoteAuditLog(auth.URL, "internalKey").Record(context.Background(), entry))
+	entry.Service = "profiles"
+	s.Assert().Equal(entry, received)
+}
+
+// Makes every request come from the user with the given UUID, without any role.
+func (s *HistoryTestSuite) signIn(uuid string) {
+	getUUID = func(w http.ResponseWriter, r *http.Request) (string, error) {
+		return uuid, nil
+	}
+	getRoles = func(r *http.Request) []string { return nil }
+}
+
+// Returns the status code and the changes returned by the history endpoint of a profile.
+func (s *HistoryTestSuite) history(router *mux.Router, uuid string) (int, []ProfileChange) {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/profile/"+uuid+"/history", nil))
+	var changes []ProfileChange
+	if rr.Result().StatusCode == http.StatusOK {
+		s.Require().NoError(json.NewDecoder(rr.Body).Decode(&changes))
+	}
+	return rr.Result().StatusCode, changes
+}
+
+// Returns the changes to field, by their new value.
+func (s *HistoryTestSuite) changesTo(changes []ProfileChange, field string) map[string]ProfileChange {
+	res := make(map[string]ProfileChange)
+	for _, c := range changes {
+		if c.Field == field {
+			res[c.NewValue] = c
+		}
+	}
+	return res
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Registers GIF with image.Decode.
+	"image/jpeg"
+	_ "image/png" // Registers PNG with image.Decode.
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxImageBytes is the largest image that can be uploaded.
+var MaxImageBytes int64 = 5 << 20
+
+// maxImagePixels is the largest image, in pixels, we agree to decode. It keeps a small file
+// that claims to be huge from taking all the memory.
+const maxImagePixels = 25_000_000
+
+// imageURLPrefix is where images are served. The rest of their URL is their key in the
+// BlobStore.
+const imageURLPrefix = "/api/profile/images/"
+
+// imageSizes is the size every kind of image is resized to, as width and height in pixels.
+var imageSizes = map[ImageKind]image.Point{
+	Avatar: {400, 400},
+	Banner: {1500, 500},
+}
+
+var (
+	errUnsupportedImage = errors.New("images must be JPEG, PNG or GIF")
+	errImageTooLarge    = errors.New("image has too many pixels")
+)
+
+// Replaces the avatar or banner of a user with the image in the body of the request. The image
+// is cropped and resized to imageSizes, and stored as a JPEG under a new key, so that browsers
+// never see a stale image.
+func uploadImage(profiles ProfileStore, blobs BlobStore, kind ImageKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := authorizeProfile(w, r)
+		if !ok {
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxImageBytes))
+		if err != nil {
+			http.Error(w, "image is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		size := imageSizes[kind]
+		resized, err := resizeImage(data, size.X, size.Y)
+		if errors.Is(err, errUnsupportedImage) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if errors.Is(err, errImageTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error reading image", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+
+		// Users can pick an avatar before filling in the rest of their profile.
+		err = profiles.CreateProfile(r.Context(), Profile{UUID: id})
+		var prof Profile
+		if err == nil {
+			prof, err = profiles.Profile(r.Context(), id)
+		}
+		if err != nil {
+			http.Error(w, "error fetching profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		key := string(kind) + "s/" + id + "-" + randomHex(8) + ".jpg"
+		if err := blobs.Put(r.Context(), key, resized); err != nil {
+			http.Error(w, "error storing image", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		updated := prof
+		setImageURL(&updated, kind, imageURLPrefix+key)
+		changes := profileChanges(prof, updated, id, time.Now())
+		if err := profiles.SetImage(r.Context(), id, kind, imageURL(updated, kind), changes...); err != nil {
+			blobs.Delete(r.Context(), key)
+			http.Error(w, "error updating profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		deleteImageBlob(r, blobs, imageURL(prof, kind))
+		json.NewEncoder(w).Encode(updated)
+	}
+}
+
+// Removes the avatar or banner of a user.
+func deleteImage(profiles ProfileStore, blobs BlobStore, kind ImageKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := authorizeProfile(w, r)
+		if !ok {
+			return
+		}
+		prof, err := profiles.Profile(r.Context(), id)
+		if errors.Is(err, ErrProfileNotFound) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error fetching profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		updated := prof
+		setImageURL(&updated, kind, "")
+		changes := profileChanges(prof, updated, id, time.Now())
+		if err := profiles.SetImage(r.Context(), id, kind, "", changes...); err != nil {
+			http.Error(w, "error updating profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		deleteImageBlob(r, blobs, imageURL(prof, kind))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Serves a stored image. Since the key of an image changes with every upload, browsers can
+// keep them forever.
+func serveImage(blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		data, err := blobs.Get(r.Context(), key)
+		if errors.Is(err, ErrBlobNotFound) {
+			http.Error(w, "no such image", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error fetching image", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Write(data)
+	}
+}
+
+// authorizeProfile returns the UUID in the path if it belongs to the signed in user.
+// Otherwise, it writes an error to the Response and returns false.
+func authorizeProfile(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := mux.Vars(r)["uuid"]
+	otherID, err := getUUID(w, r)
+	if err != nil {
+		log.Print(err.Error())
+		return "", false
+	}
+	if id != otherID {
+		http.Error(w, "error verifying user ids", http.StatusUnauthorized)
+		return "", false
+	}
+	return id, true
+}
+
+// deleteImageBlob removes the image served at url, if any. Failing only leaves an unused file
+// behind, so the error is logged rather than returned.
+func deleteImageBlob(r *http.Request, blobs BlobStore, url string) {
+	if !strings.HasPrefix(url, imageURLPrefix) {
+		return
+	}
+	if err := blobs.Delete(r.Context(), strings.TrimPrefix(url, imageURLPrefix)); err != nil {
+		log.Printf("could not delete image %s: %s", url, err)
+	}
+}
+
+func imageURL(p Profile, kind ImageKind) string {
+	if kind == Avatar {
+		return p.AvatarURL
+	}
+	return p.BannerURL
+}
+
+func setImageURL(p *Profile, kind ImageKind, url string) {
+	if kind == Avatar {
+		p.AvatarURL = url
+	} else {
+		p.BannerURL = url
+	}
+}
+
+// randomHex returns n random bytes written in hexadecimal.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// resizeImage decodes a JPEG, PNG or GIF, fits it to width by height pixels with resizeCover
+// and encodes the result as a JPEG. Transparent parts become white, since JPEG has no alpha.
+func resizeImage(data []byte, width, height int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, errUnsupportedImage
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resizeCover(src, width, height), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeCover crops the middle of src to the shape of a width by height image, then scales it
+// down to that size by averaging the pixels each one covers. Smaller images are cropped but
+// never scaled up, since that would only make them blurry.
+func resizeCover(src image.Image, width, height int) *image.RGBA {
+	b := src.Bounds()
+	// The largest part of src that has the shape of the result.
+	cropW, cropH := b.Dx(), b.Dx()*height/width
+	if cropH > b.Dy() {
+		cropW, cropH = b.Dy()*width/height, b.Dy()
+	}
+	if cropW < 1 {
+		cropW = 1
+	}
+	if cropH < 1 {
+		cropH = 1
+	}
+	crop := image.Rect(0, 0, cropW, cropH).Add(b.Min).Add(image.Pt((b.Dx()-cropW)/2, (b.Dy()-cropH)/2))
+	if cropW < width {
+		width, height = cropW, cropH
+	}
+
+	// Draws the crop onto white first, so every pixel averaged below is opaque.
+	flat := image.NewRGBA(image.Rect(0, 0, cropW, cropH))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, crop.Min, draw.Over)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*cropH/height, (y+1)*cropH/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*cropW/width, (x+1)*cropW/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, n int
+			for sy := y0; sy < y1; sy++ {
+				row := flat.Pix[flat.PixOffset(x0, sy):flat.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					r += int(row[i])
+					g += int(row[i+1])
+					bl += int(row[i+2])
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xff})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Makes sure an uploaded avatar is resized, stored and served, and that a profile is made for
+// it if there was none.
+func (s *ImagesTestSuite) TestUploadAvatar() {
+	router := s.signedInRouter()
+
+	rr := s.upload(router, "/api/profile/"+s.testProfile.UUID+"/avatar", s.testPNG(800, 600))
+
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "upload failed: %s", rr.Body.String())
+	var p Profile
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&p))
+	s.Require().True(strings.HasPrefix(p.AvatarURL, imageURLPrefix+"avatars/"), "unexpected avatar url %q", p.AvatarURL)
+	s.Assert().True(s.verifyProfileExists(p), "the profile doesn't have the avatar")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, p.AvatarURL, nil))
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "avatar not served")
+	s.Assert().Equal("image/jpeg", rr.Result().Header.Get("Content-Type"))
+	s.Assert().Contains(rr.Result().Header.Get("Cache-Control"), "immutable")
+	avatar, err := jpeg.Decode(rr.Body)
+	s.Require().NoError(err, "the avatar is not a JPEG")
+	s.Assert().Equal(image.Rect(0, 0, 400, 400), avatar.Bounds(), "the avatar was not resized")
+	// The transparent left half of the image turns white, the right half stays red.
+	r, g, b, _ := avatar.At(10, 200).RGBA()
+	s.Assert().True(r > 0xf000 && g > 0xf000 && b > 0xf000, "transparency did not turn white")
+	r, g, _, _ = avatar.At(390, 200).RGBA()
+	s.Assert().True(r > 0xf000 && g < 0x1000, "the image was not kept")
+}
+
+// Makes sure a new banner replaces the old one, and that updating the profile keeps it.
+func (s *ImagesTestSuite) TestReplaceBanner() {
+	s.Require().NoError(s.profiles.SaveProfile(context.Background(), s.testProfile))
+	router := s.signedInRouter()
+
+	rr := s.upload(router, "/api/profile/"+s.testProfile.UUID+"/banner", s.testPNG(3000, 500))
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "upload failed: %s", rr.Body.String())
+	rr = s.upload(router, "/api/profile/"+s.testProfile.UUID+"/banner", s.testPNG(100, 100))
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "upload failed: %s", rr.Body.String())
+	s.Assert().Len(s.blobs.Keys(), 1, "the old banner was kept")
+
+	// Small images are cropped to the shape of a banner but not scaled up.
+	stored, err := s.profiles.Profile(context.Background(), s.testProfile.UUID)
+	s.Require().NoError(err)
+	data, err := s.blobs.Get(context.Background(), strings.TrimPrefix(stored.BannerURL, imageURLPrefix))
+	s.Require().NoError(err)
+	banner, err := jpeg.Decode(bytes.NewReader(data))
+	s.Require().NoError(err)
+	s.Assert().Equal(image.Rect(0, 0, 100, 33), banner.Bounds())
+
+	r := httptest.NewRequest(http.MethodPut, "/api/profile/"+s.testProfile.UUID, bytes.NewReader(s.profileJSON(s.testProfile)))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode)
+	updated, err := s.profiles.Profile(context.Background(), s.testProfile.UUID)
+	s.Require().NoError(err)
+	s.Assert().Equal(stored.BannerURL, updated.BannerURL, "updating the profile removed the banner")
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/profile/"+s.testProfile.UUID+"/banner", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode)
+	s.Assert().True(s.verifyProfileExists(s.testProfile), "the banner was not removed")
+	s.Assert().Empty(s.blobs.Keys(), "the banner was kept")
+}
+
+// Makes sure images that can't be used are turned away.
+func (s *ImagesTestSuite) TestRejected() {
+	router := s.signedInRouter()
+
+	rr := s.upload(router, "/api/profile/"+s.testProfile.UUID+"/avatar", []byte("not an image"))
+	s.Assert().Equal(http.StatusUnsupportedMediaType, rr.Result().StatusCode)
+
+	defer func(max int64) { MaxImageBytes = max }(MaxImageBytes)
+	MaxImageBytes = 1000
+	rr = s.upload(router, "/api/profile/"+s.testProfile.UUID+"/avatar", s.testPNG(800, 600))
+	s.Assert().Equal(http.StatusRequestEntityTooLarge, rr.Result().StatusCode)
+
+	rr = s.upload(router, "/api/profile/"+s.testProfile.UUID+"1/avatar", s.testPNG(10, 10))
+	s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "uploaded an avatar for someone else")
+	s.Assert().Empty(s.blobs.Keys(), "a rejected image was stored")
+}
+
+// Makes sure deleting a user removes their images too.
+func (s *ImagesTestSuite) TestDeleteUser() {
+	router := s.signedInRouter()
+	RegisterInternalRoutes(router, "internalKey", s.profiles, s.blobs)
+	rr := s.upload(router, "/api/profile/"+s.testProfile.UUID+"/avatar", s.testPNG(50, 50))
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "upload failed: %s", rr.Body.String())
+
+	r := httptest.NewRequest(http.MethodDelete, "/internal/users/"+s.testProfile.UUID, nil)
+	r.Header.Set("X-Internal-Token", "internalKey")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+	s.Require().Equal(http.StatusNoContent, rr.Result().StatusCode)
+	s.Assert().Empty(s.blobs.Keys(), "the avatar of a deleted user was kept")
+}
+
+// Returns a router with the public endpoints, where every request is made by the owner of the
+// test profile.
+func (s *ImagesTestSuite) signedInRouter() *mux.Router {
+	getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err error) {
+		return s.testProfile.UUID, nil
+	}
+	router := mux.NewRouter()
+	RegisterRoutes(router, s.profiles, s.blobs, s.friends, &fakeUsernameResolver{}, s.audit)
+	return router
+}
+
+// Uploads data as an image to path.
+func (s *ImagesTestSuite) upload(router *mux.Router, path string, data []byte) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, path, bytes.NewReader(data)))
+	return rr
+}
+
+// Returns a PNG whose left half is transparent and whose right half is red.
+func (s *ImagesTestSuite) testPNG(width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := width / 2; x < width; x++ {
+			img.Set(x, y, color.NRGBA{0xff, 0, 0, 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	s.Require().NoError(png.Encode(&buf, img))
+	return buf.Bytes()
+}
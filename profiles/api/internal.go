@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RegisterInternalRoutes adds the endpoints the other services call. They are never reached
+// by browsers and only answer requests whose X-Internal-Token header is internalKey. They are
+// turned off if internalKey is empty.
+func RegisterInternalRoutes(router *mux.Router, internalKey string, profiles ProfileStore, blobs BlobStore) {
+	internal := router.PathPrefix("/internal").Subrouter()
+	internal.Use(requireInternalToken(internalKey))
+	internal.HandleFunc("/users/{uuid}", deleteUserProfile(profiles, blobs)).Methods(http.MethodDelete)
+	internal.HandleFunc("/users/{uuid}/export", exportUserProfile(profiles)).Methods(http.MethodGet)
+	internal.HandleFunc("/events", handleEvent(profiles)).Methods(http.MethodPost)
+}
+
+// requireInternalToken turns away every request that doesn't carry the internal key.
+func requireInternalToken(internalKey string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("X-Internal-Token")
+			if internalKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(internalKey)) != 1 {
+				http.Error(w, "internal token required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Removes the profile and the images of a user whose account was deleted. auth-service calls it
+// until it succeeds, so deleting a user without a profile is not an error. The images go
+// first, since the profile is how we find them.
+func deleteUserProfile(profiles ProfileStore, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uuid := mux.Vars(r)["uuid"]
+		prof, err := profiles.Profile(r.Context(), uuid)
+		if err != nil && !errors.Is(err, ErrProfileNotFound) {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		for _, url := range []string{prof.AvatarURL, prof.BannerURL} {
+			if !strings.HasPrefix(url, imageURLPrefix) {
+				continue
+			}
+			if err := blobs.Delete(r.Context(), strings.TrimPrefix(url, imageURLPrefix)); err != nil {
+				http.Error(w, "error deleting image", http.StatusInternalServerError)
+				log.Print(err.Error())
+				return
+			}
+		}
+		if err := profiles.DeleteProfile(r.Context(), uuid); err != nil {
+			http.Error(w, "error deleting profile from database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Returns the profile of a user for the archive of their data, or null if they never made
+// one.
+func exportUserProfile(profiles ProfileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := profiles.Profile(r.Context(), mux.Vars(r)["uuid"])
+		if errors.Is(err, ErrProfileNotFound) {
+			json.NewEncoder(w).Encode(nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error querying database", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// An event published by auth-service. Only the fields profiles uses are decoded.
+type event struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	UserID string `json:"userId"`
+	Data   struct {
+		Email string `json:"email"`
+	} `json:"data"`
+}
+
+// Receives the events of auth-service. A new user gets an empty profile holding their email,
+// which stays private until they say otherwise. Events may come more than once, so a profile
+// that already exists is left alone. Events profiles doesn't care about are ignored.
+func handleEvent(profiles ProfileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var e event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, "error reading event", http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+		if e.Type != "user.created" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if e.UserID == "" {
+			http.Error(w, "userId is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := profiles.CreateProfile(r.Context(), Profile{UUID: e.UserID, Email: e.Data.Email}); err != nil {
+			http.Error(w, "error creating profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// internalClient makes the calls to the internal endpoints of the other services.
+var internalClient = &http.Client{Timeout: 10 * time.Second}
+
+// errInternalNotFound is returned by getInternal when the other service answers 404.
+var errInternalNotFound = errors.New("not found")
+
+// getInternal calls GET <baseURL>/internal/users/{uuid}<suffix> of another service with
+// internalKey in the X-Internal-Token header, and decodes the JSON it returns into v. Any
+// status but 200 is an error.
+func getInternal(ctx context.Context, baseURL, uuid, suffix, internalKey string, v interface{}) error {
+	endpoint := baseURL + "/internal/users/" + url.PathEscape(uuid) + suffix
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Internal-Token", internalKey)
+	resp, err := internalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errInternalNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
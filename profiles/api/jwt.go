@@ -15,9 +15,29 @@ type AuthClaims struct {
 	Email         string
 	EmailVerified bool
 	UserID        string
+	// Roles are the roles auth-service granted the user, like "moderator".
+	Roles []string `json:",omitempty"`
 	jwt.StandardClaims
 }
 
+// The roles auth-service grants that profiles cares about.
+const (
+	// RoleAdmin holds every other role too. Admins can see the whole history of any profile.
+	RoleAdmin = "admin"
+	// RoleModerator can see how the display name of any user changed.
+	RoleModerator = "moderator"
+)
+
+// HasRole reports whether roles grant role. Admins hold every role.
+func HasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
 func validateToken(tokenString string) (jwt.MapClaims, error) {
 
 	token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
@@ -55,3 +75,41 @@ var getUUID = func(w http.ResponseWriter, r *http.Request) (uuid string, err err
 
 	return claims["UserID"].(string), nil
 }
+
+// getViewer returns the UUID of the signed in user making the request, or "" if there is none.
+// Unlike getUUID, it never writes an error, since profiles can also be seen by visitors. It is
+// a variable so tests can change it too.
+var getViewer = func(r *http.Request) string {
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		return ""
+	}
+	claims, err := validateToken(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	uuid, _ := claims["UserID"].(string)
+	return uuid
+}
+
+// getRoles returns the roles of the signed in user making the request, or nil if there is
+// none. They are as of when the access token was issued, so a revoked role keeps working until
+// it expires. It is a variable so tests can change it too.
+var getRoles = func(r *http.Request) []string {
+	cookie, err := r.Cookie("access_token")
+	if err != nil {
+		return nil
+	}
+	claims, err := validateToken(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	list, _ := claims["Roles"].([]interface{})
+	var roles []string
+	for _, r := range list {
+		if role, ok := r.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
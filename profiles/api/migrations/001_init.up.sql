@@ -0,0 +1,8 @@
+-- The original schema that used to live in db-server/initdb.sql. IF NOT EXISTS lets databases
+-- created from that script adopt this migration as already applied.
+CREATE TABLE IF NOT EXISTS users (
+    firstName VARCHAR(255),
+    lastName VARCHAR(255),
+    email VARCHAR(255),
+    uuid VARCHAR(36) PRIMARY KEY
+);
@@ -0,0 +1,7 @@
+ALTER TABLE users DROP COLUMN bannerUrl;
+ALTER TABLE users DROP COLUMN avatarUrl;
+ALTER TABLE users DROP COLUMN birthday;
+ALTER TABLE users DROP COLUMN links;
+ALTER TABLE users DROP COLUMN location;
+ALTER TABLE users DROP COLUMN pronouns;
+ALTER TABLE users DROP COLUMN bio;
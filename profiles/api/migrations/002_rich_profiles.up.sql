@@ -0,0 +1,9 @@
+-- The fields users fill in on top of their name. links holds a JSON array of URLs, birthday is
+-- formatted like 2000-01-31, and the image columns hold the paths the images are served at.
+ALTER TABLE users ADD COLUMN bio VARCHAR(500) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN pronouns VARCHAR(40) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN location VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN links VARCHAR(2048) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN birthday VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatarUrl VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bannerUrl VARCHAR(255) NOT NULL DEFAULT '';
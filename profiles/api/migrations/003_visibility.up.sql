@@ -0,0 +1,3 @@
+-- Who can see each field of a profile, as a JSON object from field names to "public",
+-- "friends" or "private". Fields that aren't in it keep their default visibility.
+ALTER TABLE users ADD COLUMN visibility VARCHAR(1024) NOT NULL DEFAULT '';
@@ -0,0 +1,12 @@
+-- Every change made to a field of a profile, so that owners, admins and moderators can see
+-- what a profile used to say. Rows are removed along with the profile.
+CREATE TABLE IF NOT EXISTS profile_history (
+    id VARCHAR(32) PRIMARY KEY,
+    uuid VARCHAR(36) NOT NULL,
+    field VARCHAR(32) NOT NULL,
+    oldValue TEXT,
+    newValue TEXT,
+    actorId VARCHAR(36) NOT NULL,
+    changedAt DATETIME NOT NULL
+);
+CREATE INDEX profile_history_uuid ON profile_history (uuid, changedAt);
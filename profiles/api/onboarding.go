@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// The onboarding steps of new users, in the order they are shown.
+const (
+	StepVerifyEmail  = "verifyEmail"
+	StepSetName      = "setName"
+	StepUploadAvatar = "uploadAvatar"
+	StepAddFriend    = "addFriend"
+	StepMakePost     = "makePost"
+)
+
+// An AccountService tells profiles about the accounts kept by auth-service.
+type AccountService interface {
+	// EmailVerified reports whether the user with the given UUID verified their email.
+	EmailVerified(ctx context.Context, uuid string) (bool, error)
+}
+
+// A PostService tells profiles about the posts kept by the posts service.
+type PostService interface {
+	// HasPosted reports whether the user with the given UUID made a post.
+	HasPosted(ctx context.Context, uuid string) (bool, error)
+}
+
+// remoteAccountService asks auth-service about accounts.
+type remoteAccountService struct {
+	authURL     string
+	internalKey string
+}
+
+// RemoteAccountService returns the AccountService that asks auth-service at authURL, through
+// its internal endpoints, with internalKey.
+func RemoteAccountService(authURL, internalKey string) AccountService {
+	return remoteAccountService{authURL: strings.TrimSuffix(authURL, "/"), internalKey: internalKey}
+}
+
+func (a remoteAccountService) EmailVerified(ctx context.Context, uuid string) (bool, error) {
+	var u struct {
+		EmailVerified bool `json:"emailVerified"`
+	}
+	if err := getInternal(ctx, a.authURL, uuid, "", a.internalKey, &u); err != nil {
+		return false, err
+	}
+	return u.EmailVerified, nil
+}
+
+// remotePostService asks the posts service about posts.
+type remotePostService struct {
+	postsURL    string
+	internalKey string
+}
+
+// RemotePostService returns the PostService that asks the posts service at postsURL, through
+// its internal endpoints, with internalKey.
+func RemotePostService(postsURL, internalKey string) PostService {
+	return remotePostService{postsURL: strings.TrimSuffix(postsURL, "/"), internalKey: internalKey}
+}
+
+func (p remotePostService) HasPosted(ctx context.Context, uuid string) (bool, error) {
+	var first json.RawMessage
+	err := getInternal(ctx, p.postsURL, uuid, "/first-post", p.internalKey, &first)
+	if errors.Is(err, errInternalNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// An OnboardingStep is something new users are asked to do.
+type OnboardingStep struct {
+	Name string `json:"name"`
+	Done bool   `json:"done"`
+	// Unknown is set when the service that knows whether the step is done didn't answer. Done
+	// is then false.
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// onboardingStatus is the body returned by GET /api/profile/{uuid}/onboarding.
+type onboardingStatus struct {
+	Steps []OnboardingStep `json:"steps"`
+	// Complete is set once every step is done.
+	Complete bool `json:"complete"`
+}
+
+// RegisterOnboardingRoutes adds the endpoint that tells new users what they have left to set
+// up. Most of it is known by the other services, which are reached with accounts, friends and
+// posts.
+func RegisterOnboardingRoutes(router *mux.Router, profiles ProfileStore, accounts AccountService, friends FriendGraph, posts PostService) {
+	router.HandleFunc("/api/profile/{uuid}/onboarding", getOnboarding(profiles, accounts, friends, posts)).Methods(http.MethodGet)
+}
+
+// Returns which onboarding steps the signed in user completed, so that the frontend can show
+// new users a checklist. The other services are asked at the same time, and a step is marked
+// as unknown if its service doesn't answer, rather than failing the whole request.
+func getOnboarding(profiles ProfileStore, accounts AccountService, friends FriendGraph, posts PostService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := authorizeProfile(w, r)
+		if !ok {
+			return
+		}
+		prof, err := profiles.Profile(r.Context(), id)
+		if errors.Is(err, ErrProfileNotFound) {
+			prof, err = Profile{UUID: id}, nil
+		}
+		if err != nil {
+			http.Error(w, "error fetching profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		checks := []func(ctx context.Context) (bool, error){
+			func(ctx context.Context) (bool, error) { return accounts.EmailVerified(ctx, id) },
+			func(ctx context.Context) (bool, error) { return prof.Firstname != "" && prof.Lastname != "", nil },
+			func(ctx context.Context) (bool, error) { return prof.AvatarURL != "", nil },
+			func(ctx context.Context) (bool, error) {
+				uuids, err := friends.FriendsOf(ctx, id)
+				return len(uuids) > 0, err
+			},
+			func(ctx context.Context) (bool, error) { return posts.HasPosted(ctx, id) },
+		}
+		status := onboardingStatus{Steps: []OnboardingStep{
+			{Name: StepVerifyEmail},
+			{Name: StepSetName},
+			{Name: StepUploadAvatar},
+			{Name: StepAddFriend},
+			{Name: StepMakePost},
+		}}
+		var wg sync.WaitGroup
+		for i, check := range checks {
+			wg.Add(1)
+			go func(step *OnboardingStep, check func(ctx context.Context) (bool, error)) {
+				defer wg.Done()
+				done, err := check(r.Context())
+				if err != nil {
+					log.Printf("could not check onboarding step %s of %s: %s", step.Name, id, err)
+					step.Unknown = true
+					return
+				}
+				step.Done = done
+			}(&status.Steps[i], check)
+		}
+		wg.Wait()
+
+		status.Complete = true
+		for _, step := range status.Steps {
+			status.Complete = status.Complete && step.Done
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Makes sure the checklist follows what the user did, in every service.
+func (s *OnboardingTestSuite) TestSteps() {
+	accounts := &fakeAccountService{}
+	posts := &fakePostService{}
+	router := mux.NewRouter()
+	RegisterOnboardingRoutes(router, s.profiles, accounts, s.friends, posts)
+	getUUID = func(w http.ResponseWriter, r *http.Request) (string, error) {
+		return s.testProfile.UUID, nil
+	}
+
+	status := s.onboarding(router, s.testProfile.UUID)
+	s.Assert().False(status.Complete)
+	for _, step := range status.Steps {
+		s.Assert().False(step.Done, "a new user already did %s", step.Name)
+	}
+
+	p := s.testProfile
+	p.Lastname = ""
+	s.Require().NoError(s.profiles.SaveProfile(context.Background(), p))
+	accounts.verified = true
+	s.friends.friends = map[string][]string{p.UUID: {"2"}}
+	s.Assert().Equal(map[string]bool{
+		StepVerifyEmail:  true,
+		StepSetName:      false,
+		StepUploadAvatar: false,
+		StepAddFriend:    true,
+		StepMakePost:     false,
+	}, s.done(s.onboarding(router, p.UUID)))
+
+	s.Require().NoError(s.profiles.SaveProfile(context.Background(), s.testProfile))
+	s.Require().NoError(s.profiles.SetImage(context.Background(), p.UUID, Avatar, imageURLPrefix+"avatars/a.jpg"))
+	posts.posted = true
+	status = s.onboarding(router, p.UUID)
+	s.Assert().True(status.Complete, "every step is done but onboarding isn't complete: %+v", status.Steps)
+
+	// A service that doesn't answer only makes its own step unknown.
+	posts.err = errors.New("posts is down")
+	status = s.onboarding(router, p.UUID)
+	s.Assert().False(status.Complete)
+	for _, step := range status.Steps {
+		s.Assert().Equal(step.Name == StepMakePost, step.Unknown, "unexpected unknown for %s", step.Name)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/profile/2/onboarding", nil))
+	s.Assert().Equal(http.StatusUnauthorized, rr.Result().StatusCode, "saw the checklist of someone else")
+}
+
+// Returns the onboarding status of the user with the given UUID.
+func (s *OnboardingTestSuite) onboarding(router *mux.Router, uuid string) onboardingStatus {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/profile/"+uuid+"/onboarding", nil))
+	s.Require().Equal(http.StatusOK, rr.Result().StatusCode, "incorrect status code returned: %s", rr.Body.String())
+	var status onboardingStatus
+	s.Require().NoError(json.NewDecoder(rr.Body).Decode(&status))
+	s.Require().Len(status.Steps, 5)
+	return status
+}
+
+// Returns whether each step is done, by name.
+func (s *OnboardingTestSuite) done(status onboardingStatus) map[string]bool {
+	done := make(map[string]bool)
+	for _, step := range status.Steps {
+		done[step.Name] = step.Done
+	}
+	return done
+}
+
+func TestRemoteOnboardingServices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Internal-Token") != "internalKey" {
+			http.Error(w, "internal token required", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/internal/users/1":
+			w.Write([]byte(`{"userId": "1", "username": "oski", "emailVerified": true}`))
+		case "/internal/users/1/first-post":
+			w.Write([]byte(`{"postID": "a", "authorID": "1"}`))
+		default:
+			http.Error(w, "no posts", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	verified, err := RemoteAccountService(server.URL+"/", "internalKey").EmailVerified(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, verified)
+	_, err = RemoteAccountService(server.URL, "wrong").EmailVerified(ctx, "1")
+	assert.Error(t, err, "a refused call counted as an answer")
+
+	posts := RemotePostService(server.URL, "internalKey")
+	posted, err := posts.HasPosted(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, posted)
+	posted, err = posts.HasPosted(ctx, "2")
+	require.NoError(t, err, "a user without posts is an error")
+	assert.False(t, posted)
+	_, err = RemotePostService(server.URL, "wrong").HasPosted(ctx, "1")
+	assert.True(t, err != nil && strings.Contains(err.Error(), "401"), "unexpected error %v", err)
+}
+
+// A fakeAccountService is an AccountService whose answers are set by the tests.
+type fakeAccountService struct {
+	verified bool
+	err      error
+}
+
+func (a *fakeAccountService) EmailVerified(ctx context.Context, uuid string) (bool, error) {
+	return a.verified, a.err
+}
+
+// A fakePostService is a PostService whose answers are set by the tests.
+type fakePostService struct {
+	posted bool
+	err    error
+}
+
+func (p *fakePostService) HasPosted(ctx context.Context, uuid string) (bool, error) {
+	return p.posted, p.err
+}
@@ -1,8 +1,143 @@
 package api
 
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on the fields of a profile. The lengths are in characters, and match the sizes of
+// the columns of the users table.
+const (
+	maxNameLength     = 255
+	maxBioLength      = 500
+	maxPronounsLength = 40
+	maxLocationLength = 100
+	maxLinks          = 5
+	maxLinkLength     = 255
+)
+
+// birthdayLayout is the format of birthdays, like "2000-01-31".
+const birthdayLayout = "2006-01-02"
+
 type Profile struct {
 	Firstname string `json:"firstName"`
 	Lastname  string `json:"lastName"`
 	Email     string `json:"email"`
 	UUID      string `json:"uuid"`
+	Bio       string `json:"bio"`
+	Pronouns  string `json:"pronouns"`
+	Location  string `json:"location"`
+	// Links are the websites of the user, as absolute http or https URLs.
+	Links []string `json:"links,omitempty"`
+	// Birthday is in birthdayLayout, or empty.
+	Birthday string `json:"birthday"`
+	// AvatarURL and BannerURL are the paths the images of the user are served at, or empty.
+	// They only change through the image endpoints.
+	AvatarURL string `json:"avatarUrl"`
+	BannerURL string `json:"bannerUrl"`
+	// Visibility tells who can see each field, by its JSON name. Fields left out get their
+	// default visibility. Only the owner of the profile gets to see it.
+	Visibility map[string]Visibility `json:"visibility,omitempty"`
+}
+
+// profilePatch holds the fields a PATCH request changes. Fields left out of the request stay
+// nil and keep their value.
+type profilePatch struct {
+	Firstname *string   `json:"firstName"`
+	Lastname  *string   `json:"lastName"`
+	Email     *string   `json:"email"`
+	Bio       *string   `json:"bio"`
+	Pronouns  *string   `json:"pronouns"`
+	Location  *string   `json:"location"`
+	Links     *[]string `json:"links"`
+	Birthday  *string   `json:"birthday"`
+	// Visibility is merged into the current settings rather than replacing them.
+	Visibility map[string]Visibility `json:"visibility"`
+}
+
+// apply changes p to the fields set in the patch.
+func (patch profilePatch) apply(p *Profile) {
+	for _, f := range []struct {
+		from *string
+		to   *string
+	}{
+		{patch.Firstname, &p.Firstname},
+		{patch.Lastname, &p.Lastname},
+		{patch.Email, &p.Email},
+		{patch.Bio, &p.Bio},
+		{patch.Pronouns, &p.Pronouns},
+		{patch.Location, &p.Location},
+		{patch.Birthday, &p.Birthday},
+	} {
+		if f.from != nil {
+			*f.to = *f.from
+		}
+	}
+	if patch.Links != nil {
+		p.Links = *patch.Links
+	}
+	if len(patch.Visibility) > 0 {
+		merged := make(map[string]Visibility, len(p.Visibility)+len(patch.Visibility))
+		for field, v := range p.Visibility {
+			merged[field] = v
+		}
+		for field, v := range patch.Visibility {
+			merged[field] = v
+		}
+		p.Visibility = merged
+	}
+}
+
+// validate checks every field users can edit, and returns what is wrong with each of them, or
+// nil if they are all fine.
+func (p Profile) validate(now time.Time) []string {
+	var problems []string
+	check := func(field, value string, max int) {
+		if utf8.RuneCountInString(value) > max {
+			problems = append(problems, fmt.Sprintf("%s can't be longer than %d characters", field, max))
+		}
+	}
+	check("firstName", p.Firstname, maxNameLength)
+	check("lastName", p.Lastname, maxNameLength)
+	check("email", p.Email, maxNameLength)
+	check("bio", p.Bio, maxBioLength)
+	check("pronouns", p.Pronouns, maxPronounsLength)
+	check("location", p.Location, maxLocationLength)
+
+	if p.Email != "" {
+		if addr, err := mail.ParseAddress(p.Email); err != nil || addr.Address != p.Email {
+			problems = append(problems, "email is not a valid address")
+		}
+	}
+
+	if len(p.Links) > maxLinks {
+		problems = append(problems, fmt.Sprintf("links can't hold more than %d links", maxLinks))
+	}
+	for _, link := range p.Links {
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("links must be http or https URLs, not %q", link))
+		} else if utf8.RuneCountInString(link) > maxLinkLength {
+			problems = append(problems, fmt.Sprintf("links can't be longer than %d characters", maxLinkLength))
+		}
+	}
+
+	if p.Birthday != "" {
+		birthday, err := time.Parse(birthdayLayout, p.Birthday)
+		if err != nil {
+			problems = append(problems, "birthday must look like 2000-01-31")
+		} else if birthday.After(now) || birthday.Year() < 1900 {
+			problems = append(problems, "birthday must be between 1900 and today")
+		}
+	}
+	return append(problems, p.validateVisibility()...)
+}
+
+// problemsText joins the problems validate found into one error message.
+func problemsText(problems []string) string {
+	return strings.Join(problems, "; ")
 }
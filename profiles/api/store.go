@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrProfileNotFound is returned by a ProfileStore when there is no profile for a UUID.
+var ErrProfileNotFound = errors.New("profile not found")
+
+// ImageKind tells the images of a profile apart.
+type ImageKind string
+
+// The images a profile can have.
+const (
+	Avatar ImageKind = "avatar"
+	Banner ImageKind = "banner"
+)
+
+// A ProfileStore holds the profiles of Bearchat users. The handlers only ever talk to the
+// database through it, which lets the tests swap MySQL for an in-memory implementation.
+type ProfileStore interface {
+	// Profile returns the profile of the user with the given UUID, or ErrProfileNotFound.
+	Profile(ctx context.Context, uuid string) (Profile, error)
+
+	// Profiles returns the profiles of the users with the given UUIDs, by UUID. Users without a
+	// profile are left out.
+	Profiles(ctx context.Context, uuids []string) (map[string]Profile, error)
+
+	// CreateProfile creates p, unless there already is a profile with p.UUID, which is then
+	// left as it is.
+	CreateProfile(ctx context.Context, p Profile) error
+
+	// SaveProfile creates or replaces the profile with p.UUID, and adds changes to its history
+	// along with it. The images of an existing profile are kept; they only change through
+	// SetImage.
+	SaveProfile(ctx context.Context, p Profile, changes ...ProfileChange) error
+
+	// SetImage sets the URL of the avatar or banner of the profile with the given UUID, and adds
+	// changes to its history along with it. It does nothing if there is no such profile.
+	SetImage(ctx context.Context, uuid string, kind ImageKind, url string, changes ...ProfileChange) error
+
+	// History returns up to limit changes made to the profile with the given UUID, newest
+	// first, skipping the first offset. Only the changes to the given fields are returned, or
+	// to every field if there are none.
+	History(ctx context.Context, uuid string, fields []string, offset, limit int) ([]ProfileChange, error)
+
+	// DeleteProfile removes the profile with the given UUID and its history. It succeeds even
+	// if there was none, so it can be run again.
+	DeleteProfile(ctx context.Context, uuid string) error
+}
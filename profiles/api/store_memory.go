@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryProfileStore is a ProfileStore that keeps profiles in memory. It is meant for tests
+// and for running the profiles service without a database; everything is lost when the
+// process exits.
+type MemoryProfileStore struct {
+	mu       sync.RWMutex
+	profiles map[string]Profile
+	// history holds the changes made to every profile, oldest first, by UUID.
+	history map[string][]ProfileChange
+}
+
+// NewMemoryProfileStore returns an empty MemoryProfileStore.
+func NewMemoryProfileStore() *MemoryProfileStore {
+	return &MemoryProfileStore{profiles: make(map[string]Profile), history: make(map[string][]ProfileChange)}
+}
+
+func (s *MemoryProfileStore) Profile(ctx context.Context, uuid string) (Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.profiles[uuid]
+	if !ok {
+		return Profile{}, ErrProfileNotFound
+	}
+	return p, nil
+}
+
+func (s *MemoryProfileStore) Profiles(ctx context.Context, uuids []string) (map[string]Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(map[string]Profile, len(uuids))
+	for _, uuid := range uuids {
+		if p, ok := s.profiles[uuid]; ok {
+			res[uuid] = p
+		}
+	}
+	return res, nil
+}
+
+func (s *MemoryProfileStore) CreateProfile(ctx context.Context, p Profile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.profiles[p.UUID]; ok {
+		return nil
+	}
+	return s.save(p)
+}
+
+func (s *MemoryProfileStore) SaveProfile(ctx context.Context, p Profile, changes ...ProfileChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addHistory(changes)
+	return s.save(p)
+}
+
+// save stores p. The caller must hold the lock.
+func (s *MemoryProfileStore) save(p Profile) error {
+	old := s.profiles[p.UUID]
+	p.AvatarURL, p.BannerURL = old.AvatarURL, old.BannerURL
+	// Copies the links and the visibility settings so the caller can't change them behind our back.
+	p.Links = append([]string(nil), p.Links...)
+	if len(p.Links) == 0 {
+		p.Links = nil
+	}
+	if len(p.Visibility) == 0 {
+		p.Visibility = nil
+	} else {
+		visibility := make(map[string]Visibility, len(p.Visibility))
+		for field, v := range p.Visibility {
+			visibility[field] = v
+		}
+		p.Visibility = visibility
+	}
+	s.profiles[p.UUID] = p
+	return nil
+}
+
+func (s *MemoryProfileStore) SetImage(ctx context.Context, uuid string, kind ImageKind, url string, changes ...ProfileChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[uuid]
+	if !ok {
+		return nil
+	}
+	s.addHistory(changes)
+	if kind == Avatar {
+		p.AvatarURL = url
+	} else {
+		p.BannerURL = url
+	}
+	s.profiles[uuid] = p
+	return nil
+}
+
+func (s *MemoryProfileStore) History(ctx context.Context, uuid string, fields []string, offset, limit int) ([]ProfileChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wanted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		wanted[field] = true
+	}
+	var res []ProfileChange
+	history := s.history[uuid]
+	for i := len(history) - 1; i >= 0 && len(res) < limit; i-- {
+		if len(fields) > 0 && !wanted[history[i].Field] {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		res = append(res, history[i])
+	}
+	return res, nil
+}
+
+// addHistory adds changes to the history of their profile. The caller must hold the lock.
+func (s *MemoryProfileStore) addHistory(changes []ProfileChange) {
+	for _, c := range changes {
+		s.history[c.UUID] = append(s.history[c.UUID], c)
+	}
+}
+
+func (s *MemoryProfileStore) DeleteProfile(ctx context.Context, uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.profiles, uuid)
+	delete(s.history, uuid)
+	return nil
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// profileColumns are the columns of the users table, in the order scanProfile reads them.
+const profileColumns = "firstName, lastName, email, uuid, bio, pronouns, location, links, birthday, avatarUrl, bannerUrl, visibility"
+
+// SQLProfileStore is the ProfileStore backed by the users table of the profiles database,
+// which can either live in MySQL or in SQLite.
+type SQLProfileStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLProfileStore returns a ProfileStore that uses db, which speaks the given Dialect.
+func NewSQLProfileStore(db *sql.DB, dialect Dialect) *SQLProfileStore {
+	return &SQLProfileStore{db: db, dialect: dialect}
+}
+
+func (s *SQLProfileStore) Profile(ctx context.Context, uuid string) (Profile, error) {
+	p, err := scanProfile(s.db.QueryRowContext(ctx, "SELECT "+profileColumns+" FROM users WHERE uuid = ?", uuid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, ErrProfileNotFound
+	}
+	return p, err
+}
+
+func (s *SQLProfileStore) Profiles(ctx context.Context, uuids []string) (map[string]Profile, error) {
+	res := make(map[string]Profile, len(uuids))
+	if len(uuids) == 0 {
+		return res, nil
+	}
+	args := make([]interface{}, len(uuids))
+	for i, uuid := range uuids {
+		args[i] = uuid
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(uuids)), ",")
+	rows, err := s.db.QueryContext(ctx, "SELECT "+profileColumns+" FROM users WHERE uuid IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		res[p.UUID] = p
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLProfileStore) CreateProfile(ctx context.Context, p Profile) error {
+	// Neither clause changes a profile that already exists.
+	update := " ON DUPLICATE KEY UPDATE uuid = uuid"
+	if s.dialect == SQLite {
+		update = " ON CONFLICT(uuid) DO NOTHING"
+	}
+	return s.insert(ctx, s.db, update, p)
+}
+
+func (s *SQLProfileStore) SaveProfile(ctx context.Context, p Profile, changes ...ProfileChange) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.insert(ctx, tx, s.upsert(), p); err != nil {
+			return err
+		}
+		return addHistory(ctx, tx, changes)
+	})
+}
+
+// insert inserts p, with the given clause deciding what happens to an existing profile.
+func (s *SQLProfileStore) insert(ctx context.Context, db execer, onConflict string, p Profile) error {
+	links, err := jsonColumn(p.Links, len(p.Links))
+	if err != nil {
+		return err
+	}
+	visibility, err := jsonColumn(p.Visibility, len(p.Visibility))
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, insertProfile+onConflict, p.Firstname, p.Lastname, p.Email, p.UUID,
+		p.Bio, p.Pronouns, p.Location, links, p.Birthday, visibility)
+	return err
+}
+
+func (s *SQLProfileStore) SetImage(ctx context.Context, uuid string, kind ImageKind, url string, changes ...ProfileChange) error {
+	column := "avatarUrl"
+	if kind == Banner {
+		column = "bannerUrl"
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "UPDATE users SET "+column+" = ? WHERE uuid = ?", url, uuid)
+		if err != nil {
+			return err
+		}
+		// Without a profile, nothing changed.
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		return addHistory(ctx, tx, changes)
+	})
+}
+
+// historyColumns are the columns of the profile_history table, in the order History reads them.
+const historyColumns = "id, uuid, field, oldValue, newValue, actorId, changedAt"
+
+func (s *SQLProfileStore) History(ctx context.Context, uuid string, fields []string, offset, limit int) ([]ProfileChange, error) {
+	query := "SELECT " + historyColumns + " FROM profile_history WHERE uuid = ?"
+	args := []interface{}{uuid}
+	if len(fields) > 0 {
+		query += " AND field IN (" + strings.TrimSuffix(strings.Repeat("?,", len(fields)), ",") + ")"
+		for _, field := range fields {
+			args = append(args, field)
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY changedAt DESC, id LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []ProfileChange
+	for rows.Next() {
+		var c ProfileChange
+		var oldValue, newValue sql.NullString
+		if err := rows.Scan(&c.ID, &c.UUID, &c.Field, &oldValue, &newValue, &c.ActorID, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		c.OldValue, c.NewValue = oldValue.String, newValue.String
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// addHistory adds changes to the history of their profile.
+func addHistory(ctx context.Context, tx *sql.Tx, changes []ProfileChange) error {
+	for _, c := range changes {
+		_, err := tx.ExecContext(ctx, "INSERT INTO profile_history ("+historyColumns+") VALUES (?,?,?,?,?,?,?)",
+			c.ID, c.UUID, c.Field, c.OldValue, c.NewValue, c.ActorID, c.ChangedAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLProfileStore) DeleteProfile(ctx context.Context, uuid string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM profile_history WHERE uuid = ?", uuid); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM users WHERE uuid = ?", uuid)
+		return err
+	})
+}
+
+// inTx runs f in a transaction, which is committed if f returns nil and rolled back otherwise.
+func (s *SQLProfileStore) inTx(ctx context.Context, f func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// execer runs statements, either on their own or in a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertProfile inserts a profile. It is followed by what to do if it already exists.
+const insertProfile = "INSERT INTO users (firstName, lastName, email, uuid, bio, pronouns, location, links, birthday, visibility) VALUES (?,?,?,?,?,?,?,?,?,?)"
+
+// upsert returns the clause that makes insertProfile overwrite the existing profile with the
+// same uuid. Unlike REPLACE INTO, it updates the row in place instead of deleting it first, so
+// the images are kept.
+func (s *SQLProfileStore) upsert() string {
+	updated := []string{"firstName", "lastName", "email", "bio", "pronouns", "location", "links", "birthday", "visibility"}
+	set := ""
+	for i, column := range updated {
+		if i > 0 {
+			set += ", "
+		}
+		if s.dialect == SQLite {
+			set += fmt.Sprintf("%s = excluded.%s", column, column)
+		} else {
+			set += fmt.Sprintf("%s = VALUES(%s)", column, column)
+		}
+	}
+	if s.dialect == SQLite {
+		return " ON CONFLICT(uuid) DO UPDATE SET " + set
+	}
+	return " ON DUPLICATE KEY UPDATE " + set
+}
+
+// scanProfile reads a row made of profileColumns.
+func scanProfile(row interface{ Scan(...interface{}) error }) (Profile, error) {
+	var p Profile
+	var firstName, lastName, email sql.NullString
+	var links, visibility string
+	err := row.Scan(&firstName, &lastName, &email, &p.UUID, &p.Bio, &p.Pronouns, &p.Location, &links,
+		&p.Birthday, &p.AvatarURL, &p.BannerURL, &visibility)
+	if err != nil {
+		return Profile{}, err
+	}
+	p.Firstname, p.Lastname, p.Email = firstName.String, lastName.String, email.String
+	if links != "" {
+		if err := json.Unmarshal([]byte(links), &p.Links); err != nil {
+			return Profile{}, fmt.Errorf("reading the links of %s: %w", p.UUID, err)
+		}
+	}
+	if visibility != "" {
+		if err := json.Unmarshal([]byte(visibility), &p.Visibility); err != nil {
+			return Profile{}, fmt.Errorf("reading the visibility of %s: %w", p.UUID, err)
+		}
+	}
+	return p, nil
+}
+
+// jsonColumn returns v as JSON to store in a column, or "" if it holds no items.
+func jsonColumn(v interface{}, items int) (string, error) {
+	if items == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
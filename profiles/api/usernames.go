@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrUsernameNotFound is returned by a UsernameResolver when nobody has the username.
+var ErrUsernameNotFound = errors.New("username not found")
+
+// A UsernameResolver finds users by username. Usernames belong to auth-service, so profiles
+// only know users by UUID.
+type UsernameResolver interface {
+	// ResolveUsername returns the UUID of the user with the given username, along with their
+	// current username, which differs from the one asked for if they renamed themselves
+	// recently. It returns ErrUsernameNotFound if nobody has or recently had the username.
+	ResolveUsername(ctx context.Context, username string) (uuid, current string, err error)
+}
+
+// authClient makes the calls to auth-service.
+var authClient = &http.Client{Timeout: 10 * time.Second}
+
+// remoteUsernameResolver asks auth-service for usernames.
+type remoteUsernameResolver struct {
+	authURL string
+}
+
+// RemoteUsernameResolver returns the UsernameResolver that asks auth-service at authURL.
+func RemoteUsernameResolver(authURL string) UsernameResolver {
+	return remoteUsernameResolver{authURL: strings.TrimSuffix(authURL, "/")}
+}
+
+func (u remoteUsernameResolver) ResolveUsername(ctx context.Context, username string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.authURL+"/api/auth/users/"+url.PathEscape(username), nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", "", ErrUsernameNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", "", fmt.Errorf("auth-service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var res struct {
+		UserID   string `json:"userId"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", "", err
+	}
+	return res.UserID, res.Username, nil
+}
+
+// Retrieves the Profile of the user with the username in the path, like getProfile, so that
+// profiles can have readable URLs. Usernames the user renamed away from redirect to their
+// current one. The redirect isn't permanent, since someone else may take the old username.
+func getProfileByUsername(profiles ProfileStore, friends FriendGraph, usernames UsernameResolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["username"]
+		id, current, err := usernames.ResolveUsername(r.Context(), username)
+		if errors.Is(err, ErrUsernameNotFound) {
+			http.Error(w, "no user has this username", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error looking up username", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		if current != username {
+			http.Redirect(w, r, "/api/profile/by-username/"+url.PathEscape(current), http.StatusFound)
+			return
+		}
+
+		prof, err := profiles.Profile(r.Context(), id)
+		if errors.Is(err, ErrProfileNotFound) {
+			http.Error(w, "this user has no profile", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "error fetching profile", http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+		rel := newViewer(getViewer(r), friends).relationTo(r.Context(), prof)
+		writeWithETag(w, r, prof.visibleTo(rel))
+	}
+}
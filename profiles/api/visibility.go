@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Visibility tells who can see a field of a profile.
+type Visibility string
+
+const (
+	// Public fields are shown to everyone, even to visitors who aren't signed in.
+	Public Visibility = "public"
+	// Friends fields are only shown to the friends of the user.
+	Friends Visibility = "friends"
+	// Private fields are only shown to the user themselves.
+	Private Visibility = "private"
+)
+
+// validVisibilities are the visibilities a field can be given.
+var validVisibilities = map[Visibility]bool{Public: true, Friends: true, Private: true}
+
+// profileFields are the fields of a profile that can be hidden, by their JSON name, along with
+// how to hide them. The UUID is always shown.
+var profileFields = map[string]func(p *Profile){
+	"firstName": func(p *Profile) { p.Firstname = "" },
+	"lastName":  func(p *Profile) { p.Lastname = "" },
+	"email":     func(p *Profile) { p.Email = "" },
+	"bio":       func(p *Profile) { p.Bio = "" },
+	"pronouns":  func(p *Profile) { p.Pronouns = "" },
+	"location":  func(p *Profile) { p.Location = "" },
+	"links":     func(p *Profile) { p.Links = nil },
+	"birthday":  func(p *Profile) { p.Birthday = "" },
+	"avatarUrl": func(p *Profile) { p.AvatarURL = "" },
+	"bannerUrl": func(p *Profile) { p.BannerURL = "" },
+}
+
+// defaultVisibilities are the visibilities of the fields users haven't picked one for. Fields
+// that aren't listed are public.
+var defaultVisibilities = map[string]Visibility{
+	"email": Private,
+}
+
+// visibility returns who can see field.
+func (p Profile) visibility(field string) Visibility {
+	if v, ok := p.Visibility[field]; ok {
+		return v
+	}
+	if v, ok := defaultVisibilities[field]; ok {
+		return v
+	}
+	return Public
+}
+
+// hasFriendsFields reports whether some field is only shown to friends, in which case it
+// matters whether the viewer is one.
+func (p Profile) hasFriendsFields() bool {
+	for field := range profileFields {
+		if p.visibility(field) == Friends {
+			return true
+		}
+	}
+	return false
+}
+
+// A relation is how the viewer of a profile is related to its owner.
+type relation int
+
+const (
+	stranger relation = iota
+	friend
+	owner
+)
+
+// visibleTo returns the profile as someone with the given relation sees it. Only the owner
+// sees every field, and the visibility settings.
+func (p Profile) visibleTo(rel relation) Profile {
+	if rel == owner {
+		return p
+	}
+	for field, hide := range profileFields {
+		switch p.visibility(field) {
+		case Public:
+		case Friends:
+			if rel != friend {
+				hide(&p)
+			}
+		default:
+			hide(&p)
+		}
+	}
+	p.Visibility = nil
+	return p
+}
+
+// validateVisibility returns what is wrong with the visibility settings of p.
+func (p Profile) validateVisibility() []string {
+	var problems []string
+	for field, v := range p.Visibility {
+		if _, ok := profileFields[field]; !ok {
+			problems = append(problems, fmt.Sprintf("visibility can't be set for %q", field))
+		} else if !validVisibilities[v] {
+			problems = append(problems, fmt.Sprintf("visibility of %s must be public, friends or private", field))
+		}
+	}
+	// Map order is random, and the same profile should always get the same message.
+	sort.Strings(problems)
+	return problems
+}
@@ -1,20 +1,37 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/BearCloud/sp21-bearchat/profiles/api"
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish once we are asked to stop.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	db := api.InitDB()
+	db, dialect, err := api.InitDB()
+	if err != nil {
+		log.Fatalf("failed to connect to the database: %s", err)
+	}
 	defer db.Close()
 
-	// Ping the database to make sure it's up
-	if err := db.Ping(); err != nil {
-		panic(err.Error())
+	// `./main migrate ...` only manages the schema and exits.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(db, dialect, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %s", err)
+		}
+		return
+	}
+	if err := autoMigrate(db, dialect); err != nil {
+		log.Fatalf("failed to migrate the database: %s", err)
 	}
 
 	// Create a new mux for routing api calls
@@ -22,10 +39,105 @@ func main() {
 	router.Use(CORS)
 	router.Methods(http.MethodOptions)
 
-	api.RegisterRoutes(router, db)
+	health := api.NewHealth()
+	health.AddCheck("database", db.PingContext)
+	health.RegisterRoutes(router)
+
+	// Avatars and banners are kept as files in BLOB_DIR.
+	blobs := api.NewFileBlobStore(blobDir())
+	health.AddCheck("blobs", blobs.Check)
+
+	// The friends service tells which fields of a profile a viewer can see.
+	internalKey := os.Getenv("INTERNAL_API_KEY")
+	friendsURL := os.Getenv("FRIENDS_URL")
+	if friendsURL == "" {
+		friendsURL = "http://172.28.1.5"
+	}
+	friends := api.RemoteFriendGraph(friendsURL, internalKey)
+	// auth-service owns usernames, which profiles can be looked up by.
+	authURL := os.Getenv("AUTH_URL")
+	if authURL == "" {
+		authURL = "http://172.28.1.1"
+	}
+	usernames := api.RemoteUsernameResolver(authURL)
+	// The onboarding checklist also asks auth-service and the posts service what new users did.
+	accounts := api.RemoteAccountService(authURL, internalKey)
+	postsURL := os.Getenv("POSTS_URL")
+	if postsURL == "" {
+		postsURL = "http://172.28.1.3"
+	}
+	posts := api.RemotePostService(postsURL, internalKey)
+
+	profiles := api.NewSQLProfileStore(db, dialect)
+	// Admins and moderators reading the history of someone else are audit-logged by auth-service.
+	api.RegisterRoutes(router, profiles, blobs, friends, usernames, api.RemoteAuditLog(authURL, internalKey))
+	api.RegisterOnboardingRoutes(router, profiles, accounts, friends, posts)
+	// auth-service removes the profiles of deleted accounts through the internal endpoints.
+	api.RegisterInternalRoutes(router, internalKey, profiles, blobs)
+
+	serve(&http.Server{Addr: listenAddr(), Handler: router}, health)
+}
+
+// serve runs the server until it receives SIGINT or SIGTERM, then stops accepting new
+// connections and waits for in-flight requests to finish.
+func serve(srv *http.Server, health *api.Health) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Print("starting profiles service")
+		errs <- srv.ListenAndServe()
+	}()
 
-	log.Print("starting profiles service")
-	http.ListenAndServe(":80", router)
+	select {
+	case err := <-errs:
+		log.Fatal(err.Error())
+	case <-ctx.Done():
+	}
+
+	log.Print("shutting down, draining in-flight requests")
+	health.Drain()
+	// Keep answering while the load balancers notice that /readyz fails and stop sending
+	// requests here.
+	time.Sleep(drainDelay())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown failed: %s", err)
+	}
+}
+
+// drainDelay is how long the server waits between failing /readyz and shutting down. It is
+// 5 seconds unless DRAIN_DELAY, a duration like "10s", says otherwise.
+func drainDelay() time.Duration {
+	v := os.Getenv("DRAIN_DELAY")
+	if v == "" {
+		return 5 * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid DRAIN_DELAY %q, using 5s", v)
+		return 5 * time.Second
+	}
+	return d
+}
+
+// listenAddr is where the server listens. It is port 80 unless PORT says otherwise, which lets
+// several services run side by side outside of Docker.
+func listenAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":80"
+}
+
+// blobDir is the directory images are stored in. It is ./blobs unless BLOB_DIR says otherwise.
+func blobDir() string {
+	if dir := os.Getenv("BLOB_DIR"); dir != "" {
+		return dir
+	}
+	return "blobs"
 }
 
 func CORS(next http.Handler) http.Handler {
@@ -34,7 +146,7 @@ func CORS(next http.Handler) http.Handler {
 		// Set headers
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 		w.Header().Set("Access-Control-Allow-Origin", "<YOUR EC2 IP HERE>:3000")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {